@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	ArchiveTar     = "tar"
+	ArchiveTarZstd = "tar.zst"
+)
+
+// How archives handle special files such as named pipes
+const (
+	SpecialFilesSkip     = "skip"     // leave them out with a warning
+	SpecialFilesRecreate = "recreate" // recreate FIFOs at the destination, without content
+)
+
+// writeArchive writes sourceDir to w in the given archive format, feeding the
+// uncompressed tar bytes to hasher. walkers directories are listed at once.
+func writeArchive(w io.Writer, sourceDir, archive, specialFiles string, skipHidden bool, walkers int, hasher io.Writer) error {
+	if archive != ArchiveTarZstd {
+		return writeTar(io.MultiWriter(hasher, w), sourceDir, specialFiles, skipHidden, walkers)
+	}
+
+	encoder, err := zstd.NewWriter(w)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd encoder: %v", err)
+	}
+	if err := writeTar(io.MultiWriter(hasher, encoder), sourceDir, specialFiles, skipHidden, walkers); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// writeTar writes the contents of sourceDir to w as a tar stream. Entries are
+// named relative to sourceDir. Besides directories and regular files, only
+// FIFOs are included, and only when specialFiles is SpecialFilesRecreate.
+// With skipHidden, dotfiles and dot-directories are left out with their contents.
+// Entries are written as visitTree reaches them, so the tree is never held in
+// memory whole.
+func writeTar(w io.Writer, sourceDir, specialFiles string, skipHidden bool, walkers int) error {
+	tw := tar.NewWriter(w)
+
+	err := visitTree(sourceDir, walkers, skipHiddenEntries(skipHidden), func(entry treeEntry) error {
+		return writeTarEntry(tw, entry, specialFiles)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, entry treeEntry, specialFiles string) error {
+	info, err := entry.d.Info()
+	if err != nil {
+		return err
+	}
+	recreate := info.Mode()&fs.ModeNamedPipe != 0 && specialFiles == SpecialFilesRecreate
+	if !info.IsDir() && !info.Mode().IsRegular() && !recreate {
+		log.Printf("Warning: skipping special file in archive: path=%s, mode=%s", entry.path, info.Mode().Type())
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(entry.rel)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// Only regular files have content; opening a FIFO would block
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := openFile(entry.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// archiveSink unpacks a tar stream into a target directory as it is received.
+type archiveSink struct {
+	server *FileTransferServer
+	pw     *io.PipeWriter
+	hasher hash.Hash // uncompressed tar bytes
+	done   chan struct{}
+	err    error // extraction result, set before done is closed
+}
+
+func (s *FileTransferServer) newArchiveSink(targetDir, archive string, preserveMtimes bool) (*archiveSink, error) {
+	// Create directory
+	if err := s.fs.MkdirAll(targetDir, 0755); err != nil {
+		return nil, s.storageError(err, "create directory")
+	}
+	if err := s.checkTargetDir(targetDir); err != nil {
+		return nil, err
+	}
+	if err := s.checkCaseCollision(targetDir); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	sink := &archiveSink{
+		server: s,
+		pw:     pw,
+		hasher: sha256.New(),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		err := s.extractArchive(pr, targetDir, archive, preserveMtimes, sink.hasher)
+		if err == nil {
+			// Drain anything after the archive so the writer never blocks
+			_, err = io.Copy(io.Discard, pr)
+		}
+		// Fail pending writes if extraction stopped early
+		pr.CloseWithError(err)
+		sink.err = err
+		close(sink.done)
+	}()
+
+	return sink, nil
+}
+
+func (s *FileTransferServer) extractArchive(r io.Reader, targetDir, archive string, preserveMtimes bool, hasher io.Writer) error {
+	if archive == ArchiveTarZstd {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return fmt.Errorf("failed to create zstd decoder: %v", err)
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+
+	tarStream := io.TeeReader(r, hasher)
+	if err := s.extractTar(tarStream, targetDir, preserveMtimes); err != nil {
+		return err
+	}
+	// Include the tar padding in the checksum
+	_, err := io.Copy(io.Discard, tarStream)
+	return err
+}
+
+func (a *archiveSink) Write(p []byte) (int, error) {
+	return a.pw.Write(p)
+}
+
+func (a *archiveSink) Commit(checksum string) error {
+	a.pw.Close()
+	<-a.done
+	if err := a.err; err != nil {
+		return a.server.storageError(err, "extract archive")
+	}
+	// Entries are already in place, but a mismatch still fails the transfer
+	return verifyChecksum(checksum, a.hasher)
+}
+
+func (a *archiveSink) Abort() {
+	a.pw.CloseWithError(errors.New("transfer aborted"))
+	<-a.done
+}
+
+// extractTar unpacks a tar stream into targetDir, validating that every entry
+// stays inside it. Each file is written to a temp file and renamed into place.
+// With preserveMtimes, entries keep the modification times from the archive.
+func (s *FileTransferServer) extractTar(r io.Reader, targetDir string, preserveMtimes bool) error {
+	tr := tar.NewReader(r)
+	// Applied last, since extracting into a directory updates its mtime
+	dirMtimes := make(map[string]time.Time)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			for dir, mtime := range dirMtimes {
+				if err := s.fs.Chtimes(dir, mtime, mtime); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Validate entry path
+		cleanName := filepath.Clean(filepath.FromSlash(s.normalizeName(header.Name)))
+		if cleanName == "." {
+			continue
+		}
+		if !isRelativePath(cleanName) {
+			return fmt.Errorf("invalid archive entry: %s", header.Name)
+		}
+		entryPath := filepath.Join(targetDir, cleanName)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := s.fs.MkdirAll(entryPath, 0755); err != nil {
+				return err
+			}
+			if err := s.checkTargetDir(entryPath); err != nil {
+				return err
+			}
+			if err := s.checkCaseCollision(entryPath); err != nil {
+				return err
+			}
+			if preserveMtimes {
+				dirMtimes[entryPath] = header.ModTime
+			}
+		case tar.TypeReg:
+			var mtime time.Time
+			if preserveMtimes {
+				mtime = header.ModTime
+			}
+			if err := s.extractFile(tr, entryPath, mtime); err != nil {
+				return err
+			}
+		case tar.TypeFifo:
+			if err := s.extractFifo(entryPath, header.FileInfo().Mode().Perm()); err != nil {
+				log.Printf("Warning: failed to recreate FIFO: path=%s, err=%v", entryPath, err)
+			}
+		default:
+			log.Printf("Skipping unsupported archive entry: name=%s, type=%c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// extractFifo creates a named pipe at targetPath, replacing whatever is there.
+func (s *FileTransferServer) extractFifo(targetPath string, perm fs.FileMode) error {
+	if err := s.fs.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	if err := s.checkTargetDir(filepath.Dir(targetPath)); err != nil {
+		return err
+	}
+	if err := s.checkCaseCollision(targetPath); err != nil {
+		return err
+	}
+	tempPath := s.tempPath(targetPath)
+	if err := s.fs.Mkfifo(tempPath, perm); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tempPath, targetPath); err != nil {
+		s.fs.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// extractFile writes r to targetPath, setting its mtime unless mtime is zero.
+func (s *FileTransferServer) extractFile(r io.Reader, targetPath string, mtime time.Time) error {
+	if err := s.fs.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return err
+	}
+	if err := s.checkTargetDir(filepath.Dir(targetPath)); err != nil {
+		return err
+	}
+	if err := s.checkCaseCollision(targetPath); err != nil {
+		return err
+	}
+
+	tempPath := s.tempPath(targetPath)
+	file, err := s.fs.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		s.fs.Remove(tempPath)
+		return err
+	}
+	if err := s.syncFile(file); err != nil {
+		file.Close()
+		s.fs.Remove(tempPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		s.fs.Remove(tempPath)
+		return err
+	}
+	if !mtime.IsZero() {
+		if err := s.fs.Chtimes(tempPath, mtime, mtime); err != nil {
+			s.fs.Remove(tempPath)
+			return err
+		}
+	}
+	if err := s.checkFile(tempPath, targetPath); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(tempPath, targetPath); err != nil {
+		return err
+	}
+	s.finalize(targetPath)
+	return nil
+}
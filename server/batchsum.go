@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// batchChecksum combines the checksums of a batch's files, keyed by target
+// path, as described on VerifyBatchRequest. Unlike the per-file checksums it
+// also changes when a file is missing or an extra one appears.
+func batchChecksum(files map[string]string) string {
+	hasher := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintf(hasher, "%s\t%s\n", name, files[name])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// batchPath is the key a file is recorded under in a batch checksum. Keys
+// are compared in NFC, so a receiver storing names in another form (see
+// NORMALIZE_NAMES) still agrees with the sender.
+func batchPath(target string, rel ...string) string {
+	return norm.NFC.String(path.Join(append([]string{filepath.ToSlash(filepath.Clean(target))}, rel...)...))
+}
+
+// VerifyBatch hashes every regular file stored at the requested targets, so
+// the sender can compare the whole batch with what it sent in one go.
+func (s *FileTransferServer) VerifyBatch(ctx context.Context, req *pb.VerifyBatchRequest) (*pb.VerifyBatchResponse, error) {
+	resp := &pb.VerifyBatchResponse{}
+	files := make(map[string]string)
+	for _, target := range req.Targets {
+		if isObjectPath(target) {
+			return nil, status.Errorf(codes.InvalidArgument, "object storage targets can't be verified: %s", target)
+		}
+		name := s.normalizeName(target)
+		targetPath, err := s.resolvePath(name)
+		if err != nil {
+			return nil, err
+		}
+		if req.Stage != "" {
+			stageDir, err := s.stagingDir(req.Stage)
+			if err != nil {
+				return nil, err
+			}
+			targetPath = filepath.Join(stageDir, filepath.Clean(name))
+		}
+
+		info, err := os.Stat(targetPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			resp.Missing = append(resp.Missing, target)
+			continue
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to stat target: %v", err)
+		}
+		if !info.IsDir() {
+			if files[batchPath(target)], err = hashFile(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to hash target: %v", err)
+			}
+			continue
+		}
+		entries, err := walkTree(targetPath, s.walkers, nil)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list target: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.d.Type().IsRegular() {
+				continue
+			}
+			if files[batchPath(target, filepath.ToSlash(entry.rel))], err = hashFile(entry.path); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to hash target: %v", err)
+			}
+		}
+	}
+	resp.BatchChecksum = batchChecksum(files)
+	return resp, nil
+}
+
+// sentBatchFiles lists the files a finished batch sent, keyed by target path,
+// with their checksums. Checksums the transfers already computed are reused;
+// other files are hashed again.
+func sentBatchFiles(cfg *Config, req *TransferRequest, sources, targets []string, report *BatchReport, checksums *checksumCache) (map[string]string, error) {
+	files := make(map[string]string)
+	for i, source := range sources {
+		fullSourcePath := filepath.Join(cfg.RootDir, filepath.Clean(source))
+		if req.Archive == "" {
+			// Ranges are only checksummed separately
+			sum := report.Files[i].Checksum
+			if sum == "" || req.ParallelChunks > 1 {
+				var err error
+				if sum, err = checksums.checksum(fullSourcePath); err != nil {
+					return nil, fmt.Errorf("failed to hash source file: %v", err)
+				}
+			}
+			files[batchPath(targets[i])] = sum
+			continue
+		}
+
+		// Only regular files count, as FIFOs and symlinks aren't sent as files
+		entries, err := walkTree(fullSourcePath, cfg.WalkConcurrency, skipHiddenEntries(bool(req.SkipHidden)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list source directory: %v", err)
+		}
+		for _, entry := range entries {
+			if !entry.d.Type().IsRegular() {
+				continue
+			}
+			if files[batchPath(targets[i], filepath.ToSlash(entry.rel))], err = checksums.checksum(entry.path); err != nil {
+				return nil, fmt.Errorf("failed to hash source directory: %v", err)
+			}
+		}
+	}
+	return files, nil
+}
+
+// VerifyPeerBatch asks the peer for the batch checksum over targets.
+func VerifyPeerBatch(ctx context.Context, cfg *Config, targets []string, stage string) (*pb.VerifyBatchResponse, error) {
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return pb.NewFileTransferClient(conn).VerifyBatch(ctx, &pb.VerifyBatchRequest{
+		Targets: targets,
+		Stage:   stage,
+	})
+}
+
+// verifyBatch compares the batch checksum of what was sent with the peer's
+// over what it stored, and returns the sent one.
+func verifyBatch(ctx context.Context, cfg *Config, req *TransferRequest, sources, targets []string, report *BatchReport, stage string, checksums *checksumCache) (string, error) {
+	files, err := sentBatchFiles(cfg, req, sources, targets, report, checksums)
+	if err != nil {
+		return "", err
+	}
+	sent := batchChecksum(files)
+	resp, err := VerifyPeerBatch(ctx, cfg, targets, stage)
+	if err != nil {
+		return sent, fmt.Errorf("failed to verify batch: %w", err)
+	}
+	report.PeerBatchChecksum = resp.BatchChecksum
+	if resp.BatchChecksum != sent {
+		message := fmt.Sprintf("batch checksum mismatch: sent=%s, stored=%s", sent, resp.BatchChecksum)
+		if len(resp.Missing) > 0 {
+			message += ", missing: " + strings.Join(resp.Missing, ", ")
+		}
+		return sent, status.Error(codes.DataLoss, message)
+	}
+	return sent, nil
+}
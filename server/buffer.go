@@ -0,0 +1,35 @@
+package main
+
+import "sync"
+
+// chunkPool shares chunk buffers across transfers to avoid allocating
+// ChunkSize bytes for every file. Pointers are pooled so Put doesn't allocate.
+var chunkPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, ChunkSize)
+		return &buffer
+	},
+}
+
+// getChunkBuffer returns a buffer of size bytes. Buffers larger than
+// ChunkSize are allocated, as the pool only holds ChunkSize buffers.
+func getChunkBuffer(size int) *[]byte {
+	if size > ChunkSize {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+	buffer := chunkPool.Get().(*[]byte)
+	*buffer = (*buffer)[:size]
+	return buffer
+}
+
+// putChunkBuffer returns a buffer to the pool. Callers must not hold any
+// reference to it afterwards; a buffer handed to stream.Send can be returned
+// once Send has returned, as the message is serialized by then.
+func putChunkBuffer(buffer *[]byte) {
+	if cap(*buffer) != ChunkSize {
+		return
+	}
+	*buffer = (*buffer)[:ChunkSize]
+	chunkPool.Put(buffer)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// errPeerMaintenance is the cause of batches cancelled through /admin/cancel-peer.
+var errPeerMaintenance = errors.New("peer maintenance")
+
+// activeBatch is an in-flight batch that can be cancelled by peer.
+type activeBatch struct {
+	peerAddr string
+	cancel   context.CancelCauseFunc
+}
+
+// activeBatches tracks in-flight batches by ID.
+type activeBatches struct {
+	mu      sync.Mutex
+	batches map[string]activeBatch
+}
+
+func newActiveBatches() *activeBatches {
+	return &activeBatches{batches: make(map[string]activeBatch)}
+}
+
+// start registers a batch to peerAddr and returns a context that is cancelled
+// when the batch's peer is; done must be called once the batch finishes.
+func (a *activeBatches) start(ctx context.Context, batchID, peerAddr string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	a.mu.Lock()
+	a.batches[batchID] = activeBatch{peerAddr: peerAddr, cancel: cancel}
+	a.mu.Unlock()
+	return ctx, func() {
+		a.mu.Lock()
+		delete(a.batches, batchID)
+		a.mu.Unlock()
+	}
+}
+
+// cancelPeer cancels every in-flight batch to peerAddr and returns how many
+// were cancelled.
+func (a *activeBatches) cancelPeer(peerAddr string, cause error) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cancelled := 0
+	for _, batch := range a.batches {
+		if batch.peerAddr == peerAddr {
+			batch.cancel(cause)
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+type CancelPeerRequest struct {
+	PeerAddress string `json:"peer_address"`
+}
+
+type CancelPeerResponse struct {
+	PeerAddress string `json:"peer_address"`
+	Cancelled   int    `json:"cancelled"`
+}
+
+// handleCancelPeer aborts all in-flight batches to one peer, e.g. before the
+// peer goes down for maintenance.
+func handleCancelPeer(batches *activeBatches) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CancelPeerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.PeerAddress == "" {
+			writeValidationError(w, []FieldError{{Field: "peer_address", Message: "is required"}})
+			return
+		}
+
+		cancelled := batches.cancelPeer(req.PeerAddress, errPeerMaintenance)
+		log.Printf("Cancelled transfers to peer: peerAddr=%s, batches=%d", req.PeerAddress, cancelled)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(CancelPeerResponse{
+			PeerAddress: req.PeerAddress,
+			Cancelled:   cancelled,
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// What /transfer does with backslashes in a target. Windows clients send them
+// as separators, but on the receiver they are valid in names.
+const (
+	BackslashKeep    = "keep"    // part of the name, as the receiver stores it
+	BackslashConvert = "convert" // separators, like slashes
+	BackslashReject  = "reject"  // refuse the request
+)
+
+// canonicalTarget returns target with repeated slashes collapsed and "."
+// segments resolved, so targets written differently are stored under the
+// same path. A trailing slash, which places the source inside the target, is
+// kept, and so are the prefix of object targets and a leading slash, which
+// validation rejects. It reports false if target has a backslash that
+// BackslashReject refuses.
+func canonicalTarget(target, backslashes string) (string, bool) {
+	if target == "" {
+		return target, true
+	}
+	prefix := ""
+	if isObjectPath(target) {
+		prefix, target = ObjectPrefix, strings.TrimPrefix(target, ObjectPrefix)
+	}
+	if strings.Contains(target, `\`) {
+		switch backslashes {
+		case BackslashReject:
+			return prefix + target, false
+		case BackslashConvert:
+			target = strings.ReplaceAll(target, `\`, "/")
+		}
+	}
+	dir := strings.HasSuffix(target, "/")
+	target = path.Clean(target)
+	if dir && !strings.HasSuffix(target, "/") {
+		target += "/"
+	}
+	return prefix + target, true
+}
+
+// canonicalizeTarget replaces a request's target with its canonical form
+// before the request is validated.
+func canonicalizeTarget(req *TransferRequest, backslashes string) []FieldError {
+	target, ok := canonicalTarget(req.Target, backslashes)
+	if !ok {
+		return []FieldError{{Field: "target", Message: "must not contain backslashes; use / to separate directories"}}
+	}
+	if target != req.Target {
+		log.Printf("Canonicalized target: from=%q, to=%q", req.Target, target)
+		req.Target = target
+	}
+	return nil
+}
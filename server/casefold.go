@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What the receiver does with a target whose name differs only in case from
+// an entry already in its directory, like Foo.txt arriving next to foo.txt.
+const (
+	CaseCollisionIgnore = "ignore" // write it as usual
+	CaseCollisionWarn   = "warn"   // write it and log a warning
+	CaseCollisionReject = "reject" // refuse it
+)
+
+// caseInsensitive reports whether the filesystem holding dir treats names
+// differing only in case as the same file, by creating a probe file and
+// looking it up in upper case.
+func caseInsensitive(dir string) bool {
+	probe, err := os.CreateTemp(dir, ".case-probe-")
+	if err != nil {
+		log.Printf("Warning: failed to check whether the root directory is case-insensitive: %v", err)
+		return false
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	if err == nil {
+		log.Printf("Root directory is case-insensitive; case-colliding targets overwrite each other: path=%s", dir)
+	}
+	return err == nil
+}
+
+// checkCaseCollision applies the case collision policy to a target about to
+// be written, comparing its name to the entries already in its directory.
+func (s *FileTransferServer) checkCaseCollision(path string) error {
+	if s.caseCheck == CaseCollisionIgnore {
+		return nil
+	}
+	dir, name := filepath.Split(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check target for case collisions: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == name || !strings.EqualFold(entry.Name(), name) {
+			continue
+		}
+		rel, _ := filepath.Rel(s.rootOf(path), path)
+		existing := filepath.Join(filepath.Dir(rel), entry.Name())
+		if s.caseCheck == CaseCollisionReject {
+			rejectPath(RejectCaseCollide, rel)
+			return status.Errorf(codes.AlreadyExists, "target differs only in case from %s: %s", existing, rel)
+		}
+		effect := "is written next to it"
+		if s.caseFolds {
+			effect = "overwrites it"
+		}
+		log.Printf("Warning: target differs only in case from an existing entry and %s: path=%s, existing=%s", effect, rel, existing)
+		return nil
+	}
+	return nil
+}
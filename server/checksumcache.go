@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// checksumCache keeps the checksums of source files while fsnotify reports
+// no change to them, so repeated sync=checksum transfers of a large tree don't
+// rehash unchanged files. A nil cache hashes on demand.
+type checksumCache struct {
+	watcher *fsnotify.Watcher
+	hits    atomic.Uint64
+
+	mu   sync.Mutex
+	sums map[string]string
+	gen  uint64 // bumped on every change, so a hash racing a write isn't kept
+}
+
+// newChecksumCache watches every directory under rootDir until ctx is done.
+func newChecksumCache(ctx context.Context, rootDir string) (*checksumCache, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	c := &checksumCache{
+		watcher: watcher,
+		sums:    make(map[string]string),
+	}
+	if err := c.watchTree(filepath.Clean(rootDir)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go c.run(ctx)
+	return c, nil
+}
+
+// watchTree adds a watch for dir and every directory below it.
+func (c *checksumCache) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return c.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (c *checksumCache) run(ctx context.Context) {
+	defer c.watcher.Close()
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			c.invalidate(event.Name)
+			if event.Has(fsnotify.Create) {
+				// New directories must be watched too; a file path fails harmlessly
+				if err := c.watchTree(event.Name); err != nil {
+					log.Printf("Warning: failed to watch new directory: path=%s, err=%v", event.Name, err)
+				}
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, so nothing cached can be trusted
+			log.Printf("Warning: checksum cache watcher failed, clearing cache: err=%v", err)
+			c.invalidate("")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// invalidate drops the checksums of path and anything below it; "" drops all.
+func (c *checksumCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for cached := range c.sums {
+		if path == "" || cached == path || strings.HasPrefix(cached, path+string(filepath.Separator)) {
+			delete(c.sums, cached)
+		}
+	}
+}
+
+// checksum returns the hex SHA-256 of a file, hashing it only if it changed
+// since it was last hashed.
+func (c *checksumCache) checksum(path string) (string, error) {
+	if c == nil {
+		return hashFile(path)
+	}
+	path = filepath.Clean(path)
+
+	c.mu.Lock()
+	sum, ok := c.sums[path]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok {
+		c.hits.Add(1)
+		return sum, nil
+	}
+
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.sums[path] = sum
+	}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// hitCount returns how many checksums were served from the cache.
+func (c *checksumCache) hitCount() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hits.Load()
+}
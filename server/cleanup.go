@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What the startup sweep does with temp files a crash left behind
+const (
+	StaleTempDelete     = "delete"
+	StaleTempQuarantine = "quarantine" // move them to QUARANTINE_DIR
+)
+
+// sweepStaleTemps removes or quarantines the temp files under the root that
+// haven't been written to for age, left behind by transfers cut off by a
+// crash. With RESUME_PARTIAL the partial files kept to be resumed stay,
+// however old. It runs before the servers start, so no transfer is writing
+// them.
+func (s *FileTransferServer) sweepStaleTemps(age time.Duration, action string) error {
+	entries, err := walkTree(s.rootDir, s.walkers, nil)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	if s.resume {
+		kept = append(kept, filepath.Join(s.rootDir, ResumeDirName))
+	}
+	// Quarantined files keep their suffix and would be swept again
+	if action == StaleTempQuarantine {
+		kept = append(kept, s.quarantine)
+	}
+
+	cutoff := time.Now().Add(-age)
+	swept := 0
+	for _, entry := range entries {
+		if !entry.d.Type().IsRegular() || !strings.HasSuffix(entry.rel, s.tempSuffix) || underAny(entry.path, kept) {
+			continue
+		}
+		info, err := entry.d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		log.Printf("Sweeping stale temp file: path=%s, modified=%s, action=%s", entry.rel, info.ModTime().Format(time.RFC3339), action)
+		if action == StaleTempQuarantine {
+			s.quarantineFile(entry.path, entry.rel)
+		} else if err := s.fs.Remove(entry.path); err != nil {
+			log.Printf("Warning: failed to remove stale temp file: path=%s, err=%v", entry.rel, err)
+			continue
+		}
+		swept++
+	}
+	log.Printf("Stale temp file sweep finished: swept=%d, olderThan=%v", swept, age)
+	return nil
+}
+
+// underAny reports whether path is inside one of dirs.
+func underAny(path string, dirs []string) bool {
+	path, _ = filepath.Abs(path)
+	for _, dir := range dirs {
+		dir, _ = filepath.Abs(dir)
+		if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	PeerAddr        string
+	AllowedPeers    []string // peers a request may pick instead of PeerAddr
+	PeerChunkSizes  map[string]int
+	PeerTransport   string // how files are sent to peers, see PeerTransportHTTP
+	PeerAPIToken    string // bearer token sent to the peer's /receive
+	RootDir         string
+	StorageBackend  string // where received files are kept, see StorageBackendMemory
+	HTTPPort        string
+	GRPCPort        string
+	HTTPListenAddrs []string
+	GRPCListenAddrs []string
+	ReportDir       string
+	TempFileSuffix  string
+	MaxRetries      int
+	RetryDelay      time.Duration
+	DialTimeout     time.Duration
+	SendTimeout     time.Duration // longest a chunk may wait for the peer to read it
+	WebhookURL      string
+	PostTransferCmd string
+	ReadAheadChunks int
+	FullChunks      bool
+	ChecksumCache   bool // watch ROOT_DIR and cache source checksums for sync=checksum
+	DisableProgress bool // leave out per-file progress updates
+	WriteFlushSize  int
+	UseMmap         bool
+	SkipOpenFiles   bool
+	MmapMinSize     int // smallest source read through mmap with UseMmap
+	FsyncPolicy     string
+	VerifyReadback  bool
+	WriteManifest   bool // write a <file>.sha256 sidecar next to each received file
+	ResumePartial   bool // keep files cut off mid-transfer to resume them by fingerprint
+	StrictRootDir   bool
+	MaxSymlinkHops  int // symlinks followed when resolving a path in strict mode
+	SymlinkParents  string
+	CaseCollisions  string // what to do with targets differing only in case from an existing one
+	NormalizeNames  string // Unicode form received names are stored in, empty to keep them as sent
+	Backslashes     string // what /transfer does with backslashes in targets
+	SetImmutable    bool
+	MaxOpenFiles    int
+	WalkConcurrency int // directories read at once when walking a tree
+	ReadOnly        bool
+	APIToken        string // bearer token required by mutating endpoints, if set
+	OTLPEndpoint    string
+	MinFreeInodes   int
+	MaxTotalUsage   int // bytes all files under RootDir may take up
+	MaxChunks       int // per received file
+	ChunkRetries    int // retransmits the receiver requests per corrupted chunk
+	RequireMount    string
+	ValidateCmd     string
+	ValidateTimeout time.Duration
+	QuarantineDir   string // where files failing ValidateCmd are moved
+
+	StaleTempAge    time.Duration // temp files older than this are swept at startup, 0 to keep them
+	StaleTempAction string        // see StaleTempDelete
+
+	StorageClasses map[string]string // root directory of each storage class besides standard
+
+	S3Endpoint        string
+	S3Bucket          string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	SlowTransferSpeed    int
+	PlanLinkSpeed        int // bytes per second /plan estimates durations with
+	SlowTransferDuration time.Duration
+	IdempotencyTTL       time.Duration
+	TransferDebounce     time.Duration
+	ConflictTimeout      time.Duration // how long on_conflict=ask waits for a decision
+
+	LoadThreshold     float64
+	LoadMaxTransfers  int
+	LoadCheckInterval time.Duration
+	LoadAvgFile       string
+	MaxQueueDepth     int
+
+	RequestRate    float64 // /transfer requests per second, 0 for no limit
+	RequestBurst   int     // requests let through at once before the rate applies
+	RequestRateKey string  // whether the rate applies to all clients together or to each IP
+
+	GRPCMaxStreams     int // concurrent streams per client connection, 0 for gRPC's default
+	GRPCWindowSize     int // flow control window per stream, 0 for gRPC's dynamic windows
+	GRPCConnWindowSize int // flow control window per connection, likewise
+
+	PeerRegistry     string // HTTP URL or srv: name to discover peers from
+	RegistryInterval time.Duration
+	DiscoveryAllow   []string // patterns discovered peer addresses must match
+
+	Profiles map[string]json.RawMessage // named transfer requests from PROFILES_FILE
+
+	HistoryFile string // append-only log of finished transfers, kept across restarts
+}
+
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		PeerAddr:        os.Getenv("PEER_SERVER_ADDR"),
+		PeerTransport:   getEnv("PEER_TRANSPORT", PeerTransportGRPC),
+		PeerAPIToken:    os.Getenv("PEER_API_TOKEN"),
+		RootDir:         os.Getenv("ROOT_DIR"),
+		StorageBackend:  getEnv("STORAGE_BACKEND", StorageBackendOS),
+		HTTPPort:        getEnv("HTTP_PORT", "8080"),
+		GRPCPort:        getEnv("GRPC_PORT", "50051"),
+		ReportDir:       os.Getenv("REPORT_DIR"),
+		TempFileSuffix:  getEnv("TEMP_FILE_SUFFIX", ".part"),
+		WebhookURL:      os.Getenv("WEBHOOK_URL"),
+		PostTransferCmd: os.Getenv("POST_TRANSFER_CMD"),
+		ValidateCmd:     os.Getenv("VALIDATE_CMD"),
+		QuarantineDir:   os.Getenv("QUARANTINE_DIR"),
+		StaleTempAction: getEnv("STALE_TEMP_ACTION", StaleTempDelete),
+		FsyncPolicy:     getEnv("FSYNC_POLICY", FsyncFull),
+		SymlinkParents:  getEnv("SYMLINK_PARENTS", SymlinkParentsFollow),
+		CaseCollisions:  getEnv("CASE_COLLISION_POLICY", CaseCollisionIgnore),
+		NormalizeNames:  strings.ToLower(getEnv("NORMALIZE_NAMES", "")),
+		Backslashes:     getEnv("TARGET_BACKSLASHES", BackslashKeep),
+		APIToken:        os.Getenv("API_TOKEN"),
+		RequireMount:    os.Getenv("REQUIRE_MOUNT"),
+		OTLPEndpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		LoadAvgFile:     getEnv("LOAD_AVG_FILE", "/proc/loadavg"),
+		PeerRegistry:    os.Getenv("PEER_REGISTRY"),
+		HistoryFile:     os.Getenv("HISTORY_FILE"),
+		RequestRateKey:  getEnv("REQUEST_RATE_KEY", RequestRateGlobal),
+
+		S3Endpoint:        os.Getenv("S3_ENDPOINT"),
+		S3Bucket:          os.Getenv("S3_BUCKET"),
+		S3Region:          getEnv("S3_REGION", "us-east-1"),
+		S3AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+	}
+
+	if cfg.PeerAddr == "" {
+		return nil, fmt.Errorf("PEER_SERVER_ADDR environment variable is required")
+	}
+
+	switch cfg.PeerTransport {
+	case PeerTransportGRPC, PeerTransportHTTP:
+	default:
+		return nil, fmt.Errorf("PEER_TRANSPORT must be one of: grpc, http: %s", cfg.PeerTransport)
+	}
+
+	// Entries are "host:port" or "host:port=<chunk size in bytes>"
+	cfg.PeerChunkSizes = make(map[string]int)
+	for _, peer := range strings.Split(os.Getenv("ALLOWED_PEERS"), ",") {
+		peer, size, hasSize := strings.Cut(strings.TrimSpace(peer), "=")
+		if peer == "" {
+			continue
+		}
+		cfg.AllowedPeers = append(cfg.AllowedPeers, peer)
+		if hasSize {
+			chunkSize, err := strconv.Atoi(size)
+			if err != nil || chunkSize <= 0 || chunkSize > MaxChunkSize {
+				return nil, fmt.Errorf("ALLOWED_PEERS chunk size for %s must be between 1 and %d bytes: %s", peer, MaxChunkSize, size)
+			}
+			cfg.PeerChunkSizes[peer] = chunkSize
+		}
+	}
+
+	if cfg.RootDir == "" {
+		return nil, fmt.Errorf("ROOT_DIR environment variable is required")
+	}
+
+	switch cfg.StorageBackend {
+	case StorageBackendOS:
+	case StorageBackendMemory:
+		if cfg.RequireMount != "" {
+			return nil, fmt.Errorf("REQUIRE_MOUNT can't be combined with STORAGE_BACKEND=memory")
+		}
+		if cfg.SymlinkParents != SymlinkParentsFollow {
+			return nil, fmt.Errorf("SYMLINK_PARENTS can't be combined with STORAGE_BACKEND=memory: %s", cfg.SymlinkParents)
+		}
+		if cfg.CaseCollisions != CaseCollisionIgnore {
+			return nil, fmt.Errorf("CASE_COLLISION_POLICY can't be combined with STORAGE_BACKEND=memory: %s", cfg.CaseCollisions)
+		}
+	default:
+		return nil, fmt.Errorf("STORAGE_BACKEND must be one of: os, memory: %s", cfg.StorageBackend)
+	}
+
+	// Entries are "class=/root/dir"; standard is always ROOT_DIR
+	cfg.StorageClasses = make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("STORAGE_CLASSES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		class, dir, _ := strings.Cut(entry, "=")
+		if !validStorageClass.MatchString(class) || class == StorageClassStandard || dir == "" {
+			return nil, fmt.Errorf("STORAGE_CLASSES entries must be <class>=<directory> with a class other than standard: %s", entry)
+		}
+		cfg.StorageClasses[class] = filepath.Clean(dir)
+	}
+
+	var err error
+	if cfg.HTTPListenAddrs, err = listenAddrs("HTTP_LISTEN_ADDR", cfg.HTTPPort); err != nil {
+		return nil, err
+	}
+	if cfg.GRPCListenAddrs, err = listenAddrs("GRPC_LISTEN_ADDR", cfg.GRPCPort); err != nil {
+		return nil, err
+	}
+	if cfg.HTTPPort == cfg.GRPCPort && os.Getenv("HTTP_LISTEN_ADDR") == "" && os.Getenv("GRPC_LISTEN_ADDR") == "" {
+		return nil, fmt.Errorf("HTTP_PORT and GRPC_PORT must differ: both are %s", cfg.HTTPPort)
+	}
+
+	if strings.ContainsAny(cfg.TempFileSuffix, `/\`) {
+		return nil, fmt.Errorf("TEMP_FILE_SUFFIX must not contain path separators: %s", cfg.TempFileSuffix)
+	}
+
+	if (cfg.S3Endpoint == "") != (cfg.S3Bucket == "") {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be set together")
+	}
+	if cfg.S3Endpoint != "" {
+		if u, err := url.Parse(cfg.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT must be an http(s) URL: %s", cfg.S3Endpoint)
+		}
+	}
+
+	if cfg.WebhookURL != "" {
+		if u, err := url.Parse(cfg.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("WEBHOOK_URL must be an http(s) URL: %s", cfg.WebhookURL)
+		}
+	}
+
+	if cfg.MaxRetries, err = getEnvInt("MAX_RETRIES", 0); err != nil || cfg.MaxRetries < 0 {
+		return nil, fmt.Errorf("MAX_RETRIES must be a non-negative integer: %s", os.Getenv("MAX_RETRIES"))
+	}
+
+	if cfg.ReadAheadChunks, err = getEnvInt("READ_AHEAD_CHUNKS", 0); err != nil || cfg.ReadAheadChunks < 0 {
+		return nil, fmt.Errorf("READ_AHEAD_CHUNKS must be a non-negative integer: %s", os.Getenv("READ_AHEAD_CHUNKS"))
+	}
+
+	if cfg.WriteFlushSize, err = getEnvInt("WRITE_FLUSH_SIZE", 0); err != nil || cfg.WriteFlushSize < 0 {
+		return nil, fmt.Errorf("WRITE_FLUSH_SIZE must be a non-negative integer: %s", os.Getenv("WRITE_FLUSH_SIZE"))
+	}
+
+	switch cfg.FsyncPolicy {
+	case FsyncNone, FsyncData, FsyncFull:
+	default:
+		return nil, fmt.Errorf("FSYNC_POLICY must be one of: none, data, full: %s", cfg.FsyncPolicy)
+	}
+
+	if cfg.FullChunks, err = getEnvBool("FULL_CHUNKS", false); err != nil {
+		return nil, fmt.Errorf("invalid FULL_CHUNKS: %v", err)
+	}
+
+	if cfg.SkipOpenFiles, err = getEnvBool("SKIP_OPEN_FILES", false); err != nil {
+		return nil, fmt.Errorf("invalid SKIP_OPEN_FILES: %v", err)
+	}
+
+	if cfg.DisableProgress, err = getEnvBool("DISABLE_PROGRESS", false); err != nil {
+		return nil, fmt.Errorf("invalid DISABLE_PROGRESS: %v", err)
+	}
+
+	if cfg.UseMmap, err = getEnvBool("USE_MMAP", false); err != nil {
+		return nil, fmt.Errorf("invalid USE_MMAP: %v", err)
+	}
+
+	if cfg.MmapMinSize, err = getEnvInt("MMAP_MIN_SIZE", 64<<20); err != nil || cfg.MmapMinSize < 0 {
+		return nil, fmt.Errorf("MMAP_MIN_SIZE must be a non-negative integer: %s", os.Getenv("MMAP_MIN_SIZE"))
+	}
+
+	if cfg.ChecksumCache, err = getEnvBool("CHECKSUM_CACHE", false); err != nil {
+		return nil, fmt.Errorf("invalid CHECKSUM_CACHE: %v", err)
+	}
+
+	if cfg.VerifyReadback, err = getEnvBool("VERIFY_READBACK", false); err != nil {
+		return nil, fmt.Errorf("invalid VERIFY_READBACK: %v", err)
+	}
+
+	if cfg.ResumePartial, err = getEnvBool("RESUME_PARTIAL", false); err != nil {
+		return nil, fmt.Errorf("invalid RESUME_PARTIAL: %v", err)
+	}
+	if cfg.ResumePartial && cfg.StorageBackend == StorageBackendMemory {
+		return nil, fmt.Errorf("RESUME_PARTIAL can't be combined with STORAGE_BACKEND=memory")
+	}
+
+	if cfg.WriteManifest, err = getEnvBool("WRITE_CHECKSUM_MANIFEST", false); err != nil {
+		return nil, fmt.Errorf("invalid WRITE_CHECKSUM_MANIFEST: %v", err)
+	}
+
+	if cfg.StrictRootDir, err = getEnvBool("STRICT_ROOT_DIR", false); err != nil {
+		return nil, fmt.Errorf("invalid STRICT_ROOT_DIR: %v", err)
+	}
+
+	if cfg.MaxSymlinkHops, err = getEnvInt("MAX_SYMLINK_HOPS", 40); err != nil || cfg.MaxSymlinkHops < 0 {
+		return nil, fmt.Errorf("MAX_SYMLINK_HOPS must be a non-negative integer: %s", os.Getenv("MAX_SYMLINK_HOPS"))
+	}
+
+	switch cfg.SymlinkParents {
+	case SymlinkParentsFollow, SymlinkParentsWithinRoot, SymlinkParentsReject:
+	default:
+		return nil, fmt.Errorf("SYMLINK_PARENTS must be one of: follow, within_root, reject: %s", cfg.SymlinkParents)
+	}
+
+	switch cfg.CaseCollisions {
+	case CaseCollisionIgnore, CaseCollisionWarn, CaseCollisionReject:
+	default:
+		return nil, fmt.Errorf("CASE_COLLISION_POLICY must be one of: ignore, warn, reject: %s", cfg.CaseCollisions)
+	}
+
+	switch cfg.NormalizeNames {
+	case "", NormalizeNFC, NormalizeNFD:
+	default:
+		return nil, fmt.Errorf("NORMALIZE_NAMES must be one of: nfc, nfd: %s", cfg.NormalizeNames)
+	}
+
+	switch cfg.Backslashes {
+	case BackslashKeep, BackslashConvert, BackslashReject:
+	default:
+		return nil, fmt.Errorf("TARGET_BACKSLASHES must be one of: keep, convert, reject: %s", cfg.Backslashes)
+	}
+
+	if cfg.MaxOpenFiles, err = getEnvInt("MAX_OPEN_FILES", 0); err != nil || cfg.MaxOpenFiles < 0 {
+		return nil, fmt.Errorf("MAX_OPEN_FILES must be a non-negative integer: %s", os.Getenv("MAX_OPEN_FILES"))
+	}
+
+	if cfg.WalkConcurrency, err = getEnvInt("WALK_CONCURRENCY", 1); err != nil || cfg.WalkConcurrency < 1 {
+		return nil, fmt.Errorf("WALK_CONCURRENCY must be a positive integer: %s", os.Getenv("WALK_CONCURRENCY"))
+	}
+
+	if cfg.SetImmutable, err = getEnvBool("SET_IMMUTABLE", false); err != nil {
+		return nil, fmt.Errorf("invalid SET_IMMUTABLE: %v", err)
+	}
+
+	if cfg.MinFreeInodes, err = getEnvInt("MIN_FREE_INODES", 0); err != nil || cfg.MinFreeInodes < 0 {
+		return nil, fmt.Errorf("MIN_FREE_INODES must be a non-negative integer: %s", os.Getenv("MIN_FREE_INODES"))
+	}
+
+	if cfg.MaxTotalUsage, err = getEnvInt("MAX_TOTAL_USAGE", 0); err != nil || cfg.MaxTotalUsage < 0 {
+		return nil, fmt.Errorf("MAX_TOTAL_USAGE must be a non-negative integer: %s", os.Getenv("MAX_TOTAL_USAGE"))
+	}
+
+	if cfg.MaxChunks, err = getEnvInt("MAX_CHUNKS_PER_FILE", 0); err != nil || cfg.MaxChunks < 0 {
+		return nil, fmt.Errorf("MAX_CHUNKS_PER_FILE must be a non-negative integer: %s", os.Getenv("MAX_CHUNKS_PER_FILE"))
+	}
+
+	if cfg.ChunkRetries, err = getEnvInt("CHUNK_RETRIES", 0); err != nil || cfg.ChunkRetries < 0 {
+		return nil, fmt.Errorf("CHUNK_RETRIES must be a non-negative integer: %s", os.Getenv("CHUNK_RETRIES"))
+	}
+
+	if cfg.ReadOnly, err = getEnvBool("READ_ONLY", false); err != nil {
+		return nil, fmt.Errorf("invalid READ_ONLY: %v", err)
+	}
+
+	if cfg.LoadThreshold, err = getEnvFloat("LOAD_THRESHOLD", 0); err != nil || cfg.LoadThreshold < 0 {
+		return nil, fmt.Errorf("LOAD_THRESHOLD must be a non-negative number: %s", os.Getenv("LOAD_THRESHOLD"))
+	}
+
+	if cfg.LoadMaxTransfers, err = getEnvInt("LOAD_MAX_TRANSFERS", 4); err != nil || cfg.LoadMaxTransfers < 1 {
+		return nil, fmt.Errorf("LOAD_MAX_TRANSFERS must be a positive integer: %s", os.Getenv("LOAD_MAX_TRANSFERS"))
+	}
+
+	if cfg.MaxQueueDepth, err = getEnvInt("MAX_QUEUE_DEPTH", 0); err != nil || cfg.MaxQueueDepth < 0 {
+		return nil, fmt.Errorf("MAX_QUEUE_DEPTH must be a non-negative integer: %s", os.Getenv("MAX_QUEUE_DEPTH"))
+	}
+
+	if cfg.LoadCheckInterval, err = getEnvDuration("LOAD_CHECK_INTERVAL", 5*time.Second); err != nil || cfg.LoadCheckInterval <= 0 {
+		return nil, fmt.Errorf("LOAD_CHECK_INTERVAL must be a positive duration: %s", os.Getenv("LOAD_CHECK_INTERVAL"))
+	}
+
+	if cfg.RequestRate, err = getEnvFloat("REQUEST_RATE_LIMIT", 0); err != nil || cfg.RequestRate < 0 {
+		return nil, fmt.Errorf("REQUEST_RATE_LIMIT must be a non-negative number: %s", os.Getenv("REQUEST_RATE_LIMIT"))
+	}
+
+	// The burst defaults to a second's worth of requests, and at least one
+	if cfg.RequestBurst, err = getEnvInt("REQUEST_RATE_BURST", max(1, int(math.Ceil(cfg.RequestRate)))); err != nil || cfg.RequestBurst < 1 {
+		return nil, fmt.Errorf("REQUEST_RATE_BURST must be a positive integer: %s", os.Getenv("REQUEST_RATE_BURST"))
+	}
+
+	if cfg.RequestRateKey != RequestRateGlobal && cfg.RequestRateKey != RequestRateIP {
+		return nil, fmt.Errorf("REQUEST_RATE_KEY must be one of: global, ip: %s", cfg.RequestRateKey)
+	}
+
+	if cfg.RetryDelay, err = getEnvDuration("RETRY_DELAY", time.Second); err != nil || cfg.RetryDelay < 0 {
+		return nil, fmt.Errorf("RETRY_DELAY must be a non-negative duration: %s", os.Getenv("RETRY_DELAY"))
+	}
+
+	if cfg.DialTimeout, err = getEnvDuration("DIAL_TIMEOUT", 10*time.Second); err != nil || cfg.DialTimeout <= 0 {
+		return nil, fmt.Errorf("DIAL_TIMEOUT must be a positive duration: %s", os.Getenv("DIAL_TIMEOUT"))
+	}
+
+	if cfg.ValidateTimeout, err = getEnvDuration("VALIDATE_TIMEOUT", 30*time.Second); err != nil || cfg.ValidateTimeout <= 0 {
+		return nil, fmt.Errorf("VALIDATE_TIMEOUT must be a positive duration: %s", os.Getenv("VALIDATE_TIMEOUT"))
+	}
+
+	if cfg.StaleTempAge, err = getEnvDuration("STALE_TEMP_AGE", 0); err != nil || cfg.StaleTempAge < 0 {
+		return nil, fmt.Errorf("STALE_TEMP_AGE must be a non-negative duration: %s", os.Getenv("STALE_TEMP_AGE"))
+	}
+	switch cfg.StaleTempAction {
+	case StaleTempDelete:
+	case StaleTempQuarantine:
+		if cfg.QuarantineDir == "" {
+			return nil, fmt.Errorf("QUARANTINE_DIR is required with STALE_TEMP_ACTION=quarantine")
+		}
+	default:
+		return nil, fmt.Errorf("STALE_TEMP_ACTION must be one of: delete, quarantine: %s", cfg.StaleTempAction)
+	}
+
+	if cfg.SendTimeout, err = getEnvDuration("SEND_TIMEOUT", 0); err != nil || cfg.SendTimeout < 0 {
+		return nil, fmt.Errorf("SEND_TIMEOUT must be a non-negative duration: %s", os.Getenv("SEND_TIMEOUT"))
+	}
+
+	if cfg.SlowTransferSpeed, err = getEnvInt("SLOW_TRANSFER_SPEED", 0); err != nil || cfg.SlowTransferSpeed < 0 {
+		return nil, fmt.Errorf("SLOW_TRANSFER_SPEED must be a non-negative integer: %s", os.Getenv("SLOW_TRANSFER_SPEED"))
+	}
+
+	if cfg.PlanLinkSpeed, err = getEnvInt("PLAN_LINK_SPEED", 0); err != nil || cfg.PlanLinkSpeed < 0 {
+		return nil, fmt.Errorf("PLAN_LINK_SPEED must be a non-negative integer: %s", os.Getenv("PLAN_LINK_SPEED"))
+	}
+
+	if cfg.SlowTransferDuration, err = getEnvDuration("SLOW_TRANSFER_DURATION", 0); err != nil || cfg.SlowTransferDuration < 0 {
+		return nil, fmt.Errorf("SLOW_TRANSFER_DURATION must be a non-negative duration: %s", os.Getenv("SLOW_TRANSFER_DURATION"))
+	}
+
+	if cfg.IdempotencyTTL, err = getEnvDuration("IDEMPOTENCY_TTL", 10*time.Minute); err != nil || cfg.IdempotencyTTL <= 0 {
+		return nil, fmt.Errorf("IDEMPOTENCY_TTL must be a positive duration: %s", os.Getenv("IDEMPOTENCY_TTL"))
+	}
+
+	if cfg.TransferDebounce, err = getEnvDuration("TRANSFER_DEBOUNCE", 0); err != nil || cfg.TransferDebounce < 0 {
+		return nil, fmt.Errorf("TRANSFER_DEBOUNCE must be a non-negative duration: %s", os.Getenv("TRANSFER_DEBOUNCE"))
+	}
+
+	if cfg.ConflictTimeout, err = getEnvDuration("CONFLICT_TIMEOUT", 10*time.Minute); err != nil || cfg.ConflictTimeout <= 0 {
+		return nil, fmt.Errorf("CONFLICT_TIMEOUT must be a positive duration: %s", os.Getenv("CONFLICT_TIMEOUT"))
+	}
+
+	for _, pattern := range strings.Split(os.Getenv("DISCOVERED_PEERS_ALLOW"), ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid DISCOVERED_PEERS_ALLOW pattern %s: %v", pattern, err)
+		}
+		cfg.DiscoveryAllow = append(cfg.DiscoveryAllow, pattern)
+	}
+	if cfg.PeerRegistry != "" {
+		if !strings.HasPrefix(cfg.PeerRegistry, RegistrySRVPrefix) {
+			if u, err := url.Parse(cfg.PeerRegistry); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("PEER_REGISTRY must be an http(s) URL or srv:<name>: %s", cfg.PeerRegistry)
+			}
+		}
+		// Whatever the registry returns is only trusted within the allowlist
+		if len(cfg.DiscoveryAllow) == 0 {
+			return nil, fmt.Errorf("DISCOVERED_PEERS_ALLOW is required with PEER_REGISTRY")
+		}
+	}
+	if cfg.RegistryInterval, err = getEnvDuration("PEER_REGISTRY_INTERVAL", time.Minute); err != nil || cfg.RegistryInterval <= 0 {
+		return nil, fmt.Errorf("PEER_REGISTRY_INTERVAL must be a positive duration: %s", os.Getenv("PEER_REGISTRY_INTERVAL"))
+	}
+
+	if cfg.GRPCMaxStreams, err = getEnvInt("GRPC_MAX_CONCURRENT_STREAMS", 0); err != nil || cfg.GRPCMaxStreams < 0 || cfg.GRPCMaxStreams > math.MaxUint32 {
+		return nil, fmt.Errorf("GRPC_MAX_CONCURRENT_STREAMS must be a non-negative integer: %s", os.Getenv("GRPC_MAX_CONCURRENT_STREAMS"))
+	}
+	// gRPC ignores windows below the HTTP/2 default of 64KB
+	for _, window := range []struct {
+		name  string
+		value *int
+	}{
+		{"GRPC_STREAM_WINDOW_SIZE", &cfg.GRPCWindowSize},
+		{"GRPC_CONN_WINDOW_SIZE", &cfg.GRPCConnWindowSize},
+	} {
+		if *window.value, err = getEnvInt(window.name, 0); err != nil || *window.value < 0 || (*window.value > 0 && *window.value < 64*1024) || *window.value > math.MaxInt32 {
+			return nil, fmt.Errorf("%s must be 0 or between 65536 and %d bytes: %s", window.name, math.MaxInt32, os.Getenv(window.name))
+		}
+	}
+
+	if file := os.Getenv("PROFILES_FILE"); file != "" {
+		if cfg.Profiles, err = loadProfiles(file); err != nil {
+			return nil, fmt.Errorf("invalid PROFILES_FILE: %v", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// listenAddrs reads a comma-separated list of "host:port" addresses from the
+// environment variable name, defaulting to port on all interfaces.
+func listenAddrs(name, port string) ([]string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return []string{":" + port}, nil
+	}
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		if slices.Contains(addrs, addr) {
+			return nil, fmt.Errorf("%s lists %s more than once", name, addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// listen binds every HTTP and gRPC listen address up front, so startup fails
+// as a whole if any of them is taken, instead of one server failing after the
+// others have started.
+func (cfg *Config) listen() (httpListeners, grpcListeners []net.Listener, err error) {
+	var bound []net.Listener
+	bind := func(name string, addrs []string) ([]net.Listener, error) {
+		var listeners []net.Listener
+		for _, addr := range addrs {
+			lis, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s is not bindable: %v", name, addr, err)
+			}
+			bound = append(bound, lis)
+			listeners = append(listeners, lis)
+		}
+		return listeners, nil
+	}
+	defer func() {
+		if err != nil {
+			for _, lis := range bound {
+				lis.Close()
+			}
+		}
+	}()
+	if httpListeners, err = bind("HTTP_LISTEN_ADDR", cfg.HTTPListenAddrs); err != nil {
+		return nil, nil, err
+	}
+	if grpcListeners, err = bind("GRPC_LISTEN_ADDR", cfg.GRPCListenAddrs); err != nil {
+		return nil, nil, err
+	}
+	return httpListeners, grpcListeners, nil
+}
+
+// serveAll runs serve on every listener and returns once the first of them
+// stops.
+func serveAll(listeners []net.Listener, serve func(net.Listener) error) error {
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		go func() { errs <- serve(lis) }()
+	}
+	return <-errs
+}
+
+// canonicalizeRootDir resolves RootDir to an absolute path without symlinks,
+// so prefix checks against it compare like with like.
+func (cfg *Config) canonicalizeRootDir() error {
+	absRoot, err := filepath.Abs(cfg.RootDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve ROOT_DIR: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return fmt.Errorf("failed to resolve ROOT_DIR: %v", err)
+	}
+	cfg.RootDir = resolved
+	return nil
+}
+
+// checkWithinRoot resolves symlinks in a path relative to rootDir and rejects
+// it if it leads outside rootDir or needs more than maxHops symlinks. Only the
+// existing part of the path is resolved, so it also works for targets that
+// are yet to be created.
+func checkWithinRoot(rootDir, path string, maxHops int) error {
+	existing := filepath.Join(rootDir, path)
+	missing := ""
+	resolved, err := evalSymlinks(existing, maxHops)
+	for os.IsNotExist(err) && existing != rootDir {
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+		resolved, err = evalSymlinks(existing, maxHops)
+	}
+	if errors.Is(err, errTooManySymlinks) {
+		rejectPath(RejectSymlinkHops, path)
+	}
+	if err != nil {
+		// Only missing components can be skipped; one that exists but can't be
+		// resolved (permissions, symlink loops) could lead anywhere
+		return fmt.Errorf("cannot resolve path %s: %w", path, err)
+	}
+
+	rel, err := filepath.Rel(rootDir, filepath.Join(resolved, missing))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rejectPath(RejectOutsideDir, path)
+		return fmt.Errorf("path resolves outside ROOT_DIR: %s", path)
+	}
+	return nil
+}
+
+var errTooManySymlinks = errors.New("too many symlinks")
+
+// evalSymlinks is filepath.EvalSymlinks for an absolute path, but gives up
+// after following maxHops symlinks, so deep chains and loops fail early.
+func evalSymlinks(path string, maxHops int) (string, error) {
+	sep := string(filepath.Separator)
+	volume := filepath.VolumeName(path)
+	resolved := volume + sep
+	pending := strings.Split(path[len(volume):], sep)
+	hops := 0
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if hops++; hops > maxHops {
+			return "", fmt.Errorf("%w: more than %d to resolve %s", errTooManySymlinks, maxHops, path)
+		}
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		// The link's components are resolved before the rest of the path
+		if filepath.IsAbs(link) {
+			volume = filepath.VolumeName(link)
+			resolved = volume + sep
+			link = link[len(volume):]
+		}
+		pending = append(strings.Split(link, sep), pending...)
+	}
+	return resolved, nil
+}
+
+// chunkSize is the chunk size for transfers to peerAddr.
+func (c *Config) chunkSize(peerAddr string) int {
+	if size, ok := c.PeerChunkSizes[peerAddr]; ok {
+		return size
+	}
+	return ChunkSize
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func getEnvFloat(key string, defaultValue float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
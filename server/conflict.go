@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+)
+
+// What a batch does with targets that already exist on the peer: overwrite
+// them, or stop at each until a client decides through POST /resolve/{id}
+const (
+	OnConflictOverwrite = "overwrite"
+	OnConflictAsk       = "ask"
+)
+
+// Decisions a conflict can be resolved with
+const (
+	ConflictOverwrite = "overwrite" // replace the existing target
+	ConflictSkip      = "skip"      // keep the existing target and leave the file out
+	ConflictRename    = "rename"    // send the file under another name instead
+)
+
+// maxRenameCandidates is how many numbered names are tried for a rename
+// without a target.
+const maxRenameCandidates = 100
+
+// ConflictInfo describes an existing target a batch is waiting on a decision
+// for. Mtimes are Unix nanoseconds.
+type ConflictInfo struct {
+	ID          string `json:"id"`
+	Size        int64  `json:"size"`
+	Mtime       int64  `json:"mtime"`
+	SourceSize  int64  `json:"source_size"`
+	SourceMtime int64  `json:"source_mtime"`
+}
+
+type ResolveRequest struct {
+	Action string `json:"action"`
+	Target string `json:"target,omitempty"` // rename only; a free numbered name next to the target if empty
+}
+
+type ResolveResponse struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+}
+
+// pendingConflicts holds the decisions batches are waiting for, by conflict ID.
+type pendingConflicts struct {
+	mu      sync.Mutex
+	pending map[string]chan ResolveRequest
+}
+
+func newPendingConflicts() *pendingConflicts {
+	return &pendingConflicts{pending: make(map[string]chan ResolveRequest)}
+}
+
+// open registers a new conflict and returns its ID and the channel its
+// decision arrives on; close must be called once the batch stops waiting.
+func (p *pendingConflicts) open() (string, <-chan ResolveRequest) {
+	id := newID()
+	decision := make(chan ResolveRequest, 1)
+	p.mu.Lock()
+	p.pending[id] = decision
+	p.mu.Unlock()
+	return id, decision
+}
+
+func (p *pendingConflicts) close(id string) {
+	p.mu.Lock()
+	delete(p.pending, id)
+	p.mu.Unlock()
+}
+
+// resolve hands decision to the batch waiting on id, reporting false if no
+// batch is.
+func (p *pendingConflicts) resolve(id string, decision ResolveRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.pending[id]
+	if ok {
+		delete(p.pending, id)
+		pending <- decision
+	}
+	return ok
+}
+
+// existingTargets asks the peer which of targets it already has, keyed by
+// target.
+func existingTargets(ctx context.Context, cfg *Config, targets []string) (map[string]*pb.QueryResult, error) {
+	results, err := QueryPeer(ctx, cfg, targets, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check targets for conflicts: %w", err)
+	}
+	existing := make(map[string]*pb.QueryResult)
+	for _, result := range results {
+		if result.Exists {
+			existing[result.FilePath] = result
+		}
+	}
+	return existing, nil
+}
+
+// awaitConflict announces that target already exists with a conflict event
+// and waits for its decision. Without one within CONFLICT_TIMEOUT the
+// existing target is kept. A rename without a target gets a free name.
+func awaitConflict(ctx context.Context, cfg *Config, conflicts *pendingConflicts, progressChan chan<- TransferProgress, source, target string, existing *pb.QueryResult) (ResolveRequest, error) {
+	id, decision := conflicts.open()
+	defer conflicts.close(id)
+
+	info := &ConflictInfo{ID: id, Size: existing.FileSize, Mtime: existing.Mtime}
+	if sourceInfo, err := os.Stat(filepath.Join(cfg.RootDir, filepath.Clean(source))); err == nil {
+		info.SourceSize = sourceInfo.Size()
+		info.SourceMtime = sourceInfo.ModTime().UnixNano()
+	}
+	progressChan <- TransferProgress{
+		Type:      "conflict",
+		Message:   fmt.Sprintf("target exists, waiting for POST /resolve/%s: %s", id, target),
+		Path:      target,
+		Conflict:  info,
+		Timestamp: time.Now(),
+	}
+
+	var resolved ResolveRequest
+	select {
+	case resolved = <-decision:
+	case <-time.After(cfg.ConflictTimeout):
+		log.Printf("Conflict not resolved in time, keeping existing target: conflictID=%s, target=%s", id, target)
+		resolved = ResolveRequest{Action: ConflictSkip}
+	case <-ctx.Done():
+		return ResolveRequest{}, context.Cause(ctx)
+	}
+
+	if resolved.Action == ConflictRename && resolved.Target == "" {
+		var err error
+		if resolved.Target, err = freeTarget(ctx, cfg, target); err != nil {
+			return ResolveRequest{}, err
+		}
+	}
+	return resolved, nil
+}
+
+// freeTarget returns the first of target's numbered variants, "name-1.ext",
+// "name-2.ext" and so on, that the peer doesn't have.
+func freeTarget(ctx context.Context, cfg *Config, target string) (string, error) {
+	ext := path.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	candidates := make([]string, maxRenameCandidates)
+	for i := range candidates {
+		candidates[i] = fmt.Sprintf("%s-%d%s", stem, i+1, ext)
+	}
+	existing, err := existingTargets(ctx, cfg, candidates)
+	if err != nil {
+		return "", err
+	}
+	for _, candidate := range candidates {
+		if existing[candidate] == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free name for %s among %d candidates", target, maxRenameCandidates)
+}
+
+// handleResolve serves POST /resolve/{id}, deciding a conflict a batch with
+// "on_conflict": "ask" is waiting on.
+func handleResolve(conflicts *pendingConflicts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ResolveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var errs []FieldError
+		invalid := func(field, message string) {
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+		switch req.Action {
+		case "":
+			invalid("action", "is required")
+		case ConflictOverwrite, ConflictSkip, ConflictRename:
+		default:
+			invalid("action", "must be one of: overwrite, skip, rename")
+		}
+		if req.Target != "" {
+			if req.Action != ConflictRename {
+				invalid("target", "only applies to rename")
+			} else if !isRelativePath(req.Target) || isObjectPath(req.Target) {
+				invalid("target", "must be a relative path inside the root directory")
+			}
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+
+		id := r.PathValue("id")
+		if !conflicts.resolve(id, req) {
+			http.Error(w, fmt.Sprintf("conflict not found: %s", id), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ResolveResponse{ID: id, Action: req.Action})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	CorrelationIDHeader = "X-Correlation-ID"
+	correlationIDKey    = "x-correlation-id" // gRPC metadata key
+)
+
+var validCorrelationID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestCorrelationID returns the caller's X-Correlation-ID if it is usable,
+// or a new ID otherwise.
+func requestCorrelationID(r *http.Request) string {
+	if id := r.Header.Get(CorrelationIDHeader); validCorrelationID.MatchString(id) {
+		return id
+	}
+	return newID()
+}
+
+// withCorrelationID attaches the ID to every gRPC call made with the returned context.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, correlationIDKey, id)
+}
+
+// incomingCorrelationID returns the ID the peer sent with a call, if any.
+func incomingCorrelationID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if ids := md.Get(correlationIDKey); len(ids) > 0 && validCorrelationID.MatchString(ids[0]) {
+		return ids[0]
+	}
+	return ""
+}
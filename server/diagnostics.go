@@ -0,0 +1,65 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+// ChunkDiagnostics summarizes how the chunks of one transfer were timed, as
+// requested with "diagnostics": true. Slow reads point at the source's disk,
+// slow sends at the network or a peer that is slow to take data off it.
+type ChunkDiagnostics struct {
+	Chunks      int            `json:"chunks"`
+	ReadLatency LatencySummary `json:"read_latency"` // waiting for the source to fill a chunk
+	SendLatency LatencySummary `json:"send_latency"` // handing a chunk to the stream, held up by flow control
+	ConfirmMs   float64        `json:"confirm_ms"`   // from the last chunk until the peer confirmed the file
+	Throughput  []int64        `json:"throughput"`   // bytes per second sent in each progress interval
+}
+
+// LatencySummary describes a set of durations in milliseconds.
+type LatencySummary struct {
+	MinMs float64 `json:"min_ms"`
+	MaxMs float64 `json:"max_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+// chunkTimings collects the timings behind ChunkDiagnostics while a transfer
+// runs.
+type chunkTimings struct {
+	reads      []time.Duration
+	sends      []time.Duration
+	throughput []int64
+	confirm    time.Duration
+}
+
+func (t *chunkTimings) summary() *ChunkDiagnostics {
+	return &ChunkDiagnostics{
+		Chunks:      len(t.sends),
+		ReadLatency: summarizeLatency(t.reads),
+		SendLatency: summarizeLatency(t.sends),
+		ConfirmMs:   milliseconds(t.confirm),
+		Throughput:  t.throughput,
+	}
+}
+
+func summarizeLatency(durations []time.Duration) LatencySummary {
+	if len(durations) == 0 {
+		return LatencySummary{}
+	}
+	sorted := slices.Sorted(slices.Values(durations))
+	// Nearest-rank percentiles
+	percentile := func(p int) time.Duration {
+		return sorted[max((len(sorted)*p+99)/100-1, 0)]
+	}
+	return LatencySummary{
+		MinMs: milliseconds(sorted[0]),
+		MaxMs: milliseconds(sorted[len(sorted)-1]),
+		P50Ms: milliseconds(percentile(50)),
+		P99Ms: milliseconds(percentile(99)),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistrySRVPrefix marks a PEER_REGISTRY that is a DNS SRV name instead of
+// an HTTP URL, e.g. "srv:_file-transfer._tcp.example.com".
+const RegistrySRVPrefix = "srv:"
+
+// DiscoveredPeer is one entry of the peer list an HTTP registry returns.
+type DiscoveredPeer struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+// peerRegistry keeps the peers found through PEER_REGISTRY, by name, so a
+// request can pick one with "peer" instead of a fixed address.
+type peerRegistry struct {
+	source   string
+	interval time.Duration
+	allow    []string // path.Match patterns a discovered address must match
+	client   *http.Client
+
+	mu    sync.RWMutex
+	peers map[string]string // name -> address
+}
+
+func newPeerRegistry(cfg *Config) *peerRegistry {
+	if cfg.PeerRegistry == "" {
+		return nil
+	}
+	return &peerRegistry{
+		source:   cfg.PeerRegistry,
+		interval: cfg.RegistryInterval,
+		allow:    cfg.DiscoveryAllow,
+		client:   &http.Client{Timeout: cfg.DialTimeout},
+		peers:    make(map[string]string),
+	}
+}
+
+// run looks up the peers on startup and then every interval until ctx ends.
+// A failed lookup keeps the peers found before.
+func (r *peerRegistry) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(ctx); err != nil {
+			log.Printf("Warning: failed to discover peers: registry=%s, err=%v", r.source, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *peerRegistry) refresh(ctx context.Context) error {
+	var discovered []DiscoveredPeer
+	var err error
+	if name, ok := strings.CutPrefix(r.source, RegistrySRVPrefix); ok {
+		discovered, err = lookupSRVPeers(ctx, name)
+	} else {
+		discovered, err = r.fetchPeers(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	peers := make(map[string]string, len(discovered))
+	for _, peer := range discovered {
+		if peer.Name == "" || !r.allowed(peer.Address) {
+			log.Printf("Warning: ignoring discovered peer: name=%s, address=%s", peer.Name, peer.Address)
+			continue
+		}
+		peers[peer.Name] = peer.Address
+	}
+	r.mu.Lock()
+	changed := len(peers) != len(r.peers)
+	for name, address := range peers {
+		changed = changed || r.peers[name] != address
+	}
+	r.peers = peers
+	r.mu.Unlock()
+	if changed {
+		log.Printf("Discovered peers: registry=%s, count=%d", r.source, len(peers))
+	}
+	return nil
+}
+
+// fetchPeers reads the JSON peer list an HTTP registry returns.
+func (r *peerRegistry) fetchPeers(ctx context.Context) ([]DiscoveredPeer, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("status=%d, body=%s", resp.StatusCode, body)
+	}
+	var peers []DiscoveredPeer
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		return nil, fmt.Errorf("invalid peer list: %v", err)
+	}
+	return peers, nil
+}
+
+// lookupSRVPeers finds peers through the SRV records of name. Each target is
+// a peer named after its host.
+func lookupSRVPeers(ctx context.Context, name string) ([]DiscoveredPeer, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]DiscoveredPeer, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		peers = append(peers, DiscoveredPeer{
+			Name:    host,
+			Address: net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+		})
+	}
+	return peers, nil
+}
+
+func (r *peerRegistry) allowed(address string) bool {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return false
+	}
+	for _, pattern := range r.allow {
+		if ok, _ := path.Match(pattern, address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// forPeer returns the configuration to reach the discovered peer name, or nil
+// if there is no such peer.
+func (r *peerRegistry) forPeer(cfg *Config, name string) *Config {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	address, ok := r.peers[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	discovered := *cfg
+	discovered.PeerAddr = address
+	return &discovered
+}
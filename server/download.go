@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// handleDownload serves a file under the root directory. Range requests are
+// supported, so interrupted downloads can be resumed; with If-Range a resumed
+// download only gets the range if the file is unchanged.
+func handleDownload(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" || !isRelativePath(path) {
+			http.Error(w, fmt.Sprintf("invalid path: %s", path), http.StatusBadRequest)
+			return
+		}
+		if cfg.StrictRootDir {
+			if err := checkWithinRoot(cfg.RootDir, path, cfg.MaxSymlinkHops); err != nil {
+				http.Error(w, fmt.Sprintf("invalid path: %v", err), pathErrorStatus(err))
+				return
+			}
+		}
+
+		file, err := openFile(filepath.Join(cfg.RootDir, filepath.Clean(path)))
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("file not found: %s", path), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to open file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		fileInfo, err := file.Stat()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to stat file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !fileInfo.Mode().IsRegular() {
+			http.Error(w, fmt.Sprintf("not a regular file: %s", path), http.StatusBadRequest)
+			return
+		}
+
+		// ServeContent handles Range, If-Range and 416 for unsatisfiable ranges.
+		// Last-Modified alone only has one-second resolution, so If-Range is
+		// matched against a strong ETag of the size and exact mtime.
+		w.Header().Set("ETag", fileETag(fileInfo))
+		http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), file)
+	}
+}
+
+// fileETag identifies a version of a file by its size and modification time.
+func fileETag(fileInfo os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fileInfo.Size(), fileInfo.ModTime().UnixNano())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventLogRetention is how long a finished batch's events stay available.
+const eventLogRetention = 5 * time.Minute
+
+// eventLog records the NDJSON events of one batch, numbering them from 1, so
+// watchers can follow the batch and resume after a dropped connection.
+type eventLog struct {
+	mu      sync.Mutex
+	events  []LogEntry
+	done    bool
+	changed chan struct{} // closed whenever an event is added or the log ends
+}
+
+func (l *eventLog) append(entry LogEntry) LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.ID = int64(len(l.events) + 1)
+	l.events = append(l.events, entry)
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return entry
+}
+
+func (l *eventLog) finish() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.done = true
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the events after lastID, whether the log has ended, and a
+// channel closed on the next change.
+func (l *eventLog) since(lastID int64) ([]LogEntry, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lastID = min(max(lastID, 0), int64(len(l.events)))
+	return l.events[lastID:], l.done, l.changed
+}
+
+// eventLogs holds the event logs of running and recently finished batches.
+type eventLogs struct {
+	mu   sync.Mutex
+	logs map[string]*eventLog
+}
+
+func newEventLogs() *eventLogs {
+	return &eventLogs{logs: make(map[string]*eventLog)}
+}
+
+func (e *eventLogs) create(batchID string) *eventLog {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	events := &eventLog{changed: make(chan struct{})}
+	e.logs[batchID] = events
+	return events
+}
+
+func (e *eventLogs) get(batchID string) *eventLog {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.logs[batchID]
+}
+
+// finish ends a batch's log and drops it once the retention period has passed.
+func (e *eventLogs) finish(batchID string) {
+	if events := e.get(batchID); events != nil {
+		events.finish()
+	}
+	time.AfterFunc(eventLogRetention, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.logs, batchID)
+	})
+}
+
+// handleTransferEvents serves GET /transfer/{batch_id}/events, streaming the
+// batch's events after the one named by the Last-Event-ID header and then
+// following the batch until it ends.
+func handleTransferEvents(logs *eventLogs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchID := r.PathValue("batch_id")
+		events := logs.get(batchID)
+		if events == nil {
+			http.Error(w, fmt.Sprintf("unknown batch: %s", batchID), http.StatusNotFound)
+			return
+		}
+
+		var lastID int64
+		if header := r.Header.Get("Last-Event-ID"); header != "" {
+			id, err := strconv.ParseInt(header, 10, 64)
+			if err != nil || id < 0 {
+				http.Error(w, fmt.Sprintf("invalid Last-Event-ID: %s", header), http.StatusBadRequest)
+				return
+			}
+			lastID = id
+		}
+
+		streamEvents(w, r, events, lastID)
+	}
+}
+
+// streamEvents writes the events after lastID as NDJSON and then follows the
+// log until it ends or the client goes away.
+func streamEvents(w http.ResponseWriter, r *http.Request, events *eventLog, lastID int64) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		entries, done, changed := events.since(lastID)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return
+			}
+			lastID = entry.ID
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
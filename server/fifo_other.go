@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mkfifo(path string, perm os.FileMode) error {
+	return errors.New("named pipes are only supported on Unix")
+}
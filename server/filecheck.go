@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkFile runs VALIDATE_CMD on a received file before it is moved to
+// target, with the file's path as $1. A file the command rejects, by exiting
+// non-zero or running past VALIDATE_TIMEOUT, is moved to QUARANTINE_DIR (or
+// deleted without one) and the transfer fails.
+func (s *FileTransferServer) checkFile(path, target string) error {
+	if s.checkCmd == "" {
+		return nil
+	}
+	rel, err := filepath.Rel(s.rootOf(target), target)
+	if err != nil {
+		rel = filepath.Base(target)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.checkWait)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", s.checkCmd, "sh", path)
+	cmd.Env = append(os.Environ(),
+		"TRANSFER_FILE="+path,
+		"TRANSFER_TARGET="+rel,
+	)
+	// Don't wait on children that outlive a killed command
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	reason := err.Error()
+	if ctx.Err() != nil {
+		reason = fmt.Sprintf("timed out after %v", s.checkWait)
+	}
+	log.Printf("Received file failed validation: path=%s, reason=%s, output=%s", rel, reason, bytes.TrimSpace(output))
+	s.quarantineFile(path, rel)
+	return status.Errorf(codes.FailedPrecondition, "file rejected by validation command: %s", reason)
+}
+
+// quarantineFile moves a rejected file to rel under QUARANTINE_DIR, or
+// deletes it if there is none or it can't be moved there.
+func (s *FileTransferServer) quarantineFile(path, rel string) {
+	if s.quarantine != "" {
+		dest := filepath.Join(s.quarantine, rel)
+		err := s.fs.MkdirAll(filepath.Dir(dest), 0755)
+		if err == nil {
+			err = s.fs.Rename(path, dest)
+		}
+		if err == nil {
+			log.Printf("Quarantined file: path=%s, quarantine=%s", rel, dest)
+			return
+		}
+		log.Printf("Warning: failed to quarantine file, deleting it: path=%s, err=%v", rel, err)
+	}
+	s.fs.Remove(path)
+}
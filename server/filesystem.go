@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// File is the subset of *os.File the receiver writes through.
+type File interface {
+	io.Writer
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// FileSystem abstracts the receiver's storage so transfers can target
+// something other than the local disk.
+type FileSystem interface {
+	MkdirAll(path string, perm os.FileMode) error
+	Create(name string) (File, error)
+	Append(name string) (File, error) // opens an existing file for writing at its end
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Chtimes(name string, atime, mtime time.Time) error
+	FreeInodes(path string) (uint64, error)
+	DeviceID(path string) (uint64, error)
+	Mkfifo(path string, perm os.FileMode) error
+}
+
+type OSFileSystem struct{}
+
+func (OSFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFileSystem) Create(name string) (File, error) {
+	file, err := createFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFileSystem) Append(name string) (File, error) {
+	file, err := appendFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (OSFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (OSFileSystem) FreeInodes(path string) (uint64, error) {
+	return freeInodes(path)
+}
+
+func (OSFileSystem) DeviceID(path string) (uint64, error) {
+	return deviceID(path)
+}
+
+func (OSFileSystem) Mkfifo(path string, perm os.FileMode) error {
+	return mkfifo(path, perm)
+}
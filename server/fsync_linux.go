@@ -0,0 +1,14 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// fdatasync flushes a file's data, and only the metadata needed to read it
+// back, to stable storage.
+func fdatasync(file File) error {
+	if f, ok := file.(interface{ Fd() uintptr }); ok {
+		return unix.Fdatasync(int(f.Fd()))
+	}
+	return file.Sync()
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// fdatasync falls back to a full sync where fdatasync isn't available.
+func fdatasync(file File) error {
+	return file.Sync()
+}
@@ -2,36 +2,292 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	pb "github.com/fa0311/file-transfer-system/proto"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 const (
-	ChunkSize        = 8 * 1024 * 1024  // 8MB chunks for optimal network performance
-	MaxMessageSize   = 16 * 1024 * 1024 // 16MB max gRPC message size
-	ProgressInterval = time.Second      // Progress update interval
+	ChunkSize        = 8 * 1024 * 1024       // 8MB chunks for optimal network performance
+	MaxMessageSize   = 16 * 1024 * 1024      // 16MB max gRPC message size
+	MaxChunkSize     = MaxMessageSize - 1024 // leaves room for the message framing
+	ProgressInterval = time.Second           // Progress update interval
+	UnknownSize      = -1                    // Declared size of streams whose length isn't known upfront
+	UnknownProgress  = -1                    // Progress percentage of transfers of unknown size
 )
 
+// ErrSourceChanged means the source file grew or shrank while it was being sent.
+var ErrSourceChanged = errors.New("source file changed size during transfer")
+
 type TransferProgress struct {
 	BytesTransferred int64
+	BytesConfirmed   int64 // bytes acknowledged by the peer, not just handed to the stream
 	TotalBytes       int64
+	BytesPerSecond   int64 // send rate since the previous update
 	Message          string
 	Timestamp        time.Time
+
+	// Set on typed events only
+	Type     string
+	Attempt  int
+	Reason   string
+	Path     string
+	Checksum string
+	Files    int
+
+	Diagnostics *ChunkDiagnostics // file_completed only, with "diagnostics": true
+	Conflict    *ConflictInfo     // conflict only, see OnConflictAsk
+	Kept        bool              // conflict_resolved only, the existing target was kept
+	Mapped      bool              // file_completed only, see TransferResult
+}
+
+type TransferResult struct {
+	BytesTransferred int64
+	Checksum         string
+	Unchanged        bool // the peer already had the file, nothing was sent
+	Chunks           int
+	Diagnostics      *ChunkDiagnostics // with "diagnostics": true
+	Mapped           bool              // read through mmap, see USE_MMAP
+}
+
+// peerSession reuses a single Transfer stream for consecutive files, so a
+// batch of small files doesn't pay a connection and stream setup per file.
+type peerSession struct {
+	peerAddr    string
+	transport   string // see PeerTransportHTTP
+	token       string // PEER_API_TOKEN, for the HTTP transport
+	dialTimeout time.Duration
+	sendTimeout time.Duration
+	chunkSize   int
+	readAhead   int
+	fullChunks  bool
+	mmap        bool
+	mmapMinSize int
+	walkers     int    // directories listed at once for archives
+	stage       string // batch ID the peer stages files under, if any
+
+	preserveMtimes bool
+	specialFiles   string // archives only, see SpecialFilesSkip
+	skipHidden     bool   // archives only, leave out dotfiles
+	diagnostics    bool   // time each chunk, see ChunkDiagnostics
+	recheckSource  bool   // files only, see checkUnmodified
+	sync           string // files only, see SyncQuick
+	storageClass   string // tier the peer stores files in, see STORAGE_CLASSES
+	checksums      *checksumCache
+	conn           *grpc.ClientConn
+	stream         pb.FileTransfer_TransferClient
+	cancel         context.CancelFunc
+}
+
+func newPeerSession(cfg *Config) *peerSession {
+	return &peerSession{
+		peerAddr:    cfg.PeerAddr,
+		transport:   cfg.PeerTransport,
+		token:       cfg.PeerAPIToken,
+		dialTimeout: cfg.DialTimeout,
+		sendTimeout: cfg.SendTimeout,
+		chunkSize:   cfg.chunkSize(cfg.PeerAddr),
+		readAhead:   cfg.ReadAheadChunks,
+		fullChunks:  cfg.FullChunks,
+		mmap:        cfg.UseMmap,
+		mmapMinSize: cfg.MmapMinSize,
+		walkers:     cfg.WalkConcurrency,
+	}
+}
+
+// fork returns a new session with the same settings and its own stream.
+func (p *peerSession) fork() *peerSession {
+	return &peerSession{
+		peerAddr:       p.peerAddr,
+		transport:      p.transport,
+		token:          p.token,
+		dialTimeout:    p.dialTimeout,
+		sendTimeout:    p.sendTimeout,
+		chunkSize:      p.chunkSize,
+		readAhead:      p.readAhead,
+		fullChunks:     p.fullChunks,
+		mmap:           p.mmap,
+		mmapMinSize:    p.mmapMinSize,
+		walkers:        p.walkers,
+		stage:          p.stage,
+		preserveMtimes: p.preserveMtimes,
+		specialFiles:   p.specialFiles,
+		skipHidden:     p.skipHidden,
+		diagnostics:    p.diagnostics,
+		recheckSource:  p.recheckSource,
+		sync:           p.sync,
+		storageClass:   p.storageClass,
+		checksums:      p.checksums,
+	}
+}
+
+// dialPeer creates a client for the peer. Connecting happens on first use;
+// each connection attempt, including the HTTP/2 handshake, fails after
+// dialTimeout, so an unreachable peer fails the RPC instead of blocking it.
+func dialPeer(peerAddr string, dialTimeout time.Duration) (*grpc.ClientConn, error) {
+	conn, err := grpc.NewClient(peerAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: dialTimeout,
+		}),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(MaxMessageSize),
+			grpc.MaxCallSendMsgSize(MaxMessageSize),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer server: %w", err)
+	}
+	return conn, nil
+}
+
+func (p *peerSession) open(ctx context.Context) error {
+	if p.transport == PeerTransportHTTP {
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := openHTTPTransfer(streamCtx, p.peerAddr, p.token, p.dialTimeout)
+		if err != nil {
+			cancel()
+			if status.Code(err) == codes.Unavailable {
+				return fmt.Errorf("peer unavailable: addr=%s: %w", p.peerAddr, err)
+			}
+			return fmt.Errorf("failed to create transfer stream: %w", err)
+		}
+		p.stream = stream
+		p.cancel = cancel
+		return nil
+	}
+
+	// Connect to peer server
+	conn, err := dialPeer(p.peerAddr, p.dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	client := pb.NewFileTransferClient(conn)
+	stream, err := client.Transfer(streamCtx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		if status.Code(err) == codes.Unavailable {
+			return fmt.Errorf("peer unavailable: addr=%s: %w", p.peerAddr, err)
+		}
+		return fmt.Errorf("failed to create transfer stream: %w", err)
+	}
+
+	p.conn = conn
+	p.stream = stream
+	p.cancel = cancel
+	return nil
+}
+
+// send transfers one file over the session's stream, opening it if needed.
+// A failed transfer leaves the stream unusable, so it is discarded and the
+// next send opens a new one.
+func (p *peerSession) send(ctx context.Context, metadata *pb.TransferMetadata, reader io.Reader, contentHash hash.Hash, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	if p.stream == nil {
+		connectCtx, span := startSpan(ctx, "connect", attribute.String("peer_address", p.peerAddr))
+		err := p.open(connectCtx)
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metadata.Stage = p.stage
+	metadata.PreserveMtimes = p.preserveMtimes
+	metadata.StorageClass = p.storageClass
+
+	// Slices of a mapping are already full
+	if _, mapped := reader.(*mappedReader); p.fullChunks && !mapped {
+		reader = fullReader{reader}
+	}
+	var stream pb.FileTransfer_TransferClient = p.stream
+	if p.sendTimeout > 0 {
+		stream = &sendWatchdog{FileTransfer_TransferClient: p.stream, timeout: p.sendTimeout, cancel: p.cancel}
+	}
+	ctx, span := startSpan(ctx, "stream", attribute.String("path", metadata.FilePath))
+	var timings *chunkTimings
+	if p.diagnostics {
+		timings = &chunkTimings{}
+	}
+	result, err := sendStream(ctx, stream, metadata, reader, p.chunkSize, p.readAhead, contentHash, timings, progressChan)
+	if err != nil {
+		p.discard()
+	}
+	if result != nil && timings != nil && !result.Unchanged {
+		result.Diagnostics = timings.summary()
+	}
+	if result != nil {
+		span.SetAttributes(
+			attribute.Int64("bytes_transferred", result.BytesTransferred),
+			attribute.Int("chunks", result.Chunks))
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+// Close ends the stream once the peer has finished with the last file.
+func (p *peerSession) Close() {
+	if p.stream == nil {
+		return
+	}
+	if err := p.stream.CloseSend(); err == nil {
+		// The peer returns once it sees the end of the stream
+		p.stream.Recv()
+	}
+	p.discard()
+}
+
+func (p *peerSession) discard() {
+	p.cancel()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = nil
+	p.stream = nil
+	p.cancel = nil
+}
+
+// sendWatchdog fails a Send that doesn't return within timeout. Once the peer
+// stops reading, HTTP/2 flow control blocks Send indefinitely; cancelling the
+// stream unblocks it, and the failed session is discarded as usual.
+type sendWatchdog struct {
+	pb.FileTransfer_TransferClient
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (w *sendWatchdog) Send(req *pb.TransferRequest) error {
+	timer := time.AfterFunc(w.timeout, w.cancel)
+	err := w.FileTransfer_TransferClient.Send(req)
+	if !timer.Stop() {
+		return status.Errorf(codes.DeadlineExceeded, "peer stopped reading: send blocked for %s", w.timeout)
+	}
+	return err
 }
 
-func TransferFile(ctx context.Context, peerAddr, sourcePath, targetPath, rootDir string, progressChan chan<- TransferProgress) error {
+func TransferFile(ctx context.Context, session *peerSession, sourcePath, targetPath, rootDir string, progressChan chan<- TransferProgress) (*TransferResult, error) {
 	// Validate source path
 	cleanSourcePath := filepath.Clean(sourcePath)
 	if strings.HasPrefix(cleanSourcePath, "..") || filepath.IsAbs(cleanSourcePath) {
-		return fmt.Errorf("invalid source path: %s", sourcePath)
+		return nil, fmt.Errorf("invalid source path: %s", sourcePath)
 	}
 
 	fullSourcePath := filepath.Join(rootDir, cleanSourcePath)
@@ -39,129 +295,473 @@ func TransferFile(ctx context.Context, peerAddr, sourcePath, targetPath, rootDir
 	// Check if file exists
 	fileInfo, err := os.Stat(fullSourcePath)
 	if err != nil {
-		return fmt.Errorf("failed to stat source file: %v", err)
+		return nil, fmt.Errorf("failed to stat source file: %v", err)
 	}
 
 	if fileInfo.IsDir() {
-		return fmt.Errorf("source path is a directory, not a file")
+		return nil, fmt.Errorf("source path is a directory, not a file")
 	}
 
-	fileSize := fileInfo.Size()
+	file, err := openFile(fullSourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
 
-	// Connect to peer server
-	conn, err := grpc.NewClient(peerAddr,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultCallOptions(
-			grpc.MaxCallRecvMsgSize(MaxMessageSize),
-			grpc.MaxCallSendMsgSize(MaxMessageSize),
-		),
-	)
+	// Pipes and other special files have no size until they end
+	metadata := &pb.TransferMetadata{
+		FilePath: targetPath,
+		FileSize: fileInfo.Size(),
+	}
+	if !fileInfo.Mode().IsRegular() {
+		metadata.FileSize = UnknownSize
+	} else if metadata.Fingerprint, err = fingerprint(file, fileInfo.Size()); err != nil {
+		return nil, fmt.Errorf("failed to fingerprint source file: %v", err)
+	}
+	if session.sync != "" && metadata.FileSize != UnknownSize {
+		metadata.Sync = session.sync
+		metadata.Mtime = fileInfo.ModTime().UnixNano()
+	}
+	if session.sync == SyncChecksum {
+		// The peer compares content before anything is sent, so hash it upfront
+		if metadata.Checksum, err = session.checksums.checksum(fullSourcePath); err != nil {
+			return nil, fmt.Errorf("failed to hash source file: %v", err)
+		}
+	}
+
+	var result *TransferResult
+	if session.mmap && metadata.FileSize > 0 && metadata.FileSize >= int64(session.mmapMinSize) {
+		mapped, mapErr := newMappedReader(file.File, metadata.FileSize)
+		if mapErr == nil {
+			defer mapped.Close()
+			result, err = session.sendMapped(ctx, metadata, mapped, progressChan)
+		} else {
+			log.Printf("Warning: failed to map source file, reading it instead: path=%s, err=%v", sourcePath, mapErr)
+		}
+	}
+	if result == nil && err == nil {
+		result, err = session.send(ctx, metadata, file, nil, progressChan)
+	}
+	if err == nil && session.recheckSource {
+		err = checkUnmodified(fullSourcePath, fileInfo)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer server: %v", err)
+		return nil, err
 	}
-	defer conn.Close()
+	return result, nil
+}
 
-	client := pb.NewFileTransferClient(conn)
-	stream, err := client.Transfer(ctx)
+// checkUnmodified fails with ErrSourceChanged if the file at path no longer
+// has the size and mtime it had before it was sent. Where writers can't be
+// detected, this still catches a file written to during its transfer, if only
+// once it has been sent.
+func checkUnmodified(path string, before os.FileInfo) error {
+	after, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("failed to create transfer stream: %v", err)
+		return fmt.Errorf("failed to stat source file: %v", err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return fmt.Errorf("%w: modified while it was sent", ErrSourceChanged)
 	}
+	return nil
+}
+
+// TransferArchive packs a source directory into a (optionally compressed) tar
+// stream on the fly and sends it as a single transfer, which the peer unpacks into targetPath.
+func TransferArchive(ctx context.Context, session *peerSession, sourcePath, targetPath, rootDir, archive string, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	// Validate source path
+	cleanSourcePath := filepath.Clean(sourcePath)
+	if strings.HasPrefix(cleanSourcePath, "..") || filepath.IsAbs(cleanSourcePath) {
+		return nil, fmt.Errorf("invalid source path: %s", sourcePath)
+	}
+
+	fullSourcePath := filepath.Join(rootDir, cleanSourcePath)
+
+	// Check if directory exists
+	fileInfo, err := os.Stat(fullSourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source directory: %v", err)
+	}
+
+	if !fileInfo.IsDir() {
+		return nil, fmt.Errorf("source path is a file, not a directory")
+	}
+
+	// The checksum covers the tar bytes before compression
+	hasher := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchive(pw, fullSourcePath, archive, session.specialFiles, session.skipHidden, session.walkers, hasher))
+	}()
+	// Unblocks the tar writer if sending stops early
+	defer pr.Close()
+
+	return session.send(ctx, &pb.TransferMetadata{
+		FilePath: targetPath,
+		FileSize: UnknownSize,
+		Archive:  archive,
+	}, pr, hasher, progressChan)
+}
+
+// sendStream streams everything read from reader to the peer as one transfer.
+// contentHash, if set, is fed by the caller with the uncompressed content;
+// otherwise the checksum is computed over the stream itself.
+// timings, if set, collects per-chunk timings for diagnostics.
+func sendStream(ctx context.Context, stream pb.FileTransfer_TransferClient, metadata *pb.TransferMetadata, reader io.Reader, chunkSize, readAhead int, contentHash hash.Hash, timings *chunkTimings, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	fileSize := metadata.FileSize
+	totalBytes := max(fileSize, 0)
+	metadata.ChunkRetransmit = true
 
 	// Step 1: Send metadata
 	if err := stream.Send(&pb.TransferRequest{
 		Payload: &pb.TransferRequest_Metadata{
-			Metadata: &pb.TransferMetadata{
-				FilePath: targetPath,
-				FileSize: fileSize,
-			},
+			Metadata: metadata,
 		},
 	}); err != nil {
-		return fmt.Errorf("failed to send metadata: %v", err)
+		return nil, fmt.Errorf("failed to send metadata: %w", err)
+	}
+
+	// Wait for the peer to accept the transfer; rejections keep their gRPC status
+	ack, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("peer rejected transfer: %w", err)
+	}
+	if ack.Skipped {
+		reportProgress(progressChan, TransferProgress{
+			TotalBytes: totalBytes,
+			Message:    "target is up to date",
+			Timestamp:  time.Now(),
+		})
+		return &TransferResult{Checksum: metadata.Checksum, Unchanged: true}, nil
+	}
+	if !ack.Ready {
+		return nil, fmt.Errorf("unexpected response from peer: %s", ack.Message)
+	}
+
+	// The peer checks every chunk and may ask for corrupted ones again
+	var resender *chunkResender
+	if ack.ChunkRetries > 0 {
+		resender = newChunkResender(stream)
+	}
+	sendErr := func(err error) error {
+		if resender != nil {
+			return resender.sendError(err)
+		}
+		return sendError(stream, err)
 	}
 
-	progressChan <- TransferProgress{
+	reportProgress(progressChan, TransferProgress{
 		BytesTransferred: 0,
-		TotalBytes:       fileSize,
+		TotalBytes:       totalBytes,
 		Message:          "transfer started",
 		Timestamp:        time.Now(),
+	})
+
+	hasher := contentHash
+	if hasher == nil {
+		hasher = sha256.New()
 	}
 
-	// Step 2: Open and send file chunks
-	file, err := os.Open(fullSourcePath)
-	if err != nil {
-		return fmt.Errorf("failed to open source file: %v", err)
+	// The peer kept the start of the file from an interrupted transfer, which
+	// still counts towards the checksum
+	offset := ack.ResumeOffset
+	if offset > 0 {
+		if contentHash != nil || offset > fileSize {
+			return nil, fmt.Errorf("peer resumed at an invalid offset: %d", offset)
+		}
+		if _, err := io.CopyN(hasher, reader, offset); err != nil {
+			return nil, fmt.Errorf("failed to read source: %v", err)
+		}
+		reportProgress(progressChan, TransferProgress{
+			BytesTransferred: offset,
+			TotalBytes:       totalBytes,
+			Message:          fmt.Sprintf("resuming at %d bytes", offset),
+			Timestamp:        time.Now(),
+		})
 	}
-	defer file.Close()
 
-	buffer := make([]byte, ChunkSize)
-	bytesTransferred := int64(0)
+	// Step 2: Send chunks
+	nextChunk, stopReading := chunkReader(reader, chunkSize, readAhead)
+	defer stopReading()
+	bytesTransferred := offset
+	chunks := 0
 	lastProgressTime := time.Now()
+	lastProgressBytes := offset
 
 	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read file: %v", err)
-		}
-		if n == 0 {
-			break
+		readStart := time.Now()
+		data, readErr := nextChunk()
+		if readErr != nil && readErr != io.EOF {
+			return nil, fmt.Errorf("failed to read source: %w", readErr)
 		}
 
-		// Send chunk without waiting for response
-		if err := stream.Send(&pb.TransferRequest{
-			Payload: &pb.TransferRequest_Chunk{
-				Chunk: &pb.FileChunk{
-					Data: buffer[:n],
-				},
-			},
-		}); err != nil {
-			return fmt.Errorf("failed to send chunk: %v", err)
+		if n := len(data); n > 0 {
+			sendStart := time.Now()
+			if timings != nil {
+				timings.reads = append(timings.reads, sendStart.Sub(readStart))
+			}
+
+			// Send chunk without waiting for response
+			var err error
+			if resender != nil {
+				err = resender.send(data)
+			} else {
+				err = stream.Send(&pb.TransferRequest{
+					Payload: &pb.TransferRequest_Chunk{
+						Chunk: &pb.FileChunk{
+							Data: data,
+						},
+					},
+				})
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to send chunk: %w", sendErr(err))
+			}
+			if timings != nil {
+				timings.sends = append(timings.sends, time.Since(sendStart))
+			}
+
+			if contentHash == nil {
+				hasher.Write(data)
+			}
+			bytesTransferred += int64(n)
+			chunks++
 		}
 
-		bytesTransferred += int64(n)
+		if readErr == io.EOF {
+			if timings != nil && bytesTransferred > lastProgressBytes {
+				elapsed := time.Since(lastProgressTime)
+				timings.throughput = append(timings.throughput, int64(float64(bytesTransferred-lastProgressBytes)/max(elapsed.Seconds(), 0.001)))
+			}
+			break
+		}
 
 		// Send local progress update
-		if time.Since(lastProgressTime) >= ProgressInterval {
-			progressChan <- TransferProgress{
+		if elapsed := time.Since(lastProgressTime); elapsed >= ProgressInterval {
+			message := fmt.Sprintf("sending: %d bytes", bytesTransferred)
+			if percent := progressPercent(bytesTransferred, fileSize); percent != UnknownProgress {
+				message = fmt.Sprintf("sending: %.2f%%", percent)
+			}
+			bytesPerSecond := int64(float64(bytesTransferred-lastProgressBytes) / elapsed.Seconds())
+			if timings != nil {
+				timings.throughput = append(timings.throughput, bytesPerSecond)
+			}
+			reportProgress(progressChan, TransferProgress{
 				BytesTransferred: bytesTransferred,
-				TotalBytes:       fileSize,
-				Message:          fmt.Sprintf("sending: %.2f%%", float64(bytesTransferred)/float64(fileSize)*100),
+				TotalBytes:       totalBytes,
+				BytesPerSecond:   bytesPerSecond,
+				Message:          message,
 				Timestamp:        time.Now(),
-			}
+			})
 			lastProgressTime = time.Now()
+			lastProgressBytes = bytesTransferred
 		}
 	}
 
+	// The declared size came from a stat taken before reading
+	if fileSize != UnknownSize && bytesTransferred != fileSize {
+		return nil, fmt.Errorf("%w: declared=%d, read=%d", ErrSourceChanged, fileSize, bytesTransferred)
+	}
+
 	// Step 3: Send completion message
+	checksum := hex.EncodeToString(hasher.Sum(nil))
 	if err := stream.Send(&pb.TransferRequest{
 		Payload: &pb.TransferRequest_Complete{
 			Complete: &pb.TransferComplete{
 				BytesTransferred: bytesTransferred,
+				Checksum:         checksum,
 			},
 		},
 	}); err != nil {
-		return fmt.Errorf("failed to send completion: %v", err)
+		return nil, fmt.Errorf("failed to send completion: %w", sendErr(err))
 	}
 
-	// Close send side
-	if err := stream.CloseSend(); err != nil {
-		return fmt.Errorf("failed to close send stream: %v", err)
-	}
+	// Everything is sent, but the peer may still be writing buffered chunks
+	reportProgress(progressChan, TransferProgress{
+		BytesTransferred: bytesTransferred,
+		TotalBytes:       totalBytes,
+		Message:          "awaiting peer confirmation",
+		Timestamp:        time.Now(),
+	})
 
 	// Wait for final response from server
-	resp, err := stream.Recv()
+	confirmStart := time.Now()
+	_, span := startSpan(ctx, "verify")
+	var resp *pb.TransferResponse
+	if resender != nil {
+		resp, err = resender.result()
+	} else {
+		resp, err = stream.Recv()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to receive final response: %w", err)
+	} else if !resp.Success {
+		err = fmt.Errorf("transfer failed: %s", resp.Message)
+	}
+	endSpan(span, err)
 	if err != nil {
-		return fmt.Errorf("failed to receive final response: %v", err)
+		return nil, err
 	}
-	if !resp.Success {
-		return fmt.Errorf("transfer failed: %s", resp.Message)
+	if timings != nil {
+		timings.confirm = time.Since(confirmStart)
 	}
 
-	progressChan <- TransferProgress{
+	reportProgress(progressChan, TransferProgress{
 		BytesTransferred: bytesTransferred,
-		TotalBytes:       fileSize,
+		BytesConfirmed:   resp.BytesReceived,
+		TotalBytes:       totalBytes,
 		Message:          "transfer completed",
 		Timestamp:        time.Now(),
+	})
+
+	return &TransferResult{
+		BytesTransferred: bytesTransferred,
+		Checksum:         checksum,
+		Chunks:           chunks,
+	}, nil
+}
+
+// sendError explains a failed Send. io.EOF means the peer ended the stream,
+// and only Recv reports the status it ended it with.
+func sendError(stream pb.FileTransfer_TransferClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if _, recvErr := stream.Recv(); recvErr != nil && recvErr != io.EOF {
+		return recvErr
+	}
+	return err
+}
+
+// reportProgress sends an update about the file being transferred. A nil
+// progressChan means progress isn't tracked (DISABLE_PROGRESS), and the update
+// is dropped.
+func reportProgress(progressChan chan<- TransferProgress, progress TransferProgress) {
+	if progressChan != nil {
+		progressChan <- progress
 	}
+}
 
-	return nil
+// MaxUnconfirmedProgress is as far as progress goes until the peer confirms
+// it has written every byte.
+const MaxUnconfirmedProgress = 99.9
+
+// progressPercent returns how much of total has been transferred, or
+// UnknownProgress if the total isn't known.
+func progressPercent(transferred, total int64) float64 {
+	if total <= 0 {
+		return UnknownProgress
+	}
+	return float64(transferred) / float64(total) * 100
+}
+
+// fullReader fills every buffer it reads into unless the source ends first, so
+// chunks read from it are all full-sized except the last, however short the
+// source's own reads are.
+type fullReader struct {
+	io.Reader
+}
+
+func (r fullReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.Reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// chunkReader returns a function yielding consecutive chunks of up to
+// chunkSize bytes of reader; each chunk is valid until the next call. With readAhead > 0 a goroutine reads up
+// to readAhead chunks ahead, so disk reads overlap hashing and sending.
+// Buffers come from chunkPool and are returned once stop is called.
+func chunkReader(reader io.Reader, chunkSize, readAhead int) (next func() ([]byte, error), stop func()) {
+	// Chunks of a mapping are read where they are, without buffers, and must
+	// only be touched on the sending goroutine, see sendMapped
+	if mapped, ok := reader.(*mappedReader); ok {
+		return func() ([]byte, error) { return mapped.chunk(chunkSize) }, func() {}
+	}
+	if readAhead <= 0 {
+		buffer := getChunkBuffer(chunkSize)
+		return func() ([]byte, error) {
+			n, err := reader.Read(*buffer)
+			return (*buffer)[:n], err
+		}, func() { putChunkBuffer(buffer) }
+	}
+
+	type chunk struct {
+		buffer *[]byte
+		n      int
+		err    error
+	}
+	chunks := make(chan chunk, readAhead)
+	free := make(chan *[]byte, readAhead+1)
+	for range readAhead + 1 {
+		free <- getChunkBuffer(chunkSize)
+	}
+	done := make(chan struct{})
+
+	// Hands every buffer still queued in free back to the pool
+	drainFree := func() {
+		for {
+			select {
+			case buffer := <-free:
+				putChunkBuffer(buffer)
+			default:
+				return
+			}
+		}
+	}
+
+	go func() {
+		defer close(chunks)
+		defer drainFree()
+		for {
+			var buffer *[]byte
+			select {
+			case buffer = <-free:
+			case <-done:
+				return
+			}
+
+			n, err := reader.Read(*buffer)
+			select {
+			case chunks <- chunk{buffer: buffer, n: n, err: err}:
+			case <-done:
+				putChunkBuffer(buffer)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var current *[]byte
+	next = func() ([]byte, error) {
+		// The previous chunk has been sent, so its buffer can be refilled
+		if current != nil {
+			free <- current
+			current = nil
+		}
+		c, ok := <-chunks
+		if !ok {
+			return nil, io.EOF
+		}
+		current = c.buffer
+		return (*c.buffer)[:c.n], c.err
+	}
+	stop = func() {
+		close(done)
+		if current != nil {
+			putChunkBuffer(current)
+		}
+		drainFree()
+		// Chunks read ahead but never consumed
+		go func() {
+			for c := range chunks {
+				putChunkBuffer(c.buffer)
+			}
+		}()
+	}
+	return next, stop
 }
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pb "github.com/fa0311/file-transfer-system/proto"
 	"google.golang.org/grpc"
@@ -18,122 +29,782 @@ const (
 	maxMessageSize = 16 * 1024 * 1024 // 16MB max gRPC message size
 )
 
+// How received files are flushed to stable storage before they are moved into place.
+const (
+	FsyncNone = "none" // leave it to the OS
+	FsyncData = "data" // fdatasync: data and the metadata needed to read it
+	FsyncFull = "full" // fsync
+)
+
+// What the receiver does when a target's directory is reached through a symlink,
+// checked after the directory is created and before the file is written.
+const (
+	SymlinkParentsFollow     = "follow"      // write wherever the symlink leads
+	SymlinkParentsWithinRoot = "within_root" // only if the real directory is inside the root
+	SymlinkParentsReject     = "reject"      // refuse any symlink between the root and the target
+)
+
 type FileTransferServer struct {
 	pb.UnimplementedFileTransferServer
-	rootDir string
+	rootDir    string
+	strictRoot bool
+	maxHops    int
+	symlinks   string // see SymlinkParentsFollow
+	caseCheck  string // see CaseCollisionIgnore
+	caseFolds  bool   // the root's filesystem ignores case
+	nameForm   string // see NormalizeNFC
+	tempSuffix string
+	immutable  bool
+	readOnly   bool
+	minInodes  uint64
+	maxChunks  int
+	chunkRetry int // retransmits requested per corrupted chunk
+	walkers    int // directories listed at once for pulls and batch checks
+	resume     bool
+	classes    map[string]string // storage class roots from STORAGE_CLASSES
+	mountPoint string
+	flushSize  int
+	fsync      string
+	readback   bool
+	fullChunks bool
+	manifest   bool
+	checkCmd   string        // VALIDATE_CMD run on each received file
+	checkWait  time.Duration // VALIDATE_TIMEOUT
+	quarantine string        // where files failing VALIDATE_CMD go, deleted if empty
+	fs         FileSystem
+	objects    FileSystem // targets with ObjectPrefix, nil without S3_BUCKET
+	usage      *diskUsage // nil without MAX_TOTAL_USAGE
+
+	storageReadOnly atomic.Bool // set when a write fails with EROFS
+
+	mu            sync.Mutex
+	activeTargets map[string]bool
+	rangedFiles   map[string]*rangedFile // by range ID
 }
 
-func NewFileTransferServer(rootDir string) *FileTransferServer {
-	return &FileTransferServer{
-		rootDir: rootDir,
+var (
+	errReadOnly        = status.Error(codes.PermissionDenied, "server is read-only")
+	errStorageReadOnly = storageStatus(codes.FailedPrecondition, StorageReadOnly, "storage is read-only")
+)
+
+func NewFileTransferServer(cfg *Config, fs FileSystem) *FileTransferServer {
+	s := &FileTransferServer{
+		rootDir:       cfg.RootDir,
+		strictRoot:    cfg.StrictRootDir,
+		maxHops:       cfg.MaxSymlinkHops,
+		symlinks:      cfg.SymlinkParents,
+		caseCheck:     cfg.CaseCollisions,
+		nameForm:      cfg.NormalizeNames,
+		tempSuffix:    cfg.TempFileSuffix,
+		immutable:     cfg.SetImmutable,
+		readOnly:      cfg.ReadOnly,
+		minInodes:     uint64(cfg.MinFreeInodes),
+		maxChunks:     cfg.MaxChunks,
+		chunkRetry:    cfg.ChunkRetries,
+		walkers:       cfg.WalkConcurrency,
+		resume:        cfg.ResumePartial,
+		mountPoint:    cfg.RequireMount,
+		flushSize:     cfg.WriteFlushSize,
+		fsync:         cfg.FsyncPolicy,
+		readback:      cfg.VerifyReadback,
+		fullChunks:    cfg.FullChunks,
+		manifest:      cfg.WriteManifest,
+		checkCmd:      cfg.ValidateCmd,
+		checkWait:     cfg.ValidateTimeout,
+		quarantine:    cfg.QuarantineDir,
+		classes:       cfg.StorageClasses,
+		fs:            fs,
+		activeTargets: make(map[string]bool),
+		rangedFiles:   make(map[string]*rangedFile),
+	}
+	if cfg.S3Bucket != "" {
+		s.objects = newObjectFileSystem(cfg)
 	}
+	s.usage = newDiskUsage(cfg.RootDir, cfg.TempFileSuffix, int64(cfg.MaxTotalUsage))
+	if s.caseCheck != CaseCollisionIgnore {
+		s.caseFolds = caseInsensitive(cfg.RootDir)
+	}
+	return s
 }
 
+// lockTarget reserves a target path for a single in-progress transfer.
+func (s *FileTransferServer) lockTarget(targetPath string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepRangedFiles(time.Now())
+	if s.activeTargets[targetPath] {
+		return false
+	}
+	s.activeTargets[targetPath] = true
+	return true
+}
+
+func (s *FileTransferServer) unlockTarget(targetPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.activeTargets, targetPath)
+}
+
+// Transfer receives files one after another until the sender closes the stream.
 func (s *FileTransferServer) Transfer(stream pb.FileTransfer_TransferServer) error {
-	// Step 1: Receive metadata
-	req, err := stream.Recv()
-	if err != nil {
-		return status.Errorf(codes.Internal, "failed to receive metadata: %v", err)
+	correlationID := incomingCorrelationID(stream.Context())
+	if s.readOnly {
+		return errReadOnly
 	}
+	for files := 0; ; files++ {
+		// Step 1: Receive metadata
+		req, err := stream.Recv()
+		if err == io.EOF {
+			log.Printf("Transfer stream closed: files=%d, correlationID=%s", files, correlationID)
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to receive metadata: %v", err)
+		}
+
+		if err := s.receiveFile(stream, req); err != nil {
+			log.Printf("Transfer failed: correlationID=%s, err=%v", correlationID, err)
+			return err
+		}
+	}
+}
 
+func (s *FileTransferServer) receiveFile(stream pb.FileTransfer_TransferServer, req *pb.TransferRequest) error {
 	metadata, ok := req.Payload.(*pb.TransferRequest_Metadata)
 	if !ok {
 		return status.Errorf(codes.InvalidArgument, "expected metadata as first message")
 	}
 
-	// Validate path
-	cleanPath := filepath.Clean(metadata.Metadata.FilePath)
-	if strings.HasPrefix(cleanPath, "..") || filepath.IsAbs(cleanPath) {
-		return status.Errorf(codes.InvalidArgument, "invalid file path: %s", metadata.Metadata.FilePath)
+	object := isObjectPath(metadata.Metadata.FilePath)
+	if !object {
+		metadata.Metadata.FilePath = s.normalizeName(metadata.Metadata.FilePath)
+	}
+	class := metadata.Metadata.StorageClass
+	if class != "" && !validStorageClass.MatchString(class) {
+		return status.Errorf(codes.InvalidArgument, "invalid storage class: %s", class)
+	}
+	var targetPath string
+	var err error
+	if object {
+		targetPath, err = s.resolveObjectPath(metadata.Metadata)
+	} else {
+		targetPath, err = s.resolveClassPath(metadata.Metadata.FilePath, class)
+	}
+	if err != nil {
+		return err
+	}
+	// Staged files are promoted into ROOT_DIR
+	inRoot := s.rootOf(targetPath) == s.rootDir
+	if metadata.Metadata.Stage != "" && !inRoot {
+		return status.Errorf(codes.InvalidArgument, "storage classes can't be staged: %s", class)
+	}
+	if metadata.Metadata.Stage != "" && s.inMemory() {
+		return status.Errorf(codes.InvalidArgument, "staging isn't supported with STORAGE_BACKEND=memory: %s", metadata.Metadata.FilePath)
+	}
+	if stage := metadata.Metadata.Stage; stage != "" && !object {
+		stageDir, err := s.stagingDir(stage)
+		if err != nil {
+			return err
+		}
+		targetPath = filepath.Join(stageDir, filepath.Clean(metadata.Metadata.FilePath))
 	}
 
-	targetPath := filepath.Join(s.rootDir, cleanPath)
+	// Reject transfers to a target that is currently being written. The
+	// ranges of one file share a lock, which newRangeSink manages.
+	ranged := metadata.Metadata.RangeCount > 0
+	if ranged && metadata.Metadata.Archive != "" {
+		return status.Errorf(codes.InvalidArgument, "archives cannot be sent as ranges")
+	}
+	if !ranged {
+		if !s.lockTarget(targetPath) {
+			return status.Errorf(codes.Aborted, "target is being written by another transfer: %s", metadata.Metadata.FilePath)
+		}
+		defer s.unlockTarget(targetPath)
+	}
 
-	// Create directory
-	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		return status.Errorf(codes.Internal, "failed to create directory: %v", err)
+	if metadata.Metadata.Sync != "" && s.inMemory() {
+		return status.Errorf(codes.InvalidArgument, "sync isn't supported with STORAGE_BACKEND=memory: %s", metadata.Metadata.FilePath)
+	}
+	if metadata.Metadata.Sync != "" && upToDate(targetPath, metadata.Metadata) {
+		return stream.Send(&pb.TransferResponse{
+			Success: true,
+			Skipped: true,
+			Message: "target is up to date",
+		})
 	}
 
-	// Create file
-	file, err := os.Create(targetPath)
+	if err := s.checkMount(); err != nil {
+		return err
+	}
+	if err := s.checkFreeInodes(); err != nil {
+		return err
+	}
+
+	// Room under MAX_TOTAL_USAGE; object targets aren't stored under the root
+	transferSuccess := false
+	var usage *usageClaim
+	if !object && inRoot {
+		replaces := !ranged && metadata.Metadata.Archive == ""
+		if usage, err = s.usage.claim(targetPath, metadata.Metadata.FileSize, replaces); err != nil {
+			return err
+		}
+		defer func() { usage.finish(transferSuccess) }()
+	}
+
+	var sink receiveSink
+	switch metadata.Metadata.Archive {
+	case "":
+		switch {
+		case ranged:
+			sink, err = s.newRangeSink(targetPath, metadata.Metadata)
+		case object:
+			sink, err = s.newFileSink(s.objectsFor(class), targetPath, 0)
+		default:
+			sink, err = s.newFileSink(s.fs, targetPath, metadata.Metadata.Mtime)
+		}
+	case ArchiveTar, ArchiveTarZstd:
+		sink, err = s.newArchiveSink(targetPath, metadata.Metadata.Archive, metadata.Metadata.PreserveMtimes)
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported archive format: %s", metadata.Metadata.Archive)
+	}
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to create file: %v", err)
+		return err
 	}
 
 	// Track transfer success
-	transferSuccess := false
+	interrupted := false
+	keepPath := ""
 	defer func() {
-		file.Close()
-		// Delete incomplete file on error
-		if !transferSuccess {
-			os.Remove(targetPath)
+		if transferSuccess {
+			return
+		}
+		// Keep what arrived of a file cut off mid-stream for the next
+		// transfer of the same content, and delete incomplete data otherwise
+		if interrupted && keepPath != "" && sink.(*fileSink).suspend(keepPath) {
+			return
 		}
+		sink.Abort()
 	}()
 
-	// Step 2: Receive chunks without sending progress responses
-	bytesReceived := int64(0)
-	for {
+	keepPath, resumeOffset, err := s.resumeSink(sink, metadata.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// Chunks are only checked one by one if the sender can resend them
+	var retrier *chunkRetrier
+	chunkRetries := 0
+	if metadata.Metadata.ChunkRetransmit && s.chunkRetry > 0 {
+		retrier = newChunkRetrier(stream, s.chunkRetry)
+		chunkRetries = s.chunkRetry
+	}
+
+	// Tell the sender it may start streaming
+	if err := stream.Send(&pb.TransferResponse{
+		Ready:        true,
+		Message:      "ready",
+		ChunkRetries: int32(chunkRetries),
+		ResumeOffset: resumeOffset,
+	}); err != nil {
+		return err
+	}
+
+	// Step 2: Receive chunks without sending progress responses. Retransmitted
+	// chunks may still follow the completion message.
+	bytesReceived := resumeOffset
+	chunks := 0
+	var complete *pb.TransferComplete
+	for complete == nil || retrier.waiting() {
 		req, err := stream.Recv()
 		if err != nil {
+			interrupted = true
 			return status.Errorf(codes.Internal, "failed to receive chunk: %v", err)
 		}
 
 		// Check if we received a chunk or complete message
 		if chunk, ok := req.Payload.(*pb.TransferRequest_Chunk); ok {
-			// Write chunk data
-			n, err := file.Write(chunk.Chunk.Data)
-			if err != nil {
-				return status.Errorf(codes.Internal, "failed to write to file: %v", err)
+			chunks++
+			if err := s.checkChunkCount(chunks); err != nil {
+				return err
 			}
 
-			bytesReceived += int64(n)
-		} else if complete, ok := req.Payload.(*pb.TransferRequest_Complete); ok {
-			// Step 3: Verify completion
-			if bytesReceived != complete.Complete.BytesTransferred {
-				return status.Errorf(codes.DataLoss, "byte count mismatch: expected=%d, actual=%d", complete.Complete.BytesTransferred, bytesReceived)
+			data := [][]byte{chunk.Chunk.Data}
+			if retrier != nil {
+				if data, err = retrier.accept(chunk.Chunk); err != nil {
+					return err
+				}
 			}
 
-			// Sync file
-			if err := file.Sync(); err != nil {
-				return status.Errorf(codes.Internal, "failed to sync file: %v", err)
+			// Write chunk data
+			for _, d := range data {
+				if metadata.Metadata.FileSize == UnknownSize {
+					if err := usage.grow(int64(len(d))); err != nil {
+						return err
+					}
+				}
+				n, err := sink.Write(d)
+				if err != nil {
+					return s.storageError(err, "write to file")
+				}
+				bytesReceived += int64(n)
 			}
+		} else if c, ok := req.Payload.(*pb.TransferRequest_Complete); ok && complete == nil {
+			complete = c.Complete
+		} else {
+			return status.Errorf(codes.InvalidArgument, "unexpected message type")
+		}
+	}
 
-			// Send final success response
-			if err := stream.Send(&pb.TransferResponse{
-				Success:       true,
-				Message:       "transfer completed",
-				BytesReceived: bytesReceived,
-			}); err != nil {
-				return err
+	// Step 3: Verify completion
+	if bytesReceived != complete.BytesTransferred {
+		return status.Errorf(codes.DataLoss, "byte count mismatch: expected=%d, actual=%d", complete.BytesTransferred, bytesReceived)
+	}
+	if size := metadata.Metadata.FileSize; size != UnknownSize && bytesReceived != size {
+		return status.Errorf(codes.FailedPrecondition, "source file changed size during transfer: declared=%d, received=%d", size, bytesReceived)
+	}
+
+	// Verify the checksum and move the completed data into place
+	if err := sink.Commit(complete.Checksum); err != nil {
+		return err
+	}
+
+	// Mark transfer as successful
+	transferSuccess = true
+
+	// Send final success response
+	return stream.Send(&pb.TransferResponse{
+		Success:       true,
+		Message:       "transfer completed",
+		BytesReceived: bytesReceived,
+	})
+}
+
+// resolvePath validates a path sent by the peer and returns it joined to the root directory.
+func (s *FileTransferServer) resolvePath(path string) (string, error) {
+	return s.resolvePathIn(s.rootDir, path)
+}
+
+// resolvePathIn is resolvePath for a storage class stored under root.
+func (s *FileTransferServer) resolvePathIn(root, path string) (string, error) {
+	if !isRelativePath(path) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid file path: %s", path)
+	}
+	cleanPath := filepath.Clean(path)
+	if s.strictRoot {
+		if err := checkWithinRoot(root, cleanPath, s.maxHops); err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				return "", status.Errorf(codes.PermissionDenied, "invalid file path: %v", err)
+			}
+			return "", status.Errorf(codes.InvalidArgument, "invalid file path: %v", err)
+		}
+	}
+	return filepath.Join(root, cleanPath), nil
+}
+
+// resolveObjectPath validates a target in object storage, which only takes
+// plain files, and returns it cleaned with its prefix.
+func (s *FileTransferServer) resolveObjectPath(metadata *pb.TransferMetadata) (string, error) {
+	if s.objects == nil {
+		return "", status.Errorf(codes.InvalidArgument, "object storage is not configured: %s", metadata.FilePath)
+	}
+	if metadata.Archive != "" || metadata.RangeCount > 0 || metadata.Stage != "" || metadata.Sync != "" {
+		return "", status.Errorf(codes.InvalidArgument, "object storage targets don't support archives, ranges, staging or sync: %s", metadata.FilePath)
+	}
+	key := strings.TrimPrefix(metadata.FilePath, ObjectPrefix)
+	if !isRelativePath(key) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid file path: %s", metadata.FilePath)
+	}
+	return ObjectPrefix + filepath.ToSlash(filepath.Clean(key)), nil
+}
+
+// checkTargetDir applies SymlinkParents to a directory targets are written
+// to. It must run after the directory is created: checking the literal path
+// beforehand can't see a symlink that MkdirAll then follows.
+func (s *FileTransferServer) checkTargetDir(dir string) error {
+	if s.symlinks == SymlinkParentsFollow {
+		return nil
+	}
+	rootDir := filepath.Clean(s.rootOf(dir))
+	rel, err := filepath.Rel(rootDir, dir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check target directory: %v", err)
+	}
+
+	if s.symlinks == SymlinkParentsReject {
+		for path := dir; path != rootDir && path != filepath.Dir(path); path = filepath.Dir(path) {
+			info, err := os.Lstat(path)
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to check target directory: %v", err)
 			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				rejectPath(RejectSymlinkDir, rel)
+				return status.Errorf(codes.PermissionDenied, "target directory is a symlink: %s", rel)
+			}
+		}
+		return nil
+	}
 
-			// Mark transfer as successful
-			transferSuccess = true
-			return nil
-		} else {
-			return status.Errorf(codes.InvalidArgument, "unexpected message type")
+	root, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to resolve root directory: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to resolve target directory: %v", err)
+	}
+	if within, err := filepath.Rel(root, resolved); err != nil || within == ".." || strings.HasPrefix(within, ".."+string(filepath.Separator)) {
+		rejectPath(RejectOutsideDir, rel)
+		return status.Errorf(codes.PermissionDenied, "target directory resolves outside ROOT_DIR: %s", rel)
+	}
+	return nil
+}
+
+// checkFreeInodes rejects a transfer when the root's filesystem is short of
+// inodes, which many small files can exhaust long before disk space.
+func (s *FileTransferServer) checkFreeInodes() error {
+	if s.minInodes == 0 {
+		return nil
+	}
+	free, err := s.fs.FreeInodes(s.rootDir)
+	if err != nil {
+		log.Printf("Warning: failed to check free inodes: path=%s, err=%v", s.rootDir, err)
+		return nil
+	}
+	if free < s.minInodes {
+		return status.Errorf(codes.ResourceExhausted, "not enough free inodes: free=%d, required=%d", free, s.minInodes)
+	}
+	return nil
+}
+
+// checkChunkCount rejects a file once it has arrived in more chunks than
+// MAX_CHUNKS_PER_FILE, however small they are.
+func (s *FileTransferServer) checkChunkCount(chunks int) error {
+	if s.maxChunks > 0 && chunks > s.maxChunks {
+		return status.Errorf(codes.ResourceExhausted, "too many chunks: limit=%d", s.maxChunks)
+	}
+	return nil
+}
+
+// checkMount rejects a transfer unless REQUIRE_MOUNT is mounted and holds the
+// root directory, so an unmounted mountpoint's underlying filesystem isn't
+// filled instead.
+func (s *FileTransferServer) checkMount() error {
+	if s.mountPoint == "" {
+		return nil
+	}
+	mountDev, err := s.fs.DeviceID(s.mountPoint)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "failed to check required mount: %v", err)
+	}
+	// A mount point lives on a different device than its parent directory
+	parentDev, err := s.fs.DeviceID(filepath.Dir(s.mountPoint))
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "failed to check required mount: %v", err)
+	}
+	if mountDev == parentDev && filepath.Dir(s.mountPoint) != s.mountPoint {
+		return status.Errorf(codes.FailedPrecondition, "required mount is not present: %s", s.mountPoint)
+	}
+	rootDev, err := s.fs.DeviceID(s.rootDir)
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "failed to check required mount: %v", err)
+	}
+	if rootDev != mountDev {
+		return status.Errorf(codes.FailedPrecondition, "root directory is not on the required mount: %s", s.mountPoint)
+	}
+	return nil
+}
+
+// storageError converts a failed write under the root directory into a gRPC
+// status carrying the error's category. A filesystem that was remounted
+// read-only, as failing disks often are, also marks the receiver not ready.
+func (s *FileTransferServer) storageError(err error, action string) error {
+	category, code := classifyStorageError(err)
+	switch category {
+	case "":
+		return status.Errorf(codes.Internal, "failed to %s: %v", action, err)
+	case StorageReadOnly:
+		if !s.storageReadOnly.Swap(true) {
+			log.Printf("Warning: storage is read-only: rootDir=%s, err=%v", s.rootDir, err)
+		}
+		return errStorageReadOnly
+	}
+	return storageStatus(code, category, fmt.Sprintf("failed to %s: %v", action, err))
+}
+
+// Ready reports whether the receiver can accept transfers. It fails while the
+// required mount is missing; once storage was found read-only, a probe file is
+// written to see whether it recovered.
+func (s *FileTransferServer) Ready() error {
+	if err := s.checkMount(); err != nil {
+		return err
+	}
+	if !s.storageReadOnly.Load() {
+		return nil
+	}
+	probe := filepath.Join(s.rootDir, ".ready-"+newID())
+	file, err := s.fs.Create(probe)
+	if err != nil {
+		return errStorageReadOnly
+	}
+	file.Close()
+	s.fs.Remove(probe)
+	s.storageReadOnly.Store(false)
+	log.Printf("Storage is writable again: rootDir=%s", s.rootDir)
+	return nil
+}
+
+// receiveSink is where the receiver writes a transfer's data until it is
+// committed into place or aborted.
+type receiveSink interface {
+	io.Writer
+	// Commit verifies the content against the sender's checksum (if any)
+	// and returns a gRPC status error on failure.
+	Commit(checksum string) error
+	Abort()
+}
+
+func verifyChecksum(expected string, hasher hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+		return status.Errorf(codes.DataLoss, "checksum mismatch: expected=%s, actual=%s", expected, actual)
+	}
+	return nil
+}
+
+// finalize applies post-write attributes to a file that is in place. Failures
+// only warn, since the data itself has been written successfully.
+func (s *FileTransferServer) finalize(path string) {
+	// Staged files are finalized once promoted, as they still need to be moved
+	if s.isStaged(path) || isObjectPath(path) {
+		return
+	}
+	if s.immutable {
+		if err := setImmutable(path); err != nil {
+			log.Printf("Warning: failed to set immutable attribute: path=%s, err=%v", path, err)
+		}
+	}
+}
+
+// writeManifest stores a file's checksum in a <path>.sha256 sidecar in
+// sha256sum format, written atomically once the file itself is in place.
+func (s *FileTransferServer) writeManifest(path, checksum string) error {
+	manifestPath := path + ManifestSuffix
+	tempPath := s.tempPath(manifestPath)
+	file, err := s.fs.Create(tempPath)
+	if err != nil {
+		return s.storageError(err, "create checksum manifest")
+	}
+	_, err = fmt.Fprintf(file, "%s  %s\n", checksum, filepath.Base(path))
+	if err == nil {
+		err = s.syncFile(file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Rename(tempPath, manifestPath)
+	}
+	if err != nil {
+		s.fs.Remove(tempPath)
+		return s.storageError(err, "write checksum manifest")
+	}
+	return nil
+}
+
+// syncFile flushes a received file as FSYNC_POLICY asks.
+func (s *FileTransferServer) syncFile(file File) error {
+	switch s.fsync {
+	case FsyncNone:
+		return nil
+	case FsyncData:
+		return fdatasync(file)
+	default:
+		return file.Sync()
+	}
+}
+
+// tempPath returns a temp file path unique to one transfer, so concurrent
+// transfers to the same target don't collide.
+func (s *FileTransferServer) tempPath(targetPath string) string {
+	return fmt.Sprintf("%s.%s%s", targetPath, newID(), s.tempSuffix)
+}
+
+// flushWriter is a destination for received data that may hold some of it
+// back until Flush.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+type writeThrough struct{ io.Writer }
+
+func (writeThrough) Flush() error { return nil }
+
+// coalesce collects small sequential writes to w into writes of flushSize
+// bytes, so many tiny chunks don't each cost a syscall. Without a flush size
+// data is written through.
+func (s *FileTransferServer) coalesce(w io.Writer) flushWriter {
+	if s.flushSize == 0 {
+		return writeThrough{w}
+	}
+	return bufio.NewWriterSize(w, s.flushSize)
+}
+
+type fileSink struct {
+	server     *FileTransferServer
+	fs         FileSystem
+	file       File
+	out        flushWriter
+	hasher     hash.Hash
+	tempPath   string
+	targetPath string
+	mtime      int64 // Unix nanoseconds to set on the file, if non-zero
+}
+
+func (s *FileTransferServer) newFileSink(fs FileSystem, targetPath string, mtime int64) (*fileSink, error) {
+	// Create directory
+	if err := fs.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		return nil, s.storageError(err, "create directory")
+	}
+	if fs == s.fs {
+		if err := s.checkTargetDir(filepath.Dir(targetPath)); err != nil {
+			return nil, err
+		}
+		if err := s.checkCaseCollision(targetPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create file
+	tempPath := s.tempPath(targetPath)
+	file, err := fs.Create(tempPath)
+	if err != nil {
+		return nil, s.storageError(err, "create file")
+	}
+
+	return &fileSink{
+		server:     s,
+		fs:         fs,
+		file:       file,
+		out:        s.coalesce(file),
+		hasher:     sha256.New(),
+		tempPath:   tempPath,
+		targetPath: targetPath,
+		mtime:      mtime,
+	}, nil
+}
+
+func (f *fileSink) Write(p []byte) (int, error) {
+	n, err := f.out.Write(p)
+	f.hasher.Write(p[:n])
+	return n, err
+}
+
+func (f *fileSink) Commit(checksum string) error {
+	if err := verifyChecksum(checksum, f.hasher); err != nil {
+		return err
+	}
+
+	if err := f.out.Flush(); err != nil {
+		return f.server.storageError(err, "write to file")
+	}
+
+	// Sync file
+	if err := f.server.syncFile(f.file); err != nil {
+		return f.server.storageError(err, "sync file")
+	}
+
+	if err := f.file.Close(); err != nil {
+		return f.server.storageError(err, "close file")
+	}
+
+	if f.server.readback {
+		if err := f.verifyReadback(); err != nil {
+			return err
+		}
+	}
+
+	if f.mtime != 0 {
+		mtime := time.Unix(0, f.mtime)
+		if err := f.fs.Chtimes(f.tempPath, mtime, mtime); err != nil {
+			return status.Errorf(codes.Internal, "failed to set mtime: %v", err)
+		}
+	}
+
+	if f.fs == f.server.fs {
+		if err := f.server.checkFile(f.tempPath, f.targetPath); err != nil {
+			return err
 		}
 	}
+	if err := f.fs.Rename(f.tempPath, f.targetPath); err != nil {
+		return f.server.storageError(err, "rename file")
+	}
+	f.server.finalize(f.targetPath)
+	if f.server.manifest && !isObjectPath(f.targetPath) {
+		return f.server.writeManifest(f.targetPath, hex.EncodeToString(f.hasher.Sum(nil)))
+	}
+	return nil
 }
 
-func StartGRPCServer(ctx context.Context, port, rootDir string) error {
-	lis, err := net.Listen("tcp", ":"+port)
+// verifyReadback reads the synced file back from storage and compares it with
+// the data that was received, catching corruption that writes don't report.
+func (f *fileSink) verifyReadback() error {
+	actual, err := hashStored(f.fs, f.tempPath)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port %s: %v", port, err)
+		return status.Errorf(codes.Internal, "failed to read back file: %v", err)
+	}
+	if expected := hex.EncodeToString(f.hasher.Sum(nil)); actual != expected {
+		return status.Errorf(codes.DataLoss, "readback checksum mismatch: expected=%s, actual=%s", expected, actual)
 	}
+	return nil
+}
+
+// hashStored returns the hex SHA-256 of a file as read back from fs.
+func hashStored(fs FileSystem, path string) (string, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
-	grpcServer := grpc.NewServer(
+func (f *fileSink) Abort() {
+	f.file.Close()
+	f.fs.Remove(f.tempPath)
+}
+
+func StartGRPCServer(ctx context.Context, cfg *Config, server *FileTransferServer, listeners []net.Listener) error {
+	options := []grpc.ServerOption{
 		grpc.MaxRecvMsgSize(maxMessageSize),
 		grpc.MaxSendMsgSize(maxMessageSize),
-	)
+	}
+	if cfg.GRPCMaxStreams > 0 {
+		options = append(options, grpc.MaxConcurrentStreams(uint32(cfg.GRPCMaxStreams)))
+	}
+	// Setting either window turns off gRPC's bandwidth-based window sizing
+	if cfg.GRPCWindowSize > 0 {
+		options = append(options, grpc.InitialWindowSize(int32(cfg.GRPCWindowSize)))
+	}
+	if cfg.GRPCConnWindowSize > 0 {
+		options = append(options, grpc.InitialConnWindowSize(int32(cfg.GRPCConnWindowSize)))
+	}
+	grpcServer := grpc.NewServer(options...)
 
-	pb.RegisterFileTransferServer(grpcServer, NewFileTransferServer(rootDir))
+	pb.RegisterFileTransferServer(grpcServer, server)
 
 	go func() {
 		<-ctx.Done()
 		grpcServer.GracefulStop()
 	}()
 
-	fmt.Printf("Starting gRPC server: port=%s, rootDir=%s\n", port, rootDir)
-	return grpcServer.Serve(lis)
+	fmt.Printf("Starting gRPC server: addrs=%s, rootDir=%s\n", strings.Join(cfg.GRPCListenAddrs, ","), cfg.RootDir)
+	return serveAll(listeners, grpcServer.Serve)
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryHistoryLimit is how many records the in-memory history keeps; older
+// ones are dropped first.
+const memoryHistoryLimit = 10000
+
+// HistoryRecord is one file of a finished batch, as kept in the transfer
+// history.
+type HistoryRecord struct {
+	BatchID          string    `json:"batch_id"`
+	CorrelationID    string    `json:"correlation_id,omitempty"`
+	Peer             string    `json:"peer"`
+	Source           string    `json:"source"`
+	Target           string    `json:"target"`
+	Status           string    `json:"status"`
+	BytesTransferred int64     `json:"bytes_transferred"`
+	Checksum         string    `json:"checksum,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	DurationMs       int64     `json:"duration_ms"`
+	StartedAt        time.Time `json:"started_at"`   // when the batch started
+	CompletedAt      time.Time `json:"completed_at"` // when the batch finished
+}
+
+// historyRecords returns the records of a finished batch's files.
+func historyRecords(report *BatchReport, peer string) []HistoryRecord {
+	completedAt := report.startedAt.Add(time.Duration(report.DurationMs) * time.Millisecond)
+	records := make([]HistoryRecord, len(report.Files))
+	for i, file := range report.Files {
+		records[i] = HistoryRecord{
+			BatchID:          report.BatchID,
+			CorrelationID:    report.CorrelationID,
+			Peer:             peer,
+			Source:           file.Source,
+			Target:           file.Target,
+			Status:           file.Status,
+			BytesTransferred: file.BytesTransferred,
+			Checksum:         file.Checksum,
+			Error:            file.Error,
+			DurationMs:       file.DurationMs,
+			StartedAt:        report.startedAt,
+			CompletedAt:      completedAt,
+		}
+	}
+	return records
+}
+
+// historyFilter selects records by when their batch finished, their peer and
+// their status. Zero fields match everything.
+type historyFilter struct {
+	since  time.Time
+	until  time.Time
+	peer   string
+	status string
+}
+
+func (f historyFilter) matches(record HistoryRecord) bool {
+	return (f.since.IsZero() || !record.CompletedAt.Before(f.since)) &&
+		(f.until.IsZero() || record.CompletedAt.Before(f.until)) &&
+		(f.peer == "" || record.Peer == f.peer) &&
+		(f.status == "" || record.Status == f.status)
+}
+
+// historyStore keeps the records of finished transfers.
+type historyStore interface {
+	add(records []HistoryRecord) error
+	// list returns the matching records, oldest first
+	list(filter historyFilter) ([]HistoryRecord, error)
+}
+
+// newHistoryStore returns the history kept in HISTORY_FILE, or one kept in
+// memory, and lost on restart, without it.
+func newHistoryStore(cfg *Config) (historyStore, error) {
+	if cfg.HistoryFile == "" {
+		return &memoryHistory{}, nil
+	}
+	return openFileHistory(cfg.HistoryFile)
+}
+
+// memoryHistory keeps the most recent memoryHistoryLimit records in memory.
+type memoryHistory struct {
+	mu      sync.Mutex
+	records []HistoryRecord
+}
+
+func (h *memoryHistory) add(records []HistoryRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, records...)
+	if drop := len(h.records) - memoryHistoryLimit; drop > 0 {
+		h.records = append([]HistoryRecord(nil), h.records[drop:]...)
+	}
+	return nil
+}
+
+func (h *memoryHistory) list(filter historyFilter) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var records []HistoryRecord
+	for _, record := range h.records {
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// fileHistory appends records to a file as NDJSON, one line per record, and
+// reads the whole file back for each query. Records are synced before add
+// returns, so they survive a restart or crash.
+type fileHistory struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func openFileHistory(path string) (*fileHistory, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history file: %v", err)
+	}
+	return &fileHistory{path: path, file: file}, nil
+}
+
+func (h *fileHistory) add(records []HistoryRecord) error {
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.file.Write(data); err != nil {
+		return err
+	}
+	return h.file.Sync()
+}
+
+func (h *fileHistory) list(filter historyFilter) ([]HistoryRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	file, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []HistoryRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record HistoryRecord
+		// A crash can leave the last line cut off
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Warning: skipping unreadable history record: path=%s, line=%d, err=%v", h.path, line, err)
+			continue
+		}
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// handleHistory lists the transfer history, filtered by the since and until
+// (RFC 3339), peer and status query parameters. limit keeps only the most
+// recent records.
+func handleHistory(history historyStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var filter historyFilter
+		for _, bound := range []struct {
+			name string
+			dst  *time.Time
+		}{{"since", &filter.since}, {"until", &filter.until}} {
+			if value := query.Get(bound.name); value != "" {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: %v", bound.name, err), http.StatusBadRequest)
+					return
+				}
+				*bound.dst = t
+			}
+		}
+		filter.peer = query.Get("peer")
+		filter.status = query.Get("status")
+		limit := 0
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				http.Error(w, fmt.Sprintf("invalid limit: %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		records, err := history.list(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read history: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if limit > 0 && len(records) > limit {
+			records = records[len(records)-limit:]
+		}
+		if records == nil {
+			records = []HistoryRecord{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(records)
+	}
+}
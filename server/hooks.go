@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const hookTimeout = 30 * time.Second
+
+// runHooks notifies the configured webhook and command about a finished batch.
+// Hooks run in the background; their failures are logged and never affect the transfer.
+func runHooks(cfg *Config, report *BatchReport) {
+	if cfg.WebhookURL == "" && cfg.PostTransferCmd == "" {
+		return
+	}
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Failed to encode hook payload: batchID=%s, err=%v", report.BatchID, err)
+		return
+	}
+
+	if cfg.WebhookURL != "" {
+		go func() {
+			if err := postWebhook(cfg.WebhookURL, payload); err != nil {
+				log.Printf("Webhook failed: batchID=%s, err=%v", report.BatchID, err)
+			}
+		}()
+	}
+
+	if cfg.PostTransferCmd != "" {
+		go func() {
+			if err := runPostTransferCmd(cfg.PostTransferCmd, report, payload); err != nil {
+				log.Printf("Post-transfer command failed: batchID=%s, err=%v", report.BatchID, err)
+			}
+		}()
+	}
+}
+
+func postWebhook(url string, payload []byte) error {
+	client := &http.Client{Timeout: hookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func runPostTransferCmd(command string, report *BatchReport, payload []byte) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"TRANSFER_BATCH_ID="+report.BatchID,
+		"TRANSFER_STATUS="+report.Status,
+		fmt.Sprintf("TRANSFER_TOTAL_FILES=%d", report.TotalFiles),
+		fmt.Sprintf("TRANSFER_FAILED_FILES=%d", report.FailedFiles),
+		fmt.Sprintf("TRANSFER_BYTES=%d", report.BytesTransferred),
+		"TRANSFER_REPORT="+string(payload),
+	)
+
+	done := make(chan error, 1)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output.Bytes()))
+		}
+		return nil
+	case <-time.After(hookTimeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("timed out after %v", hookTimeout)
+	}
+}
@@ -2,158 +2,770 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	VerifyPolicyStrict  = "strict"
+	VerifyPolicyLenient = "lenient"
 )
 
 type TransferRequest struct {
-	Source string `json:"source"`
-	Target string `json:"target"`
+	Source       string `json:"source"`
+	Target       string `json:"target"`
+	Archive      string `json:"archive,omitempty"`
+	VerifyPolicy string `json:"verify_policy,omitempty"`
+	Pull         bool   `json:"pull,omitempty"`  // fetch source from the peer into the local target
+	Stage        bool   `json:"stage,omitempty"` // hold files on the peer until POST /promote/{batch_id}
+
+	PreserveMtimes bool   `json:"preserve_mtimes,omitempty"` // keep file and directory mtimes of archive transfers
+	ParallelChunks int    `json:"parallel_chunks,omitempty"` // send each file as this many concurrent ranges
+	SpecialFiles   string `json:"special_files,omitempty"`   // "skip" or "recreate" FIFOs in archive transfers
+	PeerAddress    string `json:"peer_address,omitempty"`    // one of ALLOWED_PEERS, replacing PEER_SERVER_ADDR
+	Peer           string `json:"peer,omitempty"`            // name of a peer found through PEER_REGISTRY, replacing PEER_SERVER_ADDR
+	Sync           string `json:"sync,omitempty"`            // skip files already up to date: "quick" or "checksum"
+	IdempotencyKey string `json:"idempotency_key,omitempty"` // retries with the same key replay the first batch instead of transferring again
+	BatchChecksum  bool   `json:"batch_checksum,omitempty"`  // compare a checksum over the whole batch with the peer's once it is sent
+	Diagnostics    bool   `json:"diagnostics,omitempty"`     // time every chunk and report a summary with each file
+	MinSize        int64  `json:"min_size,omitempty"`        // leave out files smaller than this many bytes
+	MaxSize        int64  `json:"max_size,omitempty"`        // leave out files larger than this many bytes
+	OnConflict     string `json:"on_conflict,omitempty"`     // "ask" to stop at existing targets until POST /resolve/{id}
+	StorageClass   string `json:"storage_class,omitempty"`   // tier the peer stores files in, see STORAGE_CLASSES
+
+	Profile    string  `json:"profile,omitempty"`        // PROFILES_FILE entry whose fields the request starts from
+	SkipHidden offFlag `json:"include_hidden,omitempty"` // set by "include_hidden": false to leave dotfiles out of patterns and archives
+}
+
+// offFlag is a JSON boolean option that is on unless set to false. It holds
+// the negation, so the zero value means on; unlike *bool it keeps
+// TransferRequest comparable.
+type offFlag bool
+
+func (f *offFlag) UnmarshalJSON(data []byte) error {
+	var on bool
+	if err := json.Unmarshal(data, &on); err != nil {
+		return err
+	}
+	*f = offFlag(!on)
+	return nil
+}
+
+func (f offFlag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(!bool(f))
 }
 
 type LogEntry struct {
 	Timestamp        string  `json:"timestamp"`
 	Level            string  `json:"level"`
+	Type             string  `json:"type,omitempty"`
 	Message          string  `json:"message"`
+	BatchID          string  `json:"batch_id,omitempty"`
 	BytesTransferred int64   `json:"bytes_transferred"`
+	BytesConfirmed   int64   `json:"bytes_confirmed"`
 	TotalBytes       int64   `json:"total_bytes"`
 	Progress         float64 `json:"progress,omitempty"`
+	BytesPerSecond   int64   `json:"bytes_per_second,omitempty"`
+	Attempt          int     `json:"attempt,omitempty"`
 	Error            string  `json:"error,omitempty"`
+	Code             string  `json:"code,omitempty"` // category of a storage error on the peer, e.g. "disk_full"
+	Path             string  `json:"path,omitempty"`
+	Checksum         string  `json:"checksum,omitempty"`
+	Mapped           bool    `json:"mapped,omitempty"` // source read through mmap, see USE_MMAP
+	Files            int     `json:"files,omitempty"`
+	FilesCompleted   int     `json:"files_completed"`
+	FilesTotal       int     `json:"files_total"`
+	CorrelationID    string  `json:"correlation_id,omitempty"`
+	ID               int64   `json:"id,omitempty"` // position in the batch's event log, for Last-Event-ID
+
+	Diagnostics *ChunkDiagnostics `json:"diagnostics,omitempty"`
+	Conflict    *ConflictInfo     `json:"conflict,omitempty"`
+	Retries     *RetryFailure     `json:"retries,omitempty"` // set once MAX_RETRIES is used up
+	Options     *EffectiveOptions `json:"options,omitempty"` // first event only
 }
 
-func handleTransfer(peerAddr, rootDir string) http.HandlerFunc {
+func handleTransfer(cfg *Config, limiter *loadLimiter, receiver *FileTransferServer, logs *eventLogs, batches *activeBatches, keys, inflight *batchKeys, checksums *checksumCache, peers *peerRegistry, history historyStore, conflicts *pendingConflicts) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Parse request
-	var req TransferRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
-		return
-	}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	// Set headers for NDJSON streaming
-	w.Header().Set("Content-Type", "application/x-ndjson")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
+		// Parse request
+		req, err := decodeTransferRequest(r, cfg.Profiles)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
 
-	// Flush headers immediately
-	if flusher, ok := w.(http.Flusher); ok {
-		flusher.Flush()
-	}
+		errs := canonicalizeTarget(&req, cfg.Backslashes)
+		errs = append(errs, validateTransferRequest(&req, cfg.AllowedPeers)...)
+		if cfg.PeerTransport == PeerTransportHTTP {
+			errs = append(errs, validateHTTPTransport(&req)...)
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
 
-	// Create progress channel
-	progressChan := make(chan TransferProgress, 100)
-	errChan := make(chan error, 1)
+		// Turn requests away while the queue for transfer slots is full
+		if limiter.queueFull(cfg.MaxQueueDepth) {
+			retryAfter := int(math.Ceil(cfg.LoadCheckInterval.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "transfer queue is full", http.StatusServiceUnavailable)
+			return
+		}
 
-	// Start transfer in goroutine
-	ctx := r.Context()
-	go func() {
-		err := TransferFile(ctx, peerAddr, req.Source, req.Target, rootDir, progressChan)
+		// Expand source pattern into the files to transfer
+		sources, targets, code, err := batchFiles(cfg, &req)
 		if err != nil {
-			errChan <- err
+			http.Error(w, fmt.Sprintf("invalid source: %v", err), code)
+			return
+		}
+		peerCfg := cfg.forRequest(&req, peers)
+		if peerCfg == nil {
+			writeValidationError(w, []FieldError{{Field: "peer", Message: "is not a discovered peer"}})
+			return
 		}
-		close(progressChan)
-		close(errChan)
-	}()
 
-	encoder := json.NewEncoder(w)
-	flusher, _ := w.(http.Flusher)
+		// Every event is also recorded for GET /transfer/{batch_id}/events
+		batchID := newID()
+		events := logs.create(batchID)
+		defer logs.finish(batchID)
 
-	// Send initial log
-	logEntry := LogEntry{
-		Timestamp:        time.Now().Format(time.RFC3339),
-		Level:            "info",
-		Message:          "transfer initiated",
-		BytesTransferred: 0,
-		TotalBytes:       0,
-	}
-	if err := encoder.Encode(logEntry); err != nil {
-		return
-	}
-	flusher.Flush()
-
-	// Stream progress updates
-	for {
-		select {
-		case progress, ok := <-progressChan:
-			if !ok {
-				// Channel closed, check for errors
-				if err := <-errChan; err != nil {
-					logEntry := LogEntry{
-						Timestamp:        time.Now().Format(time.RFC3339),
-						Level:            "error",
-						Message:          "transfer failed",
-						BytesTransferred: 0,
-						TotalBytes:       0,
-						Error:            err.Error(),
-					}
-					_ = encoder.Encode(logEntry)
-					flusher.Flush()
-					
-					// Force close TCP connection to signal error to curl
-					if hijacker, ok := w.(http.Hijacker); ok {
-						conn, _, _ := hijacker.Hijack()
-						conn.Close()
-					}
+		var idempotent, shared *keyedBatch
+		sharedKey := transferKey(peerCfg.PeerAddr, req.Source, req.Target)
+		if req.IdempotencyKey != "" {
+			batch, claimed := keys.claim(req.IdempotencyKey, batchID, req, events)
+			if !claimed {
+				if batch.req != req {
+					http.Error(w, "idempotency_key was already used for a different request", http.StatusUnprocessableEntity)
+					return
 				}
+				log.Printf("Replaying transfer batch: batchID=%s, idempotencyKey=%s", batch.id, req.IdempotencyKey)
+				w.Header().Set(IdempotentReplayHeader, "true")
+				streamEvents(w, r, batch.events, 0)
+				return
+			}
+			idempotent = batch
+		} else {
+			// A request identical to one in flight follows that batch instead of
+			// opening a second stream
+			batch, claimed := inflight.claim(sharedKey, batchID, req, events)
+			if !claimed && batch.req == req {
+				log.Printf("Attaching to in-flight transfer batch: batchID=%s, source=%s, target=%s", batch.id, req.Source, req.Target)
+				streamEvents(w, r, batch.events, 0)
 				return
 			}
+			if claimed {
+				shared = batch
+			}
+		}
 
-			var progressPercent float64
-			if progress.TotalBytes > 0 {
-				progressPercent = float64(progress.BytesTransferred) / float64(progress.TotalBytes) * 100
+		// Hold the start back, so repeated requests for the same transfer
+		// arriving meanwhile attach to this batch
+		if cfg.TransferDebounce > 0 {
+			select {
+			case <-time.After(cfg.TransferDebounce):
+			case <-r.Context().Done():
+				if idempotent != nil {
+					keys.finish(req.IdempotencyKey, idempotent, r.Context().Err())
+				}
+				if shared != nil {
+					inflight.finish(sharedKey, shared, r.Context().Err())
+				}
+				return
 			}
+		}
+
+		// Create progress channel
+		progressChan := make(chan TransferProgress, 100)
+		errChan := make(chan error, 1)
 
-			logEntry := LogEntry{
-				Timestamp:        progress.Timestamp.Format(time.RFC3339),
-				Level:            "info",
-				Message:          progress.Message,
-				BytesTransferred: progress.BytesTransferred,
-				TotalBytes:       progress.TotalBytes,
-				Progress:         progressPercent,
+		// Start transfer in goroutine
+		correlationID := requestCorrelationID(r)
+		w.Header().Set(CorrelationIDHeader, correlationID)
+		ctx := withCorrelationID(r.Context(), correlationID)
+		ctx, batchDone := batches.start(ctx, batchID, peerCfg.PeerAddr)
+		ctx, span := startSpan(ctx, "transfer",
+			attribute.String("correlation_id", correlationID),
+			attribute.String("batch_id", batchID),
+			attribute.Int("files", len(sources)))
+		report := newBatchReport(batchID, sources, targets)
+		report.CorrelationID = correlationID
+		log.Printf("Transfer batch started: correlationID=%s, batchID=%s, files=%d, peerAddr=%s, chunkSize=%d", correlationID, batchID, len(sources), peerCfg.PeerAddr, peerCfg.chunkSize(peerCfg.PeerAddr))
+		go func() {
+			defer batchDone()
+			// All files of the batch share one stream to the peer
+			session := newPeerSession(peerCfg)
+			if req.Stage {
+				session.stage = batchID
 			}
-			if err := encoder.Encode(logEntry); err != nil {
+			session.preserveMtimes = req.PreserveMtimes
+			session.specialFiles = req.SpecialFiles
+			session.skipHidden = bool(req.SkipHidden)
+			session.sync = req.Sync
+			session.diagnostics = req.Diagnostics
+			session.storageClass = req.StorageClass
+			session.checksums = checksums
+			// Batch events are always sent, per-file progress only if tracked
+			fileProgress := progressChan
+			if cfg.DisableProgress {
+				fileProgress = nil
+			}
+			var batchErr error
+			var existing map[string]*pb.QueryResult
+			if req.OnConflict == OnConflictAsk {
+				existing, batchErr = existingTargets(ctx, peerCfg, targets)
+			}
+			verifyFailures := 0
+			for i, source := range sources {
+				if batchErr != nil {
+					break
+				}
+
+				// A file another process is still writing would arrive torn
+				if cfg.SkipOpenFiles && !req.Pull && req.Archive == "" {
+					busy, err := openForWriting(filepath.Join(cfg.RootDir, filepath.Clean(source)))
+					if err != nil {
+						session.recheckSource = true
+					} else if busy {
+						report.Files[i].Status = FileStatusBusy
+						log.Printf("Skipping file open for writing: correlationID=%s, source=%s", correlationID, source)
+						progressChan <- TransferProgress{
+							Type:      "file_busy",
+							Message:   fmt.Sprintf("file skipped, open for writing: %s", source),
+							Timestamp: time.Now(),
+						}
+						continue
+					}
+				}
+
+				// Let the client decide what happens to a target the peer already has
+				if existing[targets[i]] != nil {
+					decision, err := awaitConflict(ctx, peerCfg, conflicts, progressChan, source, targets[i], existing[targets[i]])
+					if err != nil {
+						batchErr = err
+						break
+					}
+					message := fmt.Sprintf("overwriting existing target: %s", targets[i])
+					switch decision.Action {
+					case ConflictSkip:
+						message = fmt.Sprintf("keeping existing target: %s", targets[i])
+					case ConflictRename:
+						message = fmt.Sprintf("sending to %s instead of %s", decision.Target, targets[i])
+						targets[i] = decision.Target
+						report.Files[i].Target = decision.Target
+					}
+					progressChan <- TransferProgress{
+						Type:      "conflict_resolved",
+						Message:   message,
+						Path:      targets[i],
+						Kept:      decision.Action == ConflictSkip,
+						Timestamp: time.Now(),
+					}
+					if decision.Action == ConflictSkip {
+						report.Files[i].Status = FileStatusKept
+						continue
+					}
+				}
+
+				// Wait for a slot while the system is under load
+				if !limiter.tryAcquire() {
+					progressChan <- TransferProgress{
+						Message:   "waiting for system load to drop",
+						Timestamp: time.Now(),
+					}
+					if err := limiter.acquire(ctx); err != nil {
+						batchErr = context.Cause(ctx)
+						break
+					}
+				}
+
+				startTime := time.Now()
+				result, err := transferWithRetry(ctx, peerCfg, progressChan, func() (*TransferResult, error) {
+					switch {
+					case req.Pull:
+						return PullArchive(ctx, peerCfg, receiver, source, targets[i], req.Archive, req.PreserveMtimes, req.SpecialFiles, bool(req.SkipHidden), fileProgress)
+					case req.Archive != "":
+						return TransferArchive(ctx, session, source, targets[i], cfg.RootDir, req.Archive, fileProgress)
+					case req.ParallelChunks > 1:
+						return TransferFileRanges(ctx, session, source, targets[i], cfg.RootDir, req.ParallelChunks, fileProgress)
+					default:
+						return TransferFile(ctx, session, source, targets[i], cfg.RootDir, fileProgress)
+					}
+				})
+				limiter.release()
+				if err != nil && ctx.Err() != nil {
+					// Report why the batch was cancelled rather than how the transfer noticed
+					err = context.Cause(ctx)
+				}
+				report.record(i, result, err, time.Since(startTime))
+				if err == nil {
+					message := fmt.Sprintf("file completed: %s", source)
+					if result.Unchanged {
+						message = fmt.Sprintf("file unchanged: %s", source)
+					} else {
+						warnIfSlow(cfg, correlationID, report.Files[i])
+					}
+					progressChan <- TransferProgress{
+						Type:             "file_completed",
+						Message:          message,
+						Path:             targets[i],
+						BytesTransferred: result.BytesTransferred,
+						Checksum:         result.Checksum,
+						Diagnostics:      result.Diagnostics,
+						Mapped:           result.Mapped,
+						Timestamp:        time.Now(),
+					}
+					continue
+				}
+
+				// Lenient batches record verification failures and move on
+				if req.VerifyPolicy == VerifyPolicyLenient && status.Code(err) == codes.DataLoss {
+					verifyFailures++
+					progressChan <- TransferProgress{
+						Type:      "verify_failed",
+						Message:   fmt.Sprintf("verification failed: %s", source),
+						Reason:    err.Error(),
+						Timestamp: time.Now(),
+					}
+					continue
+				}
+				batchErr = err
+				break
+			}
+			session.Close()
+			if batchErr == nil && verifyFailures > 0 {
+				batchErr = fmt.Errorf("verification failed for %d of %d files", verifyFailures, len(sources))
+			}
+			if batchErr == nil && req.BatchChecksum {
+				report.BatchChecksum, batchErr = verifyBatch(ctx, peerCfg, &req, sources, targets, report, session.stage, checksums)
+			}
+			if batchErr != nil {
+				errChan <- batchErr
+			}
+			endSpan(span, batchErr)
+			if idempotent != nil {
+				keys.finish(req.IdempotencyKey, idempotent, batchErr)
+			}
+			if shared != nil {
+				inflight.finish(sharedKey, shared, batchErr)
+			}
+
+			// Persist the batch report before the response completes
+			report.finish()
+			log.Printf("Transfer batch finished: correlationID=%s, batchID=%s, status=%s, err=%v", correlationID, batchID, report.Status, batchErr)
+			if cfg.ReportDir != "" {
+				if err := writeReport(cfg.ReportDir, report); err != nil {
+					log.Printf("Failed to write transfer report: correlationID=%s, batchID=%s, err=%v", correlationID, batchID, err)
+				}
+			}
+			if err := history.add(historyRecords(report, peerCfg.PeerAddr)); err != nil {
+				log.Printf("Failed to record transfer history: correlationID=%s, batchID=%s, err=%v", correlationID, batchID, err)
+			}
+			runHooks(cfg, report)
+			if batchErr == nil {
+				progressChan <- TransferProgress{
+					Type:             "batch_completed",
+					Message:          "batch completed",
+					BytesTransferred: report.BytesTransferred,
+					Checksum:         report.BatchChecksum,
+					Files:            report.CompletedFiles + report.UnchangedFiles,
+					Timestamp:        time.Now(),
+				}
+			}
+			close(progressChan)
+			close(errChan)
+		}()
+
+		// Hold the response until the peer accepts the first file, so a
+		// transfer conflicting with an in-progress one can still get a 409
+		firstProgress, started := <-progressChan
+		var transferErr error
+		if !started {
+			transferErr = <-errChan
+			if status.Code(transferErr) == codes.Aborted {
+				http.Error(w, fmt.Sprintf("transfer conflict: %v", transferErr), http.StatusConflict)
 				return
 			}
+		}
+
+		// Set headers for NDJSON streaming
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		// Flush headers immediately
+		if flusher, ok := w.(http.Flusher); ok {
 			flusher.Flush()
+		}
 
-		case <-ctx.Done():
-			logEntry := LogEntry{
-				Timestamp: time.Now().Format(time.RFC3339),
-				Level:     "error",
-				Message:   "transfer cancelled",
-				Error:     ctx.Err().Error(),
-			}
-			_ = encoder.Encode(logEntry)
+		encoder := json.NewEncoder(w)
+		batch := batchProgress{total: len(sources)}
+		encode := func(logEntry LogEntry) error {
+			logEntry.CorrelationID = correlationID
+			logEntry.FilesCompleted, logEntry.FilesTotal = batch.completed, batch.total
+			return encoder.Encode(events.append(logEntry))
+		}
+		flusher, _ := w.(http.Flusher)
+
+		fail := func(logEntry LogEntry) {
+			_ = encode(logEntry)
 			flusher.Flush()
-			
+
 			// Force close TCP connection to signal error to curl
 			if hijacker, ok := w.(http.Hijacker); ok {
 				conn, _, _ := hijacker.Hijack()
 				conn.Close()
 			}
+		}
+
+		// Send initial log
+		logEntry := LogEntry{
+			Timestamp:        time.Now().Format(time.RFC3339),
+			Level:            "info",
+			Message:          "transfer initiated",
+			BatchID:          batchID,
+			BytesTransferred: 0,
+			TotalBytes:       0,
+			Options:          effectiveOptions(peerCfg, &req),
+		}
+		if err := encode(logEntry); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		if !started {
+			if transferErr != nil {
+				fail(LogEntry{
+					Timestamp:        time.Now().Format(time.RFC3339),
+					Level:            "error",
+					Message:          "transfer failed",
+					BytesTransferred: 0,
+					TotalBytes:       0,
+					Error:            transferErr.Error(),
+					Code:             errorCode(transferErr),
+					Retries:          retryFailure(transferErr),
+				})
+			}
 			return
 		}
+		batch.observe(firstProgress)
+		if err := encode(progressEntry(firstProgress)); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		// Stream progress updates
+		for {
+			select {
+			case progress, ok := <-progressChan:
+				if !ok {
+					// Channel closed, check for errors
+					if err := <-errChan; err != nil {
+						fail(LogEntry{
+							Timestamp:        time.Now().Format(time.RFC3339),
+							Level:            "error",
+							Message:          "transfer failed",
+							BytesTransferred: 0,
+							TotalBytes:       0,
+							Error:            err.Error(),
+							Code:             errorCode(err),
+							Retries:          retryFailure(err),
+						})
+					}
+					return
+				}
+
+				batch.observe(progress)
+				if err := encode(progressEntry(progress)); err != nil {
+					return
+				}
+				flusher.Flush()
+
+			case <-ctx.Done():
+				fail(LogEntry{
+					Timestamp: time.Now().Format(time.RFC3339),
+					Level:     "error",
+					Message:   "transfer cancelled",
+					Error:     context.Cause(ctx).Error(),
+				})
+				return
+			}
+		}
+	}
+}
+
+// batchProgress counts a batch's files as their completion events are
+// streamed, so every event can report "N of M files". Files skipped as busy
+// or kept after a conflict are done too, so they count as completed.
+type batchProgress struct {
+	completed int
+	total     int
+}
+
+func (b *batchProgress) observe(progress TransferProgress) {
+	switch {
+	case progress.Type == "file_completed", progress.Type == "file_busy":
+		b.completed++
+	case progress.Type == "conflict_resolved" && progress.Kept:
+		b.completed++
+	}
+}
+
+func progressEntry(progress TransferProgress) LogEntry {
+	switch progress.Type {
+	case "":
+	case "file_completed", "batch_completed":
+		return LogEntry{
+			Timestamp:        progress.Timestamp.Format(time.RFC3339),
+			Level:            "info",
+			Type:             progress.Type,
+			Message:          progress.Message,
+			BytesTransferred: progress.BytesTransferred,
+			Path:             progress.Path,
+			Checksum:         progress.Checksum,
+			Files:            progress.Files,
+			Diagnostics:      progress.Diagnostics,
+			Mapped:           progress.Mapped,
+		}
+	case "conflict", "conflict_resolved":
+		return LogEntry{
+			Timestamp: progress.Timestamp.Format(time.RFC3339),
+			Level:     "info",
+			Type:      progress.Type,
+			Message:   progress.Message,
+			Path:      progress.Path,
+			Conflict:  progress.Conflict,
+		}
+	default:
+		// Other typed events (retries, verification failures) are warnings
+		return LogEntry{
+			Timestamp: progress.Timestamp.Format(time.RFC3339),
+			Level:     "warn",
+			Type:      progress.Type,
+			Message:   progress.Message,
+			Attempt:   progress.Attempt,
+			Error:     progress.Reason,
+		}
+	}
+
+	entry := LogEntry{
+		Timestamp:        progress.Timestamp.Format(time.RFC3339),
+		Level:            "info",
+		Message:          progress.Message,
+		BytesTransferred: progress.BytesTransferred,
+		BytesConfirmed:   progress.BytesConfirmed,
+		TotalBytes:       progress.TotalBytes,
+		BytesPerSecond:   progress.BytesPerSecond,
+	}
+	// Streams of unknown size report bytes and speed only
+	if percent := progressPercent(progress.BytesTransferred, progress.TotalBytes); percent != UnknownProgress {
+		if progress.BytesConfirmed < progress.TotalBytes {
+			percent = min(percent, MaxUnconfirmedProgress)
+		}
+		entry.Progress = percent
+	}
+	return entry
+}
+
+// batchFiles expands a request's source into the files of its batch and the
+// target of each. A failure comes with the HTTP status to answer it with.
+func batchFiles(cfg *Config, req *TransferRequest) (sources, targets []string, code int, err error) {
+	sources, err = expandSource(cfg.RootDir, req.Source, bool(req.SkipHidden))
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	if sources, err = filterBySize(cfg.RootDir, sources, req.MinSize, req.MaxSize); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	// Symlinks must not lead out of the root directory
+	if cfg.StrictRootDir && !req.Pull {
+		for _, source := range sources {
+			if err := checkWithinRoot(cfg.RootDir, source, cfg.MaxSymlinkHops); err != nil {
+				return nil, nil, pathErrorStatus(err), err
+			}
+		}
+	}
+
+	// Patterns transfer into the target directory, keeping paths relative to the pattern base.
+	// Otherwise the target is the exact destination, unless a trailing slash names
+	// the directory to place the source in.
+	targets = []string{req.Target}
+	if !isPattern(req.Source) && strings.HasSuffix(req.Target, "/") {
+		targets[0] = filepath.Join(req.Target, filepath.Base(req.Source))
+	}
+	if isPattern(req.Source) {
+		base := patternBase(req.Source)
+		targets = make([]string, len(sources))
+		for i, source := range sources {
+			rel, err := filepath.Rel(base, source)
+			if err != nil {
+				return nil, nil, http.StatusBadRequest, err
+			}
+			targets[i] = filepath.Join(req.Target, rel)
+		}
+	}
+	return sources, targets, 0, nil
+}
+
+// forRequest returns the configuration to reach a request's peer: an allowed
+// ad-hoc peer or a discovered one replaces PEER_SERVER_ADDR. It returns nil if
+// the request names a peer that wasn't discovered.
+func (cfg *Config) forRequest(req *TransferRequest, peers *peerRegistry) *Config {
+	if req.Peer != "" {
+		return peers.forPeer(cfg, req.Peer)
+	}
+	if req.PeerAddress == "" {
+		return cfg
+	}
+	adHoc := *cfg
+	adHoc.PeerAddr = req.PeerAddress
+	return &adHoc
+}
+
+// rejectIfReadOnly answers 403 for endpoints that start transfers or change
+// files when the server only serves reads.
+func rejectIfReadOnly(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	if !cfg.ReadOnly {
+		return next
 	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "server is read-only", http.StatusForbidden)
 	}
 }
 
-func StartHTTPServer(ctx context.Context, port, peerAddr, rootDir string) error {
+// endpoints lists the HTTP API served at the root path.
+var endpoints = []string{
+	"POST /transfer",
+	"GET /transfer/{batch_id}/events",
+	"GET /download",
+	"POST /promote/{batch_id}",
+	"POST /discard/{batch_id}",
+	"POST /admin/cancel-peer",
+	"POST /query",
+	"POST /plan",
+	"GET /profiles",
+	"GET /history",
+	"POST /verify-tree",
+	"POST /resolve/{id}",
+	"POST /receive",
+	"POST /sync",
+	"GET /metrics",
+	"GET /health",
+	"GET /ready",
+}
+
+type RootResponse struct {
+	Service   string   `json:"service"`
+	Version   string   `json:"version"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// handleRoot describes the server so a request to / is self-documenting.
+// It deliberately leaves out any configuration.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RootResponse{
+		Service:   "file-transfer-server",
+		Version:   version,
+		Endpoints: endpoints,
+	})
+}
+
+// requireToken answers 401 unless the request carries the configured API
+// token as a bearer token. Without API_TOKEN every request is allowed.
+func requireToken(cfg *Config, next http.HandlerFunc) http.HandlerFunc {
+	if cfg.APIToken == "" {
+		return next
+	}
+	want := []byte("Bearer " + cfg.APIToken)
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func StartHTTPServer(ctx context.Context, cfg *Config, receiver *FileTransferServer, listeners []net.Listener) error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/transfer", handleTransfer(peerAddr, rootDir))
+	limiter := newLoadLimiter(cfg)
+	if limiter != nil {
+		go limiter.run(ctx)
+	}
+
+	throttle := newRequestThrottle(cfg)
+
+	logs := newEventLogs()
+	batches := newActiveBatches()
+	keys := newBatchKeys(cfg.IdempotencyTTL)
+	inflight := newBatchKeys(0)
+	var checksums *checksumCache
+	if cfg.ChecksumCache {
+		var err error
+		if checksums, err = newChecksumCache(ctx, cfg.RootDir); err != nil {
+			log.Printf("Warning: failed to watch root directory, hashing sources on demand: rootDir=%s, err=%v", cfg.RootDir, err)
+		}
+	}
+	peers := newPeerRegistry(cfg)
+	if peers != nil {
+		go peers.run(ctx)
+	}
+	history, err := newHistoryStore(cfg)
+	if err != nil {
+		return err
+	}
+	conflicts := newPendingConflicts()
+	mux.HandleFunc("/transfer", throttleRequests(throttle, requireToken(cfg, rejectIfReadOnly(cfg, handleTransfer(cfg, limiter, receiver, logs, batches, keys, inflight, checksums, peers, history, conflicts)))))
+	mux.HandleFunc("GET /transfer/{batch_id}/events", handleTransferEvents(logs))
+	mux.HandleFunc("/download", handleDownload(cfg))
+	mux.HandleFunc("/promote/{batch_id}", requireToken(cfg, rejectIfReadOnly(cfg, handlePromote(cfg, false))))
+	mux.HandleFunc("/discard/{batch_id}", requireToken(cfg, rejectIfReadOnly(cfg, handlePromote(cfg, true))))
+	mux.HandleFunc("POST /admin/cancel-peer", requireToken(cfg, handleCancelPeer(batches)))
+	mux.HandleFunc("POST /query", requireToken(cfg, handleQuery(cfg)))
+	mux.HandleFunc("POST /plan", requireToken(cfg, handlePlan(cfg, checksums, peers)))
+	mux.HandleFunc("GET /profiles", requireToken(cfg, handleProfiles(cfg)))
+	mux.HandleFunc("GET /history", requireToken(cfg, handleHistory(history)))
+	mux.HandleFunc("POST /verify-tree", requireToken(cfg, handleVerifyTree(cfg)))
+	mux.HandleFunc("POST /resolve/{id}", requireToken(cfg, handleResolve(conflicts)))
+	mux.HandleFunc("POST /receive", requireToken(cfg, handleReceive(receiver)))
+	mux.HandleFunc("POST /sync", requireToken(cfg, rejectIfReadOnly(cfg, handleSyncTrees(cfg, receiver, checksums))))
+	mux.HandleFunc("/metrics", handleMetrics(limiter, checksums, throttle))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if err := receiver.Ready(); err != nil {
+			http.Error(w, status.Convert(err).Message(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("GET /{$}", handleRoot)
 
 	httpServer := &http.Server{
-		Addr:    ":" + port,
 		Handler: mux,
 	}
 
@@ -164,6 +776,6 @@ func StartHTTPServer(ctx context.Context, port, peerAddr, rootDir string) error
 		_ = httpServer.Shutdown(shutdownCtx)
 	}()
 
-	fmt.Printf("Starting HTTP server: port=%s, peerAddr=%s, rootDir=%s\n", port, peerAddr, rootDir)
-	return httpServer.ListenAndServe()
+	fmt.Printf("Starting HTTP server: addrs=%s, peerAddr=%s, rootDir=%s\n", strings.Join(cfg.HTTPListenAddrs, ","), cfg.PeerAddr, cfg.RootDir)
+	return serveAll(listeners, httpServer.Serve)
 }
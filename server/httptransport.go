@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// How files are sent to peers. Over HTTP, for networks that block gRPC, the
+// messages of the Transfer stream are framed into the body of a POST to the
+// peer's /receive and the body of its response.
+const (
+	PeerTransportGRPC = "grpc"
+	PeerTransportHTTP = "http"
+)
+
+// A frame is a kind byte, the payload's length and CRC-32C, both 4 bytes big
+// endian, and the payload: a TransferRequest or TransferResponse, or the
+// google.rpc.Status the receiver failed with as its last frame.
+const (
+	frameMessage byte = 0
+	frameStatus  byte = 1
+
+	frameHeaderSize     = 9
+	receiveContentType  = "application/x-transfer-frames"
+	receiveMaxFrameSize = maxMessageSize
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func writeFrame(w io.Writer, kind byte, message proto.Message) error {
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[5:9], crc32.Checksum(payload, castagnoli))
+	_, err = w.Write(append(frame, payload...))
+	return err
+}
+
+// readFrame returns the next frame's kind and payload, or io.EOF if the body
+// ended between frames.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, status.Errorf(codes.DataLoss, "truncated frame header")
+		}
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:5])
+	if size > receiveMaxFrameSize {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "frame of %d bytes exceeds the limit of %d", size, receiveMaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, status.Errorf(codes.DataLoss, "truncated frame")
+		}
+		return 0, nil, err
+	}
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(header[5:9]) {
+		return 0, nil, status.Errorf(codes.DataLoss, "frame checksum mismatch")
+	}
+	return header[0], payload, nil
+}
+
+// validateHTTPTransport rejects the options of a /transfer request that need
+// RPCs besides Transfer, which only the gRPC transport has.
+func validateHTTPTransport(req *TransferRequest) []FieldError {
+	var errs []FieldError
+	invalid := func(field string) {
+		errs = append(errs, FieldError{Field: field, Message: "is not supported with PEER_TRANSPORT=http"})
+	}
+	if req.Pull {
+		invalid("pull")
+	}
+	if req.Stage {
+		invalid("stage")
+	}
+	if req.BatchChecksum {
+		invalid("batch_checksum")
+	}
+	if req.OnConflict == OnConflictAsk {
+		invalid("on_conflict")
+	}
+	return errs
+}
+
+// httpTransferServer carries a Transfer stream over a /receive request. The
+// receiver only uses Send, Recv and Context.
+type httpTransferServer struct {
+	grpc.ServerStream
+	ctx  context.Context
+	body *bufio.Reader
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	mu   sync.Mutex
+}
+
+func (s *httpTransferServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *httpTransferServer) Send(resp *pb.TransferResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFrame(s.w, frameMessage, resp); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *httpTransferServer) Recv() (*pb.TransferRequest, error) {
+	kind, payload, err := readFrame(s.body)
+	if err != nil {
+		return nil, err
+	}
+	if kind != frameMessage {
+		return nil, status.Errorf(codes.InvalidArgument, "unexpected frame kind %d", kind)
+	}
+	req := &pb.TransferRequest{}
+	if err := proto.Unmarshal(payload, req); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid message: %v", err)
+	}
+	return req, nil
+}
+
+// handleReceive serves POST /receive, receiving files sent with
+// PEER_TRANSPORT=http just as the gRPC Transfer stream does.
+func handleReceive(receiver *FileTransferServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != receiveContentType {
+			http.Error(w, fmt.Sprintf("content type must be %s", receiveContentType), http.StatusUnsupportedMediaType)
+			return
+		}
+		// The sender waits for each file to be accepted before sending its chunks
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			http.Error(w, fmt.Sprintf("full duplex is not supported: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", receiveContentType)
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		ctx := r.Context()
+		if id := r.Header.Get(CorrelationIDHeader); validCorrelationID.MatchString(id) {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(correlationIDKey, id))
+		}
+		stream := &httpTransferServer{ctx: ctx, body: bufio.NewReader(r.Body), w: w, rc: rc}
+		if err := receiver.Transfer(stream); err != nil {
+			stream.mu.Lock()
+			defer stream.mu.Unlock()
+			if err := writeFrame(w, frameStatus, status.Convert(err).Proto()); err == nil {
+				_ = rc.Flush()
+			}
+		}
+	}
+}
+
+// httpTransferClient is the sending end of a /receive request. sendStream
+// only uses Send, Recv and CloseSend.
+type httpTransferClient struct {
+	grpc.ClientStream
+	ctx  context.Context
+	body *io.PipeWriter
+	resp *bufio.Reader
+}
+
+// openHTTPTransfer starts a Transfer stream to the /receive endpoint of the
+// peer's HTTP server at peerAddr. The request lasts until ctx is cancelled
+// or the stream is closed.
+func openHTTPTransfer(ctx context.Context, peerAddr, token string, dialTimeout time.Duration) (*httpTransferClient, error) {
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peerAddr+"/receive", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", receiveContentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if ids := md.Get(correlationIDKey); len(ids) > 0 {
+			req.Header.Set(CorrelationIDHeader, ids[len(ids)-1])
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		ResponseHeaderTimeout: dialTimeout,
+		DisableKeepAlives:     true, // each stream gets its own connection, as with gRPC
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		bodyWriter.Close()
+		return nil, status.Errorf(codes.Unavailable, "failed to reach /receive: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		bodyWriter.Close()
+		return nil, status.Errorf(receiveStatusCode(resp.StatusCode), "/receive answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return &httpTransferClient{ctx: ctx, body: bodyWriter, resp: bufio.NewReader(resp.Body)}, nil
+}
+
+// receiveStatusCode maps the HTTP status of a refused /receive request to
+// the gRPC code the transfer fails with.
+func receiveStatusCode(code int) codes.Code {
+	switch code {
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+func (c *httpTransferClient) Context() context.Context {
+	return c.ctx
+}
+
+func (c *httpTransferClient) Send(req *pb.TransferRequest) error {
+	// Like a gRPC stream, a failed Send leaves the reason to Recv
+	if err := writeFrame(c.body, frameMessage, req); err != nil {
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *httpTransferClient) CloseSend() error {
+	return c.body.Close()
+}
+
+func (c *httpTransferClient) Recv() (*pb.TransferResponse, error) {
+	kind, payload, err := readFrame(c.resp)
+	if err != nil {
+		if err == io.EOF || status.Code(err) != codes.Unknown {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to read from /receive: %v", err)
+	}
+	switch kind {
+	case frameMessage:
+		resp := &pb.TransferResponse{}
+		if err := proto.Unmarshal(payload, resp); err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid message from /receive: %v", err)
+		}
+		return resp, nil
+	case frameStatus:
+		st := &spb.Status{}
+		if err := proto.Unmarshal(payload, st); err != nil {
+			return nil, status.Errorf(codes.Internal, "invalid status from /receive: %v", err)
+		}
+		return nil, status.ErrorProto(st)
+	}
+	return nil, status.Errorf(codes.Internal, "unexpected frame kind %d from /receive", kind)
+}
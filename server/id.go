@@ -0,0 +1,12 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
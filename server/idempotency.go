@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// IdempotentReplayHeader marks a /transfer response that replays an earlier
+// batch with the same idempotency key.
+const IdempotentReplayHeader = "Idempotent-Replayed"
+
+// keyedBatch is the batch started under a key.
+type keyedBatch struct {
+	id     string
+	req    TransferRequest
+	events *eventLog
+}
+
+// batchKeys remembers the batches started under a key, so a repeated /transfer
+// replays or follows the batch's events instead of transferring again. Keys
+// are kept for the TTL after their batch succeeds, or only while it runs if the
+// TTL is zero. Keys of failed batches are forgotten right away, so retrying
+// them starts a new batch.
+type batchKeys struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	batches map[string]*keyedBatch
+}
+
+// transferKey identifies transfers of the same source to the same target on
+// the same peer.
+func transferKey(peerAddr, source, target string) string {
+	return peerAddr + "\x00" + source + "\x00" + target
+}
+
+func newBatchKeys(ttl time.Duration) *batchKeys {
+	return &batchKeys{ttl: ttl, batches: make(map[string]*keyedBatch)}
+}
+
+// claim registers a batch for key unless one is already running or completed
+// within the TTL, in which case that batch is returned instead.
+func (k *batchKeys) claim(key, batchID string, req TransferRequest, events *eventLog) (*keyedBatch, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if batch, ok := k.batches[key]; ok {
+		return batch, false
+	}
+	batch := &keyedBatch{id: batchID, req: req, events: events}
+	k.batches[key] = batch
+	return batch, true
+}
+
+// finish records a claimed batch's outcome.
+func (k *batchKeys) finish(key string, batch *keyedBatch, err error) {
+	forget := func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.batches[key] == batch {
+			delete(k.batches, key)
+		}
+	}
+	if err != nil || k.ttl == 0 {
+		forget()
+		return
+	}
+	time.AfterFunc(k.ttl, forget)
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// FS_IMMUTABLE_FL from linux/fs.h; not exported by x/sys/unix
+const fsImmutableFlag = 0x00000010
+
+// setImmutable sets FS_IMMUTABLE_FL on a file, so it can't be modified,
+// renamed or deleted until the flag is cleared. Requires CAP_LINUX_IMMUTABLE
+// and a filesystem that supports the flag.
+func setImmutable(path string) error {
+	file, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fd := int(file.Fd())
+	flags, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(flags|fsImmutableFlag))
+}
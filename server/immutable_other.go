@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func setImmutable(path string) error {
+	return errors.New("immutable attribute is only supported on Linux")
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeInodes returns the number of inodes available on the filesystem holding path.
+func freeInodes(path string) (uint64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Ffree, nil
+}
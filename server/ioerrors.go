@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Categories of failed writes on the receiver. They are attached to the gRPC
+// status as the reason of an ErrorInfo detail and reported to HTTP clients as
+// the code of the error event, so callers can tell them apart without parsing
+// messages.
+const (
+	StorageDiskFull         = "disk_full"
+	StorageQuotaExceeded    = "quota_exceeded"
+	StoragePermissionDenied = "permission_denied"
+	StorageReadOnly         = "read_only"
+	StorageIOError          = "io_error"
+)
+
+const errorInfoDomain = "file-transfer-system"
+
+// classifyStorageError returns the category of a failed filesystem operation
+// and the gRPC code to report it with, or "" if the cause isn't recognised.
+func classifyStorageError(err error) (string, codes.Code) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "", codes.Internal
+	}
+	switch errno {
+	case syscall.ENOSPC:
+		return StorageDiskFull, codes.ResourceExhausted
+	case syscall.EDQUOT:
+		return StorageQuotaExceeded, codes.ResourceExhausted
+	case syscall.EACCES, syscall.EPERM:
+		return StoragePermissionDenied, codes.PermissionDenied
+	case syscall.EROFS:
+		return StorageReadOnly, codes.FailedPrecondition
+	case syscall.EIO:
+		return StorageIOError, codes.Internal
+	}
+	return "", codes.Internal
+}
+
+// storageStatus returns a gRPC error carrying category as an ErrorInfo detail.
+func storageStatus(code codes.Code, category, message string) error {
+	st, err := status.New(code, message).WithDetails(&errdetails.ErrorInfo{
+		Reason: category,
+		Domain: errorInfoDomain,
+	})
+	if err != nil {
+		return status.Error(code, message)
+	}
+	return st.Err()
+}
+
+// errorCode returns the category a peer attached to a failed transfer, if any.
+func errorCode(err error) string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == errorInfoDomain {
+			return info.Reason
+		}
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadLimiter caps the number of concurrent outgoing transfers, dropping to a
+// single transfer while system load per CPU is above the threshold.
+type loadLimiter struct {
+	readLoad      func() (float64, error)
+	threshold     float64
+	maxTransfers  int
+	checkInterval time.Duration
+
+	mu      sync.Mutex
+	active  int
+	limit   int
+	waiting int           // transfers blocked in acquire
+	changed chan struct{} // closed whenever a slot may have become free
+}
+
+// newLoadLimiter returns nil when load-based throttling is disabled.
+func newLoadLimiter(cfg *Config) *loadLimiter {
+	if cfg.LoadThreshold <= 0 {
+		return nil
+	}
+	return &loadLimiter{
+		readLoad: func() (float64, error) {
+			return readLoadAvg(cfg.LoadAvgFile)
+		},
+		threshold:     cfg.LoadThreshold,
+		maxTransfers:  cfg.LoadMaxTransfers,
+		checkInterval: cfg.LoadCheckInterval,
+		limit:         cfg.LoadMaxTransfers,
+		changed:       make(chan struct{}),
+	}
+}
+
+// run re-evaluates the limit from the load source until ctx is cancelled.
+func (l *loadLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(l.checkInterval)
+	defer ticker.Stop()
+	for {
+		l.update()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *loadLimiter) update() {
+	load, err := l.readLoad()
+	if err != nil {
+		log.Printf("Failed to read system load: %v", err)
+		return
+	}
+
+	limit := l.maxTransfers
+	if load > l.threshold {
+		limit = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit != l.limit {
+		log.Printf("Load limiter: load=%.2f, threshold=%.2f, concurrency=%d", load, l.threshold, limit)
+		l.limit = limit
+		l.broadcast()
+	}
+}
+
+// tryAcquire takes a transfer slot if one is free right now.
+func (l *loadLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active < l.limit {
+		l.active++
+		return true
+	}
+	return false
+}
+
+// acquire blocks until a transfer slot is free or ctx is cancelled.
+func (l *loadLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// queueFull reports whether every slot is taken and maxDepth transfers are
+// already waiting for one. A maxDepth of 0 means the queue is unbounded.
+func (l *loadLimiter) queueFull(maxDepth int) bool {
+	if l == nil || maxDepth == 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active >= l.limit && l.waiting >= maxDepth
+}
+
+// queueDepth returns the number of transfers waiting for a slot.
+func (l *loadLimiter) queueDepth() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.waiting
+}
+
+func (l *loadLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.broadcast()
+}
+
+func (l *loadLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// readLoadAvg returns the 1-minute load average from a /proc/loadavg style
+// file, divided by the number of CPUs.
+func readLoadAvg(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty load average file: %s", path)
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid load average: %v", err)
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
@@ -6,28 +6,43 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	// Read environment variables
-	peerAddr := os.Getenv("PEER_SERVER_ADDR")
-	rootDir := os.Getenv("ROOT_DIR")
-	httpPort := getEnv("HTTP_PORT", "8080")
-	grpcPort := getEnv("GRPC_PORT", "50051")
-
-	if peerAddr == "" {
-		log.Fatal("PEER_SERVER_ADDR environment variable is required")
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if rootDir == "" {
-		log.Fatal("ROOT_DIR environment variable is required")
+	httpListeners, grpcListeners, err := cfg.listen()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Create root directory if it doesn't exist
-	if err := os.MkdirAll(rootDir, 0755); err != nil {
+	if err := os.MkdirAll(cfg.RootDir, 0755); err != nil {
 		log.Fatalf("Failed to create root directory: %v", err)
 	}
+	for class, dir := range cfg.StorageClasses {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("Failed to create storage class directory: class=%s, err=%v", class, err)
+		}
+	}
+
+	setMaxOpenFiles(cfg.MaxOpenFiles)
+
+	if cfg.StrictRootDir {
+		if err := cfg.canonicalizeRootDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Setup signal handling
 	ctx, cancel := context.WithCancel(context.Background())
@@ -42,22 +57,44 @@ func main() {
 		cancel()
 	}()
 
-	log.Printf("Starting file transfer server")
-	log.Printf("Configuration: httpPort=%s, grpcPort=%s, peerAddr=%s, rootDir=%s", httpPort, grpcPort, peerAddr, rootDir)
+	shutdownTracing, err := setupTracing(ctx, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			log.Printf("Warning: failed to flush traces: %v", err)
+		}
+	}()
 
-	// Start both servers concurrently
+	log.Printf("Starting file transfer server: version=%s", version)
+	log.Printf("Configuration: httpAddrs=%s, grpcAddrs=%s, peerAddr=%s, rootDir=%s", strings.Join(cfg.HTTPListenAddrs, ","), strings.Join(cfg.GRPCListenAddrs, ","), cfg.PeerAddr, cfg.RootDir)
+
+	// Start both servers concurrently; the receiver also unpacks pulled archives
 	errChan := make(chan error, 2)
+	var storage FileSystem = OSFileSystem{}
+	if cfg.StorageBackend == StorageBackendMemory {
+		storage = NewMemFileSystem()
+	}
+	receiver := NewFileTransferServer(cfg, storage)
+	if cfg.StaleTempAge > 0 {
+		if err := receiver.sweepStaleTemps(cfg.StaleTempAge, cfg.StaleTempAction); err != nil {
+			log.Printf("Warning: failed to sweep stale temp files: rootDir=%s, err=%v", cfg.RootDir, err)
+		}
+	}
 
 	// Start gRPC server (for receiving files)
 	go func() {
-		if err := StartGRPCServer(ctx, grpcPort, rootDir); err != nil {
+		if err := StartGRPCServer(ctx, cfg, receiver, grpcListeners); err != nil {
 			errChan <- fmt.Errorf("gRPC server error: %v", err)
 		}
 	}()
 
 	// Start HTTP server (for sending files)
 	go func() {
-		if err := StartHTTPServer(ctx, httpPort, peerAddr, rootDir); err != nil {
+		if err := StartHTTPServer(ctx, cfg, receiver, httpListeners); err != nil {
 			errChan <- fmt.Errorf("HTTP server error: %v", err)
 		}
 	}()
@@ -70,10 +107,3 @@ func main() {
 		log.Println("Shutting down...")
 	}
 }
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
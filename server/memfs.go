@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the receiver stores files: on disk, or in memory for tests and
+// relays that shouldn't touch the disk
+const (
+	StorageBackendOS     = "os"
+	StorageBackendMemory = "memory"
+)
+
+// MemFileSystem keeps files in memory. Directories only hold a name and an
+// mtime, and everything is lost when the process exits.
+type MemFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memEntry
+	dirs  map[string]time.Time // mtime by directory
+}
+
+type memEntry struct {
+	data  []byte
+	mtime time.Time
+}
+
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{files: make(map[string]*memEntry), dirs: make(map[string]time.Time)}
+}
+
+func (m *MemFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := filepath.Clean(path); !m.isDir(dir); dir = filepath.Dir(dir) {
+		if m.files[dir] != nil {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		m.dirs[dir] = time.Now()
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemFileSystem) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isDir(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	entry := &memEntry{mtime: time.Now()}
+	m.files[name] = entry
+	return &memFile{fs: m, name: name, entry: entry}, nil
+}
+
+func (m *MemFileSystem) Append(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{fs: m, name: name, entry: entry, offset: int64(len(entry.data))}, nil
+}
+
+// Open returns a copy of the file's current content.
+func (m *MemFileSystem) Open(name string) (io.ReadCloser, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(entry.data))), nil
+}
+
+func (m *MemFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.isDir(name) {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFileSystem) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(m.files, name)
+		}
+	}
+	for dir := range m.dirs {
+		if dir == path || strings.HasPrefix(dir, prefix) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// Rename moves a file, replacing any file at newpath as os.Rename does.
+func (m *MemFileSystem) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if m.isDir(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = entry
+	return nil
+}
+
+func (m *MemFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.files[name]; ok {
+		entry.mtime = mtime
+		return nil
+	}
+	if m.isDir(name) {
+		m.dirs[name] = mtime
+		return nil
+	}
+	return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+}
+
+// isDir must be called with m.mu held.
+func (m *MemFileSystem) isDir(name string) bool {
+	_, ok := m.dirs[name]
+	return ok
+}
+
+// FreeInodes reports no limit, as files in memory use none.
+func (m *MemFileSystem) FreeInodes(path string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+// DeviceID reports the same device for every path, so nothing in memory is a
+// mount point.
+func (m *MemFileSystem) DeviceID(path string) (uint64, error) {
+	return 0, nil
+}
+
+func (m *MemFileSystem) Mkfifo(path string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkfifo", Path: path, Err: errors.ErrUnsupported}
+}
+
+// memFile writes to a MemFileSystem entry. Writes after the file was removed
+// or renamed still land in its entry, as with an open file on disk.
+type memFile struct {
+	fs     *MemFileSystem
+	name   string
+	offset int64
+	entry  *memEntry
+	closed bool
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.entry.data)) {
+		f.entry.data = append(f.entry.data, make([]byte, end-int64(len(f.entry.data)))...)
+	}
+	copy(f.entry.data[off:], p)
+	f.entry.mtime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// inMemory reports whether s stores files in a MemFileSystem, which has no
+// directory tree on disk to stat or walk.
+func (s *FileTransferServer) inMemory() bool {
+	_, ok := s.fs.(*MemFileSystem)
+	return ok
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc"
+)
+
+// memTransferStream plays a sender's messages to Transfer and collects the
+// receiver's responses.
+type memTransferStream struct {
+	grpc.ServerStream
+	requests  []*pb.TransferRequest
+	responses []*pb.TransferResponse
+}
+
+func (s *memTransferStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *memTransferStream) Recv() (*pb.TransferRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func (s *memTransferStream) Send(resp *pb.TransferResponse) error {
+	s.responses = append(s.responses, resp)
+	return nil
+}
+
+// fileMessages returns the messages a sender streams for content, in chunks
+// of chunkSize, reporting bytesTransferred at the end.
+func fileMessages(path string, content []byte, chunkSize int, bytesTransferred int64) []*pb.TransferRequest {
+	requests := []*pb.TransferRequest{{Payload: &pb.TransferRequest_Metadata{
+		Metadata: &pb.TransferMetadata{FilePath: path, FileSize: int64(len(content))},
+	}}}
+	for chunk := range slices.Chunk(content, chunkSize) {
+		requests = append(requests, &pb.TransferRequest{Payload: &pb.TransferRequest_Chunk{
+			Chunk: &pb.FileChunk{Data: chunk},
+		}})
+	}
+	return append(requests, &pb.TransferRequest{Payload: &pb.TransferRequest_Complete{
+		Complete: &pb.TransferComplete{BytesTransferred: bytesTransferred},
+	}})
+}
+
+// pausingTransferStream is a memTransferStream that blocks once it has handed
+// out pauseAfter messages, until release is closed.
+type pausingTransferStream struct {
+	memTransferStream
+	pauseAfter int
+	paused     chan<- struct{}
+	release    <-chan struct{}
+}
+
+func (s *pausingTransferStream) Recv() (*pb.TransferRequest, error) {
+	if s.pauseAfter == 0 {
+		s.paused <- struct{}{}
+		<-s.release
+	}
+	s.pauseAfter--
+	return s.memTransferStream.Recv()
+}
+
+func memReceiverConfig(root string) *Config {
+	return &Config{
+		RootDir:        root,
+		TempFileSuffix: ".part",
+		SymlinkParents: SymlinkParentsFollow,
+		CaseCollisions: CaseCollisionIgnore,
+	}
+}
+
+func newMemReceiver(t *testing.T) (*FileTransferServer, *MemFileSystem, string) {
+	t.Helper()
+	// The root doesn't exist on disk, so any write that bypasses the
+	// FileSystem fails
+	root := filepath.Join(t.TempDir(), "root")
+	memory := NewMemFileSystem()
+	return NewFileTransferServer(memReceiverConfig(root), memory), memory, root
+}
+
+func readMem(t *testing.T, memory *MemFileSystem, path string) []byte {
+	t.Helper()
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+	entry, ok := memory.files[path]
+	if !ok {
+		t.Fatalf("%s isn't in memory", path)
+	}
+	return bytes.Clone(entry.data)
+}
+
+func TestTransferIntoMemory(t *testing.T) {
+	receiver, memory, root := newMemReceiver(t)
+	first := bytes.Repeat([]byte("in-memory transfer "), 1000)
+	second := []byte("a second file on the same stream")
+
+	stream := &memTransferStream{}
+	stream.requests = append(fileMessages("relay/first.bin", first, 4096, int64(len(first))),
+		fileMessages("second.txt", second, 7, int64(len(second)))...)
+	if err := receiver.Transfer(stream); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+
+	completed := 0
+	for _, resp := range stream.responses {
+		if resp.Success {
+			completed++
+		}
+	}
+	if completed != 2 {
+		t.Fatalf("got %d completed files, want 2: %v", completed, stream.responses)
+	}
+	if got := readMem(t, memory, filepath.Join(root, "relay/first.bin")); !bytes.Equal(got, first) {
+		t.Errorf("first.bin holds %d bytes that differ from the %d sent", len(got), len(first))
+	}
+	if got := readMem(t, memory, filepath.Join(root, "second.txt")); !bytes.Equal(got, second) {
+		t.Errorf("second.txt = %q, want %q", got, second)
+	}
+	if len(memory.files) != 2 {
+		t.Errorf("memory holds %d files, want only the 2 received without temp files", len(memory.files))
+	}
+	if _, err := os.Stat(root); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("root directory was touched on disk: %v", err)
+	}
+}
+
+func TestTransferIntoMemoryByteCountMismatch(t *testing.T) {
+	receiver, memory, root := newMemReceiver(t)
+	content := []byte("cut short on the way")
+
+	stream := &memTransferStream{requests: fileMessages("bad.txt", content, 8, int64(len(content))+1)}
+	if err := receiver.Transfer(stream); err == nil {
+		t.Fatal("Transfer succeeded despite a byte count mismatch")
+	}
+	if _, ok := memory.files[filepath.Join(root, "bad.txt")]; ok {
+		t.Error("target exists after a failed transfer")
+	}
+	if len(memory.files) != 0 {
+		t.Errorf("memory holds %d files after a failed transfer, want the temp file removed", len(memory.files))
+	}
+}
+
+func TestTransferIntoMemoryChecksumMismatch(t *testing.T) {
+	receiver, memory, root := newMemReceiver(t)
+	content := []byte("corrupted on the way")
+
+	requests := fileMessages("bad.txt", content, 8, int64(len(content)))
+	requests[len(requests)-1].GetComplete().Checksum = hex.EncodeToString(make([]byte, sha256.Size))
+	stream := &memTransferStream{requests: requests}
+	if err := receiver.Transfer(stream); err == nil {
+		t.Fatal("Transfer succeeded despite a checksum mismatch")
+	}
+	if _, ok := memory.files[filepath.Join(root, "bad.txt")]; ok {
+		t.Error("target exists after a failed transfer")
+	}
+	if len(memory.files) != 0 {
+		t.Errorf("memory holds %d files after a failed transfer, want the temp file removed", len(memory.files))
+	}
+}
+
+func TestConcurrentTransfersUseDistinctTempFiles(t *testing.T) {
+	_, memory, root := newMemReceiver(t)
+	contents := [][]byte{bytes.Repeat([]byte("first "), 100), bytes.Repeat([]byte("second"), 100)}
+	paused := make(chan struct{}, len(contents))
+	release := make(chan struct{})
+	errs := make(chan error, len(contents))
+	// Two receivers sharing a root write next to the same target at once
+	for _, content := range contents {
+		receiver := NewFileTransferServer(memReceiverConfig(root), memory)
+		stream := &pausingTransferStream{
+			memTransferStream: memTransferStream{requests: fileMessages("shared.bin", content, 64, int64(len(content)))},
+			pauseAfter:        2,
+			paused:            paused,
+			release:           release,
+		}
+		go func() { errs <- receiver.Transfer(stream) }()
+	}
+	for range contents {
+		<-paused
+	}
+
+	var temps []string
+	memory.mu.Lock()
+	for name := range memory.files {
+		if strings.HasPrefix(name, filepath.Join(root, "shared.bin.")) && strings.HasSuffix(name, ".part") {
+			temps = append(temps, name)
+		}
+	}
+	memory.mu.Unlock()
+	close(release)
+	for range contents {
+		if err := <-errs; err != nil {
+			t.Fatalf("Transfer: %v", err)
+		}
+	}
+
+	if len(temps) != 2 {
+		t.Errorf("got temp files %v mid-transfer, want one per transfer", temps)
+	}
+	got := readMem(t, memory, filepath.Join(root, "shared.bin"))
+	if !bytes.Equal(got, contents[0]) && !bytes.Equal(got, contents[1]) {
+		t.Errorf("shared.bin holds %q, want one complete stream", got)
+	}
+	if len(memory.files) != 1 {
+		t.Errorf("memory holds %d files, want the temp files renamed away", len(memory.files))
+	}
+}
+
+func TestMemFileSystemDirectoryMtime(t *testing.T) {
+	memory := NewMemFileSystem()
+	if err := memory.MkdirAll("/root/extracted/dir", 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := memory.Chtimes("/root/extracted/dir", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes on a directory: %v", err)
+	}
+	if got := memory.dirs["/root/extracted/dir"]; !got.Equal(mtime) {
+		t.Errorf("directory mtime = %v, want %v", got, mtime)
+	}
+	if err := memory.Chtimes("/root/missing", mtime, mtime); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Chtimes on a missing path = %v, want ErrNotExist", err)
+	}
+}
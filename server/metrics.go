@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Reasons a path is rejected, used as the path_validation_rejections_total label
+const (
+	RejectTraversal   = "traversal"    // climbs out of the root with ..
+	RejectOutsideDir  = "outside_dir"  // resolves outside the root through a symlink
+	RejectRelative    = "relative"     // absolute where a relative path is required
+	RejectSymlinkHops = "symlink_hops" // needs more than MAX_SYMLINK_HOPS symlinks to resolve
+	RejectSymlinkDir  = "symlink_dir"  // a target directory is a symlink, with SYMLINK_PARENTS=reject
+	RejectCaseCollide = "case_clash"   // differs only in case from an existing entry, with CASE_COLLISION_POLICY=reject
+)
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+// write renders the counter in the Prometheus text exposition format.
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+var pathRejections = newCounterVec("path_validation_rejections_total", "Paths rejected by validation.", "reason")
+
+// rejectPath records a rejected path so probing attempts show up in metrics and logs.
+func rejectPath(reason, path string) {
+	pathRejections.inc(reason)
+	log.Printf("Warning: path rejected: reason=%s, path=%q", reason, path)
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+func handleMetrics(limiter *loadLimiter, checksums *checksumCache, throttle *requestThrottle) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		pathRejections.write(w)
+		writeGauge(w, "transfer_queue_depth", "Transfers waiting for a slot.", limiter.queueDepth())
+		writeCounter(w, "checksum_cache_hits_total", "Source checksums served from the checksum cache.", checksums.hitCount())
+		writeCounter(w, "throttled_requests_total", "Requests rejected by REQUEST_RATE_LIMIT.", throttle.throttledCount())
+	}
+}
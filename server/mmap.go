@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+)
+
+// mappedReader reads a source file through a read-only memory mapping, so
+// chunks are slices of the mapping instead of copies in a chunk buffer.
+type mappedReader struct {
+	file   *os.File
+	data   []byte
+	offset int
+}
+
+func newMappedReader(file *os.File, size int64) (*mappedReader, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, fmt.Errorf("can't map %d bytes", size)
+	}
+	data, err := mmapFile(file, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedReader{file: file, data: data}, nil
+}
+
+// Read copies from the mapping, for the start of a file the peer resumes.
+func (m *mappedReader) Read(p []byte) (int, error) {
+	if m.offset == len(m.data) {
+		return 0, m.end()
+	}
+	n := copy(p, m.data[m.offset:])
+	m.offset += n
+	return n, nil
+}
+
+// chunk returns the next n bytes of the mapping without copying them. They
+// stay valid until Close.
+func (m *mappedReader) chunk(n int) ([]byte, error) {
+	if m.offset == len(m.data) {
+		return nil, m.end()
+	}
+	data := m.data[m.offset:min(m.offset+n, len(m.data))]
+	m.offset += len(data)
+	return data, nil
+}
+
+// end reports io.EOF, unless the file no longer has the size it was mapped
+// at. A file that grew would otherwise be sent without its new end.
+func (m *mappedReader) end() error {
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() != int64(len(m.data)) {
+		return fmt.Errorf("%w: mapped=%d, now=%d", ErrSourceChanged, len(m.data), info.Size())
+	}
+	return io.EOF
+}
+
+func (m *mappedReader) Close() error {
+	return munmapFile(m.data)
+}
+
+// sendMapped sends a file read through a mapping. Touching a page the file
+// was truncated away from raises SIGBUS, which would crash the server, so
+// faults are turned into panics and recovered as a changed source instead.
+// Chunks are only read on this goroutine, as the read-ahead goroutine is
+// skipped for mapped files.
+func (p *peerSession) sendMapped(ctx context.Context, metadata *pb.TransferMetadata, reader *mappedReader, progressChan chan<- TransferProgress) (result *TransferResult, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if _, fault := r.(interface{ Addr() uintptr }); !fault {
+			panic(r)
+		}
+		p.discard()
+		result, err = nil, fmt.Errorf("%w: truncated while mapped", ErrSourceChanged)
+	}()
+
+	result, err = p.send(ctx, metadata, reader, nil, progressChan)
+	if result != nil {
+		result.Mapped = true
+	}
+	return result, err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory-mapped reads are only supported on Unix")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// deviceID returns the ID of the device holding path.
+func deviceID(path string) (uint64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Dev), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func deviceID(path string) (uint64, error) {
+	return 0, errors.New("mount checks are only supported on Linux")
+}
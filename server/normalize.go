@@ -0,0 +1,23 @@
+package main
+
+import "golang.org/x/text/unicode/norm"
+
+// Unicode forms the receiver can store names in. macOS writes names
+// decomposed (NFD) while Linux keeps whatever it is given, usually composed
+// (NFC), so the same name can arrive in either byte encoding.
+const (
+	NormalizeNFC = "nfc"
+	NormalizeNFD = "nfd"
+)
+
+// normalizeName converts a target path to the NORMALIZE_NAMES form, leaving
+// it as sent if none is configured.
+func (s *FileTransferServer) normalizeName(path string) string {
+	switch s.nameForm {
+	case NormalizeNFC:
+		return norm.NFC.String(path)
+	case NormalizeNFD:
+		return norm.NFD.String(path)
+	}
+	return path
+}
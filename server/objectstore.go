@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectPrefix marks a transfer target stored in the configured S3 bucket
+// instead of under the root directory, e.g. "s3:backups/db.dump".
+const ObjectPrefix = "s3:"
+
+func isObjectPath(path string) bool {
+	return strings.HasPrefix(path, ObjectPrefix)
+}
+
+// objectFileSystem stores files as objects in an S3-compatible bucket. Objects
+// can't be written in pieces, so each file is spooled to a local temp file and
+// uploaded when it is renamed into place.
+type objectFileSystem struct {
+	store *objectStore
+
+	mu     sync.Mutex
+	spools map[string]string // path being written -> local spool file
+}
+
+func newObjectFileSystem(cfg *Config) *objectFileSystem {
+	return &objectFileSystem{
+		store: &objectStore{
+			endpoint:  strings.TrimSuffix(cfg.S3Endpoint, "/"),
+			bucket:    cfg.S3Bucket,
+			region:    cfg.S3Region,
+			accessKey: cfg.S3AccessKeyID,
+			secretKey: cfg.S3SecretAccessKey,
+			// Bound reaching the endpoint and waiting for its answer, but not
+			// the upload itself, which takes as long as the file is large
+			client: &http.Client{Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext,
+				TLSHandshakeTimeout:   cfg.DialTimeout,
+				ResponseHeaderTimeout: cfg.DialTimeout,
+			}},
+		},
+		spools: make(map[string]string),
+	}
+}
+
+func (o *objectFileSystem) spool(name string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	path, ok := o.spools[name]
+	return path, ok
+}
+
+// MkdirAll is a no-op, as keys need no parent directories.
+func (o *objectFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (o *objectFileSystem) Create(name string) (File, error) {
+	file, err := os.CreateTemp("", "file-transfer-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	o.spools[name] = file.Name()
+	o.mu.Unlock()
+	return file, nil
+}
+
+func (o *objectFileSystem) Append(name string) (File, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (o *objectFileSystem) Open(name string) (io.ReadCloser, error) {
+	path, ok := o.spool(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return os.Open(path)
+}
+
+// Remove discards a file that is still being written.
+func (o *objectFileSystem) Remove(name string) error {
+	path, ok := o.spool(name)
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	o.mu.Lock()
+	delete(o.spools, name)
+	o.mu.Unlock()
+	return os.Remove(path)
+}
+
+func (o *objectFileSystem) RemoveAll(path string) error {
+	return o.Remove(path)
+}
+
+// Rename uploads a spooled file as the object newpath.
+func (o *objectFileSystem) Rename(oldpath, newpath string) error {
+	return o.upload(oldpath, newpath, "")
+}
+
+// upload uploads a spooled file as the object newpath, in the given S3
+// storage class or the bucket's default if empty.
+func (o *objectFileSystem) upload(oldpath, newpath, storageClass string) error {
+	path, ok := o.spool(oldpath)
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	if err := o.store.put(strings.TrimPrefix(newpath, ObjectPrefix), path, storageClass); err != nil {
+		return err
+	}
+	return o.Remove(oldpath)
+}
+
+// Chtimes is a no-op, as objects keep their upload time.
+func (o *objectFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return nil
+}
+
+func (o *objectFileSystem) FreeInodes(path string) (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+func (o *objectFileSystem) DeviceID(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (o *objectFileSystem) Mkfifo(path string, perm os.FileMode) error {
+	return errors.ErrUnsupported
+}
+
+// objectStore uploads objects to an S3-compatible endpoint using path-style
+// URLs and Signature Version 4.
+type objectStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *objectStore) put(key, path, storageClass string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The payload hash is part of the signature
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/"+s.bucket+"/"+escapeKey(key), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if storageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", storageClass)
+	}
+	s.sign(req, hex.EncodeToString(hasher.Sum(nil)), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload object %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to upload object %s: status=%d, body=%s", key, resp.StatusCode, body)
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *objectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := []string{
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+	}
+	if storageClass := req.Header.Get("X-Amz-Storage-Class"); storageClass != "" {
+		signedHeaders += ";x-amz-storage-class"
+		canonicalHeaders = append(canonicalHeaders, "x-amz-storage-class:"+storageClass)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		strings.Join(canonicalHeaders, "\n"),
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapeKey percent-encodes each segment of an object key as SigV4 expects,
+// leaving only unreserved characters as they are.
+func escapeKey(key string) string {
+	segments := strings.Split(filepath.ToSlash(key), "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// fileLimiter bounds how many source and destination files are open at once
+// across all transfers, so a burst of transfers waits instead of hitting EMFILE.
+type fileLimiter struct {
+	slots chan struct{}
+}
+
+// openFiles is shared by every transfer in the process; nil means unlimited.
+var openFiles *fileLimiter
+
+func setMaxOpenFiles(n int) {
+	openFiles = nil
+	if n > 0 {
+		openFiles = &fileLimiter{slots: make(chan struct{}, n)}
+	}
+}
+
+func (l *fileLimiter) acquire() {
+	if l != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+func (l *fileLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// limitedFile holds an open-file slot until it is closed.
+type limitedFile struct {
+	*os.File
+	limiter *fileLimiter
+	once    sync.Once
+}
+
+func (f *limitedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.limiter.release)
+	return err
+}
+
+func limitFile(open func() (*os.File, error)) (*limitedFile, error) {
+	limiter := openFiles
+	limiter.acquire()
+	file, err := open()
+	if err != nil {
+		limiter.release()
+		return nil, err
+	}
+	return &limitedFile{File: file, limiter: limiter}, nil
+}
+
+// openFile is os.Open within the open-file budget.
+func openFile(name string) (*limitedFile, error) {
+	return limitFile(func() (*os.File, error) { return os.Open(name) })
+}
+
+// createFile is os.Create within the open-file budget.
+func createFile(name string) (*limitedFile, error) {
+	return limitFile(func() (*os.File, error) { return os.Create(name) })
+}
+
+// appendFile opens an existing file for writing at its end, within the
+// open-file budget. Unlike O_APPEND, it still allows WriteAt.
+func appendFile(name string) (*limitedFile, error) {
+	return limitFile(func() (*os.File, error) {
+		file, err := os.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	})
+}
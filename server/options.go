@@ -0,0 +1,80 @@
+package main
+
+// How a batch sends its files, as reported in EffectiveOptions
+const (
+	TransferModeFile    = "file"
+	TransferModeRanges  = "ranges" // parallel_chunks above 1
+	TransferModeArchive = "archive"
+	TransferModePull    = "pull"
+)
+
+// EffectiveOptions is how a batch is configured once its request, profile and
+// the server's defaults are merged, sent with its first event. Empty strings
+// mean the option is off.
+type EffectiveOptions struct {
+	Profile     string `json:"profile,omitempty"`
+	PeerAddress string `json:"peer_address"`
+	Transport   string `json:"transport"`
+	Mode        string `json:"mode"`
+
+	ChunkSize      int    `json:"chunk_size"` // of files sent; pulls arrive in the peer's
+	ParallelChunks int    `json:"parallel_chunks"`
+	Archive        string `json:"archive"`
+	VerifyPolicy   string `json:"verify_policy"`
+	OnConflict     string `json:"on_conflict"`
+	Sync           string `json:"sync"`
+	StorageClass   string `json:"storage_class"`
+	SpecialFiles   string `json:"special_files"`
+	PreserveMtimes bool   `json:"preserve_mtimes"`
+	IncludeHidden  bool   `json:"include_hidden"`
+	Stage          bool   `json:"stage"`
+	BatchChecksum  bool   `json:"batch_checksum"`
+	Diagnostics    bool   `json:"diagnostics"`
+	MinSize        int64  `json:"min_size"`
+	MaxSize        int64  `json:"max_size"` // 0 for no limit
+	MaxRetries     int    `json:"max_retries"`
+	RetryDelayMs   int64  `json:"retry_delay_ms"`
+}
+
+// effectiveOptions resolves the options of a validated request sent through
+// peerCfg.
+func effectiveOptions(peerCfg *Config, req *TransferRequest) *EffectiveOptions {
+	options := &EffectiveOptions{
+		Profile:        req.Profile,
+		PeerAddress:    peerCfg.PeerAddr,
+		Transport:      peerCfg.PeerTransport,
+		Mode:           TransferModeFile,
+		ChunkSize:      peerCfg.chunkSize(peerCfg.PeerAddr),
+		ParallelChunks: max(req.ParallelChunks, 1),
+		Archive:        req.Archive,
+		VerifyPolicy:   req.VerifyPolicy,
+		OnConflict:     req.OnConflict,
+		Sync:           req.Sync,
+		StorageClass:   req.StorageClass,
+		SpecialFiles:   req.SpecialFiles,
+		PreserveMtimes: req.PreserveMtimes,
+		IncludeHidden:  !bool(req.SkipHidden),
+		Stage:          req.Stage,
+		BatchChecksum:  req.BatchChecksum,
+		Diagnostics:    req.Diagnostics,
+		MinSize:        req.MinSize,
+		MaxSize:        req.MaxSize,
+		MaxRetries:     peerCfg.MaxRetries,
+		RetryDelayMs:   peerCfg.RetryDelay.Milliseconds(),
+	}
+	switch {
+	case req.Pull:
+		options.Mode = TransferModePull
+	case req.Archive != "":
+		options.Mode = TransferModeArchive
+	case req.ParallelChunks > 1:
+		options.Mode = TransferModeRanges
+	}
+	if options.OnConflict == "" {
+		options.OnConflict = OnConflictOverwrite
+	}
+	if options.StorageClass == "" {
+		options.StorageClass = StorageClassStandard
+	}
+	return options
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isPattern reports whether a source path should be expanded instead of used verbatim.
+func isPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[{")
+}
+
+// expandBraces expands shell-like {a,b} groups, including nested ones, into
+// separate patterns. A group without a top-level comma is kept literally.
+func expandBraces(pattern string) ([]string, error) {
+	start := -1
+	depth := 0
+	for i, c := range pattern {
+		switch c {
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("unbalanced '}' in pattern: %s", pattern)
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			alternatives := splitTopLevel(pattern[start+1 : i])
+			prefix, suffix := pattern[:start], pattern[i+1:]
+			if len(alternatives) < 2 {
+				// Not a brace group, keep the braces and expand the rest
+				rest, err := expandBraces(suffix)
+				if err != nil {
+					return nil, err
+				}
+				inner, err := expandBraces(pattern[start+1 : i])
+				if err != nil {
+					return nil, err
+				}
+				var result []string
+				for _, in := range inner {
+					for _, r := range rest {
+						result = append(result, prefix+"{"+in+"}"+r)
+					}
+				}
+				return result, nil
+			}
+
+			var result []string
+			for _, alt := range alternatives {
+				expanded, err := expandBraces(prefix + alt + suffix)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, expanded...)
+			}
+			return result, nil
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced '{' in pattern: %s", pattern)
+	}
+	return []string{pattern}, nil
+}
+
+// splitTopLevel splits s on commas that are not nested inside braces.
+func splitTopLevel(s string) []string {
+	var parts []string
+	depth, last := 0, 0
+	for i, c := range s {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[last:i])
+				last = i + 1
+			}
+		}
+	}
+	return append(parts, s[last:])
+}
+
+// expandSource resolves a source path or pattern into the list of regular files
+// it refers to, relative to rootDir and sorted. With skipHidden, matches are
+// dropped if a name below the pattern's static base starts with ".".
+func expandSource(rootDir, source string, skipHidden bool) ([]string, error) {
+	if !isPattern(source) {
+		return []string{source}, nil
+	}
+
+	patterns, err := expandBraces(source)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		// Validate each expanded pattern against the root directory
+		cleanPattern := filepath.Clean(pattern)
+		if strings.HasPrefix(cleanPattern, "..") || filepath.IsAbs(cleanPattern) {
+			return nil, fmt.Errorf("invalid source pattern: %s", pattern)
+		}
+
+		matches, err := filepath.Glob(filepath.Join(rootDir, cleanPattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid source pattern %s: %v", pattern, err)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			rel, err := filepath.Rel(rootDir, match)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve match %s: %v", match, err)
+			}
+			if skipHidden && hasHiddenPart(patternBase(cleanPattern), rel) {
+				continue
+			}
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match pattern: %s", source)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// filterBySize keeps the sources whose size is at least minSize and at most
+// maxSize bytes; a bound of 0 is unset.
+func filterBySize(rootDir string, sources []string, minSize, maxSize int64) ([]string, error) {
+	if minSize == 0 && maxSize == 0 {
+		return sources, nil
+	}
+	var files []string
+	for _, source := range sources {
+		info, err := os.Stat(filepath.Join(rootDir, filepath.Clean(source)))
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < minSize || maxSize > 0 && info.Size() > maxSize {
+			continue
+		}
+		files = append(files, source)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files within the size range: %s", formatSizeRange(minSize, maxSize))
+	}
+	return files, nil
+}
+
+func formatSizeRange(minSize, maxSize int64) string {
+	switch {
+	case maxSize == 0:
+		return fmt.Sprintf("at least %d bytes", minSize)
+	case minSize == 0:
+		return fmt.Sprintf("at most %d bytes", maxSize)
+	default:
+		return fmt.Sprintf("%d to %d bytes", minSize, maxSize)
+	}
+}
+
+// isHidden reports whether a file or directory name marks it as hidden.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// hasHiddenPart reports whether any name of path below base is hidden.
+func hasHiddenPart(base, path string) bool {
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return false
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if isHidden(part) {
+			return true
+		}
+	}
+	return false
+}
+
+// patternBase returns the leading directory of a pattern that contains no
+// pattern characters. Matched files keep their path relative to it.
+func patternBase(pattern string) string {
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	var static []string
+	for _, part := range parts[:len(parts)-1] {
+		if isPattern(part) {
+			break
+		}
+		static = append(static, part)
+	}
+	return filepath.Clean(filepath.Join(static...))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+)
+
+// What a plan does with a file
+const (
+	PlanTransfer = "transfer"
+	PlanSkip     = "skip"
+)
+
+type PlanEntry struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"` // why a file is skipped
+}
+
+type TransferPlan struct {
+	Files            []PlanEntry `json:"files"`
+	FilesToTransfer  int         `json:"files_to_transfer"`
+	FilesSkipped     int         `json:"files_skipped"`
+	BytesToTransfer  int64       `json:"bytes_to_transfer"`
+	BytesSkipped     int64       `json:"bytes_skipped"`
+	EstimatedSeconds float64     `json:"estimated_seconds,omitempty"` // at PLAN_LINK_SPEED, if set
+}
+
+func (p *TransferPlan) add(entry PlanEntry) {
+	p.Files = append(p.Files, entry)
+	if entry.Action == PlanSkip {
+		p.FilesSkipped++
+		p.BytesSkipped += entry.Size
+		return
+	}
+	p.FilesToTransfer++
+	p.BytesToTransfer += entry.Size
+}
+
+// planBatch works out what a /transfer request would do without sending
+// anything. For sync requests, existing holds what the peer reported for each
+// target, which is compared to the source as the peer would.
+func planBatch(cfg *Config, req *TransferRequest, sources, targets []string, existing []*pb.QueryResult, checksums *checksumCache) (*TransferPlan, error) {
+	plan := &TransferPlan{Files: []PlanEntry{}}
+	if req.Archive != "" {
+		for i, source := range sources {
+			if err := planArchive(plan, cfg.RootDir, source, targets[i], req, cfg.WalkConcurrency); err != nil {
+				return nil, err
+			}
+		}
+		return plan, nil
+	}
+
+	for i, source := range sources {
+		fullSourcePath := filepath.Join(cfg.RootDir, filepath.Clean(source))
+		info, err := os.Stat(fullSourcePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat source file: %v", err)
+		}
+		if info.IsDir() {
+			return nil, fmt.Errorf("source path is a directory; use archive to transfer it: %s", source)
+		}
+		entry := PlanEntry{Source: source, Target: targets[i], Size: info.Size(), Action: PlanTransfer}
+		if !info.Mode().IsRegular() {
+			entry.Size = 0 // streams until it ends
+		}
+
+		// Files of unknown size are always sent, as TransferFile does
+		if existing != nil && existing[i].Exists && info.Mode().IsRegular() {
+			target := existing[i]
+			metadata := &pb.TransferMetadata{
+				FileSize: info.Size(),
+				Sync:     req.Sync,
+				Mtime:    info.ModTime().UnixNano(),
+			}
+			if req.Sync == SyncChecksum && target.FileSize == info.Size() {
+				if metadata.Checksum, err = checksums.checksum(fullSourcePath); err != nil {
+					return nil, fmt.Errorf("failed to hash source file: %v", err)
+				}
+			}
+			upToDate := inSync(metadata, target.FileSize, time.Unix(0, target.Mtime), func() (string, error) {
+				return target.Checksum, nil
+			})
+			if upToDate {
+				entry.Action = PlanSkip
+				entry.Reason = "target has the same size and mtime"
+				if req.Sync == SyncChecksum {
+					entry.Reason = "target has the same size and content"
+				}
+			}
+		}
+		plan.add(entry)
+	}
+	return plan, nil
+}
+
+// planArchive adds the entries of a directory as writeTar would pack them.
+func planArchive(plan *TransferPlan, rootDir, source, target string, req *TransferRequest, walkers int) error {
+	sourceDir := filepath.Join(rootDir, filepath.Clean(source))
+	entries, err := walkTree(sourceDir, walkers, skipHiddenEntries(bool(req.SkipHidden)))
+	if err != nil {
+		return err
+	}
+	for _, file := range entries {
+		if file.d.IsDir() {
+			continue
+		}
+		info, err := file.d.Info()
+		if err != nil {
+			return err
+		}
+		entry := PlanEntry{
+			Source: filepath.Join(source, file.rel),
+			Target: filepath.Join(target, file.rel),
+			Size:   info.Size(),
+			Action: PlanTransfer,
+		}
+		if !info.Mode().IsRegular() {
+			entry.Size = 0
+			if info.Mode()&fs.ModeNamedPipe == 0 || req.SpecialFiles != SpecialFilesRecreate {
+				entry.Action = PlanSkip
+				entry.Reason = "special file"
+			}
+		}
+		plan.add(entry)
+	}
+	return nil
+}
+
+// handlePlan serves POST /plan, answering a /transfer request body with the
+// plan for it instead of running it.
+func handlePlan(cfg *Config, checksums *checksumCache, peers *peerRegistry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeTransferRequest(r, cfg.Profiles)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		errs := canonicalizeTarget(&req, cfg.Backslashes)
+		errs = append(errs, validateTransferRequest(&req, cfg.AllowedPeers)...)
+		if req.Pull {
+			errs = append(errs, FieldError{Field: "pull", Message: "cannot be planned, as the source is on the peer"})
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+
+		sources, targets, code, err := batchFiles(cfg, &req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid source: %v", err), code)
+			return
+		}
+		peerCfg := cfg.forRequest(&req, peers)
+		if peerCfg == nil {
+			writeValidationError(w, []FieldError{{Field: "peer", Message: "is not a discovered peer"}})
+			return
+		}
+
+		// Sync decisions need to know what the peer already has
+		var existing []*pb.QueryResult
+		if req.Sync != "" {
+			ctx := withCorrelationID(r.Context(), requestCorrelationID(r))
+			if existing, err = QueryPeer(ctx, peerCfg, targets, req.Sync == SyncChecksum); err != nil {
+				http.Error(w, fmt.Sprintf("failed to query peer: %v", err), httpStatusFromError(err))
+				return
+			}
+		}
+
+		plan, err := planBatch(cfg, &req, sources, targets, existing, checksums)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cfg.PlanLinkSpeed > 0 {
+			plan.EstimatedSeconds = float64(plan.BytesToTransfer) / float64(cfg.PlanLinkSpeed)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(plan)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// loadProfiles reads named transfer requests from a JSON file mapping each
+// name to the request fields it bundles, e.g.
+// {"nightly-logs": {"source": "logs/*.log", "target": "logs", "sync": "quick"}}.
+func loadProfiles(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles map[string]json.RawMessage
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+	// Catch misspelled options now rather than when the profile is used
+	for name, raw := range profiles {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		var req TransferRequest
+		if err := decoder.Decode(&req); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		if req.Profile != "" {
+			return nil, fmt.Errorf("profile %s: cannot refer to another profile", name)
+		}
+	}
+	return profiles, nil
+}
+
+// decodeTransferRequest reads a transfer request from the body of r. A request
+// naming a profile starts from the profile's fields; any it sets itself
+// replace them.
+func decodeTransferRequest(r *http.Request, profiles map[string]json.RawMessage) (TransferRequest, error) {
+	var req TransferRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, err
+	}
+	if req.Profile == "" {
+		return req, nil
+	}
+	profile, ok := profiles[req.Profile]
+	if !ok {
+		return req, fmt.Errorf("unknown profile: %s", req.Profile)
+	}
+	name := req.Profile
+	req = TransferRequest{}
+	if err := json.Unmarshal(profile, &req); err != nil {
+		return req, err
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, err
+	}
+	log.Printf("Using transfer profile: profile=%s", name)
+	return req, nil
+}
+
+// handleProfiles exports the configured profiles in the format PROFILES_FILE
+// is read in, so they can be copied to another server.
+func handleProfiles(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profiles := cfg.Profiles
+		if profiles == nil {
+			profiles = map[string]json.RawMessage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(profiles)
+	}
+}
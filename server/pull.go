@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Pull streams a directory under the root to the caller as an archive, or a
+// single file as is, followed by its byte count and checksum.
+func (s *FileTransferServer) Pull(req *pb.PullRequest, stream pb.FileTransfer_PullServer) error {
+	switch req.Archive {
+	case "", ArchiveTar, ArchiveTarZstd:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported archive format: %s", req.Archive)
+	}
+
+	log.Printf("Serving pull: correlationID=%s, path=%s", incomingCorrelationID(stream.Context()), req.FilePath)
+
+	sourcePath, err := s.resolvePath(req.FilePath)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(sourcePath)
+	if os.IsNotExist(err) {
+		return status.Errorf(codes.NotFound, "source not found: %s", req.FilePath)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to stat source: %v", err)
+	}
+	if req.Archive == "" && !fileInfo.Mode().IsRegular() {
+		return status.Errorf(codes.InvalidArgument, "source path is not a regular file: %s", req.FilePath)
+	}
+	if req.Archive != "" && !fileInfo.IsDir() {
+		return status.Errorf(codes.InvalidArgument, "source path is a file, not a directory: %s", req.FilePath)
+	}
+
+	// The checksum covers the tar bytes before compression
+	hasher := sha256.New()
+	var source io.Reader
+	if req.Archive == "" {
+		file, err := os.Open(sourcePath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to open source: %v", err)
+		}
+		defer file.Close()
+		source = io.TeeReader(file, hasher)
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeArchive(pw, sourcePath, req.Archive, req.SpecialFiles, req.SkipHidden, s.walkers, hasher))
+		}()
+		// Unblocks the tar writer if sending stops early
+		defer pr.Close()
+		source = pr
+	}
+
+	if s.fullChunks {
+		source = fullReader{source}
+	}
+	nextChunk, stopReading := chunkReader(source, ChunkSize, 0)
+	defer stopReading()
+	bytesSent := int64(0)
+	for {
+		data, readErr := nextChunk()
+		if readErr != nil && readErr != io.EOF {
+			return status.Errorf(codes.Internal, "failed to read source: %v", readErr)
+		}
+
+		if len(data) > 0 {
+			if err := stream.Send(&pb.PullResponse{
+				Payload: &pb.PullResponse_Chunk{
+					Chunk: &pb.FileChunk{Data: data},
+				},
+			}); err != nil {
+				return err
+			}
+			bytesSent += int64(len(data))
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	return stream.Send(&pb.PullResponse{
+		Payload: &pb.PullResponse_Complete{
+			Complete: &pb.TransferComplete{
+				BytesTransferred: bytesSent,
+				Checksum:         hex.EncodeToString(hasher.Sum(nil)),
+			},
+		},
+	})
+}
+
+// PullArchive fetches a directory from the peer as an archive stream and
+// unpacks it into targetPath through the local receiver, which validates
+// every entry before writing it.
+func PullArchive(ctx context.Context, cfg *Config, receiver *FileTransferServer, sourcePath, targetPath, archive string, preserveMtimes bool, specialFiles string, skipHidden bool, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	targetDir, err := receiver.resolvePath(receiver.normalizeName(targetPath))
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject pulls into a target that is currently being written
+	if !receiver.lockTarget(targetDir) {
+		return nil, status.Errorf(codes.Aborted, "target is being written by another transfer: %s", targetPath)
+	}
+	defer receiver.unlockTarget(targetDir)
+
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewFileTransferClient(conn).Pull(ctx, &pb.PullRequest{
+		FilePath:     sourcePath,
+		Archive:      archive,
+		SpecialFiles: specialFiles,
+		SkipHidden:   skipHidden,
+	})
+	if status.Code(err) == codes.Unavailable {
+		return nil, fmt.Errorf("peer unavailable: addr=%s: %w", cfg.PeerAddr, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pull stream: %w", err)
+	}
+
+	if err := receiver.checkMount(); err != nil {
+		return nil, err
+	}
+	if err := receiver.checkFreeInodes(); err != nil {
+		return nil, err
+	}
+	sink, err := receiver.newArchiveSink(targetDir, archive, preserveMtimes)
+	if err != nil {
+		return nil, err
+	}
+	return receivePull(stream, receiver, sink, progressChan)
+}
+
+// PullFile fetches a single file from the peer into targetPath, the way the
+// receiver writes a file sent to it, and gives it mtime (Unix nanoseconds)
+// if non-zero.
+func PullFile(ctx context.Context, cfg *Config, receiver *FileTransferServer, sourcePath, targetPath string, mtime int64, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	target, err := receiver.resolvePath(receiver.normalizeName(targetPath))
+	if err != nil {
+		return nil, err
+	}
+	if !receiver.lockTarget(target) {
+		return nil, status.Errorf(codes.Aborted, "target is being written by another transfer: %s", targetPath)
+	}
+	defer receiver.unlockTarget(target)
+
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewFileTransferClient(conn).Pull(ctx, &pb.PullRequest{FilePath: sourcePath})
+	if status.Code(err) == codes.Unavailable {
+		return nil, fmt.Errorf("peer unavailable: addr=%s: %w", cfg.PeerAddr, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pull stream: %w", err)
+	}
+
+	if err := receiver.checkMount(); err != nil {
+		return nil, err
+	}
+	if err := receiver.checkFreeInodes(); err != nil {
+		return nil, err
+	}
+	sink, err := receiver.newFileSink(receiver.fs, target, mtime)
+	if err != nil {
+		return nil, err
+	}
+	return receivePull(stream, receiver, sink, progressChan)
+}
+
+// receivePull writes what a pull stream sends into sink and commits it once
+// the byte count and checksum match, aborting it otherwise.
+func receivePull(stream pb.FileTransfer_PullClient, receiver *FileTransferServer, sink receiveSink, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	pullSuccess := false
+	defer func() {
+		if !pullSuccess {
+			sink.Abort()
+		}
+	}()
+
+	reportProgress(progressChan, TransferProgress{
+		Message:   "transfer started",
+		Timestamp: time.Now(),
+	})
+
+	bytesReceived := int64(0)
+	chunks := 0
+	lastProgressTime := time.Now()
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return nil, fmt.Errorf("peer closed pull stream before completion")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to receive archive: %w", err)
+		}
+
+		switch payload := resp.Payload.(type) {
+		case *pb.PullResponse_Chunk:
+			chunks++
+			if err := receiver.checkChunkCount(chunks); err != nil {
+				return nil, err
+			}
+			n, err := sink.Write(payload.Chunk.Data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to unpack archive: %v", err)
+			}
+			bytesReceived += int64(n)
+
+			if time.Since(lastProgressTime) >= ProgressInterval {
+				reportProgress(progressChan, TransferProgress{
+					BytesTransferred: bytesReceived,
+					Message:          fmt.Sprintf("receiving: %d bytes", bytesReceived),
+					Timestamp:        time.Now(),
+				})
+				lastProgressTime = time.Now()
+			}
+
+		case *pb.PullResponse_Complete:
+			if bytesReceived != payload.Complete.BytesTransferred {
+				return nil, status.Errorf(codes.DataLoss, "byte count mismatch: expected=%d, actual=%d", payload.Complete.BytesTransferred, bytesReceived)
+			}
+			if err := sink.Commit(payload.Complete.Checksum); err != nil {
+				return nil, err
+			}
+			pullSuccess = true
+
+			reportProgress(progressChan, TransferProgress{
+				BytesTransferred: bytesReceived,
+				BytesConfirmed:   bytesReceived,
+				Message:          "transfer completed",
+				Timestamp:        time.Now(),
+			})
+			return &TransferResult{
+				BytesTransferred: bytesReceived,
+				Checksum:         payload.Complete.Checksum,
+			}, nil
+
+		default:
+			return nil, fmt.Errorf("unexpected message from peer")
+		}
+	}
+}
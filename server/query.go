@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/status"
+)
+
+// QueryExisting answers each requested path with what the root holds there,
+// so a sender can plan a sync without a round trip per file. An invalid or
+// unreadable path is reported in its result and doesn't end the stream.
+func (s *FileTransferServer) QueryExisting(stream pb.FileTransfer_QueryExistingServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(s.queryPath(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FileTransferServer) queryPath(req *pb.QueryRequest) *pb.QueryResult {
+	result := &pb.QueryResult{FilePath: req.FilePath}
+	if isObjectPath(req.FilePath) {
+		result.Error = "object storage targets can't be queried"
+		return result
+	}
+	path, err := s.resolvePath(s.normalizeName(req.FilePath))
+	if err != nil {
+		result.Error = status.Convert(err).Message()
+		return result
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if !info.Mode().IsRegular() {
+		return result
+	}
+	result.Exists = true
+	result.FileSize = info.Size()
+	result.Mtime = info.ModTime().UnixNano()
+	if req.Checksum {
+		if result.Checksum, err = hashFile(path); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+// QueryPeer asks the peer which of paths it already has, in the order given.
+func QueryPeer(ctx context.Context, cfg *Config, paths []string, checksum bool) ([]*pb.QueryResult, error) {
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := pb.NewFileTransferClient(conn).QueryExisting(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create query stream: %w", err)
+	}
+
+	// Send every path up front; results are read as the peer answers
+	go func() {
+		for _, path := range paths {
+			if err := stream.Send(&pb.QueryRequest{FilePath: path, Checksum: checksum}); err != nil {
+				return
+			}
+		}
+		_ = stream.CloseSend()
+	}()
+
+	results := make([]*pb.QueryResult, 0, len(paths))
+	for range paths {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			return nil, fmt.Errorf("peer closed query stream after %d of %d paths", len(results), len(paths))
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+type QueryRequest struct {
+	Paths    []string `json:"paths"`
+	Checksum bool     `json:"checksum,omitempty"`
+}
+
+type QueryEntry struct {
+	Path     string `json:"path"`
+	Exists   bool   `json:"exists"`
+	Size     int64  `json:"size,omitempty"`
+	Mtime    int64  `json:"mtime,omitempty"` // Unix nanoseconds
+	Checksum string `json:"checksum,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type QueryResponse struct {
+	Files []QueryEntry `json:"files"`
+}
+
+// handleQuery serves POST /query, reporting which paths the peer already has.
+func handleQuery(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req QueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(req.Paths) == 0 {
+			writeValidationError(w, []FieldError{{Field: "paths", Message: "is required"}})
+			return
+		}
+
+		results, err := QueryPeer(withCorrelationID(r.Context(), requestCorrelationID(r)), cfg, req.Paths, req.Checksum)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusFromError(err))
+			return
+		}
+
+		resp := QueryResponse{Files: make([]QueryEntry, len(results))}
+		for i, result := range results {
+			resp.Files[i] = QueryEntry{
+				Path:     result.FilePath,
+				Exists:   result.Exists,
+				Size:     result.FileSize,
+				Mtime:    result.Mtime,
+				Checksum: result.Checksum,
+				Error:    result.Error,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MaxParallelChunks caps the number of concurrent streams for one file.
+const MaxParallelChunks = 64
+
+// rangedFileIdle is how long a ranged file waits for its missing ranges while
+// none is streaming. After that it is abandoned, as the sender may have
+// given up on them, so it doesn't hold its target's lock for good.
+const rangedFileIdle = 2 * time.Minute
+
+// rangedFile is a file the receiver assembles from concurrent range streams.
+// It is moved into place once every range has been committed, or removed once
+// a range has failed and the others have finished, or after rangedFileIdle
+// without a range streaming.
+type rangedFile struct {
+	targetPath string
+	tempPath   string
+	file       File
+	totalSize  int64
+	ranges     int32
+
+	// Guarded by FileTransferServer.mu
+	active    int
+	committed int32
+	failed    bool
+	idleSince time.Time // when active last dropped to 0
+}
+
+// newRangeSink joins a range stream to its file, creating the file and taking
+// the target lock for the first range to arrive.
+func (s *FileTransferServer) newRangeSink(targetPath string, metadata *pb.TransferMetadata) (*rangeSink, error) {
+	if metadata.RangeId == "" || metadata.RangeCount < 1 || metadata.RangeOffset < 0 || metadata.FileSize < 0 ||
+		metadata.RangeOffset+metadata.FileSize > metadata.TotalSize {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid range: count=%d, offset=%d, size=%d, total=%d", metadata.RangeCount, metadata.RangeOffset, metadata.FileSize, metadata.TotalSize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepRangedFiles(time.Now())
+
+	rf := s.rangedFiles[metadata.RangeId]
+	if rf == nil {
+		if s.activeTargets[targetPath] {
+			return nil, status.Errorf(codes.Aborted, "target is being written by another transfer: %s", metadata.FilePath)
+		}
+		if err := s.fs.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return nil, s.storageError(err, "create directory")
+		}
+		if err := s.checkTargetDir(filepath.Dir(targetPath)); err != nil {
+			return nil, err
+		}
+		if err := s.checkCaseCollision(targetPath); err != nil {
+			return nil, err
+		}
+		tempPath := s.tempPath(targetPath)
+		file, err := s.fs.Create(tempPath)
+		if err != nil {
+			return nil, s.storageError(err, "create file")
+		}
+		rf = &rangedFile{
+			targetPath: targetPath,
+			tempPath:   tempPath,
+			file:       file,
+			totalSize:  metadata.TotalSize,
+			ranges:     metadata.RangeCount,
+		}
+		s.activeTargets[targetPath] = true
+		s.rangedFiles[metadata.RangeId] = rf
+	} else if rf.targetPath != targetPath || rf.totalSize != metadata.TotalSize || rf.ranges != metadata.RangeCount {
+		return nil, status.Errorf(codes.InvalidArgument, "range does not match its file: %s", metadata.FilePath)
+	} else if rf.failed {
+		return nil, status.Errorf(codes.Aborted, "another range of the file failed: %s", metadata.FilePath)
+	}
+	rf.active++
+
+	return &rangeSink{
+		server:  s,
+		rf:      rf,
+		rangeID: metadata.RangeId,
+		out:     s.coalesce(io.NewOffsetWriter(rf.file, metadata.RangeOffset)),
+		hasher:  sha256.New(),
+	}, nil
+}
+
+// rangeSink writes one range of a rangedFile at its offset.
+type rangeSink struct {
+	server   *FileTransferServer
+	rf       *rangedFile
+	rangeID  string
+	out      flushWriter
+	written  int64
+	hasher   hash.Hash
+	finished bool
+}
+
+func (r *rangeSink) Write(p []byte) (int, error) {
+	n, err := r.out.Write(p)
+	r.written += int64(n)
+	r.hasher.Write(p[:n])
+	return n, err
+}
+
+// Commit verifies the range against the sender's checksum; the last range to
+// commit moves the assembled file into place.
+func (r *rangeSink) Commit(checksum string) error {
+	if err := verifyChecksum(checksum, r.hasher); err != nil {
+		return err
+	}
+	if err := r.out.Flush(); err != nil {
+		return r.server.storageError(err, "write to file")
+	}
+	return r.finish(true)
+}
+
+func (r *rangeSink) Abort() {
+	r.finish(false)
+}
+
+func (r *rangeSink) finish(ok bool) error {
+	if r.finished {
+		return nil
+	}
+	r.finished = true
+
+	s, rf := r.server, r.rf
+	s.mu.Lock()
+	rf.active--
+	if ok {
+		rf.committed++
+	} else {
+		rf.failed = true
+	}
+	complete := rf.committed == rf.ranges
+	abandoned := rf.failed && rf.active == 0
+	if complete || abandoned {
+		delete(s.rangedFiles, r.rangeID)
+	} else if rf.active == 0 {
+		rf.idleSince = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !complete && !abandoned {
+		return nil
+	}
+	defer s.unlockTarget(rf.targetPath)
+
+	if abandoned {
+		rf.file.Close()
+		s.fs.Remove(rf.tempPath)
+		return nil
+	}
+	if err := s.syncFile(rf.file); err != nil {
+		rf.file.Close()
+		s.fs.Remove(rf.tempPath)
+		return s.storageError(err, "sync file")
+	}
+	if err := rf.file.Close(); err != nil {
+		s.fs.Remove(rf.tempPath)
+		return s.storageError(err, "close file")
+	}
+	if err := s.checkFile(rf.tempPath, rf.targetPath); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(rf.tempPath, rf.targetPath); err != nil {
+		s.fs.Remove(rf.tempPath)
+		return s.storageError(err, "rename file")
+	}
+	s.finalize(rf.targetPath)
+	if s.manifest {
+		// Ranges are checked separately, so the whole file is hashed once assembled
+		checksum, err := hashStored(s.fs, rf.targetPath)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to hash file: %v", err)
+		}
+		return s.writeManifest(rf.targetPath, checksum)
+	}
+	return nil
+}
+
+// sweepRangedFiles abandons the ranged files that have gone rangedFileIdle
+// without a range streaming, releasing their targets. It must be called with
+// s.mu held.
+func (s *FileTransferServer) sweepRangedFiles(now time.Time) {
+	for rangeID, rf := range s.rangedFiles {
+		if rf.active > 0 || now.Sub(rf.idleSince) < rangedFileIdle {
+			continue
+		}
+		log.Printf("Abandoning incomplete ranged file: path=%s, committed=%d, ranges=%d", rf.targetPath, rf.committed, rf.ranges)
+		delete(s.rangedFiles, rangeID)
+		delete(s.activeTargets, rf.targetPath)
+		rf.file.Close()
+		s.fs.Remove(rf.tempPath)
+	}
+}
+
+// countingReader adds the number of bytes read to a counter shared by several readers.
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// TransferFileRanges splits a file into up to parts ranges and sends each over
+// its own connection, so a single large file can use more than one stream.
+// The peer writes every range at its offset and moves the file into place
+// once all of them have arrived.
+func TransferFileRanges(ctx context.Context, session *peerSession, sourcePath, targetPath, rootDir string, parts int, progressChan chan<- TransferProgress) (*TransferResult, error) {
+	// Validate source path
+	cleanSourcePath := filepath.Clean(sourcePath)
+	if strings.HasPrefix(cleanSourcePath, "..") || filepath.IsAbs(cleanSourcePath) {
+		return nil, fmt.Errorf("invalid source path: %s", sourcePath)
+	}
+
+	fullSourcePath := filepath.Join(rootDir, cleanSourcePath)
+
+	fileInfo, err := os.Stat(fullSourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat source file: %v", err)
+	}
+	if fileInfo.IsDir() {
+		return nil, fmt.Errorf("source path is a directory, not a file")
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("parallel chunks need a regular file of known size")
+	}
+
+	// Ranges read through one handle with ReadAt
+	file, err := openFile(fullSourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source file: %v", err)
+	}
+	defer file.Close()
+
+	size := fileInfo.Size()
+	ranges := max(min(int64(parts), size), 1)
+	rangeSize := (size + ranges - 1) / ranges
+	rangeID := newID()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Per-range progress is replaced by the combined byte count
+	var bytesSent atomic.Int64
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	for i := range ranges {
+		offset := i * rangeSize
+		length := max(min(rangeSize, size-offset), 0)
+		rangeSession := session.fork()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer rangeSession.Close()
+			_, err := rangeSession.send(ctx, &pb.TransferMetadata{
+				FilePath:    targetPath,
+				FileSize:    length,
+				RangeId:     rangeID,
+				RangeCount:  int32(ranges),
+				RangeOffset: offset,
+				TotalSize:   size,
+			}, &countingReader{
+				reader: io.NewSectionReader(file, offset, length),
+				count:  &bytesSent,
+			}, nil, nil)
+			if err != nil {
+				// Stop the other ranges, so the peer discards the file
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("range at offset %d failed: %w", offset, err)
+					cancel()
+				})
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(ProgressInterval)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ticker.C:
+			sent := bytesSent.Load()
+			reportProgress(progressChan, TransferProgress{
+				BytesTransferred: sent,
+				TotalBytes:       size,
+				Message:          fmt.Sprintf("sending: %.2f%%", float64(sent)/float64(max(size, 1))*100),
+				Timestamp:        time.Now(),
+			})
+		case <-done:
+			waiting = false
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if session.recheckSource {
+		if err := checkUnmodified(fullSourcePath, fileInfo); err != nil {
+			return nil, err
+		}
+	}
+
+	reportProgress(progressChan, TransferProgress{
+		BytesTransferred: size,
+		BytesConfirmed:   size,
+		TotalBytes:       size,
+		Message:          "transfer completed",
+		Timestamp:        time.Now(),
+	})
+	return &TransferResult{BytesTransferred: size}, nil
+}
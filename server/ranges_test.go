@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIdleRangedFileReleasesTarget(t *testing.T) {
+	receiver, memory, root := newMemReceiver(t)
+	target := filepath.Join(root, "ranged.bin")
+
+	// The first of two ranges commits, and the second never arrives
+	sink, err := receiver.newRangeSink(target, &pb.TransferMetadata{
+		FilePath: "ranged.bin", FileSize: 4, TotalSize: 8, RangeId: "r1", RangeCount: 2,
+	})
+	if err != nil {
+		t.Fatalf("newRangeSink: %v", err)
+	}
+	if _, err := sink.Write([]byte("abcd")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := sink.Commit(""); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if receiver.lockTarget(target) {
+		t.Fatal("target was free while the file waited for its other range")
+	}
+
+	receiver.rangedFiles["r1"].idleSince = time.Now().Add(-rangedFileIdle)
+	if !receiver.lockTarget(target) {
+		t.Fatal("target stayed locked after the ranged file went idle")
+	}
+	if len(receiver.rangedFiles) != 0 {
+		t.Errorf("%d ranged files left after the sweep", len(receiver.rangedFiles))
+	}
+	if len(memory.files) != 0 {
+		t.Errorf("memory holds %d files, want the temp file removed", len(memory.files))
+	}
+}
+
+func TestRangeSinkRejectsZeroRanges(t *testing.T) {
+	receiver, memory, root := newMemReceiver(t)
+
+	_, err := receiver.newRangeSink(filepath.Join(root, "ranged.bin"), &pb.TransferMetadata{
+		FilePath: "ranged.bin", FileSize: 4, TotalSize: 4, RangeId: "r1", RangeCount: 0,
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("newRangeSink with no ranges = %v, want InvalidArgument", err)
+	}
+	if len(receiver.rangedFiles) != 0 || len(memory.files) != 0 {
+		t.Errorf("a rejected range left %d ranged files and %d files", len(receiver.rangedFiles), len(memory.files))
+	}
+}
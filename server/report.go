@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	FileStatusCompleted = "completed"
+	FileStatusFailed    = "failed"
+	FileStatusSkipped   = "skipped"
+	FileStatusUnchanged = "unchanged" // already up to date on the peer
+	FileStatusBusy      = "busy"      // open for writing by another process, see SKIP_OPEN_FILES
+	FileStatusKept      = "kept"      // existing target kept by a conflict decision, see OnConflictAsk
+)
+
+type FileReport struct {
+	Source           string `json:"source"`
+	Target           string `json:"target"`
+	Status           string `json:"status"`
+	BytesTransferred int64  `json:"bytes_transferred"`
+	Checksum         string `json:"checksum,omitempty"`
+	DurationMs       int64  `json:"duration_ms"`
+	Error            string `json:"error,omitempty"`
+	Mapped           bool   `json:"mapped,omitempty"` // read through mmap
+
+	Diagnostics *ChunkDiagnostics `json:"diagnostics,omitempty"`
+}
+
+type BatchReport struct {
+	BatchID          string       `json:"batch_id"`
+	Status           string       `json:"status"`
+	StartedAt        string       `json:"started_at"`
+	CompletedAt      string       `json:"completed_at"`
+	DurationMs       int64        `json:"duration_ms"`
+	TotalFiles       int          `json:"total_files"`
+	CompletedFiles   int          `json:"completed_files"`
+	FailedFiles      int          `json:"failed_files"`
+	SkippedFiles     int          `json:"skipped_files"`
+	UnchangedFiles   int          `json:"unchanged_files"`
+	BusyFiles        int          `json:"busy_files"`
+	KeptFiles        int          `json:"kept_files"`
+	BytesTransferred int64        `json:"bytes_transferred"`
+	Files            []FileReport `json:"files"`
+	CorrelationID    string       `json:"correlation_id,omitempty"`
+
+	// With batch_checksum: the checksum over the files sent and the one the
+	// peer computed over what it stored
+	BatchChecksum     string `json:"batch_checksum,omitempty"`
+	PeerBatchChecksum string `json:"peer_batch_checksum,omitempty"`
+
+	startedAt time.Time
+}
+
+func newBatchReport(batchID string, sources, targets []string) *BatchReport {
+	report := &BatchReport{
+		BatchID:    batchID,
+		TotalFiles: len(sources),
+		Files:      make([]FileReport, len(sources)),
+		startedAt:  time.Now(),
+	}
+	// Files stay skipped unless the batch reaches them
+	for i, source := range sources {
+		report.Files[i] = FileReport{
+			Source: source,
+			Target: targets[i],
+			Status: FileStatusSkipped,
+		}
+	}
+	return report
+}
+
+func (r *BatchReport) record(i int, result *TransferResult, err error, duration time.Duration) {
+	file := &r.Files[i]
+	file.DurationMs = duration.Milliseconds()
+	if err != nil {
+		file.Status = FileStatusFailed
+		file.Error = err.Error()
+		return
+	}
+	file.Status = FileStatusCompleted
+	if result.Unchanged {
+		file.Status = FileStatusUnchanged
+	}
+	file.BytesTransferred = result.BytesTransferred
+	file.Checksum = result.Checksum
+	file.Diagnostics = result.Diagnostics
+	file.Mapped = result.Mapped
+}
+
+// warnIfSlow logs a completed file whose average speed or duration crossed
+// the configured thresholds.
+func warnIfSlow(cfg *Config, correlationID string, file FileReport) {
+	duration := time.Duration(file.DurationMs) * time.Millisecond
+	speed := float64(file.BytesTransferred) / max(duration.Seconds(), 0.001)
+
+	tooSlow := cfg.SlowTransferSpeed > 0 && speed < float64(cfg.SlowTransferSpeed)
+	tooLong := cfg.SlowTransferDuration > 0 && duration > cfg.SlowTransferDuration
+	if tooSlow || tooLong {
+		log.Printf("Warning: slow transfer: correlationID=%s, source=%s, target=%s, bytes=%d, duration=%v, speed=%.0fB/s",
+			correlationID, file.Source, file.Target, file.BytesTransferred, duration, speed)
+	}
+}
+
+func (r *BatchReport) finish() {
+	completedAt := time.Now()
+	r.StartedAt = r.startedAt.Format(time.RFC3339)
+	r.CompletedAt = completedAt.Format(time.RFC3339)
+	r.DurationMs = completedAt.Sub(r.startedAt).Milliseconds()
+
+	for _, file := range r.Files {
+		switch file.Status {
+		case FileStatusCompleted:
+			r.CompletedFiles++
+		case FileStatusFailed:
+			r.FailedFiles++
+		case FileStatusSkipped:
+			r.SkippedFiles++
+		case FileStatusUnchanged:
+			r.UnchangedFiles++
+		case FileStatusBusy:
+			r.BusyFiles++
+		case FileStatusKept:
+			r.KeptFiles++
+		}
+		r.BytesTransferred += file.BytesTransferred
+	}
+
+	r.Status = FileStatusCompleted
+	if r.CompletedFiles+r.UnchangedFiles+r.BusyFiles+r.KeptFiles != r.TotalFiles || r.BatchChecksum != r.PeerBatchChecksum {
+		r.Status = FileStatusFailed
+	}
+}
+
+// writeReport stores the report as <dir>/<batch_id>.json, replacing it atomically.
+func writeReport(dir string, report *BatchReport) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %v", err)
+	}
+
+	path := filepath.Join(dir, report.BatchID+".json")
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	return nil
+}
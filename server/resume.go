@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ResumeDirName is the directory under the receiver's root where files cut
+// off mid-transfer are kept, as <ResumeDirName>/<fingerprint>.part.
+const ResumeDirName = ".resume"
+
+// FingerprintBlock is how much of each end of a file its fingerprint covers.
+const FingerprintBlock = 64 * 1024
+
+var validFingerprint = regexp.MustCompile(`^[0-9]+-[0-9a-f]{64}$`)
+
+// fingerprint identifies a file's content without reading all of it, as its
+// size and the SHA-256 of its first and last blocks. A renamed file keeps its
+// fingerprint, so its transfer can resume what an earlier one left behind.
+func fingerprint(file io.ReaderAt, size int64) (string, error) {
+	hasher := sha256.New()
+	head := io.NewSectionReader(file, 0, min(size, FingerprintBlock))
+	tail := io.NewSectionReader(file, max(size-FingerprintBlock, 0), min(size, FingerprintBlock))
+	if _, err := io.Copy(hasher, io.MultiReader(head, tail)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%s", size, hex.EncodeToString(hasher.Sum(nil))), nil
+}
+
+// resumePath returns where a partial file with the given fingerprint is kept.
+func (s *FileTransferServer) resumePath(fingerprint string) (string, error) {
+	if !validFingerprint.MatchString(fingerprint) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid fingerprint: %s", fingerprint)
+	}
+	return filepath.Join(s.rootDir, ResumeDirName, fingerprint+s.tempSuffix), nil
+}
+
+// resumeSink continues sink from a partial file kept for the same content,
+// if there is one. It returns where to keep the file should this transfer be
+// cut off too, or "" if it can't be resumed, and how many bytes are already
+// there.
+func (s *FileTransferServer) resumeSink(sink receiveSink, metadata *pb.TransferMetadata) (string, int64, error) {
+	file, ok := sink.(*fileSink)
+	if !s.resume || !ok || file.fs != s.fs || metadata.Fingerprint == "" || metadata.FileSize == UnknownSize {
+		return "", 0, nil
+	}
+	path, err := s.resumePath(metadata.Fingerprint)
+	if err != nil {
+		return "", 0, err
+	}
+	offset, err := file.resume(path, metadata.FileSize)
+	if err != nil {
+		return "", 0, err
+	}
+	if offset > 0 {
+		log.Printf("Resuming transfer: path=%s, fingerprint=%s, offset=%d", metadata.FilePath, metadata.Fingerprint, offset)
+	}
+	return path, offset, nil
+}
+
+// resume moves the partial file at path in place of the empty temp file and
+// continues writing after it. It returns the bytes already there, or 0 if
+// there is no partial file that fits.
+func (f *fileSink) resume(path string, size int64) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > size {
+		return 0, nil
+	}
+	// Claims the partial file, so only one transfer resumes it
+	if err := f.fs.Rename(path, f.tempPath); err != nil {
+		return 0, nil
+	}
+	f.file.Close()
+	file, err := f.fs.Append(f.tempPath)
+	if err != nil {
+		return 0, f.server.storageError(err, "open partial file")
+	}
+	f.file, f.out = file, f.server.coalesce(file)
+
+	// The checksum covers the whole file, including what was kept
+	stored, err := f.fs.Open(f.tempPath)
+	if err != nil {
+		return 0, f.server.storageError(err, "read partial file")
+	}
+	defer stored.Close()
+	if _, err := io.Copy(f.hasher, stored); err != nil {
+		return 0, f.server.storageError(err, "read partial file")
+	}
+	return info.Size(), nil
+}
+
+// suspend keeps what was written so far at path instead of discarding it,
+// and reports whether it did.
+func (f *fileSink) suspend(path string) bool {
+	if err := f.out.Flush(); err != nil {
+		return false
+	}
+	if err := f.file.Close(); err != nil {
+		return false
+	}
+	info, err := os.Stat(f.tempPath)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	if err := f.fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false
+	}
+	if err := f.fs.Rename(f.tempPath, path); err != nil {
+		log.Printf("Warning: failed to keep partial file: path=%s, err=%v", f.targetPath, err)
+		return false
+	}
+	log.Printf("Kept partial file to resume: path=%s, bytes=%d", f.targetPath, info.Size())
+	return true
+}
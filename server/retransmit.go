@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkRetrier checks each received chunk against its checksum and asks the
+// sender to retransmit a corrupted one, holding back the chunks after it until
+// it arrives, so data is still written in order. A nil retrier is inactive.
+type chunkRetrier struct {
+	stream  pb.FileTransfer_TransferServer
+	limit   int              // retransmits per chunk
+	next    int64            // index of the next chunk to write
+	held    map[int64][]byte // verified chunks waiting for an earlier one
+	retries map[int64]int    // retransmits requested for chunks still missing
+}
+
+func newChunkRetrier(stream pb.FileTransfer_TransferServer, limit int) *chunkRetrier {
+	return &chunkRetrier{
+		stream:  stream,
+		limit:   limit,
+		held:    make(map[int64][]byte),
+		retries: make(map[int64]int),
+	}
+}
+
+// waiting reports whether a retransmitted chunk is still expected.
+func (r *chunkRetrier) waiting() bool {
+	return r != nil && len(r.retries) > 0
+}
+
+// accept returns the chunks that can be written now, in order.
+func (r *chunkRetrier) accept(chunk *pb.FileChunk) ([][]byte, error) {
+	if chunk.Index < r.next {
+		return nil, nil // already written
+	}
+	sum := sha256.Sum256(chunk.Data)
+	if hex.EncodeToString(sum[:]) != chunk.Checksum {
+		retries := r.retries[chunk.Index] + 1
+		if retries > r.limit {
+			return nil, status.Errorf(codes.DataLoss, "chunk %d failed its checksum after %d retransmits", chunk.Index, r.limit)
+		}
+		r.retries[chunk.Index] = retries
+		log.Printf("Warning: chunk failed its checksum, requesting retransmit: index=%d, retry=%d/%d", chunk.Index, retries, r.limit)
+		return nil, r.stream.Send(&pb.TransferResponse{
+			Retransmit: &pb.RetransmitChunk{Index: chunk.Index},
+		})
+	}
+	delete(r.retries, chunk.Index)
+
+	if chunk.Index > r.next {
+		r.held[chunk.Index] = chunk.Data
+		return nil, nil
+	}
+	ready := [][]byte{chunk.Data}
+	for r.next++; ; r.next++ {
+		data, ok := r.held[r.next]
+		if !ok {
+			break
+		}
+		ready = append(ready, data)
+		delete(r.held, r.next)
+	}
+	// Lets the sender drop the chunks it kept for retransmission
+	return ready, r.stream.Send(&pb.TransferResponse{ChunksVerified: r.next})
+}
+
+// chunkResender sends chunks with their checksums and keeps each one until
+// the peer has verified it, resending those the peer asks for again. The
+// peer's responses are read in the background until the final one.
+type chunkResender struct {
+	stream  pb.FileTransfer_TransferClient
+	next    int64            // index of the next new chunk
+	sent    map[int64][]byte // chunks the peer hasn't verified yet
+	replies chan peerReply
+}
+
+type peerReply struct {
+	resp *pb.TransferResponse
+	err  error
+}
+
+func newChunkResender(stream pb.FileTransfer_TransferClient) *chunkResender {
+	r := &chunkResender{
+		stream:  stream,
+		sent:    make(map[int64][]byte),
+		replies: make(chan peerReply, 16),
+	}
+	go func() {
+		defer close(r.replies)
+		for {
+			resp, err := stream.Recv()
+			select {
+			case r.replies <- peerReply{resp: resp, err: err}:
+			case <-stream.Context().Done():
+				return
+			}
+			if err != nil || (resp.Retransmit == nil && resp.ChunksVerified == 0) {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// send sends the next chunk, first handling any responses already received.
+// data is copied, as chunk buffers are reused once Send returns.
+func (r *chunkResender) send(data []byte) error {
+	for len(r.replies) > 0 {
+		resp, err := r.handle(<-r.replies)
+		if err != nil {
+			return err
+		}
+		if resp != nil {
+			return fmt.Errorf("unexpected response from peer: %s", resp.Message)
+		}
+	}
+
+	index := r.next
+	r.next++
+	r.sent[index] = bytes.Clone(data)
+	return r.sendChunk(index, r.sent[index])
+}
+
+func (r *chunkResender) sendChunk(index int64, data []byte) error {
+	sum := sha256.Sum256(data)
+	return r.stream.Send(&pb.TransferRequest{
+		Payload: &pb.TransferRequest_Chunk{
+			Chunk: &pb.FileChunk{
+				Data:     data,
+				Index:    index,
+				Checksum: hex.EncodeToString(sum[:]),
+			},
+		},
+	})
+}
+
+// handle acts on one response from the peer and returns it if it is the final one.
+func (r *chunkResender) handle(reply peerReply) (*pb.TransferResponse, error) {
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	resp := reply.resp
+	if resp == nil {
+		return nil, io.ErrUnexpectedEOF // replies closed
+	}
+	switch {
+	case resp.Retransmit != nil:
+		index := resp.Retransmit.Index
+		data, ok := r.sent[index]
+		if !ok {
+			return nil, fmt.Errorf("peer asked to retransmit chunk %d, which is not held", index)
+		}
+		log.Printf("Retransmitting chunk: index=%d", index)
+		if err := r.sendChunk(index, data); err != nil {
+			return nil, fmt.Errorf("failed to retransmit chunk: %w", r.sendError(err))
+		}
+		return nil, nil
+	case resp.ChunksVerified > 0:
+		for index := range r.sent {
+			if index < resp.ChunksVerified {
+				delete(r.sent, index)
+			}
+		}
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// result waits for the peer's final response, resending chunks until then.
+func (r *chunkResender) result() (*pb.TransferResponse, error) {
+	for {
+		resp, err := r.handle(<-r.replies)
+		if err != nil || resp != nil {
+			return resp, err
+		}
+	}
+}
+
+// sendError is sendError for a stream whose responses are read in the
+// background: the status the peer ended the stream with arrives as a reply.
+func (r *chunkResender) sendError(err error) error {
+	if err != io.EOF {
+		return err
+	}
+	for reply := range r.replies {
+		if reply.err != nil {
+			if reply.err != io.EOF {
+				return reply.err
+			}
+			return err
+		}
+	}
+	return err
+}
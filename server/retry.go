@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetriesExhausted is the code of a transfer that failed on every attempt
+// MAX_RETRIES allowed.
+const RetriesExhausted = "retries_exhausted"
+
+// Categories of errors a transfer is retried after
+const (
+	RetryUnavailable   = "unavailable"    // the peer couldn't be reached
+	RetrySourceChanged = "source_changed" // the source changed size while it was read
+)
+
+// RetriesExhaustedError is the final error of a transfer that still failed
+// after its last retry. Its gRPC status keeps the last attempt's code and
+// adds the details as an ErrorInfo.
+type RetriesExhaustedError struct {
+	Attempts int
+	Category string // of the last error, see RetryUnavailable
+	PeerAddr string
+	Err      error // the last attempt's
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("%v (gave up after %d attempts)", e.Err, e.Attempts)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RetriesExhaustedError) GRPCStatus() *status.Status {
+	code := status.Code(e.Err)
+	st, err := status.New(code, e.Error()).WithDetails(&errdetails.ErrorInfo{
+		Reason: RetriesExhausted,
+		Domain: errorInfoDomain,
+		Metadata: map[string]string{
+			"attempts":     strconv.Itoa(e.Attempts),
+			"category":     e.Category,
+			"peer_address": e.PeerAddr,
+		},
+	})
+	if err != nil {
+		return status.New(code, e.Error())
+	}
+	return st
+}
+
+// RetryFailure is how a RetriesExhaustedError is reported in the NDJSON
+// error event.
+type RetryFailure struct {
+	Attempts    int    `json:"attempts"`
+	Category    string `json:"category"`
+	PeerAddress string `json:"peer_address"`
+}
+
+// retryFailure returns the details of err if it ended a transfer's retries.
+func retryFailure(err error) *RetryFailure {
+	var exhausted *RetriesExhaustedError
+	if !errors.As(err, &exhausted) {
+		return nil
+	}
+	return &RetryFailure{Attempts: exhausted.Attempts, Category: exhausted.Category, PeerAddress: exhausted.PeerAddr}
+}
+
+// retryCategory returns the category of a failed transfer that may succeed
+// if attempted again, or "" if it isn't retryable.
+func retryCategory(err error) string {
+	// A fresh attempt re-reads the file at its new size
+	if errors.Is(err, ErrSourceChanged) {
+		return RetrySourceChanged
+	}
+	switch status.Code(err) {
+	case codes.Unavailable:
+		return RetryUnavailable
+	}
+	return ""
+}
+
+// transferWithRetry runs transfer, retrying transient failures up to
+// cfg.MaxRetries times and reporting each retry on progressChan. Once the
+// retries are used up the last error is returned as a RetriesExhaustedError.
+func transferWithRetry(ctx context.Context, cfg *Config, progressChan chan<- TransferProgress, transfer func() (*TransferResult, error)) (*TransferResult, error) {
+	delay := cfg.RetryDelay
+	for attempt := 1; ; attempt++ {
+		result, err := transfer()
+		if err == nil || retryCategory(err) == "" || ctx.Err() != nil {
+			return result, err
+		}
+		if attempt > cfg.MaxRetries {
+			if cfg.MaxRetries > 0 {
+				err = &RetriesExhaustedError{Attempts: attempt, Category: retryCategory(err), PeerAddr: cfg.PeerAddr, Err: err}
+			}
+			return result, err
+		}
+
+		progressChan <- TransferProgress{
+			Message:   fmt.Sprintf("retrying transfer (attempt %d of %d)", attempt+1, cfg.MaxRetries+1),
+			Timestamp: time.Now(),
+			Type:      "retry",
+			Attempt:   attempt + 1,
+			Reason:    err.Error(),
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
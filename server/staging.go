@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StagingDirName is the directory under the receiver's root where staged
+// batches wait for promotion, as <StagingDirName>/<batch_id>/<target>.
+const StagingDirName = ".staging"
+
+func (s *FileTransferServer) stagingDir(batchID string) (string, error) {
+	if !validCorrelationID.MatchString(batchID) || strings.HasPrefix(batchID, ".") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid batch id: %s", batchID)
+	}
+	return filepath.Join(s.rootDir, StagingDirName, batchID), nil
+}
+
+func (s *FileTransferServer) isStaged(path string) bool {
+	return strings.HasPrefix(path, filepath.Join(s.rootDir, StagingDirName)+string(filepath.Separator))
+}
+
+// Promote moves every file of a staged batch to the same path under the root,
+// or deletes the batch when discard is set. All targets are locked before
+// the first file is moved, so a conflict leaves the batch fully staged.
+func (s *FileTransferServer) Promote(ctx context.Context, req *pb.PromoteRequest) (*pb.PromoteResponse, error) {
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	stageDir, err := s.stagingDir(req.BatchId)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(stageDir); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "no staged batch: %s", req.BatchId)
+	}
+
+	var files []string
+	err = filepath.WalkDir(stageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			rel, err := filepath.Rel(stageDir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list staged batch: %v", err)
+	}
+
+	if req.Discard {
+		if err := s.fs.RemoveAll(stageDir); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to discard staged batch: %v", err)
+		}
+		return &pb.PromoteResponse{Files: int64(len(files))}, nil
+	}
+
+	// Reserve every target first
+	for i, file := range files {
+		if !s.lockTarget(filepath.Join(s.rootDir, file)) {
+			for _, locked := range files[:i] {
+				s.unlockTarget(filepath.Join(s.rootDir, locked))
+			}
+			return nil, status.Errorf(codes.Aborted, "target is being written by another transfer: %s", file)
+		}
+	}
+	defer func() {
+		for _, file := range files {
+			s.unlockTarget(filepath.Join(s.rootDir, file))
+		}
+	}()
+
+	for _, file := range files {
+		targetPath := filepath.Join(s.rootDir, file)
+		if err := s.fs.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create directory: %v", err)
+		}
+		if err := s.checkTargetDir(filepath.Dir(targetPath)); err != nil {
+			return nil, err
+		}
+		if err := s.checkCaseCollision(targetPath); err != nil {
+			return nil, err
+		}
+		if err := s.fs.Rename(filepath.Join(stageDir, file), targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to promote %s: %v", file, err)
+		}
+		s.finalize(targetPath)
+	}
+
+	if err := s.fs.RemoveAll(stageDir); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to clean up staged batch: %v", err)
+	}
+	return &pb.PromoteResponse{Files: int64(len(files))}, nil
+}
+
+// PromoteBatch asks the peer to promote (or discard) a staged batch and
+// returns the number of files affected.
+func PromoteBatch(ctx context.Context, cfg *Config, batchID string, discard bool) (int64, error) {
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	resp, err := pb.NewFileTransferClient(conn).Promote(ctx, &pb.PromoteRequest{
+		BatchId: batchID,
+		Discard: discard,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return resp.Files, nil
+}
+
+type PromoteResult struct {
+	BatchID string `json:"batch_id"`
+	Files   int64  `json:"files"`
+}
+
+// handlePromote serves POST /promote/{batch_id} and POST /discard/{batch_id}.
+func handlePromote(cfg *Config, discard bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		batchID := r.PathValue("batch_id")
+		files, err := PromoteBatch(withCorrelationID(r.Context(), requestCorrelationID(r)), cfg, batchID, discard)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusFromError(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(PromoteResult{BatchID: batchID, Files: files})
+	}
+}
+
+// httpStatusFromError maps a peer's gRPC status to the closest HTTP status.
+func httpStatusFromError(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
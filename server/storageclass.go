@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageClassStandard is the tier files are stored in without a
+// storage_class: ROOT_DIR, or the bucket's default class for object targets.
+const StorageClassStandard = "standard"
+
+var validStorageClass = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// classRoot returns the directory files of the given storage class are
+// stored under, from STORAGE_CLASSES.
+func (s *FileTransferServer) classRoot(class string) (string, error) {
+	if class == "" || class == StorageClassStandard {
+		return s.rootDir, nil
+	}
+	root, ok := s.classes[class]
+	if !ok {
+		return "", status.Errorf(codes.InvalidArgument, "unknown storage class: %s", class)
+	}
+	return root, nil
+}
+
+// rootOf returns the root of the storage class path is stored in.
+func (s *FileTransferServer) rootOf(path string) string {
+	for _, root := range s.classes {
+		if underAny(path, []string{root}) {
+			return root
+		}
+	}
+	return s.rootDir
+}
+
+// classedObjects uploads the objects of one file with an S3 storage class,
+// the request's class in upper case, e.g. "glacier" as GLACIER.
+type classedObjects struct {
+	*objectFileSystem
+	class string
+}
+
+func (o classedObjects) Rename(oldpath, newpath string) error {
+	return o.upload(oldpath, newpath, strings.ToUpper(o.class))
+}
+
+// objectsFor returns the object storage files of the given storage class are
+// written to.
+func (s *FileTransferServer) objectsFor(class string) FileSystem {
+	objects, ok := s.objects.(*objectFileSystem)
+	if !ok || class == "" {
+		return s.objects
+	}
+	return classedObjects{objectFileSystem: objects, class: class}
+}
+
+// resolveClassPath is resolvePath for a file of the given storage class.
+func (s *FileTransferServer) resolveClassPath(path, class string) (string, error) {
+	root, err := s.classRoot(class)
+	if err != nil {
+		return "", err
+	}
+	return s.resolvePathIn(root, path)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+)
+
+// Sync modes decide when a file whose target already exists is sent again
+const (
+	SyncQuick    = "quick"    // skip targets with the same size and mtime
+	SyncChecksum = "checksum" // skip targets with the same size and content
+)
+
+// upToDate reports whether the target already holds the file described by
+// metadata, so the transfer can be skipped.
+func upToDate(targetPath string, metadata *pb.TransferMetadata) bool {
+	info, err := os.Stat(targetPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return inSync(metadata, info.Size(), info.ModTime(), func() (string, error) {
+		return hashFile(targetPath)
+	})
+}
+
+// inSync reports whether a regular file of size bytes modified at mtime holds
+// the file metadata describes. checksum is only called if the sizes match.
+func inSync(metadata *pb.TransferMetadata, size int64, mtime time.Time, checksum func() (string, error)) bool {
+	if size != metadata.FileSize {
+		return false
+	}
+	if metadata.Sync == SyncChecksum {
+		sum, err := checksum()
+		return err == nil && sum == metadata.Checksum
+	}
+	return mtime.Equal(time.Unix(0, metadata.Mtime))
+}
+
+// hashFile returns the hex SHA-256 of a file's content.
+func hashFile(path string) (string, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
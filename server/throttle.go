@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Which clients share a REQUEST_RATE_LIMIT bucket
+const (
+	RequestRateGlobal = "global" // all clients together
+	RequestRateIP     = "ip"     // each client IP on its own
+)
+
+// throttleIdle is how long a per-IP bucket goes unused before it is dropped.
+// By then it has refilled, so dropping it changes nothing.
+const throttleIdle = time.Minute
+
+// tokenBucket lets burst requests through at once and refills at rate per
+// second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// requestThrottle limits the rate of requests with a token bucket, one for
+// all clients or one per client IP.
+type requestThrottle struct {
+	rate  float64
+	burst float64
+	perIP bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+
+	throttled atomic.Uint64 // requests answered with 429
+}
+
+// newRequestThrottle returns nil when request throttling is disabled.
+func newRequestThrottle(cfg *Config) *requestThrottle {
+	if cfg.RequestRate <= 0 {
+		return nil
+	}
+	return &requestThrottle{
+		rate:    cfg.RequestRate,
+		burst:   float64(cfg.RequestBurst),
+		perIP:   cfg.RequestRateKey == RequestRateIP,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from key's bucket. If it is empty, it reports how long
+// until the next token instead.
+func (t *requestThrottle) allow(key string, now time.Time) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+
+	bucket, ok := t.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: t.burst, last: now}
+		t.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(t.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*t.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / t.rate * float64(time.Second))
+}
+
+// sweep drops the buckets of clients that have been quiet for throttleIdle.
+func (t *requestThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < throttleIdle {
+		return
+	}
+	t.lastSweep = now
+	for key, bucket := range t.buckets {
+		if now.Sub(bucket.last) >= throttleIdle {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// clientKey returns the bucket a request counts against.
+func (t *requestThrottle) clientKey(r *http.Request) string {
+	if !t.perIP {
+		return RequestRateGlobal
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// throttleRequests answers 429 with a Retry-After once requests arrive
+// faster than REQUEST_RATE_LIMIT allows.
+func throttleRequests(throttle *requestThrottle, next http.HandlerFunc) http.HandlerFunc {
+	if throttle == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := throttle.clientKey(r)
+		if ok, wait := throttle.allow(key, time.Now()); !ok {
+			throttle.throttled.Add(1)
+			log.Printf("Request throttled: client=%s, path=%s, retryAfter=%v", key, r.URL.Path, wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (t *requestThrottle) throttledCount() uint64 {
+	if t == nil {
+		return 0
+	}
+	return t.throttled.Load()
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	pb "github.com/fa0311/file-transfer-system/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SyncStateDirName is the directory under the root where POST /sync keeps
+// what each pair of trees held after its last sync, as <SyncStateDirName>/<key>.json.
+const SyncStateDirName = ".sync"
+
+// How POST /sync settles a file changed on both sides since the last sync
+const (
+	SyncConflictReport = "report" // leave both sides as they are and report it
+	SyncConflictNewer  = "newer"  // the side with the later mtime wins
+	SyncConflictLocal  = "local"  // this server's side wins
+	SyncConflictRemote = "remote" // the peer's side wins
+)
+
+type TreeSyncRequest struct {
+	Path           string `json:"path"`                      // directory under ROOT_DIR
+	Target         string `json:"target,omitempty"`          // directory on the peer, path if empty
+	Delete         bool   `json:"delete,omitempty"`          // propagate deletions instead of restoring deleted files
+	ConflictPolicy string `json:"conflict_policy,omitempty"` // see SyncConflictReport
+}
+
+// SyncEntry is one side's version of a file. Mtimes are Unix nanoseconds.
+type SyncEntry struct {
+	Size     int64  `json:"size"`
+	Mtime    int64  `json:"mtime"`
+	Checksum string `json:"checksum"`
+}
+
+type SyncConflict struct {
+	Path       string     `json:"path"`
+	Local      *SyncEntry `json:"local"`                // null if deleted here
+	Remote     *SyncEntry `json:"remote"`               // null if deleted on the peer
+	Resolution string     `json:"resolution,omitempty"` // "local" or "remote" if conflict_policy picked a side
+}
+
+// TreeSyncResponse lists what a sync did. Paths are relative to the synced
+// directories.
+type TreeSyncResponse struct {
+	Converged     bool           `json:"converged"` // both trees now hold the same files
+	InSync        int            `json:"in_sync"`   // files both sides already had
+	Pushed        []string       `json:"pushed"`    // sent to the peer
+	Pulled        []string       `json:"pulled"`    // fetched from the peer
+	DeletedLocal  []string       `json:"deleted_local"`
+	DeletedRemote []string       `json:"deleted_remote"`
+	Conflicts     []SyncConflict `json:"conflicts"`
+	Errors        []string       `json:"errors,omitempty"`
+}
+
+// sameVersion reports whether two sides hold the same content, or both
+// nothing.
+func sameVersion(a, b *SyncEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Size == b.Size && a.Checksum == b.Checksum
+}
+
+// syncIgnored reports whether a file under the root is left out of syncs:
+// temp files, checksum sidecars and the server's own directories.
+func (s *FileTransferServer) syncIgnored(path string) bool {
+	if strings.HasSuffix(path, s.tempSuffix) || strings.HasSuffix(path, ManifestSuffix) {
+		return true
+	}
+	rel, err := filepath.Rel(s.rootDir, path)
+	if err != nil {
+		return false
+	}
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return first == ResumeDirName || first == StagingDirName || first == SyncStateDirName
+}
+
+// listTree returns every regular file below dir that syncs cover, keyed by
+// its slash-separated path relative to dir, hashed with hash if set. A
+// missing dir holds nothing.
+func (s *FileTransferServer) listTree(dir string, hash func(path string) (string, error)) ([]*pb.QueryResult, error) {
+	entries, err := walkTree(dir, s.walkers, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var results []*pb.QueryResult
+	for _, entry := range entries {
+		if !entry.d.Type().IsRegular() || s.syncIgnored(entry.path) {
+			continue
+		}
+		result := &pb.QueryResult{FilePath: filepath.ToSlash(entry.rel), Exists: true}
+		info, err := entry.d.Info()
+		if err == nil {
+			result.FileSize = info.Size()
+			result.Mtime = info.ModTime().UnixNano()
+			if hash != nil {
+				result.Checksum, err = hash(entry.path)
+			}
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ListTree lists the files below a directory for a peer's POST /sync.
+func (s *FileTransferServer) ListTree(req *pb.ListTreeRequest, stream pb.FileTransfer_ListTreeServer) error {
+	dir, err := s.resolvePath(s.normalizeName(req.FilePath))
+	if err != nil {
+		return err
+	}
+	var hash func(string) (string, error)
+	if req.Checksum {
+		hash = hashFile
+	}
+	results, err := s.listTree(dir, hash)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list directory: %v", err)
+	}
+	for _, result := range results {
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes a file a peer's POST /sync found deleted on its side.
+func (s *FileTransferServer) Remove(ctx context.Context, req *pb.RemoveRequest) (*pb.RemoveResponse, error) {
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+	path, err := s.resolvePath(s.normalizeName(req.FilePath))
+	if err != nil {
+		return nil, err
+	}
+	removed, err := s.removeFile(path, req.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RemoveResponse{Removed: removed}, nil
+}
+
+// removeFile deletes the file at path, and its checksum sidecar, provided
+// its content still hashes to checksum. It reports false if it was already
+// gone.
+func (s *FileTransferServer) removeFile(path, checksum string) (bool, error) {
+	if checksum == "" {
+		return false, status.Errorf(codes.InvalidArgument, "checksum is required")
+	}
+	if !s.lockTarget(path) {
+		return false, status.Errorf(codes.Aborted, "target is being written by another transfer: %s", path)
+	}
+	defer s.unlockTarget(path)
+
+	actual, err := hashFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "failed to hash file: %v", err)
+	}
+	if actual != checksum {
+		return false, status.Errorf(codes.FailedPrecondition, "file changed since it was listed: %s", path)
+	}
+	if err := s.fs.Remove(path); err != nil {
+		return false, s.storageError(err, "remove file")
+	}
+	if s.manifest {
+		_ = s.fs.Remove(path + ManifestSuffix)
+	}
+	log.Printf("Removed file deleted on the other side of a sync: path=%s", path)
+	return true, nil
+}
+
+// syncStatePath returns where the state of syncing dir with target on
+// peerAddr is kept.
+func syncStatePath(rootDir, peerAddr, dir, target string) string {
+	key := sha256.Sum256([]byte(peerAddr + "\n" + dir + "\n" + target))
+	return filepath.Join(rootDir, SyncStateDirName, hex.EncodeToString(key[:16])+".json")
+}
+
+func readSyncState(path string) (map[string]*SyncEntry, error) {
+	state := make(map[string]*SyncEntry)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid sync state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+func writeSyncState(path string, state map[string]*SyncEntry) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+func syncEntry(result *pb.QueryResult) *SyncEntry {
+	return &SyncEntry{Size: result.FileSize, Mtime: result.Mtime, Checksum: result.Checksum}
+}
+
+// newerSide returns the side whose version was modified last, "local" or
+// "remote", or "" if both were at once. A modified file beats a deletion.
+func newerSide(l, r *SyncEntry) string {
+	switch {
+	case r == nil || l != nil && l.Mtime > r.Mtime:
+		return SyncConflictLocal
+	case l == nil || r.Mtime > l.Mtime:
+		return SyncConflictRemote
+	}
+	return ""
+}
+
+// syncTrees reconciles dir under the root with target on the peer. A file
+// changed on one side since the last sync is copied to, or with delete
+// removed from, the other; a file changed on both is a conflict, settled by
+// the conflict policy or reported. Without an earlier sync every difference
+// counts as changed on both sides.
+func syncTrees(ctx context.Context, cfg *Config, receiver *FileTransferServer, checksums *checksumCache, req *TreeSyncRequest) (*TreeSyncResponse, error) {
+	resp := &TreeSyncResponse{Pushed: []string{}, Pulled: []string{}, DeletedLocal: []string{}, DeletedRemote: []string{}, Conflicts: []SyncConflict{}}
+	localDir := filepath.Join(cfg.RootDir, filepath.Clean(req.Path))
+
+	statePath := syncStatePath(cfg.RootDir, cfg.PeerAddr, filepath.ToSlash(filepath.Clean(req.Path)), req.Target)
+	if !receiver.lockTarget(statePath) {
+		return nil, status.Errorf(codes.Aborted, "a sync of %s is already running", req.Path)
+	}
+	defer receiver.unlockTarget(statePath)
+	base, err := readSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files that couldn't be listed aren't touched, as if they didn't exist
+	unreadable := make(map[string]bool)
+	local := make(map[string]*SyncEntry)
+	listed, err := receiver.listTree(localDir, checksums.checksum)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", req.Path, err)
+	}
+	for _, result := range listed {
+		if result.Error != "" {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %s", result.FilePath, result.Error))
+			unreadable[result.FilePath] = true
+			continue
+		}
+		local[result.FilePath] = syncEntry(result)
+	}
+
+	conn, err := dialPeer(cfg.PeerAddr, cfg.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := pb.NewFileTransferClient(conn)
+	stream, err := client.ListTree(ctx, &pb.ListTreeRequest{FilePath: req.Target, Checksum: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peer's %s: %w", req.Target, err)
+	}
+	remote := make(map[string]*SyncEntry)
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list peer's %s: %w", req.Target, err)
+		}
+		if result.Error != "" {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: peer: %s", result.FilePath, result.Error))
+			unreadable[result.FilePath] = true
+			continue
+		}
+		remote[result.FilePath] = syncEntry(result)
+	}
+
+	session := newPeerSession(cfg)
+	session.sync = SyncChecksum
+	session.checksums = checksums
+	defer session.Close()
+
+	paths := make(map[string]bool)
+	for _, entries := range []map[string]*SyncEntry{local, remote, base} {
+		for rel := range entries {
+			paths[rel] = true
+		}
+	}
+	for _, rel := range slices.Sorted(maps.Keys(paths)) {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		if unreadable[rel] {
+			continue
+		}
+		l, r, b := local[rel], remote[rel], base[rel]
+		if sameVersion(l, r) {
+			if l != nil {
+				resp.InSync++
+				base[rel] = l
+			} else {
+				delete(base, rel)
+			}
+			continue
+		}
+
+		// Which side's version the other side gets
+		winner := ""
+		switch localChanged, remoteChanged := !sameVersion(l, b), !sameVersion(r, b); {
+		case localChanged && !remoteChanged:
+			winner = SyncConflictLocal
+		case remoteChanged && !localChanged:
+			winner = SyncConflictRemote
+		default:
+			conflict := SyncConflict{Path: rel, Local: l, Remote: r}
+			switch req.ConflictPolicy {
+			case SyncConflictLocal, SyncConflictRemote:
+				winner = req.ConflictPolicy
+			case SyncConflictNewer:
+				winner = newerSide(l, r)
+			}
+			conflict.Resolution = winner
+			resp.Conflicts = append(resp.Conflicts, conflict)
+			if winner == "" {
+				continue
+			}
+		}
+
+		// The winner's version is copied over, or with delete its deletion;
+		// without delete a deleted file is restored from the other side
+		push := winner == SyncConflictLocal
+		if !req.Delete && (push && l == nil || !push && r == nil) {
+			push = !push
+		}
+		source := filepath.Join(req.Path, filepath.FromSlash(rel))
+		target := path.Join(req.Target, rel)
+		var err error
+		switch {
+		case push && l != nil:
+			if _, err = TransferFile(ctx, session, source, target, cfg.RootDir, nil); err == nil {
+				resp.Pushed = append(resp.Pushed, rel)
+				base[rel] = l
+			}
+		case !push && r != nil:
+			if _, err = PullFile(ctx, cfg, receiver, target, source, r.Mtime, nil); err == nil {
+				resp.Pulled = append(resp.Pulled, rel)
+				base[rel] = r
+			}
+		case push:
+			if _, err = client.Remove(ctx, &pb.RemoveRequest{FilePath: target, Checksum: r.Checksum}); err == nil {
+				resp.DeletedRemote = append(resp.DeletedRemote, rel)
+				delete(base, rel)
+			}
+		default:
+			if _, err = receiver.removeFile(filepath.Join(localDir, filepath.FromSlash(rel)), l.Checksum); err == nil {
+				resp.DeletedLocal = append(resp.DeletedLocal, rel)
+				delete(base, rel)
+			}
+		}
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", rel, err))
+		}
+	}
+
+	if err := writeSyncState(statePath, base); err != nil {
+		return nil, fmt.Errorf("failed to save sync state: %v", err)
+	}
+	unresolved := slices.ContainsFunc(resp.Conflicts, func(c SyncConflict) bool { return c.Resolution == "" })
+	resp.Converged = !unresolved && len(resp.Errors) == 0
+	return resp, nil
+}
+
+// handleSyncTrees serves POST /sync, reconciling a directory under the root
+// with one on the peer in both directions.
+func handleSyncTrees(cfg *Config, receiver *FileTransferServer, checksums *checksumCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TreeSyncRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if req.Target == "" {
+			req.Target = filepath.ToSlash(filepath.Clean(req.Path))
+		}
+		var errs []FieldError
+		invalid := func(field, message string) {
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+		if req.Path == "" {
+			invalid("path", "is required")
+		} else if !isRelativePath(req.Path) {
+			invalid("path", "must be a relative path inside the root directory")
+		} else if cfg.StrictRootDir {
+			if err := checkWithinRoot(cfg.RootDir, req.Path, cfg.MaxSymlinkHops); err != nil {
+				invalid("path", err.Error())
+			}
+		}
+		if !isRelativePath(req.Target) || isObjectPath(req.Target) {
+			invalid("target", "must be a relative path inside the peer's root directory")
+		}
+		switch req.ConflictPolicy {
+		case "":
+			req.ConflictPolicy = SyncConflictReport
+		case SyncConflictReport, SyncConflictNewer, SyncConflictLocal, SyncConflictRemote:
+		default:
+			invalid("conflict_policy", "must be one of: report, newer, local, remote")
+		}
+		if cfg.PeerTransport == PeerTransportHTTP {
+			invalid("path", "is not supported with PEER_TRANSPORT=http")
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+
+		ctx := withCorrelationID(r.Context(), requestCorrelationID(r))
+		resp, err := syncTrees(ctx, cfg, receiver, checksums, &req)
+		if status.Code(err) == codes.Aborted {
+			http.Error(w, status.Convert(err).Message(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to sync: %v", err), http.StatusBadGateway)
+			return
+		}
+		log.Printf("Sync finished: path=%s, target=%s, pushed=%d, pulled=%d, deletedLocal=%d, deletedRemote=%d, conflicts=%d, errors=%d",
+			req.Path, req.Target, len(resp.Pushed), len(resp.Pulled), len(resp.DeletedLocal), len(resp.DeletedRemote), len(resp.Conflicts), len(resp.Errors))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
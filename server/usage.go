@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// diskUsage enforces MAX_TOTAL_USAGE, a hard cap on the bytes stored under
+// the root directory. Nothing is ever evicted to make room: a transfer that
+// doesn't fit is rejected. The usage is scanned once and then kept up to date
+// as transfers complete; files changed by anything else are only noticed by
+// the rescan that happens before a transfer is rejected.
+type diskUsage struct {
+	root       string
+	tempSuffix string
+	limit      int64
+
+	mu       sync.Mutex
+	stored   int64 // bytes in files under root
+	reserved int64 // bytes transfers in progress may still add
+}
+
+func newDiskUsage(root, tempSuffix string, limit int64) *diskUsage {
+	if limit == 0 {
+		return nil
+	}
+	u := &diskUsage{root: root, tempSuffix: tempSuffix, limit: limit}
+	u.rescan()
+	log.Printf("Disk usage: root=%s, used=%d, limit=%d", root, u.stored, limit)
+	return u
+}
+
+// rescan measures the root again. Files still being written are left out, as
+// their transfers reserve room for them.
+func (u *diskUsage) rescan() {
+	var used int64
+	err := filepath.WalkDir(u.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || strings.HasSuffix(path, u.tempSuffix) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			used += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to measure disk usage: root=%s, err=%v", u.root, err)
+	}
+	u.stored = used
+}
+
+// reserve makes room for n more bytes, or fails with ResourceExhausted if they
+// would take the usage past the limit.
+func (u *diskUsage) reserve(n int64) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.stored+u.reserved+n > u.limit {
+		// Files may have been deleted since the last scan
+		u.rescan()
+		if u.stored+u.reserved+n > u.limit {
+			return status.Errorf(codes.ResourceExhausted, "total usage limit reached: used=%d, reserved=%d, requested=%d, limit=%d",
+				u.stored, u.reserved, n, u.limit)
+		}
+	}
+	u.reserved += n
+	return nil
+}
+
+// usageClaim is the room one transfer reserved for its target.
+type usageClaim struct {
+	usage    *diskUsage
+	target   string
+	before   int64 // what the target held when the transfer started
+	reserved int64
+}
+
+// claim reserves room for size bytes written to target, or none if the size
+// isn't known yet. Replacing the whole target frees what it holds, so that
+// only counts the difference.
+func (u *diskUsage) claim(target string, size int64, replaces bool) (*usageClaim, error) {
+	if u == nil {
+		return nil, nil
+	}
+	c := &usageClaim{usage: u, target: target, before: pathUsage(target)}
+	n := max(size, 0)
+	if replaces {
+		n = max(n-c.before, 0)
+	}
+	if err := u.reserve(n); err != nil {
+		return nil, err
+	}
+	c.reserved = n
+	return c, nil
+}
+
+// grow reserves n more bytes for a transfer of unknown size.
+func (c *usageClaim) grow(n int64) error {
+	if c == nil {
+		return nil
+	}
+	if err := c.usage.reserve(n); err != nil {
+		return err
+	}
+	c.reserved += n
+	return nil
+}
+
+// finish releases the reservation and, if the transfer succeeded, accounts
+// for what it actually changed in the target.
+func (c *usageClaim) finish(success bool) {
+	if c == nil {
+		return
+	}
+	var delta int64
+	if success {
+		delta = pathUsage(c.target) - c.before
+	}
+	c.usage.mu.Lock()
+	c.usage.reserved -= c.reserved
+	c.usage.stored += delta
+	c.usage.mu.Unlock()
+}
+
+// pathUsage returns the bytes in the regular files at or below path.
+func pathUsage(path string) int64 {
+	var used int64
+	filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			used += info.Size()
+		}
+		return nil
+	})
+	return used
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+// validateTransferRequest checks a /transfer request before any work starts,
+// filling in defaults for omitted options. It returns every problem found.
+func validateTransferRequest(req *TransferRequest, allowedPeers []string) []FieldError {
+	var errs []FieldError
+	invalid := func(field, message string) {
+		errs = append(errs, FieldError{Field: field, Message: message})
+	}
+
+	if req.Source == "" {
+		invalid("source", "is required")
+	} else if !isRelativePath(req.Source) {
+		invalid("source", "must be a relative path inside the root directory")
+	}
+
+	if req.Target == "" {
+		invalid("target", "is required")
+	} else if !isRelativePath(req.Target) {
+		invalid("target", "must be a relative path inside the root directory")
+	}
+
+	// Pulls always fetch a directory as an archive
+	if req.Pull && req.Stage {
+		invalid("stage", "cannot be combined with pull")
+	}
+	if req.Pull {
+		if isPattern(req.Source) {
+			invalid("pull", "cannot be combined with a source pattern")
+		} else if req.Archive == "" {
+			req.Archive = ArchiveTar
+		}
+	}
+
+	switch req.Archive {
+	case "":
+	case ArchiveTar, ArchiveTarZstd:
+		if isPattern(req.Source) {
+			invalid("archive", "cannot be combined with a source pattern")
+		}
+	default:
+		invalid("archive", "must be one of: tar, tar.zst")
+	}
+
+	if req.PreserveMtimes && req.Archive == "" {
+		invalid("preserve_mtimes", "requires an archive transfer or pull")
+	}
+
+	switch req.SpecialFiles {
+	case "":
+		req.SpecialFiles = SpecialFilesSkip
+	case SpecialFilesSkip, SpecialFilesRecreate:
+		if req.Archive == "" {
+			invalid("special_files", "requires an archive transfer or pull")
+		}
+	default:
+		invalid("special_files", "must be one of: skip, recreate")
+	}
+
+	switch req.Sync {
+	case "":
+	case SyncQuick, SyncChecksum:
+		if req.Archive != "" || req.ParallelChunks > 1 {
+			invalid("sync", "only applies to single-stream file transfers")
+		}
+	default:
+		invalid("sync", "must be one of: quick, checksum")
+	}
+
+	switch req.OnConflict {
+	case "", OnConflictOverwrite:
+	case OnConflictAsk:
+		if req.Archive != "" || isObjectPath(req.Target) {
+			invalid("on_conflict", "only applies to file transfers to the peer's root directory")
+		} else if req.Sync != "" {
+			invalid("on_conflict", "cannot be combined with sync")
+		}
+	default:
+		invalid("on_conflict", "must be one of: overwrite, ask")
+	}
+
+	if req.StorageClass != "" {
+		switch {
+		case !validStorageClass.MatchString(req.StorageClass):
+			invalid("storage_class", "must be lowercase letters, digits, '-' and '_'")
+		case req.Pull || req.Stage:
+			invalid("storage_class", "cannot be combined with pull or stage")
+		case req.BatchChecksum || req.OnConflict == OnConflictAsk:
+			invalid("storage_class", "cannot be combined with batch_checksum or on_conflict ask")
+		}
+	}
+
+	if req.ParallelChunks < 0 || req.ParallelChunks > MaxParallelChunks {
+		invalid("parallel_chunks", fmt.Sprintf("must be between 0 and %d", MaxParallelChunks))
+	} else if req.ParallelChunks > 1 && req.Archive != "" {
+		invalid("parallel_chunks", "cannot be combined with an archive transfer or pull")
+	}
+
+	if req.BatchChecksum {
+		if req.Pull {
+			invalid("batch_checksum", "cannot be combined with pull")
+		} else if isObjectPath(req.Target) {
+			invalid("batch_checksum", "doesn't apply to object storage targets")
+		}
+	}
+
+	if req.Diagnostics && (req.Pull || req.ParallelChunks > 1) {
+		invalid("diagnostics", "only applies to single-stream sends")
+	}
+
+	if req.MinSize < 0 {
+		invalid("min_size", "must not be negative")
+	}
+	if req.MaxSize < 0 {
+		invalid("max_size", "must not be negative")
+	} else if req.MaxSize > 0 && req.MaxSize < req.MinSize {
+		invalid("max_size", "must not be less than min_size")
+	}
+	if (req.MinSize != 0 || req.MaxSize != 0) && req.Archive != "" {
+		invalid("min_size", "only applies to file transfers, not archives or pulls")
+	}
+
+	if req.PeerAddress != "" {
+		if !slices.Contains(allowedPeers, req.PeerAddress) {
+			invalid("peer_address", "is not in ALLOWED_PEERS")
+		} else if req.Stage {
+			invalid("peer_address", "cannot be combined with stage")
+		}
+	}
+
+	if req.Peer != "" {
+		if req.PeerAddress != "" {
+			invalid("peer", "cannot be combined with peer_address")
+		} else if req.Stage {
+			invalid("peer", "cannot be combined with stage")
+		}
+	}
+
+	switch req.VerifyPolicy {
+	case "":
+		req.VerifyPolicy = VerifyPolicyStrict
+	case VerifyPolicyStrict, VerifyPolicyLenient:
+	default:
+		invalid("verify_policy", "must be one of: strict, lenient")
+	}
+
+	return errs
+}
+
+// isRelativePath reports whether path stays inside the root directory,
+// recording a rejection when it does not.
+func isRelativePath(path string) bool {
+	cleanPath := filepath.Clean(path)
+	switch {
+	case filepath.IsAbs(cleanPath):
+		rejectPath(RejectRelative, path)
+		return false
+	case strings.HasPrefix(cleanPath, ".."):
+		rejectPath(RejectTraversal, path)
+		return false
+	}
+	return true
+}
+
+// pathErrorStatus is the HTTP status for a path rejected by checkWithinRoot.
+func pathErrorStatus(err error) int {
+	if errors.Is(err, fs.ErrPermission) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func writeValidationError(w http.ResponseWriter, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(ValidationErrorResponse{
+		Error:  "invalid request",
+		Fields: errs,
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ManifestSuffix is appended to a file's name for its checksum sidecar, see
+// WRITE_CHECKSUM_MANIFEST.
+const ManifestSuffix = ".sha256"
+
+var manifestLine = regexp.MustCompile(`^([0-9a-f]{64})  (.+)$`)
+
+type VerifyTreeRequest struct {
+	Path     string `json:"path"`               // directory under ROOT_DIR to check
+	Manifest string `json:"manifest,omitempty"` // sha256sum file under ROOT_DIR instead of sidecars
+}
+
+type ChecksumMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// VerifyTreeResponse lists how a directory differs from its manifest. Paths
+// are relative to the directory.
+type VerifyTreeResponse struct {
+	OK         bool               `json:"ok"`
+	Verified   int                `json:"verified"` // files matching their checksum
+	Missing    []string           `json:"missing"`  // in the manifest but not in the tree
+	Extra      []string           `json:"extra"`    // in the tree but not in the manifest
+	Mismatched []ChecksumMismatch `json:"mismatched"`
+	Errors     []string           `json:"errors,omitempty"` // unreadable files and manifest lines
+}
+
+// readManifest parses sha256sum output into checksums keyed by file name.
+func readManifest(path string) (map[string]string, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	var invalid []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		match := manifestLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			invalid = append(invalid, fmt.Sprintf("%s:%d: not a sha256sum line", filepath.Base(path), line))
+			continue
+		}
+		sums[filepath.ToSlash(filepath.Clean(match[2]))] = match[1]
+	}
+	return sums, invalid, scanner.Err()
+}
+
+// verifyTree checks every regular file below dir against the expected
+// checksums, keyed by path relative to dir. Without a manifest they are read
+// from the sidecars in the tree; sidecars are never checked themselves.
+func verifyTree(cfg *Config, dir, manifest string) (*VerifyTreeResponse, error) {
+	resp := &VerifyTreeResponse{Missing: []string{}, Extra: []string{}, Mismatched: []ChecksumMismatch{}}
+	entries, err := walkTree(dir, cfg.WalkConcurrency, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var expected map[string]string
+	if manifest != "" {
+		if expected, resp.Errors, err = readManifest(manifest); err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+	} else {
+		expected = make(map[string]string)
+		for _, entry := range entries {
+			if !entry.d.Type().IsRegular() || !strings.HasSuffix(entry.rel, ManifestSuffix) {
+				continue
+			}
+			sums, invalid, err := readManifest(entry.path)
+			if err != nil {
+				resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", filepath.ToSlash(entry.rel), err))
+				continue
+			}
+			resp.Errors = append(resp.Errors, invalid...)
+			// A sidecar covers the file it is named after, whatever name it records
+			for _, sum := range sums {
+				expected[filepath.ToSlash(strings.TrimSuffix(entry.rel, ManifestSuffix))] = sum
+			}
+		}
+	}
+
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		rel := filepath.ToSlash(entry.rel)
+		skip := entry.path == manifest || strings.HasSuffix(rel, cfg.TempFileSuffix) ||
+			strings.HasSuffix(rel, ManifestSuffix)
+		if !entry.d.Type().IsRegular() || skip {
+			continue
+		}
+		found[rel] = true
+		sum, ok := expected[rel]
+		if !ok {
+			resp.Extra = append(resp.Extra, rel)
+			continue
+		}
+		actual, err := hashFile(entry.path)
+		if err != nil {
+			resp.Errors = append(resp.Errors, fmt.Sprintf("%s: %v", rel, err))
+			continue
+		}
+		if actual != sum {
+			resp.Mismatched = append(resp.Mismatched, ChecksumMismatch{Path: rel, Expected: sum, Actual: actual})
+			continue
+		}
+		resp.Verified++
+	}
+	for _, rel := range slices.Sorted(maps.Keys(expected)) {
+		if !found[rel] {
+			resp.Missing = append(resp.Missing, rel)
+		}
+	}
+	resp.OK = len(resp.Missing)+len(resp.Extra)+len(resp.Mismatched)+len(resp.Errors) == 0
+	return resp, nil
+}
+
+// handleVerifyTree serves POST /verify-tree, checking a directory under the
+// root against its checksum manifest without transferring anything.
+func handleVerifyTree(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req VerifyTreeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var errs []FieldError
+		invalid := func(field, message string) {
+			errs = append(errs, FieldError{Field: field, Message: message})
+		}
+		if req.Path == "" {
+			invalid("path", "is required")
+		}
+		for _, field := range []struct{ name, path string }{{"path", req.Path}, {"manifest", req.Manifest}} {
+			if field.path == "" {
+				continue
+			}
+			if !isRelativePath(field.path) {
+				invalid(field.name, "must be a relative path inside the root directory")
+			} else if cfg.StrictRootDir {
+				if err := checkWithinRoot(cfg.RootDir, field.path, cfg.MaxSymlinkHops); err != nil {
+					invalid(field.name, err.Error())
+				}
+			}
+		}
+		if len(errs) > 0 {
+			writeValidationError(w, errs)
+			return
+		}
+
+		dir := filepath.Join(cfg.RootDir, filepath.Clean(req.Path))
+		info, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("directory not found: %s", req.Path), http.StatusNotFound)
+			return
+		}
+		if err == nil && !info.IsDir() {
+			writeValidationError(w, []FieldError{{Field: "path", Message: "must be a directory"}})
+			return
+		}
+		manifest := ""
+		if err == nil && req.Manifest != "" {
+			manifest = filepath.Join(cfg.RootDir, filepath.Clean(req.Manifest))
+			if _, err = os.Stat(manifest); errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, fmt.Sprintf("manifest not found: %s", req.Manifest), http.StatusNotFound)
+				return
+			}
+		}
+		var resp *VerifyTreeResponse
+		if err == nil {
+			resp, err = verifyTree(cfg, dir, manifest)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to verify tree: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// treeEntry is a file or directory found by walkTree.
+type treeEntry struct {
+	path string // including the walked root
+	rel  string // relative to the walked root
+	d    fs.DirEntry
+}
+
+// walkTree lists everything below root, as visitTree visits it.
+func walkTree(root string, workers int, skip func(d fs.DirEntry) bool) ([]treeEntry, error) {
+	var tree []treeEntry
+	err := visitTree(root, workers, skip, func(entry treeEntry) error {
+		tree = append(tree, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// visitTree calls visit for everything below root in the order
+// filepath.WalkDir visits it: depth first, each directory's entries sorted by
+// name. With more than one worker, up to workers subdirectories of each
+// directory on the way down are read ahead of the walk, at most workers at
+// once, which pays off on high-latency storage such as network filesystems.
+// Entries skip returns true for are left out, directories with their
+// contents. Like WalkDir, symlinks aren't followed. It stops at the first
+// error visit returns.
+func visitTree(root string, workers int, skip func(d fs.DirEntry) bool, visit func(entry treeEntry) error) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	w := &treeWalker{skip: skip, visit: visit}
+	if workers > 1 {
+		w.ahead = workers
+		w.slots = make(chan struct{}, workers)
+	}
+	return w.walkDir(treeEntry{path: root}, w.read(root))
+}
+
+// treeWalker holds the state of one visitTree.
+type treeWalker struct {
+	ahead int           // subdirectories read ahead per directory, 0 to read each when it is reached
+	slots chan struct{} // bounds the directories being read at once
+	skip  func(d fs.DirEntry) bool
+	visit func(entry treeEntry) error
+}
+
+// dirListing is a directory being read, ready once done is closed.
+type dirListing struct {
+	done    chan struct{}
+	entries []fs.DirEntry
+	err     error
+}
+
+func (w *treeWalker) read(path string) *dirListing {
+	listing := &dirListing{done: make(chan struct{})}
+	if w.ahead == 0 {
+		listing.entries, listing.err = os.ReadDir(path)
+		close(listing.done)
+		return listing
+	}
+	go func() {
+		defer close(listing.done)
+		w.slots <- struct{}{}
+		listing.entries, listing.err = os.ReadDir(path)
+		<-w.slots
+	}()
+	return listing
+}
+
+func (w *treeWalker) walkDir(dir treeEntry, listing *dirListing) error {
+	<-listing.done
+	if listing.err != nil {
+		return listing.err
+	}
+	var children, pending []treeEntry // pending: subdirectories not being read yet
+	for _, d := range listing.entries {
+		if w.skip != nil && w.skip(d) {
+			continue
+		}
+		child := treeEntry{
+			path: filepath.Join(dir.path, d.Name()),
+			rel:  filepath.Join(dir.rel, d.Name()),
+			d:    d,
+		}
+		children = append(children, child)
+		if d.IsDir() {
+			pending = append(pending, child)
+		}
+	}
+
+	// Listings of the next subdirectories, in walk order
+	var ahead []*dirListing
+	readAhead := func() {
+		for len(ahead) < w.ahead && len(pending) > 0 {
+			ahead = append(ahead, w.read(pending[0].path))
+			pending = pending[1:]
+		}
+	}
+	readAhead()
+	for _, child := range children {
+		if err := w.visit(child); err != nil {
+			return err
+		}
+		if !child.d.IsDir() {
+			continue
+		}
+		if len(ahead) == 0 {
+			ahead = append(ahead, w.read(pending[0].path))
+			pending = pending[1:]
+		}
+		next := ahead[0]
+		ahead = ahead[1:]
+		readAhead()
+		if err := w.walkDir(child, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipHiddenEntries is a walkTree skip function leaving out dotfiles and
+// dot-directories, or nil to keep everything.
+func skipHiddenEntries(skipHidden bool) func(d fs.DirEntry) bool {
+	if !skipHidden {
+		return nil
+	}
+	return func(d fs.DirEntry) bool {
+		return isHidden(d.Name())
+	}
+}
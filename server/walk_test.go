@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// makeTree creates a tree depth directories deep, with fanout subdirectories
+// and files in each directory, and returns its root.
+func makeTree(tb testing.TB, depth, fanout int) string {
+	tb.Helper()
+	root := tb.TempDir()
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := range fanout {
+			name := filepath.Join(dir, fmt.Sprintf("file-%d.txt", i))
+			if err := os.WriteFile(name, []byte(name), 0644); err != nil {
+				tb.Fatal(err)
+			}
+			if level == depth {
+				continue
+			}
+			sub := filepath.Join(dir, fmt.Sprintf("dir-%d", i))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				tb.Fatal(err)
+			}
+			fill(sub, level+1)
+		}
+	}
+	fill(root, 1)
+	return root
+}
+
+func TestWalkTreeMatchesWalkDir(t *testing.T) {
+	root := makeTree(t, 4, 3)
+	if err := os.WriteFile(filepath.Join(root, "dir-1", ".hidden"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, ".cache", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, skipHidden := range []bool{false, true} {
+		var want []string
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || path == root {
+				return err
+			}
+			if skipHidden && isHidden(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			want = append(want, rel)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workers := range []int{1, 2, 8} {
+			entries, err := walkTree(root, workers, skipHiddenEntries(skipHidden))
+			if err != nil {
+				t.Fatalf("walkTree(workers=%d): %v", workers, err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.rel)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("walkTree(workers=%d, skipHidden=%v) listed %d entries that differ from WalkDir's %d", workers, skipHidden, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestVisitTreeStopsAtError(t *testing.T) {
+	root := makeTree(t, 3, 3)
+	stop := fmt.Errorf("stop")
+	for _, workers := range []int{1, 8} {
+		visited := 0
+		err := visitTree(root, workers, nil, func(entry treeEntry) error {
+			if visited++; visited == 5 {
+				return stop
+			}
+			return nil
+		})
+		if err != stop || visited != 5 {
+			t.Errorf("visitTree(workers=%d) = %v after %d entries, want to stop after 5", workers, err, visited)
+		}
+	}
+}
+
+func BenchmarkWalkTree(b *testing.B) {
+	root := makeTree(b, 6, 4)
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := walkTree(root, workers, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
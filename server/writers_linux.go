@@ -0,0 +1,63 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// openForWriting reports whether any process has the file at path open for
+// writing, by looking through the file descriptors listed in /proc. Processes
+// whose descriptors can't be read, e.g. another user's without root, aren't seen.
+func openForWriting(path string) (bool, error) {
+	// A missing source fails when it is sent instead
+	target, err := filepath.Abs(path)
+	if err != nil {
+		return false, nil
+	}
+	if target, err = filepath.EvalSymlinks(target); err != nil {
+		return false, nil
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, err
+	}
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // exited, or not ours to inspect
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && link == target && fdWritable(proc.Name(), fd.Name()) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// fdWritable reports whether a process opened a descriptor for writing, from
+// the access mode in its fdinfo flags.
+func fdWritable(pid, fd string) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", pid, "fdinfo", fd))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "flags:"); ok {
+			flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 64)
+			return err == nil && flags&unix.O_ACCMODE != unix.O_RDONLY
+		}
+	}
+	return false
+}
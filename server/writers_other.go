@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openForWriting(path string) (bool, error) {
+	return false, errors.New("detecting open files is only supported on Linux")
+}
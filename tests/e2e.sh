@@ -24,6 +24,9 @@ cleanup() {
     if [ ! -z "$SENDER_PID" ]; then
         kill $SENDER_PID 2>/dev/null || true
     fi
+    if [ ! -z "$WEBHOOK_PID" ]; then
+        kill $WEBHOOK_PID 2>/dev/null || true
+    fi
     rm -rf "${TEST_DIR}"
 }
 
@@ -89,10 +92,30 @@ if ! kill -0 $RECEIVER_PID 2>/dev/null; then
 fi
 print_result 0 "Receiver server started"
 
+# Start webhook listener that appends every POST body to a file
+WEBHOOK_PORT=8090
+python3 -c '
+import sys
+from http.server import BaseHTTPRequestHandler, HTTPServer
+class Handler(BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        with open(sys.argv[1], "ab") as f:
+            f.write(body + b"\n")
+        self.send_response(204)
+        self.end_headers()
+HTTPServer(("localhost", int(sys.argv[2])), Handler).serve_forever()
+' "${TEST_DIR}/webhook.log" ${WEBHOOK_PORT} > /dev/null 2>&1 &
+WEBHOOK_PID=$!
+
 # Start sender server
 print_test_header "Starting sender server"
 PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
 ROOT_DIR="${SENDER_DIR}" \
+REPORT_DIR="${TEST_DIR}/reports" \
+READ_AHEAD_CHUNKS=2 \
+WEBHOOK_URL="http://localhost:${WEBHOOK_PORT}/hook" \
+POST_TRANSFER_CMD='echo "$TRANSFER_BATCH_ID $TRANSFER_STATUS" >> '"${TEST_DIR}/hooks.log" \
 HTTP_PORT=${SENDER_PORT} \
 GRPC_PORT=50052 \
 ./bin/file-transfer-server > "${TEST_DIR}/sender.log" 2>&1 &
@@ -207,7 +230,20 @@ print_test_header "Test 5: Verify NDJSON log format"
 if grep -q '"timestamp"' "${TEST_DIR}/transfer1.log" && \
    grep -q '"level"' "${TEST_DIR}/transfer1.log" && \
    grep -q '"message"' "${TEST_DIR}/transfer1.log" && \
-   grep -q '"bytes_transferred"' "${TEST_DIR}/transfer1.log"; then
+   grep -q '"bytes_transferred"' "${TEST_DIR}/transfer1.log" && \
+   grep -q '"message":"transfer completed","bytes_transferred":14,"bytes_confirmed":14' "${TEST_DIR}/transfer1.log" && \
+   python3 -c '
+import json, sys
+events = [json.loads(line) for line in open(sys.argv[1]) if line.startswith("{")]
+messages = [e["message"] for e in events]
+done = messages.index("transfer completed")
+# Until the peer acknowledges the file, nothing reports it as complete
+assert "awaiting peer confirmation" in messages[:done]
+for e in events[:done]:
+    assert e["bytes_confirmed"] < e["total_bytes"] or e["total_bytes"] == 0, e
+    assert e.get("progress", 0) < 100 and "type" not in e, e
+assert events[done]["progress"] == 100, events[done]
+' "${TEST_DIR}/transfer1.log"; then
     print_result 0 "NDJSON log format is correct"
 else
     print_result 1 "NDJSON log format is incorrect"
@@ -222,6 +258,3447 @@ else
     print_result 1 "Health endpoint returned status $HEALTH_STATUS"
 fi
 
+# Test 7: Transfer files matching a brace pattern
+print_test_header "Test 7: Transfer files matching a brace pattern"
+mkdir -p "${SENDER_DIR}/logs/app" "${SENDER_DIR}/logs/db" "${SENDER_DIR}/logs/tmp"
+echo "app log" > "${SENDER_DIR}/logs/app/1.log"
+echo "db log" > "${SENDER_DIR}/logs/db/1.log"
+echo "tmp log" > "${SENDER_DIR}/logs/tmp/1.log"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"logs/{app,db}/*.log","target":"pattern"}' \
+    > "${TEST_DIR}/transfer7.log" 2>&1
+
+sleep 1
+
+if [ -f "${RECEIVER_DIR}/pattern/app/1.log" ] && \
+   [ -f "${RECEIVER_DIR}/pattern/db/1.log" ] && \
+   [ ! -e "${RECEIVER_DIR}/pattern/tmp" ]; then
+    print_result 0 "Brace pattern transferred only the matching files"
+else
+    print_result 1 "Brace pattern transfer produced unexpected files"
+fi
+
+# Test 8: Check batch report
+print_test_header "Test 8: Verify batch report"
+BATCH_ID=$(grep -o '"batch_id":"[0-9a-f]*"' "${TEST_DIR}/transfer7.log" | head -n 1 | sed -n 's/.*"batch_id":"\([0-9a-f]*\)".*/\1/p')
+REPORT_FILE="${TEST_DIR}/reports/${BATCH_ID}.json"
+if [ -n "$BATCH_ID" ] && [ -f "$REPORT_FILE" ] && \
+   [ "$(grep -c '"status": "completed"' "$REPORT_FILE")" = "3" ] && \
+   grep -q '"total_files": 2' "$REPORT_FILE"; then
+    print_result 0 "Batch report lists every file as completed"
+else
+    print_result 1 "Batch report is missing or incorrect"
+fi
+
+# Test 9: STORAGE_BACKEND=memory keeps received files off the disk
+print_test_header "Test 9: In-memory storage backend"
+MEMORY_ROOT="${TEST_DIR}/memory-root"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${MEMORY_ROOT}" \
+STORAGE_BACKEND=memory \
+VERIFY_READBACK=true \
+HTTP_PORT=8185 \
+GRPC_PORT=50159 \
+./bin/file-transfer-server > "${TEST_DIR}/memory-receiver.log" 2>&1 &
+MEMORY_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50159" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8184 \
+GRPC_PORT=50158 \
+./bin/file-transfer-server > "${TEST_DIR}/memory-sender.log" 2>&1 &
+MEMORY_SENDER_PID=$!
+sleep 2
+
+# Read back from memory after writing, so the received bytes are compared
+curl -s -X POST http://localhost:8184/transfer -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"relay/medium.bin"}' > "${TEST_DIR}/transfer9.log" 2>&1 || true
+MEMORY_INVALID=$(PEER_SERVER_ADDR="localhost:50140" ROOT_DIR="${MEMORY_ROOT}" STORAGE_BACKEND=tmpfs \
+    HTTP_PORT=8186 GRPC_PORT=50160 timeout 5 ./bin/file-transfer-server 2>&1 || true)
+kill $MEMORY_RECEIVER_PID $MEMORY_SENDER_PID 2>/dev/null || true
+
+if grep -q '"message":"transfer completed"' "${TEST_DIR}/transfer9.log" && \
+   [ -z "$(find "${MEMORY_ROOT}" -mindepth 1 2>/dev/null)" ] && \
+   echo "$MEMORY_INVALID" | grep -q "STORAGE_BACKEND must be one of: os, memory"; then
+    print_result 0 "The file was received and read back from memory without touching the root on disk"
+else
+    print_result 1 "Unexpected in-memory transfer: $(tail -n1 "${TEST_DIR}/transfer9.log"), on disk: $(find "${MEMORY_ROOT}" -mindepth 1 2>/dev/null | tr '\n' ' ')"
+fi
+
+# Test 10: Concurrent transfers to the same target
+print_test_header "Test 10: Concurrent transfers to the same target"
+# The requests differ in an option, so they aren't collapsed into one batch
+for i in 1 2; do
+    [ "$i" = "1" ] && policy=strict || policy=lenient
+    curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"large.bin\",\"target\":\"conflict.bin\",\"verify_policy\":\"${policy}\"}" \
+        > "${TEST_DIR}/conflict${i}.status" 2>/dev/null &
+    CONFLICT_PIDS="$CONFLICT_PIDS $!"
+done
+wait $CONFLICT_PIDS
+
+STATUSES="$(cat "${TEST_DIR}/conflict1.status") $(cat "${TEST_DIR}/conflict2.status")"
+RECEIVED_MD5=$(md5sum "${RECEIVER_DIR}/conflict.bin" 2>/dev/null | awk '{print $1}')
+if echo "$STATUSES" | grep -q "200" && echo "$STATUSES" | grep -q "409" && \
+   [ "$LARGE_MD5" = "$RECEIVED_MD5" ]; then
+    print_result 0 "Conflicting transfer was rejected with 409"
+else
+    print_result 1 "Expected one 200 and one 409, got: $STATUSES"
+fi
+
+# Test 11: a transfer whose first attempt fails reports its retries and completes
+print_test_header "Test 11: Retry events before a transfer succeeds"
+LATE_RECEIVER_DIR="${TEST_DIR}/late-receiver"
+mkdir -p "${LATE_RECEIVER_DIR}"
+PEER_SERVER_ADDR="localhost:50173" \
+ROOT_DIR="${SENDER_DIR}" \
+MAX_RETRIES=3 \
+RETRY_DELAY=1s \
+HTTP_PORT=8192 \
+GRPC_PORT=50172 \
+./bin/file-transfer-server > "${TEST_DIR}/late-sender.log" 2>&1 &
+LATE_SENDER_PID=$!
+sleep 2
+
+# The receiver only starts after the first attempt has failed
+curl -s -X POST http://localhost:8192/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"late.txt"}' \
+    > "${TEST_DIR}/transfer11.log" 2>&1 &
+LATE_CURL_PID=$!
+sleep 1
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${LATE_RECEIVER_DIR}" \
+HTTP_PORT=8193 \
+GRPC_PORT=50173 \
+./bin/file-transfer-server > "${TEST_DIR}/late-receiver.log" 2>&1 &
+LATE_RECEIVER_PID=$!
+wait $LATE_CURL_PID || true
+kill $LATE_SENDER_PID $LATE_RECEIVER_PID 2>/dev/null || true
+
+LATE_RESULT=$(python3 -c '
+import json, sys
+events = [json.loads(line) for line in open(sys.argv[1])]
+retries = [e for e in events if e.get("type") == "retry"]
+attempts = [e.get("attempt") for e in retries]
+reasons = all(e.get("error") for e in retries)
+print(attempts[:1], attempts == list(range(2, len(retries) + 2)), reasons, events[-1].get("type"))
+' "${TEST_DIR}/transfer11.log" 2>&1 || true)
+if [ "$LATE_RESULT" = "[2] True True batch_completed" ] && \
+   cmp -s "${SENDER_DIR}/small.txt" "${LATE_RECEIVER_DIR}/late.txt"; then
+    print_result 0 "The failed first attempt was followed by numbered retry events with reasons, then the file arrived"
+else
+    print_result 1 "Unexpected retry events: ${LATE_RESULT}, events=$(grep -c . "${TEST_DIR}/transfer11.log")"
+fi
+
+# Test 12: Transfer a directory as a tar stream
+print_test_header "Test 12: Transfer a directory as a tar stream"
+mkdir -p "${SENDER_DIR}/tree/sub/deep" "${SENDER_DIR}/tree/empty"
+echo "top" > "${SENDER_DIR}/tree/a.txt"
+echo "nested" > "${SENDER_DIR}/tree/sub/b.txt"
+cp "${SENDER_DIR}/medium.bin" "${SENDER_DIR}/tree/sub/deep/c.bin"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree","target":"tree-copy","archive":"tar"}' \
+    > "${TEST_DIR}/transfer12.log" 2>&1
+
+sleep 1
+
+if diff -r "${SENDER_DIR}/tree" "${RECEIVER_DIR}/tree-copy" > /dev/null 2>&1; then
+    print_result 0 "Directory structure and contents match after tar transfer"
+else
+    print_result 1 "Directory tar transfer does not match the source"
+fi
+
+# Test 13: Transfer a directory as a zstd-compressed tar stream
+print_test_header "Test 13: Transfer a directory as a zstd-compressed tar stream"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree","target":"tree-zst","archive":"tar.zst"}' \
+    > "${TEST_DIR}/transfer13.log" 2>&1
+
+sleep 1
+
+if diff -r "${SENDER_DIR}/tree" "${RECEIVER_DIR}/tree-zst" > /dev/null 2>&1; then
+    print_result 0 "Directory structure and contents match after tar.zst transfer"
+else
+    print_result 1 "Directory tar.zst transfer does not match the source"
+fi
+
+# Test 14: Verify policy option
+print_test_header "Test 14: Verify policy option"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"logs/*/*.log","target":"lenient","verify_policy":"lenient"}' \
+    > "${TEST_DIR}/transfer14.log" 2>&1
+INVALID_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"policy.txt","verify_policy":"sometimes"}')
+
+if diff -r "${SENDER_DIR}/logs" "${RECEIVER_DIR}/lenient" > /dev/null 2>&1 && \
+   [ "$INVALID_STATUS" = "400" ]; then
+    print_result 0 "Lenient batch completed and unknown policy was rejected"
+else
+    print_result 1 "Verify policy handling failed (invalid policy status: $INVALID_STATUS)"
+fi
+
+# Test 15: Post-transfer hooks
+print_test_header "Test 15: Post-transfer hooks"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"hooked.txt"}' \
+    > "${TEST_DIR}/transfer15.log" 2>&1
+
+sleep 1
+
+HOOK_BATCH_ID=$(grep -o '"batch_id":"[0-9a-f]*"' "${TEST_DIR}/transfer15.log" | head -n1 | cut -d'"' -f4)
+if grep -q "\"batch_id\":\"${HOOK_BATCH_ID}\",\"status\":\"completed\"" "${TEST_DIR}/webhook.log" 2>/dev/null && \
+   grep -q "^${HOOK_BATCH_ID} completed$" "${TEST_DIR}/hooks.log" 2>/dev/null; then
+    print_result 0 "Webhook and post-transfer command received the batch result"
+else
+    print_result 1 "Hooks did not receive the batch result for ${HOOK_BATCH_ID}"
+fi
+
+# Test 16: Startup rejects the same port for HTTP and gRPC
+print_test_header "Test 16: Startup rejects the same port for HTTP and gRPC"
+if PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/same-port" \
+    HTTP_PORT=8095 \
+    GRPC_PORT=8095 \
+    ./bin/file-transfer-server > "${TEST_DIR}/same-port.log" 2>&1; then
+    print_result 1 "Server started with HTTP_PORT equal to GRPC_PORT"
+elif grep -q "HTTP_PORT and GRPC_PORT must differ" "${TEST_DIR}/same-port.log"; then
+    print_result 0 "Same-port configuration was rejected at startup"
+else
+    print_result 1 "Unexpected startup failure: $(cat "${TEST_DIR}/same-port.log")"
+fi
+
+# Test 17: Pattern batches share one stream
+print_test_header "Test 17: Pattern batches share one stream"
+SHARED_BEFORE=$(grep -c "Transfer stream closed: files=3" "${TEST_DIR}/receiver.log" || true)
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"logs/*/*.log","target":"shared"}' \
+    > "${TEST_DIR}/transfer17.log" 2>&1
+
+sleep 1
+
+if diff -r "${SENDER_DIR}/logs" "${RECEIVER_DIR}/shared" > /dev/null 2>&1 && \
+   [ "$(grep -c "Transfer stream closed: files=3" "${TEST_DIR}/receiver.log")" -eq $((SHARED_BEFORE + 1)) ]; then
+    print_result 0 "Three files were sent over a single stream"
+else
+    print_result 1 "Pattern batch did not use a single stream"
+fi
+
+# Test 18: Strict mode resolves a symlinked ROOT_DIR
+print_test_header "Test 18: Strict mode resolves a symlinked ROOT_DIR"
+mkdir -p "${TEST_DIR}/outside"
+echo "secret" > "${TEST_DIR}/outside/secret.txt"
+ln -s "${TEST_DIR}/outside/secret.txt" "${SENDER_DIR}/escape.txt"
+ln -s "${SENDER_DIR}" "${TEST_DIR}/sender-link"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${TEST_DIR}/sender-link" \
+STRICT_ROOT_DIR=true \
+HTTP_PORT=8082 \
+GRPC_PORT=50053 \
+./bin/file-transfer-server > "${TEST_DIR}/strict.log" 2>&1 &
+STRICT_PID=$!
+sleep 2
+
+curl -X POST http://localhost:8082/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"strict.txt"}' \
+    > "${TEST_DIR}/transfer18.log" 2>&1
+ESCAPE_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8082/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"escape.txt","target":"escape.txt"}')
+kill $STRICT_PID 2>/dev/null || true
+
+if grep -q "rootDir=${SENDER_DIR}$" "${TEST_DIR}/strict.log" && \
+   [ "$SMALL_MD5" = "$(md5sum "${RECEIVER_DIR}/strict.txt" 2>/dev/null | awk '{print $1}')" ] && \
+   [ "$ESCAPE_STATUS" = "400" ] && [ ! -e "${RECEIVER_DIR}/escape.txt" ]; then
+    print_result 0 "Strict mode used the resolved ROOT_DIR and rejected an escaping symlink"
+else
+    print_result 1 "Strict root handling failed (escape status: $ESCAPE_STATUS)"
+fi
+
+# Test 19: Load-based throttling
+print_test_header "Test 19: Load-based throttling"
+echo "1000.00 1000.00 1000.00 1/100 12345" > "${TEST_DIR}/loadavg"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+LOAD_THRESHOLD=0.5 \
+LOAD_MAX_TRANSFERS=3 \
+LOAD_CHECK_INTERVAL=200ms \
+LOAD_AVG_FILE="${TEST_DIR}/loadavg" \
+HTTP_PORT=8083 \
+GRPC_PORT=50054 \
+./bin/file-transfer-server > "${TEST_DIR}/load.log" 2>&1 &
+LOAD_PID=$!
+sleep 2
+
+curl -X POST http://localhost:8083/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"loaded.txt"}' \
+    > "${TEST_DIR}/transfer19.log" 2>&1
+echo "0.00 0.00 0.00 1/100 12345" > "${TEST_DIR}/loadavg"
+sleep 1
+kill $LOAD_PID 2>/dev/null || true
+
+if grep -q "concurrency=1$" "${TEST_DIR}/load.log" && \
+   grep -q "concurrency=3$" "${TEST_DIR}/load.log" && \
+   [ "$SMALL_MD5" = "$(md5sum "${RECEIVER_DIR}/loaded.txt" 2>/dev/null | awk '{print $1}')" ]; then
+    print_result 0 "Concurrency dropped under high load and recovered"
+else
+    print_result 1 "Load limiter did not adjust concurrency"
+fi
+
+# Test 20: Invalid requests are rejected with field errors
+print_test_header "Test 20: Invalid requests are rejected with field errors"
+INVALID_STATUS=$(curl -s -o "${TEST_DIR}/invalid.json" -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"target":"../outside","archive":"zip","verify_policy":"sometimes"}')
+
+if [ "$INVALID_STATUS" = "400" ] && \
+   grep -q '"field":"source","message":"is required"' "${TEST_DIR}/invalid.json" && \
+   grep -q '"field":"target"' "${TEST_DIR}/invalid.json" && \
+   grep -q '"field":"archive"' "${TEST_DIR}/invalid.json" && \
+   grep -q '"field":"verify_policy"' "${TEST_DIR}/invalid.json"; then
+    print_result 0 "Every invalid field was reported"
+else
+    print_result 1 "Unexpected validation response ($INVALID_STATUS): $(cat "${TEST_DIR}/invalid.json")"
+fi
+
+# Test 21: Pull a directory tree from the peer
+print_test_header "Test 21: Pull a directory tree from the peer"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree-copy","target":"pulled","pull":true,"archive":"tar.zst"}' \
+    > "${TEST_DIR}/transfer21.log" 2>&1
+
+if diff -r "${SENDER_DIR}/tree" "${SENDER_DIR}/pulled" > /dev/null 2>&1; then
+    print_result 0 "Pulled tree matches the peer's directory"
+else
+    print_result 1 "Pulled tree does not match the peer's directory"
+fi
+
+# Test 22: Correlation ID ties sender and receiver logs together
+print_test_header "Test 22: Correlation ID ties sender and receiver logs together"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -H "X-Correlation-ID: e2e-trace-22" \
+    -d '{"source":"small.txt","target":"traced.txt"}' \
+    > "${TEST_DIR}/transfer22.log" 2>&1
+
+sleep 1
+
+if grep -q '"correlation_id":"e2e-trace-22"' "${TEST_DIR}/transfer22.log" && \
+   grep -q "correlationID=e2e-trace-22" "${TEST_DIR}/sender.log" && \
+   grep -q "correlationID=e2e-trace-22" "${TEST_DIR}/receiver.log"; then
+    print_result 0 "Correlation ID appears in events and both servers' logs"
+else
+    print_result 1 "Correlation ID was not propagated end to end"
+fi
+
+# Test 23: Range requests on /download
+print_test_header "Test 23: Range requests on /download"
+RANGE_STATUS=$(curl -s -o "${TEST_DIR}/range1.out" -w "%{http_code}" -H "Range: bytes=0-4" \
+    "http://localhost:${SENDER_PORT}/download?path=small.txt")
+OPEN_STATUS=$(curl -s -o "${TEST_DIR}/range2.out" -w "%{http_code}" -H "Range: bytes=7-" \
+    "http://localhost:${SENDER_PORT}/download?path=small.txt")
+UNSATISFIABLE_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -H "Range: bytes=100-200" \
+    "http://localhost:${SENDER_PORT}/download?path=small.txt")
+
+if [ "$RANGE_STATUS" = "206" ] && [ "$(cat "${TEST_DIR}/range1.out")" = "Hello" ] && \
+   [ "$OPEN_STATUS" = "206" ] && [ "$(cat "${TEST_DIR}/range2.out")" = "World!" ] && \
+   [ "$UNSATISFIABLE_STATUS" = "416" ]; then
+    print_result 0 "Single, open-ended and unsatisfiable ranges handled"
+else
+    print_result 1 "Range handling failed: $RANGE_STATUS $OPEN_STATUS $UNSATISFIABLE_STATUS"
+fi
+
+# Test 24: Immutable attribute on received files (needs CAP_LINUX_IMMUTABLE)
+print_test_header "Test 24: Immutable attribute on received files"
+mkdir -p "${TEST_DIR}/immutable"
+touch "${TEST_DIR}/immutable/probe"
+if command -v chattr > /dev/null 2>&1 && chattr +i "${TEST_DIR}/immutable/probe" 2>/dev/null; then
+    chattr -i "${TEST_DIR}/immutable/probe"
+    PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/immutable" \
+    SET_IMMUTABLE=true \
+    HTTP_PORT=8085 \
+    GRPC_PORT=50055 \
+    ./bin/file-transfer-server > "${TEST_DIR}/immutable-receiver.log" 2>&1 &
+    IMMUTABLE_RECEIVER_PID=$!
+    PEER_SERVER_ADDR="localhost:50055" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HTTP_PORT=8084 \
+    GRPC_PORT=50056 \
+    ./bin/file-transfer-server > "${TEST_DIR}/immutable-sender.log" 2>&1 &
+    IMMUTABLE_SENDER_PID=$!
+    sleep 2
+
+    curl -X POST http://localhost:8084/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"small.txt","target":"locked.txt"}' \
+        > "${TEST_DIR}/transfer24.log" 2>&1
+    kill $IMMUTABLE_RECEIVER_PID $IMMUTABLE_SENDER_PID 2>/dev/null || true
+
+    ATTRS=$(lsattr "${TEST_DIR}/immutable/locked.txt" 2>/dev/null | awk '{print $1}')
+    chattr -i "${TEST_DIR}/immutable/locked.txt" 2>/dev/null || true
+    if echo "$ATTRS" | grep -q "i"; then
+        print_result 0 "Received file has the immutable attribute"
+    else
+        print_result 1 "Immutable attribute not set (attributes: $ATTRS)"
+    fi
+else
+    echo -e "${YELLOW}SKIP${NC}: chattr +i not permitted here"
+fi
+
+# Test 25: Open-file budget
+print_test_header "Test 25: Open-file budget"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+MAX_OPEN_FILES=1 \
+HTTP_PORT=8086 \
+GRPC_PORT=50057 \
+./bin/file-transfer-server > "${TEST_DIR}/budget.log" 2>&1 &
+BUDGET_PID=$!
+sleep 2
+
+BUDGET_PIDS=""
+for i in 1 2 3; do
+    curl -s -X POST http://localhost:8086/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"large.bin\",\"target\":\"budget${i}.bin\"}" \
+        > "${TEST_DIR}/budget${i}.log" 2>&1 &
+    BUDGET_PIDS="$BUDGET_PIDS $!"
+done
+
+# Sample the sender's open source files while the transfers run
+MAX_OPEN=0
+while kill -0 $BUDGET_PIDS 2>/dev/null; do
+    OPEN=$(ls -l /proc/${BUDGET_PID}/fd 2>/dev/null | grep -c "${SENDER_DIR}/" || true)
+    [ "$OPEN" -gt "$MAX_OPEN" ] && MAX_OPEN=$OPEN
+    sleep 0.05
+done
+wait $BUDGET_PIDS
+kill $BUDGET_PID 2>/dev/null || true
+
+BUDGET_OK=1
+for i in 1 2 3; do
+    [ "$LARGE_MD5" = "$(md5sum "${RECEIVER_DIR}/budget${i}.bin" 2>/dev/null | awk '{print $1}')" ] || BUDGET_OK=0
+done
+if [ "$BUDGET_OK" = "1" ] && [ "$MAX_OPEN" -le 1 ]; then
+    print_result 0 "Concurrent transfers completed within a budget of one open file"
+else
+    print_result 1 "Open-file budget exceeded or transfers failed (max open: $MAX_OPEN)"
+fi
+
+# Test 26: Staged transfers are promoted or discarded
+print_test_header "Test 26: Staged transfers are promoted or discarded"
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"logs/{app,db}/*.log","target":"staged","stage":true}' \
+    > "${TEST_DIR}/transfer26a.log" 2>&1
+STAGED_ID=$(grep -o '"batch_id":"[0-9a-f]*"' "${TEST_DIR}/transfer26a.log" | head -n1 | cut -d'"' -f4)
+STAGED_BEFORE=$([ -f "${RECEIVER_DIR}/.staging/${STAGED_ID}/staged/app/1.log" ] && [ ! -e "${RECEIVER_DIR}/staged" ] && echo ok)
+PROMOTE_STATUS=$(curl -s -o "${TEST_DIR}/promote.json" -w "%{http_code}" -X POST \
+    http://localhost:${SENDER_PORT}/promote/${STAGED_ID})
+
+curl -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"discarded.txt","stage":true}' \
+    > "${TEST_DIR}/transfer26b.log" 2>&1
+DISCARD_ID=$(grep -o '"batch_id":"[0-9a-f]*"' "${TEST_DIR}/transfer26b.log" | head -n1 | cut -d'"' -f4)
+DISCARD_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/discard/${DISCARD_ID})
+MISSING_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/promote/${DISCARD_ID})
+
+if [ "$STAGED_BEFORE" = "ok" ] && [ "$PROMOTE_STATUS" = "200" ] && \
+   grep -q '"files":2' "${TEST_DIR}/promote.json" && \
+   diff "${SENDER_DIR}/logs/app/1.log" "${RECEIVER_DIR}/staged/app/1.log" > /dev/null && \
+   diff "${SENDER_DIR}/logs/db/1.log" "${RECEIVER_DIR}/staged/db/1.log" > /dev/null && \
+   [ ! -e "${RECEIVER_DIR}/.staging/${STAGED_ID}" ] && \
+   [ "$DISCARD_STATUS" = "200" ] && [ ! -e "${RECEIVER_DIR}/discarded.txt" ] && \
+   [ ! -e "${RECEIVER_DIR}/.staging/${DISCARD_ID}" ] && [ "$MISSING_STATUS" = "404" ]; then
+    print_result 0 "Staged batch was promoted and another was discarded"
+else
+    print_result 1 "Staging failed (staged: $STAGED_BEFORE, promote: $PROMOTE_STATUS, discard: $DISCARD_STATUS, missing: $MISSING_STATUS)"
+fi
+
+# Test 27: Source file shrinking mid-transfer is reported clearly
+print_test_header "Test 27: Source file shrinking mid-transfer is reported clearly"
+truncate -s 2G "${SENDER_DIR}/shrinking.bin"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"shrinking.bin","target":"shrinking.bin"}' \
+    > "${TEST_DIR}/transfer27.log" 2>&1 &
+SHRINK_CURL_PID=$!
+sleep 0.3
+truncate -s 1M "${SENDER_DIR}/shrinking.bin"
+wait $SHRINK_CURL_PID || true
+
+if grep -q "source file changed size during transfer" "${TEST_DIR}/transfer27.log" && \
+   [ ! -e "${RECEIVER_DIR}/shrinking.bin" ]; then
+    print_result 0 "Size change was reported and no partial file was kept"
+else
+    print_result 1 "Size change was not reported: $(tail -n1 "${TEST_DIR}/transfer27.log")"
+fi
+rm -f "${SENDER_DIR}/shrinking.bin"
+
+# Test 28: Archive transfers can preserve directory mtimes
+print_test_header "Test 28: Archive transfers can preserve directory mtimes"
+touch -d "2020-01-02 03:04:05" "${SENDER_DIR}/tree/sub/b.txt" "${SENDER_DIR}/tree/sub"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree","target":"tree-mtimes","archive":"tar","preserve_mtimes":true}' \
+    > "${TEST_DIR}/transfer28.log" 2>&1
+
+SOURCE_MTIME=$(stat -c %Y "${SENDER_DIR}/tree/sub")
+TARGET_MTIME=$(stat -c %Y "${RECEIVER_DIR}/tree-mtimes/sub" 2>/dev/null || echo missing)
+FILE_MTIME=$(stat -c %Y "${RECEIVER_DIR}/tree-mtimes/sub/b.txt" 2>/dev/null || echo missing)
+if [ "$SOURCE_MTIME" = "$TARGET_MTIME" ] && [ "$(stat -c %Y "${SENDER_DIR}/tree/sub/b.txt")" = "$FILE_MTIME" ]; then
+    print_result 0 "Directory and file mtimes match the source"
+else
+    print_result 1 "Mtime mismatch: source=${SOURCE_MTIME}, target=${TARGET_MTIME}, file=${FILE_MTIME}"
+fi
+
+# Test 29: Read-only mode rejects writes but serves reads
+print_test_header "Test 29: Read-only mode rejects writes but serves reads"
+mkdir -p "${TEST_DIR}/readonly/shared"
+echo "replica" > "${TEST_DIR}/readonly/shared/r.txt"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${TEST_DIR}/readonly" \
+READ_ONLY=true \
+HTTP_PORT=8087 \
+GRPC_PORT=50058 \
+./bin/file-transfer-server > "${TEST_DIR}/readonly.log" 2>&1 &
+READONLY_PID=$!
+PEER_SERVER_ADDR="localhost:50058" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8088 \
+GRPC_PORT=50059 \
+./bin/file-transfer-server > "${TEST_DIR}/readonly-client.log" 2>&1 &
+READONLY_CLIENT_PID=$!
+sleep 2
+
+TRANSFER_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8087/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"shared/r.txt","target":"r.txt"}')
+PROMOTE_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8087/promote/some-batch)
+DOWNLOAD_BODY=$(curl -s "http://localhost:8087/download?path=shared/r.txt")
+curl -s -X POST http://localhost:8088/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"pushed.txt"}' \
+    > "${TEST_DIR}/transfer29-push.log" 2>&1 || true
+curl -s -X POST http://localhost:8088/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"shared","target":"readonly-pulled","pull":true}' \
+    > "${TEST_DIR}/transfer29-pull.log" 2>&1
+kill $READONLY_PID $READONLY_CLIENT_PID 2>/dev/null || true
+
+if [ "$TRANSFER_STATUS" = "403" ] && [ "$PROMOTE_STATUS" = "403" ] && \
+   [ "$DOWNLOAD_BODY" = "replica" ] && \
+   grep -q "server is read-only" "${TEST_DIR}/transfer29-push.log" && \
+   [ ! -e "${TEST_DIR}/readonly/pushed.txt" ] && \
+   diff -r "${TEST_DIR}/readonly/shared" "${SENDER_DIR}/readonly-pulled" > /dev/null 2>&1; then
+    print_result 0 "Writes were rejected and reads succeeded"
+else
+    print_result 1 "Read-only mode misbehaved: transfer=${TRANSFER_STATUS}, promote=${PROMOTE_STATUS}, download=${DOWNLOAD_BODY}"
+fi
+
+# Test 30: Slow transfers are logged
+print_test_header "Test 30: Slow transfers are logged"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+SLOW_TRANSFER_SPEED=1048576 \
+HTTP_PORT=8086 \
+GRPC_PORT=50057 \
+./bin/file-transfer-server > "${TEST_DIR}/slow.log" 2>&1 &
+SLOW_PID=$!
+sleep 2
+
+# A 14-byte file cannot reach 1MB/s; 10MB over loopback easily does
+curl -s -X POST http://localhost:8086/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"slow-small.txt"}' \
+    > "${TEST_DIR}/transfer30-slow.log" 2>&1
+curl -s -X POST http://localhost:8086/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"slow-medium.bin"}' \
+    > "${TEST_DIR}/transfer30-fast.log" 2>&1
+kill $SLOW_PID 2>/dev/null || true
+
+if grep -q "slow transfer: .*source=small.txt" "${TEST_DIR}/slow.log" && \
+   ! grep -q "slow transfer: .*source=medium.bin" "${TEST_DIR}/slow.log"; then
+    print_result 0 "Only the slow transfer was logged"
+else
+    print_result 1 "Unexpected slow-transfer warnings: $(grep "slow transfer" "${TEST_DIR}/slow.log")"
+fi
+
+# Test 31: Trailing slash on the target means "into this directory"
+print_test_header "Test 31: Target filename vs. target directory"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree/a.txt","target":"renamed.txt"}' \
+    > "${TEST_DIR}/transfer31-file.log" 2>&1
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree/a.txt","target":"into-dir/"}' \
+    > "${TEST_DIR}/transfer31-dir.log" 2>&1
+
+if [ -f "${RECEIVER_DIR}/renamed.txt" ] && [ -f "${RECEIVER_DIR}/into-dir/a.txt" ] && \
+   diff "${SENDER_DIR}/tree/a.txt" "${RECEIVER_DIR}/renamed.txt" > /dev/null && \
+   diff "${SENDER_DIR}/tree/a.txt" "${RECEIVER_DIR}/into-dir/a.txt" > /dev/null; then
+    print_result 0 "Target without a slash is the filename, with a slash the directory"
+else
+    print_result 1 "Target path semantics incorrect"
+fi
+
+# Test 32: Path traversal attempts are counted
+print_test_header "Test 32: Path traversal attempts are counted"
+metric_value() {
+    curl -s http://localhost:${SENDER_PORT}/metrics | \
+        awk -v m="path_validation_rejections_total{reason=\"$1\"}" '$1 == m {print $2}'
+}
+BEFORE=$(metric_value traversal)
+curl -s -o /dev/null "http://localhost:${SENDER_PORT}/download?path=../etc/passwd"
+AFTER=$(metric_value traversal)
+
+if [ "${AFTER:-0}" -eq $(( ${BEFORE:-0} + 1 )) ] && grep -q 'path rejected: reason=traversal, path="../etc/passwd"' "${TEST_DIR}/sender.log"; then
+    print_result 0 "Traversal attempt incremented the rejection counter"
+else
+    print_result 1 "Rejection counter not incremented (before: ${BEFORE:-0}, after: ${AFTER:-0})"
+fi
+
+# Test 33: A large file sent as parallel ranges
+print_test_header "Test 33: A large file sent as parallel ranges"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"large.bin","target":"ranged/large.bin","parallel_chunks":4}' \
+    > "${TEST_DIR}/transfer33.log" 2>&1
+
+RANGED_MD5=$(md5sum "${RECEIVER_DIR}/ranged/large.bin" 2>/dev/null | awk '{print $1}')
+if [ "$LARGE_MD5" = "$RANGED_MD5" ] && [ "$(ls "${RECEIVER_DIR}/ranged")" = "large.bin" ]; then
+    print_result 0 "Ranges were reassembled into an identical file"
+else
+    print_result 1 "Ranged transfer failed: $(tail -n1 "${TEST_DIR}/transfer33.log")"
+fi
+
+# Test 34: An unresponsive peer fails within DIAL_TIMEOUT
+print_test_header "Test 34: An unresponsive peer fails within DIAL_TIMEOUT"
+# Accepts connections but never completes the HTTP/2 handshake
+python3 -c '
+import socket
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50060))
+s.listen(16)
+conns = []
+while True:
+    conns.append(s.accept()[0])
+' &
+SILENT_PEER_PID=$!
+PEER_SERVER_ADDR="127.0.0.1:50060" \
+ROOT_DIR="${SENDER_DIR}" \
+DIAL_TIMEOUT=1s \
+HTTP_PORT=8089 \
+GRPC_PORT=50061 \
+./bin/file-transfer-server > "${TEST_DIR}/dial-timeout.log" 2>&1 &
+DIAL_TIMEOUT_PID=$!
+sleep 2
+
+DIAL_START=$(date +%s)
+curl -s --max-time 20 -X POST http://localhost:8089/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"unreachable.txt"}' \
+    > "${TEST_DIR}/transfer34.log" 2>&1 || true
+DIAL_ELAPSED=$(( $(date +%s) - DIAL_START ))
+kill $DIAL_TIMEOUT_PID $SILENT_PEER_PID 2>/dev/null || true
+
+if grep -q "peer unavailable" "${TEST_DIR}/transfer34.log" && [ "$DIAL_ELAPSED" -le 5 ]; then
+    print_result 0 "Transfer failed after ${DIAL_ELAPSED}s with a peer unavailable error"
+else
+    print_result 1 "Dial did not fail fast (${DIAL_ELAPSED}s): $(tail -n1 "${TEST_DIR}/transfer34.log")"
+fi
+
+# Test 35: Resume a batch's event stream with Last-Event-ID
+print_test_header "Test 35: Resume a batch's event stream with Last-Event-ID"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"events.bin"}' \
+    > "${TEST_DIR}/transfer35.log" 2>&1
+EVENTS_BATCH_ID=$(head -n1 "${TEST_DIR}/transfer35.log" | grep -o '"batch_id":"[^"]*"' | cut -d'"' -f4)
+curl -s -H "Last-Event-ID: 2" "http://localhost:${SENDER_PORT}/transfer/${EVENTS_BATCH_ID}/events" \
+    > "${TEST_DIR}/events35.log" 2>&1
+
+if [ -s "${TEST_DIR}/events35.log" ] && \
+   diff <(tail -n +3 "${TEST_DIR}/transfer35.log") "${TEST_DIR}/events35.log" > /dev/null && \
+   head -n1 "${TEST_DIR}/events35.log" | grep -q '"id":3}'; then
+    print_result 0 "Reconnect received only events after Last-Event-ID"
+else
+    print_result 1 "Resumed events differ from the original stream"
+fi
+
+# Test 36: Transfers are rejected when free inodes are below MIN_FREE_INODES
+print_test_header "Test 36: Transfers are rejected when free inodes run low"
+mkdir -p "${TEST_DIR}/inodes"
+# No filesystem has this many free inodes, while its free space is untouched
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/inodes" \
+MIN_FREE_INODES=9000000000000000000 \
+HTTP_PORT=8093 \
+GRPC_PORT=50063 \
+./bin/file-transfer-server > "${TEST_DIR}/inodes-receiver.log" 2>&1 &
+INODES_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50063" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8094 \
+GRPC_PORT=50064 \
+./bin/file-transfer-server > "${TEST_DIR}/inodes-sender.log" 2>&1 &
+INODES_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8094/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree","target":"tree","archive":"tar"}' \
+    > "${TEST_DIR}/transfer36.log" 2>&1 || true
+kill $INODES_RECEIVER_PID $INODES_SENDER_PID 2>/dev/null || true
+
+if grep -q "not enough free inodes" "${TEST_DIR}/transfer36.log" && [ ! -e "${TEST_DIR}/inodes/tree" ]; then
+    print_result 0 "Archive transfer was rejected for lack of inodes"
+else
+    print_result 1 "Inode check did not reject the transfer: $(tail -n1 "${TEST_DIR}/transfer36.log")"
+fi
+
+# Test 37: Strict mode rejects path components it cannot resolve
+print_test_header "Test 37: Strict mode rejects unresolvable path components"
+mkdir -p "${TEST_DIR}/resolve/locked"
+echo "hidden" > "${TEST_DIR}/resolve/locked/file.txt"
+ln -s loop "${TEST_DIR}/resolve/loop"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${TEST_DIR}/resolve" \
+STRICT_ROOT_DIR=true \
+HTTP_PORT=8082 \
+GRPC_PORT=50053 \
+./bin/file-transfer-server > "${TEST_DIR}/resolve.log" 2>&1 &
+RESOLVE_PID=$!
+sleep 2
+
+MISSING_STATUS=$(curl -s -o /dev/null -w "%{http_code}" "http://localhost:8082/download?path=missing/dir/file.txt")
+LOOP_STATUS=$(curl -s -o "${TEST_DIR}/loop37.log" -w "%{http_code}" "http://localhost:8082/download?path=loop/file.txt")
+# Permission checks only apply when not running as root
+chmod 000 "${TEST_DIR}/resolve/locked"
+if ls "${TEST_DIR}/resolve/locked" > /dev/null 2>&1; then
+    LOCKED_STATUS=skipped
+else
+    LOCKED_STATUS=$(curl -s -o /dev/null -w "%{http_code}" "http://localhost:8082/download?path=locked/file.txt")
+fi
+chmod 755 "${TEST_DIR}/resolve/locked"
+kill $RESOLVE_PID 2>/dev/null || true
+
+if [ "$MISSING_STATUS" = "404" ] && [ "$LOOP_STATUS" = "400" ] && grep -q "cannot resolve path" "${TEST_DIR}/loop37.log" && \
+   { [ "$LOCKED_STATUS" = "skipped" ] || [ "$LOCKED_STATUS" = "403" ]; }; then
+    print_result 0 "Missing paths fell back, unresolvable ones were rejected (permission case: ${LOCKED_STATUS})"
+else
+    print_result 1 "Unexpected results: missing=${MISSING_STATUS}, loop=${LOOP_STATUS}, locked=${LOCKED_STATUS}"
+fi
+
+# Test 38: Named pipes are skipped or recreated per policy
+print_test_header "Test 38: Named pipes are skipped or recreated per policy"
+mkdir -p "${SENDER_DIR}/special"
+echo "data" > "${SENDER_DIR}/special/data.txt"
+mkfifo "${SENDER_DIR}/special/pipe"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"special","target":"special-skip","archive":"tar"}' \
+    > "${TEST_DIR}/transfer38-skip.log" 2>&1
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"special","target":"special-fifo","archive":"tar","special_files":"recreate"}' \
+    > "${TEST_DIR}/transfer38-recreate.log" 2>&1
+rm -f "${SENDER_DIR}/special/pipe"
+
+if [ -f "${RECEIVER_DIR}/special-skip/data.txt" ] && [ ! -e "${RECEIVER_DIR}/special-skip/pipe" ] && \
+   grep -q "skipping special file in archive: path=.*special/pipe" "${TEST_DIR}/sender.log" && \
+   [ -p "${RECEIVER_DIR}/special-fifo/pipe" ] && [ -f "${RECEIVER_DIR}/special-fifo/data.txt" ]; then
+    print_result 0 "FIFO was skipped by default and recreated on request"
+else
+    print_result 1 "Special file policy not applied"
+fi
+
+# Test 39: Per-request peer address limited to ALLOWED_PEERS
+print_test_header "Test 39: Per-request peer address limited to ALLOWED_PEERS"
+PEER_SERVER_ADDR="localhost:1" \
+ALLOWED_PEERS="localhost:${RECEIVER_PORT}, localhost:50098" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8096 \
+GRPC_PORT=50066 \
+./bin/file-transfer-server > "${TEST_DIR}/adhoc.log" 2>&1 &
+ADHOC_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8096/transfer \
+    -H "Content-Type: application/json" \
+    -d "{\"source\":\"small.txt\",\"target\":\"adhoc.txt\",\"peer_address\":\"localhost:${RECEIVER_PORT}\"}" \
+    > "${TEST_DIR}/transfer39-allowed.log" 2>&1
+DENIED_STATUS=$(curl -s -o "${TEST_DIR}/transfer39-denied.log" -w "%{http_code}" -X POST http://localhost:8096/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"adhoc-denied.txt","peer_address":"localhost:50099"}')
+kill $ADHOC_PID 2>/dev/null || true
+
+if [ "$SMALL_MD5" = "$(md5sum "${RECEIVER_DIR}/adhoc.txt" 2>/dev/null | awk '{print $1}')" ] && \
+   [ "$DENIED_STATUS" = "400" ] && grep -q '"field":"peer_address"' "${TEST_DIR}/transfer39-denied.log"; then
+    print_result 0 "Allowed ad-hoc peer was used and a disallowed one rejected"
+else
+    print_result 1 "Ad-hoc peer handling failed (denied status: $DENIED_STATUS)"
+fi
+
+# Test 40: Per-file and batch completion events
+print_test_header "Test 40: Per-file and batch completion events"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"logs/*/1.log","target":"completion"}' \
+    > "${TEST_DIR}/transfer40.log" 2>&1
+
+FILE_EVENTS=$(grep -c '"type":"file_completed"' "${TEST_DIR}/transfer40.log" || true)
+BATCH_EVENTS=$(grep -c '"type":"batch_completed"' "${TEST_DIR}/transfer40.log" || true)
+if [ "$FILE_EVENTS" = "3" ] && [ "$BATCH_EVENTS" = "1" ] && \
+   grep '"type":"file_completed"' "${TEST_DIR}/transfer40.log" | grep -q '"path":"completion/app/1.log".*"checksum":"' && \
+   tail -n1 "${TEST_DIR}/transfer40.log" | grep -q '"type":"batch_completed".*"files":3'; then
+    print_result 0 "Three file_completed events followed by one batch_completed"
+else
+    print_result 1 "Unexpected completion events: file=${FILE_EVENTS}, batch=${BATCH_EVENTS}"
+fi
+
+# Test 41: Requests beyond MAX_QUEUE_DEPTH are rejected with 503
+print_test_header "Test 41: Requests beyond MAX_QUEUE_DEPTH are rejected with 503"
+# A peer that never answers keeps the single slot busy until DIAL_TIMEOUT
+python3 -c '
+import socket
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50060))
+s.listen(16)
+conns = []
+while True:
+    conns.append(s.accept()[0])
+' &
+SILENT_PEER_PID=$!
+echo "1000.00 1000.00 1000.00 1/100 12345" > "${TEST_DIR}/loadavg-queue"
+PEER_SERVER_ADDR="127.0.0.1:50060" \
+ROOT_DIR="${SENDER_DIR}" \
+DIAL_TIMEOUT=4s \
+LOAD_THRESHOLD=0.5 \
+LOAD_CHECK_INTERVAL=2s \
+LOAD_AVG_FILE="${TEST_DIR}/loadavg-queue" \
+MAX_QUEUE_DEPTH=1 \
+HTTP_PORT=8097 \
+GRPC_PORT=50067 \
+./bin/file-transfer-server > "${TEST_DIR}/queue.log" 2>&1 &
+QUEUE_PID=$!
+sleep 2
+
+QUEUE_PIDS=""
+for i in 1 2; do
+    curl -s -X POST http://localhost:8097/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"small.txt\",\"target\":\"queued${i}.txt\"}" \
+        > "${TEST_DIR}/transfer41-${i}.log" 2>&1 &
+    QUEUE_PIDS="$QUEUE_PIDS $!"
+    sleep 0.5
+done
+QUEUE_DEPTH=$(curl -s http://localhost:8097/metrics | awk '$1 == "transfer_queue_depth" {print $2}')
+curl -s -D "${TEST_DIR}/transfer41-rejected.headers" -o /dev/null -X POST http://localhost:8097/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"queued3.txt"}'
+wait $QUEUE_PIDS || true
+kill $QUEUE_PID $SILENT_PEER_PID 2>/dev/null || true
+
+if head -n1 "${TEST_DIR}/transfer41-rejected.headers" | grep -q " 503" && \
+   grep -qi "^Retry-After: 2" "${TEST_DIR}/transfer41-rejected.headers" && [ "$QUEUE_DEPTH" = "1" ]; then
+    print_result 0 "Request beyond the queue limit got 503 with Retry-After"
+else
+    print_result 1 "Queue limit not enforced (depth: ${QUEUE_DEPTH}): $(head -n1 "${TEST_DIR}/transfer41-rejected.headers")"
+fi
+
+# Test 42: Incremental sync skips unchanged files
+print_test_header "Test 42: Incremental sync skips unchanged files"
+sync_transfer() {
+    curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"sync.txt\",\"target\":\"sync.txt\",\"sync\":\"$1\"}" \
+        > "${TEST_DIR}/transfer42-$2.log" 2>&1
+}
+echo "version 1" > "${SENDER_DIR}/sync.txt"
+touch -d "2021-05-05 10:00:00" "${SENDER_DIR}/sync.txt"
+sync_transfer quick first
+sync_transfer quick repeat
+# Same size and mtime, different content: quick check misses it, checksum mode does not
+echo "version 2" > "${SENDER_DIR}/sync.txt"
+touch -d "2021-05-05 10:00:00" "${SENDER_DIR}/sync.txt"
+SYNC_MTIME=$(stat -c %Y "${SENDER_DIR}/sync.txt")
+sync_transfer quick same-stat
+QUICK_CONTENT=$(cat "${RECEIVER_DIR}/sync.txt")
+sync_transfer checksum forced
+CHECKSUM_CONTENT=$(cat "${RECEIVER_DIR}/sync.txt")
+sync_transfer checksum unchanged
+
+if grep -q '"file completed: sync.txt"' "${TEST_DIR}/transfer42-first.log" && \
+   grep -q '"file unchanged: sync.txt"' "${TEST_DIR}/transfer42-repeat.log" && \
+   [ "$QUICK_CONTENT" = "version 1" ] && \
+   grep -q '"file completed: sync.txt"' "${TEST_DIR}/transfer42-forced.log" && \
+   [ "$CHECKSUM_CONTENT" = "version 2" ] && \
+   grep -q '"file unchanged: sync.txt"' "${TEST_DIR}/transfer42-unchanged.log" && \
+   [ "$(stat -c %Y "${RECEIVER_DIR}/sync.txt")" = "$SYNC_MTIME" ]; then
+    print_result 0 "Quick check skipped unchanged files and checksum mode caught a same-stat change"
+else
+    print_result 1 "Incremental sync misbehaved (quick: ${QUICK_CONTENT}, checksum: ${CHECKSUM_CONTENT})"
+fi
+
+# Test 43: The root path lists the available endpoints
+print_test_header "Test 43: Root path lists endpoints"
+ROOT_STATUS=$(curl -s -o "${TEST_DIR}/root43.json" -w "%{http_code}" http://localhost:${SENDER_PORT}/)
+UNKNOWN_STATUS=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:${SENDER_PORT}/unknown)
+
+if [ "$ROOT_STATUS" = "200" ] && \
+   grep -q '"version":' "${TEST_DIR}/root43.json" && \
+   grep -q '"POST /transfer"' "${TEST_DIR}/root43.json" && \
+   grep -q '"GET /health"' "${TEST_DIR}/root43.json" && \
+   [ "$UNKNOWN_STATUS" = "404" ]; then
+    print_result 0 "Root path returned the endpoint list"
+else
+    print_result 1 "Root path returned ${ROOT_STATUS} (unknown path: ${UNKNOWN_STATUS}): $(cat "${TEST_DIR}/root43.json")"
+fi
+
+# Test 44: With API_TOKEN set, mutating endpoints require the bearer token
+print_test_header "Test 44: API_TOKEN requires a bearer token"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+API_TOKEN="s3cret" \
+HTTP_PORT=8098 \
+GRPC_PORT=50068 \
+./bin/file-transfer-server > "${TEST_DIR}/token.log" 2>&1 &
+TOKEN_PID=$!
+sleep 2
+
+token_transfer() {
+    curl -s -o "${TEST_DIR}/transfer44-$1.log" -w "%{http_code}" -X POST http://localhost:8098/transfer \
+        -H "Content-Type: application/json" "${@:2}" \
+        -d "{\"source\":\"small.txt\",\"target\":\"token-$1.txt\"}"
+}
+MISSING_STATUS=$(token_transfer missing)
+WRONG_STATUS=$(token_transfer wrong -H "Authorization: Bearer wrong")
+AUTHORIZED_STATUS=$(token_transfer authorized -H "Authorization: Bearer s3cret")
+TOKEN_HEALTH=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:8098/health)
+kill $TOKEN_PID 2>/dev/null || true
+
+if [ "$MISSING_STATUS" = "401" ] && [ "$WRONG_STATUS" = "401" ] && [ "$AUTHORIZED_STATUS" = "200" ] && \
+   [ "$TOKEN_HEALTH" = "200" ] && [ -f "${RECEIVER_DIR}/token-authorized.txt" ] && \
+   [ ! -f "${RECEIVER_DIR}/token-missing.txt" ] && [ ! -f "${RECEIVER_DIR}/token-wrong.txt" ]; then
+    print_result 0 "Only the request with the right token was accepted"
+else
+    print_result 1 "Token check misbehaved (missing: ${MISSING_STATUS}, wrong: ${WRONG_STATUS}, authorized: ${AUTHORIZED_STATUS}, health: ${TOKEN_HEALTH})"
+fi
+
+# Test 45: WRITE_FLUSH_SIZE coalesces writes without changing the received data
+print_test_header "Test 45: Coalesced writes with WRITE_FLUSH_SIZE"
+mkdir -p "${TEST_DIR}/flush"
+# An odd flush size so chunks straddle buffer boundaries and leave a tail to flush
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/flush" \
+WRITE_FLUSH_SIZE=12345678 \
+HTTP_PORT=8099 \
+GRPC_PORT=50069 \
+./bin/file-transfer-server > "${TEST_DIR}/flush-receiver.log" 2>&1 &
+FLUSH_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50069" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8100 \
+GRPC_PORT=50070 \
+./bin/file-transfer-server > "${TEST_DIR}/flush-sender.log" 2>&1 &
+FLUSH_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8100/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"medium.bin"}' \
+    > "${TEST_DIR}/transfer45-single.log" 2>&1
+curl -s -X POST http://localhost:8100/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"large.bin","target":"large.bin","parallel_chunks":7}' \
+    > "${TEST_DIR}/transfer45-ranged.log" 2>&1
+kill $FLUSH_RECEIVER_PID $FLUSH_SENDER_PID 2>/dev/null || true
+
+FLUSH_MEDIUM_MD5=$(md5sum "${TEST_DIR}/flush/medium.bin" 2>/dev/null | awk '{print $1}')
+FLUSH_LARGE_MD5=$(md5sum "${TEST_DIR}/flush/large.bin" 2>/dev/null | awk '{print $1}')
+if [ "$FLUSH_MEDIUM_MD5" = "$MEDIUM_MD5" ] && [ "$FLUSH_LARGE_MD5" = "$LARGE_MD5" ]; then
+    print_result 0 "Single and ranged transfers arrived intact with coalesced writes"
+else
+    print_result 1 "Coalesced writes corrupted data (medium: ${FLUSH_MEDIUM_MD5}, large: ${FLUSH_LARGE_MD5})"
+fi
+
+# Test 46: Transfers are exported as OpenTelemetry spans
+print_test_header "Test 46: OpenTelemetry spans are exported over OTLP"
+# A minimal OTLP/HTTP collector that stores every exported payload
+python3 -c '
+import http.server, sys
+class Collector(http.server.BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        if self.path == "/v1/traces":
+            with open(sys.argv[1], "ab") as f:
+                f.write(body)
+        self.send_response(200)
+        self.send_header("Content-Type", "application/x-protobuf")
+        self.end_headers()
+    def log_message(self, *args):
+        pass
+http.server.HTTPServer(("127.0.0.1", 4318), Collector).serve_forever()
+' "${TEST_DIR}/spans.bin" &
+COLLECTOR_PID=$!
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+OTEL_EXPORTER_OTLP_ENDPOINT="http://127.0.0.1:4318" \
+OTEL_BSP_SCHEDULE_DELAY=200 \
+HTTP_PORT=8101 \
+GRPC_PORT=50071 \
+./bin/file-transfer-server > "${TEST_DIR}/tracing.log" 2>&1 &
+TRACING_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8101/transfer \
+    -H "Content-Type: application/json" \
+    -H "X-Correlation-ID: trace-e2e-46" \
+    -d '{"source":"small.txt","target":"traced.txt"}' \
+    > "${TEST_DIR}/transfer46.log" 2>&1
+sleep 1
+kill $TRACING_PID 2>/dev/null || true
+wait $TRACING_PID 2>/dev/null || true
+kill $COLLECTOR_PID 2>/dev/null || true
+
+SPAN_NAMES_FOUND=0
+for name in transfer connect stream verify trace-e2e-46; do
+    if grep -qa "$name" "${TEST_DIR}/spans.bin" 2>/dev/null; then
+        SPAN_NAMES_FOUND=$((SPAN_NAMES_FOUND + 1))
+    fi
+done
+if [ "$SPAN_NAMES_FOUND" = "5" ] && [ -f "${RECEIVER_DIR}/traced.txt" ]; then
+    print_result 0 "Transfer, connect, stream and verify spans were exported with the correlation ID"
+else
+    print_result 1 "Expected spans were not exported (found ${SPAN_NAMES_FOUND} of 5)"
+fi
+
+# Test 47: VERIFY_READBACK reads received files back before accepting them
+print_test_header "Test 47: Readback verification with VERIFY_READBACK"
+mkdir -p "${TEST_DIR}/readback"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/readback" \
+VERIFY_READBACK=true \
+HTTP_PORT=8102 \
+GRPC_PORT=50072 \
+./bin/file-transfer-server > "${TEST_DIR}/readback-receiver.log" 2>&1 &
+READBACK_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50072" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8103 \
+GRPC_PORT=50073 \
+./bin/file-transfer-server > "${TEST_DIR}/readback-sender.log" 2>&1 &
+READBACK_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8103/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"medium.bin"}' \
+    > "${TEST_DIR}/transfer47.log" 2>&1
+kill $READBACK_RECEIVER_PID $READBACK_SENDER_PID 2>/dev/null || true
+
+READBACK_MD5=$(md5sum "${TEST_DIR}/readback/medium.bin" 2>/dev/null | awk '{print $1}')
+if grep -q '"batch_completed"' "${TEST_DIR}/transfer47.log" && [ "$READBACK_MD5" = "$MEDIUM_MD5" ]; then
+    print_result 0 "File passed readback verification and was moved into place"
+else
+    print_result 1 "Readback verification failed an intact transfer: $(tail -n1 "${TEST_DIR}/transfer47.log")"
+fi
+
+# Test 48: Targets prefixed with s3: are uploaded to the configured bucket
+print_test_header "Test 48: s3: targets are uploaded to object storage"
+mkdir -p "${TEST_DIR}/s3"
+# A mock S3 endpoint that checks each request's SigV4 signature before storing it
+python3 -c '
+import hashlib, hmac, http.server, os, re, sys, urllib.parse
+root = sys.argv[1]
+def mac(key, msg):
+    return hmac.new(key, msg.encode(), hashlib.sha256).digest()
+class S3(http.server.BaseHTTPRequestHandler):
+    def do_PUT(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        auth = re.match(r"AWS4-HMAC-SHA256 Credential=([^/]+)/([^,]+), SignedHeaders=([^,]+), Signature=(\w+)", self.headers["Authorization"] or "")
+        payload = self.headers["X-Amz-Content-Sha256"]
+        ok = auth is not None and auth.group(1) == "test-key" and payload == hashlib.sha256(body).hexdigest()
+        if ok:
+            date, region, service, _ = auth.group(2).split("/")
+            canonical = "\n".join(["PUT", self.path, "", "host:" + self.headers["Host"],
+                "x-amz-content-sha256:" + payload, "x-amz-date:" + self.headers["X-Amz-Date"], "",
+                auth.group(3), payload])
+            to_sign = "\n".join(["AWS4-HMAC-SHA256", self.headers["X-Amz-Date"], auth.group(2),
+                hashlib.sha256(canonical.encode()).hexdigest()])
+            key = mac(("AWS4" + "test-secret").encode(), date)
+            for part in (region, service, "aws4_request"):
+                key = mac(key, part)
+            ok = hmac.compare_digest(hmac.new(key, to_sign.encode(), hashlib.sha256).hexdigest(), auth.group(4))
+        if not ok:
+            self.send_response(403)
+            self.end_headers()
+            return
+        path = os.path.join(root, urllib.parse.unquote(self.path.lstrip("/")))
+        os.makedirs(os.path.dirname(path), exist_ok=True)
+        with open(path, "wb") as f:
+            f.write(body)
+        self.send_response(200)
+        self.end_headers()
+    def log_message(self, *args):
+        pass
+http.server.HTTPServer(("127.0.0.1", 9000), S3).serve_forever()
+' "${TEST_DIR}/s3" &
+S3_PID=$!
+mkdir -p "${TEST_DIR}/s3-receiver"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/s3-receiver" \
+S3_ENDPOINT="http://127.0.0.1:9000" \
+S3_BUCKET="transfers" \
+S3_ACCESS_KEY_ID="test-key" \
+S3_SECRET_ACCESS_KEY="test-secret" \
+HTTP_PORT=8104 \
+GRPC_PORT=50074 \
+./bin/file-transfer-server > "${TEST_DIR}/s3-receiver.log" 2>&1 &
+S3_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50074" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8105 \
+GRPC_PORT=50075 \
+./bin/file-transfer-server > "${TEST_DIR}/s3-sender.log" 2>&1 &
+S3_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8105/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"s3:backups/medium copy.bin"}' \
+    > "${TEST_DIR}/transfer48.log" 2>&1
+kill $S3_RECEIVER_PID $S3_SENDER_PID $S3_PID 2>/dev/null || true
+
+S3_MD5=$(md5sum "${TEST_DIR}/s3/transfers/backups/medium copy.bin" 2>/dev/null | awk '{print $1}')
+S3_SPOOLS=$(find "${TMPDIR:-/tmp}" -maxdepth 1 -name 'file-transfer-spool-*' 2>/dev/null | wc -l)
+if grep -q '"batch_completed"' "${TEST_DIR}/transfer48.log" && [ "$S3_MD5" = "$MEDIUM_MD5" ] && \
+   [ -z "$(ls -A "${TEST_DIR}/s3-receiver")" ] && [ "$S3_SPOOLS" = "0" ]; then
+    print_result 0 "Object was uploaded with a valid signature and the correct bytes"
+else
+    print_result 1 "Object upload failed (md5: ${S3_MD5}, spools left: ${S3_SPOOLS}): $(tail -n1 "${TEST_DIR}/transfer48.log")"
+fi
+
+# Test 49: ALLOWED_PEERS entries can set their own chunk size
+print_test_header "Test 49: Per-peer chunk sizes"
+# Both entries reach the same receiver under different addresses
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+ALLOWED_PEERS="localhost:${RECEIVER_PORT}=1048576,127.0.0.1:${RECEIVER_PORT}=12582912" \
+HTTP_PORT=8106 \
+GRPC_PORT=50076 \
+./bin/file-transfer-server > "${TEST_DIR}/chunk-size.log" 2>&1 &
+CHUNK_SIZE_PID=$!
+sleep 2
+
+for peer in "localhost" "127.0.0.1"; do
+    curl -s -X POST http://localhost:8106/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"medium.bin\",\"target\":\"chunked-${peer}.bin\",\"peer_address\":\"${peer}:${RECEIVER_PORT}\"}" \
+        > "${TEST_DIR}/transfer49-${peer}.log" 2>&1
+done
+kill $CHUNK_SIZE_PID 2>/dev/null || true
+# A chunk size that can't fit in a gRPC message is rejected at startup
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" ROOT_DIR="${SENDER_DIR}" \
+ALLOWED_PEERS="localhost:${RECEIVER_PORT}=16777216" HTTP_PORT=8106 GRPC_PORT=50076 \
+./bin/file-transfer-server > "${TEST_DIR}/chunk-size-invalid.log" 2>&1 || true
+
+if grep -q "peerAddr=localhost:${RECEIVER_PORT}, chunkSize=1048576" "${TEST_DIR}/chunk-size.log" && \
+   grep -q "peerAddr=127.0.0.1:${RECEIVER_PORT}, chunkSize=12582912" "${TEST_DIR}/chunk-size.log" && \
+   [ "$(md5sum "${RECEIVER_DIR}/chunked-localhost.bin" | awk '{print $1}')" = "$MEDIUM_MD5" ] && \
+   [ "$(md5sum "${RECEIVER_DIR}/chunked-127.0.0.1.bin" | awk '{print $1}')" = "$MEDIUM_MD5" ] && \
+   grep -q "chunk size for localhost:${RECEIVER_PORT} must be between" "${TEST_DIR}/chunk-size-invalid.log"; then
+    print_result 0 "Each peer used its own chunk size and oversized chunks were rejected"
+else
+    print_result 1 "Per-peer chunk sizes misbehaved: $(grep 'batch started' "${TEST_DIR}/chunk-size.log")"
+fi
+
+# Test 50: A root directory that turns read-only is reported cleanly and fails readiness
+print_test_header "Test 50: Read-only storage is detected"
+mkdir -p "${TEST_DIR}/rofs"
+if mount -t tmpfs tmpfs "${TEST_DIR}/rofs" 2>/dev/null; then
+    PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/rofs" \
+    HTTP_PORT=8107 \
+    GRPC_PORT=50077 \
+    ./bin/file-transfer-server > "${TEST_DIR}/rofs-receiver.log" 2>&1 &
+    ROFS_RECEIVER_PID=$!
+    PEER_SERVER_ADDR="localhost:50077" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HTTP_PORT=8108 \
+    GRPC_PORT=50078 \
+    ./bin/file-transfer-server > "${TEST_DIR}/rofs-sender.log" 2>&1 &
+    ROFS_SENDER_PID=$!
+    sleep 2
+
+    mount -o remount,ro "${TEST_DIR}/rofs"
+    curl -s -X POST http://localhost:8108/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"small.txt","target":"small.txt"}' \
+        > "${TEST_DIR}/transfer50.log" 2>&1 || true
+    READY_RO=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:8107/ready)
+    mount -o remount,rw "${TEST_DIR}/rofs"
+    READY_RW=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:8107/ready)
+    kill $ROFS_RECEIVER_PID $ROFS_SENDER_PID 2>/dev/null || true
+    wait $ROFS_RECEIVER_PID 2>/dev/null || true
+    umount "${TEST_DIR}/rofs"
+
+    if grep -q "FailedPrecondition desc = storage is read-only" "${TEST_DIR}/transfer50.log" && \
+       [ "$READY_RO" = "503" ] && [ "$READY_RW" = "200" ]; then
+        print_result 0 "Read-only storage failed the transfer cleanly and readiness recovered"
+    else
+        print_result 1 "Read-only storage misreported (ready: ${READY_RO} then ${READY_RW}): $(tail -n1 "${TEST_DIR}/transfer50.log")"
+    fi
+else
+    echo -e "${YELLOW}SKIP${NC}: mounting a tmpfs not permitted here"
+fi
+
+# Test 51: Events count completed files across a batch
+print_test_header "Test 51: Batch events report files completed"
+mkdir -p "${SENDER_DIR}/batch51"
+for name in a b c; do
+    echo "file ${name}" > "${SENDER_DIR}/batch51/${name}.txt"
+done
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"batch51/*.txt","target":"batch51"}' \
+    > "${TEST_DIR}/transfer51.log" 2>&1
+
+# The file_completed events count up and the rest of the batch carries the same total
+COMPLETED_COUNTS=$(grep '"type":"file_completed"' "${TEST_DIR}/transfer51.log" | grep -o '"files_completed":[0-9]*' | cut -d: -f2 | tr '\n' ' ')
+if [ "$COMPLETED_COUNTS" = "1 2 3 " ] && \
+   head -n1 "${TEST_DIR}/transfer51.log" | grep -q '"files_completed":0,"files_total":3' && \
+   grep '"type":"batch_completed"' "${TEST_DIR}/transfer51.log" | grep -q '"files_completed":3,"files_total":3' && \
+   [ "$(grep -c '"files_total":3' "${TEST_DIR}/transfer51.log")" = "$(wc -l < "${TEST_DIR}/transfer51.log")" ]; then
+    print_result 0 "Every event reported files completed out of the batch total"
+else
+    print_result 1 "Unexpected file counts (file_completed events: ${COMPLETED_COUNTS})"
+fi
+
+# Test 52: MAX_SYMLINK_HOPS caps how many symlinks a path may need
+print_test_header "Test 52: Symlink hop limit"
+mkdir -p "${TEST_DIR}/hops/data"
+echo "hops" > "${TEST_DIR}/hops/data/file.txt"
+# short -> hop1 -> data (2 hops), long -> hop4 -> ... -> hop1 -> data (5 hops)
+ln -s data "${TEST_DIR}/hops/hop1"
+for i in 2 3 4; do
+    ln -s "hop$((i - 1))" "${TEST_DIR}/hops/hop${i}"
+done
+ln -s hop1 "${TEST_DIR}/hops/short"
+ln -s hop4 "${TEST_DIR}/hops/long"
+ln -s ping "${TEST_DIR}/hops/pong"
+ln -s pong "${TEST_DIR}/hops/ping"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${TEST_DIR}/hops" \
+STRICT_ROOT_DIR=true \
+MAX_SYMLINK_HOPS=3 \
+HTTP_PORT=8109 \
+GRPC_PORT=50079 \
+./bin/file-transfer-server > "${TEST_DIR}/hops.log" 2>&1 &
+HOPS_PID=$!
+sleep 2
+
+SHORT_STATUS=$(curl -s -o /dev/null -w "%{http_code}" "http://localhost:8109/download?path=short/file.txt")
+LONG_STATUS=$(curl -s -o "${TEST_DIR}/hops-long.txt" -w "%{http_code}" "http://localhost:8109/download?path=long/file.txt")
+LOOP_STATUS=$(timeout 10 curl -s -o "${TEST_DIR}/hops-loop.txt" -w "%{http_code}" "http://localhost:8109/download?path=ping/file.txt")
+HOPS_REJECTIONS=$(curl -s http://localhost:8109/metrics | awk '$1 == "path_validation_rejections_total{reason=\"symlink_hops\"}" {print $2}')
+kill $HOPS_PID 2>/dev/null || true
+
+if [ "$SHORT_STATUS" = "200" ] && [ "$LONG_STATUS" = "400" ] && [ "$LOOP_STATUS" = "400" ] && \
+   grep -q "too many symlinks: more than 3" "${TEST_DIR}/hops-long.txt" && \
+   grep -q "too many symlinks" "${TEST_DIR}/hops-loop.txt" && [ "$HOPS_REJECTIONS" = "2" ]; then
+    print_result 0 "Paths within the hop limit resolved; deeper chains and loops were rejected"
+else
+    print_result 1 "Unexpected results: short=${SHORT_STATUS}, long=${LONG_STATUS}, loop=${LOOP_STATUS}, rejections=${HOPS_REJECTIONS}"
+fi
+
+# Test 53: WRITE_CHECKSUM_MANIFEST writes a sha256sum sidecar for each received file
+print_test_header "Test 53: Checksum manifests"
+mkdir -p "${TEST_DIR}/manifest"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/manifest" \
+WRITE_CHECKSUM_MANIFEST=true \
+HTTP_PORT=8110 \
+GRPC_PORT=50080 \
+./bin/file-transfer-server > "${TEST_DIR}/manifest-receiver.log" 2>&1 &
+MANIFEST_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50080" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8111 \
+GRPC_PORT=50081 \
+./bin/file-transfer-server > "${TEST_DIR}/manifest-sender.log" 2>&1 &
+MANIFEST_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8111/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"medium.bin"}' \
+    > "${TEST_DIR}/transfer53-single.log" 2>&1
+curl -s -X POST http://localhost:8111/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"large.bin","target":"large.bin","parallel_chunks":4}' \
+    > "${TEST_DIR}/transfer53-ranged.log" 2>&1
+kill $MANIFEST_RECEIVER_PID $MANIFEST_SENDER_PID 2>/dev/null || true
+
+EXPECTED_MANIFEST="$(cd "${SENDER_DIR}" && sha256sum medium.bin large.bin)"
+ACTUAL_MANIFEST="$(cat "${TEST_DIR}/manifest/medium.bin.sha256" "${TEST_DIR}/manifest/large.bin.sha256" 2>/dev/null)"
+if [ "$ACTUAL_MANIFEST" = "$EXPECTED_MANIFEST" ] && \
+   (cd "${TEST_DIR}/manifest" && sha256sum --quiet -c medium.bin.sha256 large.bin.sha256) && \
+   [ "$(ls "${TEST_DIR}/manifest" | wc -l)" = "4" ]; then
+    print_result 0 "Manifests match the transferred files and verify with sha256sum"
+else
+    print_result 1 "Manifests do not match: $(ls "${TEST_DIR}/manifest" | tr '\n' ' ')"
+fi
+
+# Test 54: /admin/cancel-peer aborts only the transfers to that peer
+print_test_header "Test 54: Cancelling all transfers to one peer"
+# Two peers that accept connections but never answer, so transfers stay in flight
+for port in 50060 50082; do
+    python3 -c '
+import socket, sys
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", int(sys.argv[1])))
+s.listen(16)
+conns = []
+while True:
+    conns.append(s.accept()[0])
+' "$port" &
+    SILENT_PEER_PIDS="$SILENT_PEER_PIDS $!"
+done
+PEER_SERVER_ADDR="127.0.0.1:50060" \
+ROOT_DIR="${SENDER_DIR}" \
+ALLOWED_PEERS="127.0.0.1:50082" \
+DIAL_TIMEOUT=30s \
+HTTP_PORT=8112 \
+GRPC_PORT=50083 \
+./bin/file-transfer-server > "${TEST_DIR}/cancel-peer.log" 2>&1 &
+CANCEL_PEER_PID=$!
+sleep 2
+
+CANCEL_A_PIDS=""
+for i in 1 2; do
+    curl -s -X POST http://localhost:8112/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"small.txt\",\"target\":\"cancel-a${i}.txt\"}" \
+        > "${TEST_DIR}/transfer54-a${i}.log" 2>&1 &
+    CANCEL_A_PIDS="$CANCEL_A_PIDS $!"
+done
+curl -s -X POST http://localhost:8112/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"cancel-b.txt","peer_address":"127.0.0.1:50082"}' \
+    > "${TEST_DIR}/transfer54-b.log" 2>&1 &
+CANCEL_B_PID=$!
+sleep 1
+
+CANCEL_A_RESPONSE=$(curl -s -X POST http://localhost:8112/admin/cancel-peer \
+    -H "Content-Type: application/json" -d '{"peer_address":"127.0.0.1:50060"}')
+wait $CANCEL_A_PIDS || true
+sleep 0.5
+B_STILL_RUNNING=false
+if kill -0 $CANCEL_B_PID 2>/dev/null; then
+    B_STILL_RUNNING=true
+fi
+CANCEL_B_RESPONSE=$(curl -s -X POST http://localhost:8112/admin/cancel-peer \
+    -H "Content-Type: application/json" -d '{"peer_address":"127.0.0.1:50082"}')
+wait $CANCEL_B_PID || true
+kill $CANCEL_PEER_PID $SILENT_PEER_PIDS 2>/dev/null || true
+
+if echo "$CANCEL_A_RESPONSE" | grep -q '"cancelled":2' && \
+   grep -q '"error":"peer maintenance"' "${TEST_DIR}/transfer54-a1.log" && \
+   grep -q '"error":"peer maintenance"' "${TEST_DIR}/transfer54-a2.log" && \
+   [ "$B_STILL_RUNNING" = "true" ] && echo "$CANCEL_B_RESPONSE" | grep -q '"cancelled":1'; then
+    print_result 0 "Only the targeted peer's transfers were cancelled"
+else
+    print_result 1 "Unexpected cancellation (first: ${CANCEL_A_RESPONSE}, other peer still running: ${B_STILL_RUNNING}, second: ${CANCEL_B_RESPONSE})"
+fi
+
+# Test 55: Every FSYNC_POLICY delivers intact files
+print_test_header "Test 55: Fsync policies"
+FSYNC_PEERS=""
+FSYNC_PIDS=""
+for policy in none data full; do
+    case $policy in
+        none) http_port=8113; grpc_port=50084 ;;
+        data) http_port=8114; grpc_port=50085 ;;
+        full) http_port=8115; grpc_port=50086 ;;
+    esac
+    mkdir -p "${TEST_DIR}/fsync-${policy}"
+    PEER_SERVER_ADDR="localhost:50087" \
+    ROOT_DIR="${TEST_DIR}/fsync-${policy}" \
+    FSYNC_POLICY=$policy \
+    HTTP_PORT=$http_port \
+    GRPC_PORT=$grpc_port \
+    ./bin/file-transfer-server > "${TEST_DIR}/fsync-${policy}.log" 2>&1 &
+    FSYNC_PIDS="$FSYNC_PIDS $!"
+    FSYNC_PEERS="${FSYNC_PEERS:+${FSYNC_PEERS},}localhost:${grpc_port}"
+done
+PEER_SERVER_ADDR="localhost:50084" \
+ROOT_DIR="${SENDER_DIR}" \
+ALLOWED_PEERS="$FSYNC_PEERS" \
+HTTP_PORT=8116 \
+GRPC_PORT=50087 \
+./bin/file-transfer-server > "${TEST_DIR}/fsync-sender.log" 2>&1 &
+FSYNC_PIDS="$FSYNC_PIDS $!"
+sleep 2
+
+FSYNC_FAILED=""
+for grpc_port in 50084 50085 50086; do
+    curl -s -X POST http://localhost:8116/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"medium.bin\",\"target\":\"medium.bin\",\"peer_address\":\"localhost:${grpc_port}\"}" \
+        > "${TEST_DIR}/transfer55-${grpc_port}.log" 2>&1
+    curl -s -X POST http://localhost:8116/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"large.bin\",\"target\":\"large.bin\",\"peer_address\":\"localhost:${grpc_port}\",\"parallel_chunks\":4}" \
+        > "${TEST_DIR}/transfer55-${grpc_port}-ranged.log" 2>&1
+done
+kill $FSYNC_PIDS 2>/dev/null || true
+
+for policy in none data full; do
+    for file in medium.bin large.bin; do
+        if [ "$(md5sum < "${SENDER_DIR}/${file}")" != "$(md5sum < "${TEST_DIR}/fsync-${policy}/${file}" 2>/dev/null)" ]; then
+            FSYNC_FAILED="$FSYNC_FAILED ${policy}/${file}"
+        fi
+    done
+done
+
+INVALID_FSYNC_EXIT=0
+PEER_SERVER_ADDR="localhost:50084" FSYNC_POLICY=sometimes HTTP_PORT=8117 GRPC_PORT=50088 ROOT_DIR="${TEST_DIR}" \
+    timeout 5 ./bin/file-transfer-server > "${TEST_DIR}/fsync-invalid.log" 2>&1 || INVALID_FSYNC_EXIT=$?
+
+if [ -z "$FSYNC_FAILED" ] && [ "$INVALID_FSYNC_EXIT" != "0" ] && [ "$INVALID_FSYNC_EXIT" != "124" ] && \
+   grep -q "FSYNC_POLICY" "${TEST_DIR}/fsync-invalid.log"; then
+    print_result 0 "Files arrive intact under none, data and full, and unknown policies are rejected"
+else
+    print_result 1 "Fsync policy transfer failed:${FSYNC_FAILED} (invalid policy exit: ${INVALID_FSYNC_EXIT})"
+fi
+
+# Test 56: A retried request with the same idempotency key transfers only once
+print_test_header "Test 56: Idempotency keys"
+IDEM_BODY='{"source":"small.txt","target":"idempotent.txt","idempotency_key":"test-56"}'
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" -H "X-Correlation-ID: idem-first" \
+    -d "$IDEM_BODY" > "${TEST_DIR}/transfer56-first.log" 2>&1
+# Removing the file shows whether the retry transfers it again
+rm -f "${RECEIVER_DIR}/idempotent.txt"
+curl -s -D "${TEST_DIR}/transfer56-retry.headers" -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" -H "X-Correlation-ID: idem-retry" \
+    -d "$IDEM_BODY" > "${TEST_DIR}/transfer56-retry.log" 2>&1
+IDEM_MISMATCH_STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"idempotent.txt","idempotency_key":"test-56"}')
+
+FIRST_BATCH=$(head -n 1 "${TEST_DIR}/transfer56-first.log" | grep -o '"batch_id":"[^"]*"')
+RETRY_BATCH=$(head -n 1 "${TEST_DIR}/transfer56-retry.log" | grep -o '"batch_id":"[^"]*"')
+if [ -n "$FIRST_BATCH" ] && [ "$FIRST_BATCH" = "$RETRY_BATCH" ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer56-retry.log" && \
+   grep -qi "^Idempotent-Replayed: true" "${TEST_DIR}/transfer56-retry.headers" && \
+   [ ! -e "${RECEIVER_DIR}/idempotent.txt" ] && \
+   ! grep -q "correlationID=idem-retry" "${TEST_DIR}/sender.log" && \
+   [ "$IDEM_MISMATCH_STATUS" = "422" ]; then
+    print_result 0 "The retry replayed the first batch without transferring again"
+else
+    print_result 1 "Retry was not idempotent (first: ${FIRST_BATCH}, retry: ${RETRY_BATCH}, mismatch status: ${IDEM_MISMATCH_STATUS})"
+fi
+
+# Test 57: Identical concurrent transfers share one stream
+print_test_header "Test 57: Collapsing duplicate concurrent transfers"
+for i in 1 2; do
+    curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+        -H "Content-Type: application/json" -H "X-Correlation-ID: dedupe-${i}" \
+        -d '{"source":"large.bin","target":"dedupe.bin"}' \
+        > "${TEST_DIR}/transfer57-${i}.log" 2>&1 &
+    eval "DEDUPE_PID_${i}=\$!"
+done
+wait $DEDUPE_PID_1 $DEDUPE_PID_2 || true
+
+DEDUPE_BATCH_1=$(head -n 1 "${TEST_DIR}/transfer57-1.log" | grep -o '"batch_id":"[^"]*"')
+DEDUPE_BATCH_2=$(head -n 1 "${TEST_DIR}/transfer57-2.log" | grep -o '"batch_id":"[^"]*"')
+DEDUPE_STARTED=$(grep -c "Transfer batch started: correlationID=dedupe-" "${TEST_DIR}/sender.log")
+DEDUPE_MD5=$(md5sum "${RECEIVER_DIR}/dedupe.bin" 2>/dev/null | awk '{print $1}')
+if [ -n "$DEDUPE_BATCH_1" ] && [ "$DEDUPE_BATCH_1" = "$DEDUPE_BATCH_2" ] && [ "$DEDUPE_STARTED" = "1" ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer57-1.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer57-2.log" && \
+   [ "$DEDUPE_MD5" = "$LARGE_MD5" ]; then
+    print_result 0 "Both requests completed with one batch and one stream"
+else
+    print_result 1 "Duplicate transfer was not collapsed (batches: ${DEDUPE_BATCH_1} ${DEDUPE_BATCH_2}, started: ${DEDUPE_STARTED})"
+fi
+
+# Test 58: FULL_CHUNKS sends full-sized chunks even when the source returns short reads
+print_test_header "Test 58: Full-sized chunks from a short-reading archive stream"
+python3 -c '
+import http.server, sys
+class Collector(http.server.BaseHTTPRequestHandler):
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers["Content-Length"]))
+        if self.path == "/v1/traces":
+            with open(sys.argv[1], "ab") as f:
+                f.write(body)
+        self.send_response(200)
+        self.send_header("Content-Type", "application/x-protobuf")
+        self.end_headers()
+    def log_message(self, *args):
+        pass
+http.server.HTTPServer(("127.0.0.1", 4318), Collector).serve_forever()
+' "${TEST_DIR}/spans58.bin" &
+COLLECTOR_PID=$!
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+FULL_CHUNKS=true \
+OTEL_EXPORTER_OTLP_ENDPOINT="http://127.0.0.1:4318" \
+OTEL_BSP_SCHEDULE_DELAY=200 \
+HTTP_PORT=8117 \
+GRPC_PORT=50088 \
+./bin/file-transfer-server > "${TEST_DIR}/full-chunks.log" 2>&1 &
+FULL_CHUNKS_PID=$!
+sleep 2
+
+# The tar writer feeds the stream through a pipe, in reads far smaller than a chunk
+curl -s -X POST http://localhost:8117/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tree","target":"tree-full-chunks","archive":"tar"}' \
+    > "${TEST_DIR}/transfer58.log" 2>&1
+sleep 1
+kill $FULL_CHUNKS_PID 2>/dev/null || true
+wait $FULL_CHUNKS_PID 2>/dev/null || true
+kill $COLLECTOR_PID 2>/dev/null || true
+
+ARCHIVE_BYTES=$(grep '"type":"file_completed"' "${TEST_DIR}/transfer58.log" | grep -o '"bytes_transferred":[0-9]*' | cut -d: -f2)
+EXPECTED_CHUNKS=$(( (ARCHIVE_BYTES + 8388607) / 8388608 ))
+# The stream span's "chunks" attribute, read straight from the OTLP protobuf
+SENT_CHUNKS=$(python3 -c '
+import re, sys
+data = open(sys.argv[1], "rb").read()
+m = re.search(rb"\n\x06chunks\x12.\x18", data, re.S)
+value, shift = 0, 0
+for b in data[m.end():] if m else b"":
+    value |= (b & 0x7f) << shift
+    shift += 7
+    if b < 0x80:
+        break
+print(value if m else "")
+' "${TEST_DIR}/spans58.bin" 2>/dev/null)
+if [ -n "$ARCHIVE_BYTES" ] && [ "$SENT_CHUNKS" = "$EXPECTED_CHUNKS" ] && \
+   diff -r "${SENDER_DIR}/tree" "${RECEIVER_DIR}/tree-full-chunks" > /dev/null 2>&1; then
+    print_result 0 "${ARCHIVE_BYTES} archive bytes were sent as ${SENT_CHUNKS} full-sized chunks"
+else
+    print_result 1 "Expected ${EXPECTED_CHUNKS} chunks for ${ARCHIVE_BYTES} bytes, sent ${SENT_CHUNKS}"
+fi
+
+# Test 59: A FIFO source of unknown size reports bytes and speed without a percentage
+print_test_header "Test 59: Progress for a source of unknown size"
+mkdir -p "${SENDER_DIR}/fifo"
+mkfifo "${SENDER_DIR}/fifo/stream"
+# Written slowly, so progress is reported while the stream is still open
+(for i in 1 2 3; do head -c 1048576 /dev/urandom; sleep 1; done) \
+    | tee "${TEST_DIR}/fifo-stream.expected" > "${SENDER_DIR}/fifo/stream" &
+FIFO_WRITER_PID=$!
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"fifo/stream","target":"fifo-stream.bin"}' \
+    > "${TEST_DIR}/transfer59.log" 2>&1
+wait $FIFO_WRITER_PID 2>/dev/null || true
+rm -rf "${SENDER_DIR}/fifo"
+
+SENDING_EVENTS=$(grep '"message":"sending: ' "${TEST_DIR}/transfer59.log")
+if [ -n "$SENDING_EVENTS" ] && \
+   ! grep -q '"progress":' "${TEST_DIR}/transfer59.log" && \
+   echo "$SENDING_EVENTS" | grep -q '"bytes_per_second":[1-9]' && \
+   cmp -s "${TEST_DIR}/fifo-stream.expected" "${RECEIVER_DIR}/fifo-stream.bin"; then
+    print_result 0 "Progress reported bytes and speed without a percentage, and the stream arrived intact"
+else
+    print_result 1 "Unexpected progress for an unknown-size source: $(tail -n 3 "${TEST_DIR}/transfer59.log")"
+fi
+
+# Test 60: REQUIRE_MOUNT rejects transfers until the mount is present
+print_test_header "Test 60: Required mount"
+mkdir -p "${TEST_DIR}/mountpoint"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/mountpoint" \
+REQUIRE_MOUNT="${TEST_DIR}/mountpoint" \
+HTTP_PORT=8118 \
+GRPC_PORT=50089 \
+./bin/file-transfer-server > "${TEST_DIR}/mount-receiver.log" 2>&1 &
+MOUNT_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50089" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8119 \
+GRPC_PORT=50090 \
+./bin/file-transfer-server > "${TEST_DIR}/mount-sender.log" 2>&1 &
+MOUNT_SENDER_PID=$!
+sleep 2
+
+# Unmounted, the directory shares its parent's device
+curl -s -X POST http://localhost:8119/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt"}' \
+    > "${TEST_DIR}/transfer60-unmounted.log" 2>&1 || true
+READY_UNMOUNTED=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:8118/ready)
+UNMOUNTED_REJECTED=false
+if grep -q "FailedPrecondition desc = required mount is not present" "${TEST_DIR}/transfer60-unmounted.log" && \
+   [ ! -e "${TEST_DIR}/mountpoint/small.txt" ] && [ "$READY_UNMOUNTED" = "503" ]; then
+    UNMOUNTED_REJECTED=true
+fi
+
+if mount -t tmpfs tmpfs "${TEST_DIR}/mountpoint" 2>/dev/null; then
+    curl -s -X POST http://localhost:8119/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"small.txt","target":"small.txt"}' \
+        > "${TEST_DIR}/transfer60-mounted.log" 2>&1 || true
+    READY_MOUNTED=$(curl -s -o /dev/null -w "%{http_code}" http://localhost:8118/ready)
+    MOUNTED_MD5=$(md5sum "${TEST_DIR}/mountpoint/small.txt" 2>/dev/null | awk '{print $1}')
+    umount "${TEST_DIR}/mountpoint"
+fi
+kill $MOUNT_RECEIVER_PID $MOUNT_SENDER_PID 2>/dev/null || true
+
+if [ "$UNMOUNTED_REJECTED" != "true" ]; then
+    print_result 1 "Transfer into an unmounted mountpoint was not rejected (ready: ${READY_UNMOUNTED}): $(tail -n1 "${TEST_DIR}/transfer60-unmounted.log")"
+elif [ -z "$READY_MOUNTED" ]; then
+    echo -e "${YELLOW}SKIP${NC}: mounting a tmpfs not permitted here; the unmounted case passed"
+elif [ "$MOUNTED_MD5" = "$SMALL_MD5" ] && [ "$READY_MOUNTED" = "200" ]; then
+    print_result 0 "Transfers were rejected until the mount was present"
+else
+    print_result 1 "Transfer onto the mounted filesystem failed (ready: ${READY_MOUNTED}): $(tail -n1 "${TEST_DIR}/transfer60-mounted.log")"
+fi
+
+# Test 61: MAX_CHUNKS_PER_FILE aborts a file streamed as endless tiny chunks
+print_test_header "Test 61: Chunk limit per file"
+mkdir -p "${TEST_DIR}/chunk-limit" "${SENDER_DIR}/fifo"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/chunk-limit" \
+MAX_CHUNKS_PER_FILE=5 \
+HTTP_PORT=8120 \
+GRPC_PORT=50091 \
+./bin/file-transfer-server > "${TEST_DIR}/chunk-limit-receiver.log" 2>&1 &
+CHUNK_LIMIT_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50091" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8121 \
+GRPC_PORT=50092 \
+./bin/file-transfer-server > "${TEST_DIR}/chunk-limit-sender.log" 2>&1 &
+CHUNK_LIMIT_SENDER_PID=$!
+sleep 2
+
+# Each small write to the FIFO is sent as its own chunk
+mkfifo "${SENDER_DIR}/fifo/trickle"
+(for i in $(seq 1 20); do echo "tiny chunk ${i}"; sleep 0.1; done > "${SENDER_DIR}/fifo/trickle") 2>/dev/null &
+TRICKLE_PID=$!
+curl -s -X POST http://localhost:8121/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"fifo/trickle","target":"trickle.txt"}' \
+    > "${TEST_DIR}/transfer61-trickle.log" 2>&1 || true
+kill $TRICKLE_PID 2>/dev/null || true
+wait $TRICKLE_PID 2>/dev/null || true
+rm -rf "${SENDER_DIR}/fifo"
+curl -s -X POST http://localhost:8121/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt"}' \
+    > "${TEST_DIR}/transfer61-small.log" 2>&1
+kill $CHUNK_LIMIT_RECEIVER_PID $CHUNK_LIMIT_SENDER_PID 2>/dev/null || true
+
+if grep -q "ResourceExhausted desc = too many chunks: limit=5" "${TEST_DIR}/transfer61-trickle.log" && \
+   [ "$(ls -A "${TEST_DIR}/chunk-limit")" = "small.txt" ]; then
+    print_result 0 "The trickled file was aborted and cleaned up, while a normal file still arrived"
+else
+    print_result 1 "Chunk limit did not apply (receiver dir: $(ls -A "${TEST_DIR}/chunk-limit" | tr '\n' ' ')): $(tail -n1 "${TEST_DIR}/transfer61-trickle.log")"
+fi
+
+# Test 62: If-Range resumes a download only while the file is unchanged
+print_test_header "Test 62: Download resumption with If-Range"
+printf 'version one of the file\n' > "${SENDER_DIR}/if-range.txt"
+DOWNLOAD_ETAG=$(curl -s -D - -o /dev/null "http://localhost:${SENDER_PORT}/download?path=if-range.txt" \
+    | tr -d '\r' | grep -i '^ETag:' | cut -d' ' -f2)
+MATCHED=$(curl -s -w " %{http_code}" -H "Range: bytes=8-" -H "If-Range: ${DOWNLOAD_ETAG}" \
+    "http://localhost:${SENDER_PORT}/download?path=if-range.txt")
+# Same size and within the same second, so only the ETag tells the versions apart
+printf 'version two of the file\n' > "${SENDER_DIR}/if-range.txt"
+MISMATCHED=$(curl -s -w " %{http_code}" -H "Range: bytes=8-" -H "If-Range: ${DOWNLOAD_ETAG}" \
+    "http://localhost:${SENDER_PORT}/download?path=if-range.txt")
+
+if [ -n "$DOWNLOAD_ETAG" ] && [ "$MATCHED" = "one of the file
+ 206" ] && [ "$MISMATCHED" = "version two of the file
+ 200" ]; then
+    print_result 0 "A matching If-Range got the range and a changed file was sent in full"
+else
+    print_result 1 "Unexpected If-Range responses (ETag: ${DOWNLOAD_ETAG}): matched=[${MATCHED}] mismatched=[${MISMATCHED}]"
+fi
+
+# Test 63: TRANSFER_DEBOUNCE coalesces rapid-fire requests for the same path
+print_test_header "Test 63: Debouncing repeated requests"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+TRANSFER_DEBOUNCE=1s \
+HTTP_PORT=8122 \
+GRPC_PORT=50093 \
+./bin/file-transfer-server > "${TEST_DIR}/debounce.log" 2>&1 &
+DEBOUNCE_PID=$!
+sleep 2
+
+DEBOUNCE_PIDS=""
+for i in 1 2 3; do
+    curl -s -X POST http://localhost:8122/transfer \
+        -H "Content-Type: application/json" -H "X-Correlation-ID: debounce-${i}" \
+        -d '{"source":"small.txt","target":"debounced.txt"}' \
+        > "${TEST_DIR}/transfer63-${i}.log" 2>&1 &
+    DEBOUNCE_PIDS="$DEBOUNCE_PIDS $!"
+    sleep 0.2
+done
+wait $DEBOUNCE_PIDS || true
+kill $DEBOUNCE_PID 2>/dev/null || true
+
+DEBOUNCE_BATCHES=$(head -q -n 1 "${TEST_DIR}"/transfer63-*.log | grep -o '"batch_id":"[^"]*"' | sort -u | wc -l)
+DEBOUNCE_STARTED=$(grep -c "Transfer batch started" "${TEST_DIR}/debounce.log")
+if [ "$DEBOUNCE_BATCHES" = "1" ] && [ "$DEBOUNCE_STARTED" = "1" ] && \
+   [ "$(grep -l '"type":"batch_completed"' "${TEST_DIR}"/transfer63-*.log | wc -l)" = "3" ] && \
+   [ "$(md5sum < "${RECEIVER_DIR}/debounced.txt")" = "$(md5sum < "${SENDER_DIR}/small.txt")" ]; then
+    print_result 0 "Three rapid requests ran as one transfer"
+else
+    print_result 1 "Requests were not coalesced (batches: ${DEBOUNCE_BATCHES}, started: ${DEBOUNCE_STARTED})"
+fi
+
+# Test 64: A request cancelled during TRANSFER_DEBOUNCE releases its idempotency key
+print_test_header "Test 64: Idempotency key released by a cancelled debounce"
+DEBOUNCE_KEY_DIR="${TEST_DIR}/debounce-key-receiver"
+mkdir -p "${DEBOUNCE_KEY_DIR}"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${DEBOUNCE_KEY_DIR}" \
+HTTP_PORT=8183 \
+GRPC_PORT=50157 \
+./bin/file-transfer-server > "${TEST_DIR}/debounce-key-receiver.log" 2>&1 &
+DEBOUNCE_KEY_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50157" \
+ROOT_DIR="${SENDER_DIR}" \
+TRANSFER_DEBOUNCE=3s \
+HTTP_PORT=8182 \
+GRPC_PORT=50156 \
+./bin/file-transfer-server > "${TEST_DIR}/debounce-key-sender.log" 2>&1 &
+DEBOUNCE_KEY_SENDER_PID=$!
+sleep 2
+
+DEBOUNCE_KEY_BODY='{"source":"small.txt","target":"debounce-key.txt","idempotency_key":"test-64"}'
+# Give up while the start is still held back
+curl -s --max-time 1 -X POST http://localhost:8182/transfer \
+    -H "Content-Type: application/json" -d "$DEBOUNCE_KEY_BODY" > /dev/null 2>&1 || true
+sleep 1
+curl -s -D "${TEST_DIR}/transfer64-headers.txt" -X POST http://localhost:8182/transfer \
+    -H "Content-Type: application/json" -d "$DEBOUNCE_KEY_BODY" > "${TEST_DIR}/transfer64.log" 2>&1 || true
+kill $DEBOUNCE_KEY_RECEIVER_PID $DEBOUNCE_KEY_SENDER_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer64.log" && \
+   ! grep -qi "Idempotent-Replayed" "${TEST_DIR}/transfer64-headers.txt" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${DEBOUNCE_KEY_DIR}/debounce-key.txt" && \
+   [ "$(grep -c "Transfer batch started" "${TEST_DIR}/debounce-key-sender.log")" = "1" ]; then
+    print_result 0 "The retry with the same key ran the transfer instead of replaying the cancelled request"
+else
+    print_result 1 "The retry did not transfer: $(head -c 300 "${TEST_DIR}/transfer64.log"), headers: $(tr -d '\r' < "${TEST_DIR}/transfer64-headers.txt" | tr '\n' ' ')"
+fi
+
+# Test 65: Storage errors on the peer are classified in the error event's code
+print_test_header "Test 65: Storage error classification"
+mkdir -p "${TEST_DIR}/tiny"
+if mount -t tmpfs -o size=1M tmpfs "${TEST_DIR}/tiny" 2>/dev/null; then
+    PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/tiny" \
+    HTTP_PORT=8123 \
+    GRPC_PORT=50094 \
+    ./bin/file-transfer-server > "${TEST_DIR}/tiny-receiver.log" 2>&1 &
+    TINY_RECEIVER_PID=$!
+    PEER_SERVER_ADDR="localhost:50094" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HTTP_PORT=8124 \
+    GRPC_PORT=50095 \
+    ./bin/file-transfer-server > "${TEST_DIR}/tiny-sender.log" 2>&1 &
+    TINY_SENDER_PID=$!
+
+    # Run as nobody, so a root-owned directory can't be written
+    mkdir -p "${TEST_DIR}/unprivileged/locked" "${TEST_DIR}/unprivileged-bin"
+    chmod 777 "${TEST_DIR}/unprivileged"
+    cp ./bin/file-transfer-server "${TEST_DIR}/unprivileged-bin/"
+    PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/unprivileged" \
+    HTTP_PORT=8125 \
+    GRPC_PORT=50096 \
+    setpriv --reuid=65534 --regid=65534 --clear-groups \
+        "${TEST_DIR}/unprivileged-bin/file-transfer-server" > "${TEST_DIR}/unprivileged-receiver.log" 2>&1 &
+    UNPRIVILEGED_RECEIVER_PID=$!
+    PEER_SERVER_ADDR="localhost:50096" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HTTP_PORT=8126 \
+    GRPC_PORT=50097 \
+    ./bin/file-transfer-server > "${TEST_DIR}/unprivileged-sender.log" 2>&1 &
+    UNPRIVILEGED_SENDER_PID=$!
+    sleep 2
+
+    curl -s -X POST http://localhost:8124/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"medium.bin","target":"medium.bin"}' \
+        > "${TEST_DIR}/transfer65-full.log" 2>&1 || true
+    mount -o remount,ro "${TEST_DIR}/tiny"
+    curl -s -X POST http://localhost:8124/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"small.txt","target":"small.txt"}' \
+        > "${TEST_DIR}/transfer65-ro.log" 2>&1 || true
+    curl -s -X POST http://localhost:8126/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"small.txt","target":"locked/small.txt"}' \
+        > "${TEST_DIR}/transfer65-denied.log" 2>&1 || true
+    kill $TINY_RECEIVER_PID $TINY_SENDER_PID $UNPRIVILEGED_RECEIVER_PID $UNPRIVILEGED_SENDER_PID 2>/dev/null || true
+    wait $TINY_RECEIVER_PID 2>/dev/null || true
+    TINY_LEFTOVERS=$(ls -A "${TEST_DIR}/tiny")
+    umount "${TEST_DIR}/tiny"
+
+    if grep -q '"code":"disk_full"' "${TEST_DIR}/transfer65-full.log" && \
+       grep -q "ResourceExhausted" "${TEST_DIR}/transfer65-full.log" && [ -z "$TINY_LEFTOVERS" ] && \
+       grep -q '"code":"read_only"' "${TEST_DIR}/transfer65-ro.log" && \
+       grep -q '"code":"permission_denied"' "${TEST_DIR}/transfer65-denied.log" && \
+       grep -q "PermissionDenied" "${TEST_DIR}/transfer65-denied.log"; then
+        print_result 0 "ENOSPC, EROFS and EACCES were reported as disk_full, read_only and permission_denied"
+    else
+        print_result 1 "Unexpected classification: full=[$(tail -n1 "${TEST_DIR}/transfer65-full.log")] ro=[$(tail -n1 "${TEST_DIR}/transfer65-ro.log")] denied=[$(tail -n1 "${TEST_DIR}/transfer65-denied.log")]"
+    fi
+else
+    echo -e "${YELLOW}SKIP${NC}: mounting a tmpfs not permitted here"
+fi
+
+# Test 66: CHECKSUM_CACHE reuses checksums until a watched file changes
+print_test_header "Test 66: Source checksum cache"
+mkdir -p "${SENDER_DIR}/cached"
+printf 'cached content, first version\n' > "${SENDER_DIR}/cached/file.txt"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+CHECKSUM_CACHE=true \
+HTTP_PORT=8127 \
+GRPC_PORT=50098 \
+./bin/file-transfer-server > "${TEST_DIR}/checksum-cache.log" 2>&1 &
+CHECKSUM_CACHE_PID=$!
+sleep 2
+
+for run in first repeat; do
+    curl -s -X POST http://localhost:8127/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"cached/file.txt","target":"cached.txt","sync":"checksum"}' \
+        > "${TEST_DIR}/transfer66-${run}.log" 2>&1
+done
+CACHE_HITS=$(curl -s http://localhost:8127/metrics | grep '^checksum_cache_hits_total' | awk '{print $2}')
+
+# Same size and mtime, so only a fresh checksum notices the change
+touch -r "${SENDER_DIR}/cached/file.txt" "${TEST_DIR}/cached-mtime"
+printf 'cached content, later version\n' > "${SENDER_DIR}/cached/file.txt"
+touch -r "${TEST_DIR}/cached-mtime" "${SENDER_DIR}/cached/file.txt"
+sleep 0.5
+curl -s -X POST http://localhost:8127/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"cached/file.txt","target":"cached.txt","sync":"checksum"}' \
+    > "${TEST_DIR}/transfer66-modified.log" 2>&1
+kill $CHECKSUM_CACHE_PID 2>/dev/null || true
+
+if grep -q '"message":"file unchanged: cached/file.txt"' "${TEST_DIR}/transfer66-repeat.log" && \
+   [ "$CACHE_HITS" = "1" ] && \
+   grep -q '"message":"file completed: cached/file.txt"' "${TEST_DIR}/transfer66-modified.log" && \
+   cmp -s "${SENDER_DIR}/cached/file.txt" "${RECEIVER_DIR}/cached.txt"; then
+    print_result 0 "The cached checksum was reused, then invalidated when the file changed"
+else
+    print_result 1 "Checksum cache misbehaved (hits: ${CACHE_HITS}): $(grep -o '"message":"file [^"]*"' "${TEST_DIR}"/transfer66-*.log | tr '\n' ' ')"
+fi
+
+# Test 67: /query reports which targets the receiver already has
+print_test_header "Test 67: Query existing files"
+mkdir -p "${RECEIVER_DIR}/query"
+printf 'present on the receiver\n' > "${RECEIVER_DIR}/query/present.txt"
+QUERY_SIZE=$(stat -c%s "${RECEIVER_DIR}/query/present.txt")
+QUERY_SUM=$(sha256sum "${RECEIVER_DIR}/query/present.txt" | awk '{print $1}')
+curl -s -X POST http://localhost:${SENDER_PORT}/query \
+    -H "Content-Type: application/json" \
+    -d '{"paths":["query/present.txt","query/absent.txt","query","../escape.txt"],"checksum":true}' \
+    > "${TEST_DIR}/query.json" 2>&1
+
+if python3 - "${TEST_DIR}/query.json" "${QUERY_SIZE}" "${QUERY_SUM}" <<'PY'
+import json, sys
+files = json.load(open(sys.argv[1]))["files"]
+present, absent, directory, escape = files
+assert present["path"] == "query/present.txt" and present["exists"]
+assert present["size"] == int(sys.argv[2]) and present["checksum"] == sys.argv[3]
+assert absent["path"] == "query/absent.txt" and not absent["exists"] and "error" not in absent
+assert directory["path"] == "query" and not directory["exists"]
+assert escape["path"] == "../escape.txt" and not escape["exists"] and escape["error"]
+PY
+then
+    print_result 0 "Present, absent, directory and invalid paths were reported in order"
+else
+    print_result 1 "Unexpected query result: $(cat "${TEST_DIR}/query.json")"
+fi
+
+# Test 68: SYMLINK_PARENTS=within_root refuses targets whose directory symlinks out of the root
+print_test_header "Test 68: Symlinked target directories"
+mkdir -p "${TEST_DIR}/symlinked/real" "${TEST_DIR}/symlink-target"
+ln -s "${TEST_DIR}/symlink-target" "${TEST_DIR}/symlinked/escape"
+ln -s real "${TEST_DIR}/symlinked/alias"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/symlinked" \
+SYMLINK_PARENTS=within_root \
+HTTP_PORT=8128 \
+GRPC_PORT=50099 \
+./bin/file-transfer-server > "${TEST_DIR}/symlinked-receiver.log" 2>&1 &
+SYMLINKED_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50099" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8129 \
+GRPC_PORT=50100 \
+./bin/file-transfer-server > "${TEST_DIR}/symlinked-sender.log" 2>&1 &
+SYMLINKED_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8129/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"escape/nested/small.txt"}' \
+    > "${TEST_DIR}/transfer68-escape.log" 2>&1 || true
+curl -s -X POST http://localhost:8129/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"alias/small.txt"}' \
+    > "${TEST_DIR}/transfer68-alias.log" 2>&1 || true
+kill $SYMLINKED_RECEIVER_PID $SYMLINKED_SENDER_PID 2>/dev/null || true
+
+if grep -q "PermissionDenied" "${TEST_DIR}/transfer68-escape.log" && \
+   [ -z "$(find "${TEST_DIR}/symlink-target" -type f)" ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer68-alias.log" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TEST_DIR}/symlinked/real/small.txt"; then
+    print_result 0 "A directory symlinked out of the root was refused, one inside it was written through"
+else
+    print_result 1 "Symlinked directories misbehaved: escape=[$(tail -n1 "${TEST_DIR}/transfer68-escape.log")] outside=[$(find "${TEST_DIR}/symlink-target" -type f)]"
+fi
+
+# Test 69: CHUNK_RETRIES has a chunk corrupted in transit sent again instead of failing
+print_test_header "Test 69: Chunk retransmission"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${RECEIVER_DIR}" \
+CHUNK_RETRIES=2 \
+HTTP_PORT=8130 \
+GRPC_PORT=50101 \
+./bin/file-transfer-server > "${TEST_DIR}/retransmit-receiver.log" 2>&1 &
+RETRANSMIT_RECEIVER_PID=$!
+# Forwards to the receiver, flipping one bit in the first megabyte-or-later HTTP/2 DATA frame
+python3 -c '
+import socket, threading
+def pipe(src, dst, flip):
+    buf = src.recv(24) if flip else b""  # client preface
+    dst.sendall(buf)
+    seen, flipped = 0, not flip
+    while True:
+        header = b""
+        while len(header) < 9:
+            data = src.recv(9 - len(header))
+            if not data:
+                return
+            header += data
+        length = int.from_bytes(header[:3], "big")
+        payload = b""
+        while len(payload) < length:
+            payload += src.recv(length - len(payload))
+        if header[3] == 0 and not flipped:
+            seen += length
+            if seen > 1 << 20 and length > 64:
+                payload = bytearray(payload)
+                payload[length // 2] ^= 1
+                payload, flipped = bytes(payload), True
+        dst.sendall(header + payload)
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50102))
+s.listen(4)
+client = s.accept()[0]
+server = socket.create_connection(("127.0.0.1", 50101))
+threading.Thread(target=pipe, args=(server, client, False), daemon=True).start()
+pipe(client, server, True)
+' &
+FLIP_PROXY_PID=$!
+PEER_SERVER_ADDR="127.0.0.1:50102" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8131 \
+GRPC_PORT=50103 \
+./bin/file-transfer-server > "${TEST_DIR}/retransmit-sender.log" 2>&1 &
+RETRANSMIT_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8131/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"retransmitted.bin"}' \
+    > "${TEST_DIR}/transfer69.log" 2>&1 || true
+kill $RETRANSMIT_RECEIVER_PID $RETRANSMIT_SENDER_PID $FLIP_PROXY_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer69.log" && \
+   grep -q "chunk failed its checksum, requesting retransmit: index=0" "${TEST_DIR}/retransmit-receiver.log" && \
+   grep -q "Retransmitting chunk: index=0" "${TEST_DIR}/retransmit-sender.log" && \
+   [ "$(md5sum < "${RECEIVER_DIR}/retransmitted.bin" | awk '{print $1}')" = "$MEDIUM_MD5" ]; then
+    print_result 0 "The corrupted chunk was retransmitted and the file arrived intact"
+else
+    print_result 1 "Chunk retransmission failed: $(tail -n1 "${TEST_DIR}/transfer69.log")"
+fi
+
+# Test 70: "include_hidden": false leaves dotfiles out of patterns and archives
+print_test_header "Test 70: Hidden files"
+mkdir -p "${SENDER_DIR}/dotted/.git" "${SENDER_DIR}/dotted/sub"
+echo "visible" > "${SENDER_DIR}/dotted/visible.txt"
+echo "env" > "${SENDER_DIR}/dotted/.env"
+echo "config" > "${SENDER_DIR}/dotted/.git/config"
+echo "nested" > "${SENDER_DIR}/dotted/sub/file.txt"
+echo "secret" > "${SENDER_DIR}/dotted/sub/.secret"
+for variant in default excluded; do
+    OPTION=""
+    [ "$variant" = "excluded" ] && OPTION=',"include_hidden":false'
+    curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"dotted\",\"target\":\"dotted-tar-${variant}\",\"archive\":\"tar\"${OPTION}}" \
+        > "${TEST_DIR}/transfer70-tar-${variant}.log" 2>&1
+    curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"dotted/*\",\"target\":\"dotted-glob-${variant}\"${OPTION}}" \
+        > "${TEST_DIR}/transfer70-glob-${variant}.log" 2>&1
+done
+list_files() {
+    (cd "$1" && find . -type f | sort | tr '\n' ' ')
+}
+
+if [ "$(list_files "${RECEIVER_DIR}/dotted-tar-default")" = "./.env ./.git/config ./sub/.secret ./sub/file.txt ./visible.txt " ] && \
+   [ "$(list_files "${RECEIVER_DIR}/dotted-tar-excluded")" = "./sub/file.txt ./visible.txt " ] && \
+   [ "$(list_files "${RECEIVER_DIR}/dotted-glob-default")" = "./.env ./visible.txt " ] && \
+   [ "$(list_files "${RECEIVER_DIR}/dotted-glob-excluded")" = "./visible.txt " ]; then
+    print_result 0 "Dotfiles were included by default and left out with include_hidden=false"
+else
+    print_result 1 "Unexpected files: tar=[$(list_files "${RECEIVER_DIR}/dotted-tar-default")|$(list_files "${RECEIVER_DIR}/dotted-tar-excluded")] glob=[$(list_files "${RECEIVER_DIR}/dotted-glob-default")|$(list_files "${RECEIVER_DIR}/dotted-glob-excluded")]"
+fi
+
+# Test 71: /plan previews a sync batch without transferring anything
+print_test_header "Test 71: Transfer plan"
+mkdir -p "${SENDER_DIR}/planned"
+printf 'already on the receiver\n' > "${SENDER_DIR}/planned/synced.txt"
+head -c 4000 /dev/urandom > "${SENDER_DIR}/planned/new.bin"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"planned/synced.txt","target":"planned/synced.txt","sync":"quick"}' \
+    > "${TEST_DIR}/transfer71-seed.log" 2>&1
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+PLAN_LINK_SPEED=1000 \
+HTTP_PORT=8132 \
+GRPC_PORT=50104 \
+./bin/file-transfer-server > "${TEST_DIR}/plan.log" 2>&1 &
+PLAN_PID=$!
+sleep 2
+
+PLAN=$(curl -s -X POST http://localhost:8132/plan \
+    -H "Content-Type: application/json" \
+    -d '{"source":"planned/*","target":"planned","sync":"quick"}')
+kill $PLAN_PID 2>/dev/null || true
+
+if echo "$PLAN" | grep -q '"files_to_transfer":1' && \
+   echo "$PLAN" | grep -q '"files_skipped":1' && \
+   echo "$PLAN" | grep -q '"bytes_to_transfer":4000' && \
+   echo "$PLAN" | grep -q '"estimated_seconds":4' && \
+   echo "$PLAN" | grep -q '"source":"planned/synced.txt","target":"planned/synced.txt","size":[0-9]*,"action":"skip"' && \
+   [ ! -e "${RECEIVER_DIR}/planned/new.bin" ]; then
+    print_result 0 "The plan skipped the synced file and nothing was transferred"
+else
+    print_result 1 "Unexpected plan: ${PLAN}"
+fi
+
+# Test 72: CASE_COLLISION_POLICY warns about or rejects targets differing only in case
+print_test_header "Test 72: Case collisions"
+mkdir -p "${SENDER_DIR}/cased" "${TEST_DIR}/case-warn" "${TEST_DIR}/case-reject"
+echo "upper" > "${SENDER_DIR}/cased/Notes.txt"
+echo "lower" > "${SENDER_DIR}/cased/notes.txt"
+for policy in warn reject; do
+    case $policy in
+        warn) CASE_HTTP=8133; CASE_GRPC=50105 ;;
+        reject) CASE_HTTP=8135; CASE_GRPC=50107 ;;
+    esac
+    PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+    ROOT_DIR="${TEST_DIR}/case-${policy}" \
+    CASE_COLLISION_POLICY=${policy} \
+    HTTP_PORT=${CASE_HTTP} \
+    GRPC_PORT=${CASE_GRPC} \
+    ./bin/file-transfer-server > "${TEST_DIR}/case-${policy}-receiver.log" 2>&1 &
+    CASE_RECEIVER_PID=$!
+    PEER_SERVER_ADDR="localhost:${CASE_GRPC}" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HTTP_PORT=$((CASE_HTTP + 1)) \
+    GRPC_PORT=$((CASE_GRPC + 1)) \
+    ./bin/file-transfer-server > "${TEST_DIR}/case-${policy}-sender.log" 2>&1 &
+    CASE_SENDER_PID=$!
+    sleep 2
+    curl -s -X POST http://localhost:$((CASE_HTTP + 1))/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"cased/*","target":"cased"}' \
+        > "${TEST_DIR}/transfer72-${policy}.log" 2>&1 || true
+    kill $CASE_RECEIVER_PID $CASE_SENDER_PID 2>/dev/null || true
+done
+CASE_WARN_FILES=$(ls "${TEST_DIR}/case-warn/cased" 2>/dev/null | wc -l)
+CASE_REJECT_FILES=$(ls "${TEST_DIR}/case-reject/cased" 2>/dev/null | wc -l)
+
+if [ "$CASE_WARN_FILES" = "2" ] && \
+   grep -q "target differs only in case from an existing entry" "${TEST_DIR}/case-warn-receiver.log" && \
+   [ "$CASE_REJECT_FILES" = "1" ] && \
+   grep -q "AlreadyExists" "${TEST_DIR}/transfer72-reject.log"; then
+    print_result 0 "The case collision was logged with warn and refused with reject"
+else
+    print_result 1 "Case collisions misbehaved: warn=${CASE_WARN_FILES} files, reject=${CASE_REJECT_FILES} files, $(tail -n1 "${TEST_DIR}/transfer72-reject.log")"
+fi
+
+# Test 73: batch_checksum verifies the whole batch and notices a file lost after it arrived
+print_test_header "Test 73: Batch checksum"
+mkdir -p "${SENDER_DIR}/batchsum" "${SENDER_DIR}/batchsum-lossy"
+echo "first" > "${SENDER_DIR}/batchsum/a.txt"
+echo "second" > "${SENDER_DIR}/batchsum/b.txt"
+EXPECTED_BATCH_SUM=$(for f in a.txt b.txt; do
+    printf 'verified/%s\t%s\n' "$f" "$(sha256sum "${SENDER_DIR}/batchsum/$f" | cut -d' ' -f1)"
+done | sha256sum | cut -d' ' -f1)
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"batchsum/*","target":"verified","batch_checksum":true}' \
+    > "${TEST_DIR}/transfer73-verified.log" 2>&1
+
+# The batch waits on the FIFO, which is sent last, while a file already
+# received is deleted
+echo "first" > "${SENDER_DIR}/batchsum-lossy/a.txt"
+echo "second" > "${SENDER_DIR}/batchsum-lossy/b.txt"
+mkfifo "${SENDER_DIR}/batchsum-lossy/z.pipe"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"batchsum-lossy/*","target":"lossy","batch_checksum":true}' \
+    > "${TEST_DIR}/transfer73-lossy.log" 2>&1 &
+LOSSY_PID=$!
+for _ in $(seq 1 50); do
+    [ -f "${RECEIVER_DIR}/lossy/b.txt" ] && break
+    sleep 0.1
+done
+rm -f "${RECEIVER_DIR}/lossy/b.txt"
+echo "piped" > "${SENDER_DIR}/batchsum-lossy/z.pipe"
+wait $LOSSY_PID || true
+
+if grep -q "\"type\":\"batch_completed\".*\"checksum\":\"${EXPECTED_BATCH_SUM}\"" "${TEST_DIR}/transfer73-verified.log" && \
+   grep -q "batch checksum mismatch" "${TEST_DIR}/transfer73-lossy.log" && \
+   grep -q "missing: lossy/b.txt" "${TEST_DIR}/transfer73-lossy.log" && \
+   ! grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer73-lossy.log"; then
+    print_result 0 "The batch checksum matched, then caught the file lost on the receiver"
+else
+    print_result 1 "Batch checksum misbehaved: verified=[$(tail -n1 "${TEST_DIR}/transfer73-verified.log")] lossy=[$(tail -n1 "${TEST_DIR}/transfer73-lossy.log")]"
+fi
+
+# Test 74: WALK_CONCURRENCY lists a deep tree in the same order as a sequential walk
+print_test_header "Test 74: Concurrent directory walking"
+for a in a b c; do
+    for b in x y.d z; do
+        for c in 1 2 3; do
+            mkdir -p "${SENDER_DIR}/deep/${a}/${b}/${c}/leaf"
+            echo "${a}${b}${c}" > "${SENDER_DIR}/deep/${a}/${b}/${c}/leaf/file.txt"
+            echo "${a}${b}${c}" > "${SENDER_DIR}/deep/${a}/${b}/${c}.txt"
+        done
+    done
+    echo "${a}" > "${SENDER_DIR}/deep/${a}.txt"
+done
+mkdir -p "${SENDER_DIR}/deep/a/.hidden"
+echo "hidden" > "${SENDER_DIR}/deep/a/.hidden/file.txt"
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+WALK_CONCURRENCY=8 \
+HTTP_PORT=8137 \
+GRPC_PORT=50109 \
+./bin/file-transfer-server > "${TEST_DIR}/walk.log" 2>&1 &
+WALK_PID=$!
+sleep 2
+
+for option in '' ',"include_hidden":false'; do
+    curl -s -X POST http://localhost:${SENDER_PORT}/plan \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"deep\",\"target\":\"deep\",\"archive\":\"tar\"${option}}" \
+        >> "${TEST_DIR}/walk-sequential.json"
+    curl -s -X POST http://localhost:8137/plan \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"deep\",\"target\":\"deep\",\"archive\":\"tar\"${option}}" \
+        >> "${TEST_DIR}/walk-concurrent.json"
+done
+curl -s -X POST http://localhost:8137/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"deep","target":"deep-walked","archive":"tar"}' \
+    > "${TEST_DIR}/transfer74.log" 2>&1
+kill $WALK_PID 2>/dev/null || true
+WALK_FILES=$(grep -o '"source":"[^"]*"' "${TEST_DIR}/walk-concurrent.json" | wc -l)
+
+if [ "$WALK_FILES" = "115" ] && \
+   cmp -s "${TEST_DIR}/walk-sequential.json" "${TEST_DIR}/walk-concurrent.json" && \
+   diff -r "${SENDER_DIR}/deep" "${RECEIVER_DIR}/deep-walked" > /dev/null; then
+    print_result 0 "The concurrent walk found the same files in the same order as the sequential one"
+else
+    print_result 1 "Concurrent walk differed (${WALK_FILES} files): $(diff <(tr '{' '\n' < "${TEST_DIR}/walk-sequential.json") <(tr '{' '\n' < "${TEST_DIR}/walk-concurrent.json") | head -n 5)"
+fi
+
+# Test 75: RESUME_PARTIAL resumes an interrupted file from a renamed source by its fingerprint
+print_test_header "Test 75: Resume by content fingerprint"
+mkdir -p "${SENDER_DIR}/resumable" "${TEST_DIR}/resume"
+head -c 20000000 /dev/urandom > "${SENDER_DIR}/resumable/original.bin"
+RESUMABLE_MD5=$(md5sum < "${SENDER_DIR}/resumable/original.bin" | awk '{print $1}')
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/resume" \
+RESUME_PARTIAL=true \
+HTTP_PORT=8138 \
+GRPC_PORT=50110 \
+./bin/file-transfer-server > "${TEST_DIR}/resume-receiver.log" 2>&1 &
+RESUME_RECEIVER_PID=$!
+# Forwards to the receiver and drops the connection after 12 MB from the sender,
+# half way through the second chunk
+python3 -c '
+import socket, threading
+def pipe(src, dst, limit):
+    sent = 0
+    while sent < limit:
+        data = src.recv(65536)
+        if not data:
+            break
+        dst.sendall(data)
+        sent += len(data)
+    for sock in (src, dst):
+        sock.shutdown(socket.SHUT_RDWR)
+        sock.close()
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50111))
+s.listen(4)
+client = s.accept()[0]
+server = socket.create_connection(("127.0.0.1", 50110))
+threading.Thread(target=pipe, args=(server, client, float("inf")), daemon=True).start()
+pipe(client, server, 12 << 20)
+' &
+CUT_PROXY_PID=$!
+PEER_SERVER_ADDR="127.0.0.1:50111" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8139 \
+GRPC_PORT=50112 \
+./bin/file-transfer-server > "${TEST_DIR}/resume-cut-sender.log" 2>&1 &
+CUT_SENDER_PID=$!
+PEER_SERVER_ADDR="localhost:50110" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8140 \
+GRPC_PORT=50113 \
+./bin/file-transfer-server > "${TEST_DIR}/resume-sender.log" 2>&1 &
+RESUME_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8139/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"resumable/original.bin","target":"incoming/original.bin"}' \
+    > "${TEST_DIR}/transfer75-cut.log" 2>&1 || true
+sleep 1
+KEPT_PARTS=$(find "${TEST_DIR}/resume/.resume" -name '*.part' 2>/dev/null | wc -l)
+
+# The staging directory renames the file; its content stays the same
+mv "${SENDER_DIR}/resumable/original.bin" "${SENDER_DIR}/resumable/renamed.bin"
+curl -s -X POST http://localhost:8140/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"resumable/renamed.bin","target":"done/renamed.bin"}' \
+    > "${TEST_DIR}/transfer75-resumed.log" 2>&1
+kill $RESUME_RECEIVER_PID $CUT_PROXY_PID $CUT_SENDER_PID $RESUME_SENDER_PID 2>/dev/null || true
+RESUME_OFFSET=$(grep -o 'Resuming transfer: path=done/renamed.bin, fingerprint=[^,]*, offset=[0-9]*' "${TEST_DIR}/resume-receiver.log" | sed 's/.*offset=//')
+
+if [ "$KEPT_PARTS" = "1" ] && \
+   [ -n "$RESUME_OFFSET" ] && [ "$RESUME_OFFSET" -gt 0 ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer75-resumed.log" && \
+   [ "$(md5sum < "${TEST_DIR}/resume/done/renamed.bin" | awk '{print $1}')" = "$RESUMABLE_MD5" ] && \
+   [ -z "$(find "${TEST_DIR}/resume/.resume" -type f)" ]; then
+    print_result 0 "The renamed source resumed at ${RESUME_OFFSET} bytes and arrived intact"
+else
+    print_result 1 "Resume failed (kept: ${KEPT_PARTS}, offset: ${RESUME_OFFSET}): $(tail -n1 "${TEST_DIR}/transfer75-resumed.log")"
+fi
+
+# Test 76: min_size and max_size select files by size
+print_test_header "Test 76: Size-filtered batches"
+mkdir -p "${SENDER_DIR}/tiered"
+head -c 1000 /dev/urandom > "${SENDER_DIR}/tiered/small.bin"
+head -c 100000 /dev/urandom > "${SENDER_DIR}/tiered/medium.bin"
+head -c 1000000 /dev/urandom > "${SENDER_DIR}/tiered/large.bin"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tiered/*","target":"cold","min_size":100000}' \
+    > "${TEST_DIR}/transfer76.log" 2>&1
+SMALL_PLAN=$(curl -s -X POST http://localhost:${SENDER_PORT}/plan \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tiered/*","target":"warm","max_size":99999}')
+MEDIUM_PLAN=$(curl -s -X POST http://localhost:${SENDER_PORT}/plan \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tiered/*","target":"warm","min_size":1001,"max_size":100000}')
+EMPTY_STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tiered/*","target":"none","min_size":2000000}')
+INVERTED=$(curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"tiered/*","target":"none","min_size":10,"max_size":5}')
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer76.log" && \
+   cmp -s "${SENDER_DIR}/tiered/medium.bin" "${RECEIVER_DIR}/cold/medium.bin" && \
+   cmp -s "${SENDER_DIR}/tiered/large.bin" "${RECEIVER_DIR}/cold/large.bin" && \
+   [ ! -e "${RECEIVER_DIR}/cold/small.bin" ] && \
+   echo "$SMALL_PLAN" | grep -q '"files_to_transfer":1' && \
+   echo "$SMALL_PLAN" | grep -q '"source":"tiered/small.bin"' && \
+   echo "$MEDIUM_PLAN" | grep -q '"files_to_transfer":1' && \
+   echo "$MEDIUM_PLAN" | grep -q '"source":"tiered/medium.bin"' && \
+   [ "$EMPTY_STATUS" = "400" ] && \
+   echo "$INVERTED" | grep -q '"field":"max_size"'; then
+    print_result 0 "Each bound selected only the files in range"
+else
+    print_result 1 "Unexpected selection: transfer=$(tail -n1 "${TEST_DIR}/transfer76.log"), max=${SMALL_PLAN}, range=${MEDIUM_PLAN}, empty=${EMPTY_STATUS}, inverted=${INVERTED}"
+fi
+
+# Test 77: SEND_TIMEOUT fails a transfer whose peer stops reading
+print_test_header "Test 77: Send watchdog"
+mkdir -p "${SENDER_DIR}/stalled"
+head -c 50000000 /dev/urandom > "${SENDER_DIR}/stalled/big.bin"
+# Forwards to the receiver, then stops reading from the sender after 1 MB
+python3 -c '
+import socket, threading, time
+def pipe(src, dst, limit):
+    sent = 0
+    while sent < limit:
+        data = src.recv(65536)
+        if not data:
+            return
+        dst.sendall(data)
+        sent += len(data)
+    time.sleep(3600)
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50114))
+s.listen(4)
+client = s.accept()[0]
+server = socket.create_connection(("127.0.0.1", int(__import__("sys").argv[1])))
+threading.Thread(target=pipe, args=(server, client, float("inf")), daemon=True).start()
+pipe(client, server, 1 << 20)
+' "${RECEIVER_PORT}" &
+STALL_PROXY_PID=$!
+PEER_SERVER_ADDR="127.0.0.1:50114" \
+ROOT_DIR="${SENDER_DIR}" \
+SEND_TIMEOUT=2s \
+HTTP_PORT=8141 \
+GRPC_PORT=50115 \
+./bin/file-transfer-server > "${TEST_DIR}/send-timeout.log" 2>&1 &
+SEND_TIMEOUT_PID=$!
+sleep 2
+
+STALL_START=$(date +%s)
+timeout 30 curl -s -X POST http://localhost:8141/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"stalled/big.bin","target":"stalled/big.bin"}' \
+    > "${TEST_DIR}/transfer77.log" 2>&1 || true
+STALL_SECONDS=$(( $(date +%s) - STALL_START ))
+# The receiver notices the sender is gone once the connection closes
+kill $STALL_PROXY_PID $SEND_TIMEOUT_PID 2>/dev/null || true
+wait $STALL_PROXY_PID 2>/dev/null || true
+sleep 1
+
+if grep -q 'peer stopped reading: send blocked for 2s' "${TEST_DIR}/transfer77.log" && \
+   [ "$STALL_SECONDS" -lt 15 ] && \
+   [ -z "$(find "${RECEIVER_DIR}/stalled" -type f 2>/dev/null)" ]; then
+    print_result 0 "The stalled send failed after ${STALL_SECONDS}s and the partial file was discarded"
+else
+    print_result 1 "Send watchdog did not fire (${STALL_SECONDS}s): $(tail -n1 "${TEST_DIR}/transfer77.log")"
+fi
+
+# Test 78: PROFILES_FILE bundles a transfer's options under a name
+print_test_header "Test 78: Transfer profiles"
+cat > "${TEST_DIR}/profiles.json" <<'PROFILES'
+{
+  "nightly-logs": {"source": "logs/{app,db}/*.log", "target": "profiled", "sync": "quick", "verify_policy": "lenient"}
+}
+PROFILES
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ROOT_DIR="${SENDER_DIR}" \
+PROFILES_FILE="${TEST_DIR}/profiles.json" \
+HTTP_PORT=8142 \
+GRPC_PORT=50116 \
+./bin/file-transfer-server > "${TEST_DIR}/profiles.log" 2>&1 &
+PROFILES_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8142/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"profile":"nightly-logs"}' \
+    > "${TEST_DIR}/transfer78.log" 2>&1
+# The profile syncs, so running it again skips both files
+curl -s -X POST http://localhost:8142/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"profile":"nightly-logs"}' \
+    > "${TEST_DIR}/transfer78-again.log" 2>&1
+curl -s -X POST http://localhost:8142/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"profile":"nightly-logs","target":"profiled-override"}' \
+    > "${TEST_DIR}/transfer78-override.log" 2>&1
+UNKNOWN_PROFILE=$(curl -s -o "${TEST_DIR}/unknown-profile.txt" -w '%{http_code}' -X POST http://localhost:8142/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"profile":"weekly"}')
+EXPORTED=$(curl -s http://localhost:8142/profiles)
+kill $PROFILES_PID 2>/dev/null || true
+# A misspelled option fails at startup
+echo '{"typo": {"source": "a", "taget": "b"}}' > "${TEST_DIR}/profiles-typo.json"
+if PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" ROOT_DIR="${SENDER_DIR}" PROFILES_FILE="${TEST_DIR}/profiles-typo.json" \
+    HTTP_PORT=8142 GRPC_PORT=50116 timeout 5 ./bin/file-transfer-server > "${TEST_DIR}/profiles-typo.log" 2>&1; then
+    TYPO_REJECTED=false
+else
+    TYPO_REJECTED=$(grep -q 'invalid PROFILES_FILE: profile typo: .*unknown field "taget"' "${TEST_DIR}/profiles-typo.log" && echo true || echo false)
+fi
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer78.log" && \
+   [ "$(cat "${RECEIVER_DIR}/profiled/app/1.log")" = "app log" ] && \
+   [ "$(cat "${RECEIVER_DIR}/profiled/db/1.log")" = "db log" ] && \
+   [ ! -e "${RECEIVER_DIR}/profiled/tmp" ] && \
+   [ "$(grep -c '"file unchanged: ' "${TEST_DIR}/transfer78-again.log")" = "2" ] && \
+   [ -f "${RECEIVER_DIR}/profiled-override/app/1.log" ] && \
+   [ "$UNKNOWN_PROFILE" = "400" ] && grep -q 'unknown profile: weekly' "${TEST_DIR}/unknown-profile.txt" && \
+   echo "$EXPORTED" | grep -q '"nightly-logs":{"source":"logs/{app,db}/\*.log"' && \
+   [ "$TYPO_REJECTED" = "true" ]; then
+    print_result 0 "The profile's pattern and options were applied, overridden and exported"
+else
+    print_result 1 "Unexpected profile results: first=$(tail -n1 "${TEST_DIR}/transfer78.log"), unknown=${UNKNOWN_PROFILE}, exported=${EXPORTED}, typo=${TYPO_REJECTED}"
+fi
+
+# Test 79: "diagnostics": true summarizes per-chunk timings
+print_test_header "Test 79: Chunk timing diagnostics"
+curl -s -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"diagnosed/medium.bin","diagnostics":true}' \
+    > "${TEST_DIR}/transfer79.log" 2>&1
+DIAGNOSTICS_STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X POST http://localhost:${SENDER_PORT}/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"diagnosed/ranged.bin","diagnostics":true,"parallel_chunks":2}')
+DIAGNOSTICS_CHECK=$(python3 -c '
+import json, sys
+for line in open(sys.argv[1]):
+    event = json.loads(line)
+    if event.get("type") != "file_completed":
+        continue
+    d = event["diagnostics"]
+    ok = d["chunks"] == 2 and d["confirm_ms"] >= 0
+    for name in ("read_latency", "send_latency"):
+        l = d[name]
+        ok = ok and 0 <= l["min_ms"] <= l["p50_ms"] <= l["p99_ms"] <= l["max_ms"]
+    ok = ok and len(d["throughput"]) >= 1 and all(t > 0 for t in d["throughput"])
+    print("ok" if ok else "bad: %s" % json.dumps(d))
+' "${TEST_DIR}/transfer79.log" 2>&1)
+
+if [ "$DIAGNOSTICS_CHECK" = "ok" ] && \
+   cmp -s "${SENDER_DIR}/medium.bin" "${RECEIVER_DIR}/diagnosed/medium.bin" && \
+   [ "$DIAGNOSTICS_STATUS" = "400" ] && \
+   ! grep -q '"diagnostics":{' "${TEST_DIR}/transfer1.log"; then
+    print_result 0 "The file_completed event carried a consistent timing summary"
+else
+    print_result 1 "Unexpected diagnostics: ${DIAGNOSTICS_CHECK} (ranged: ${DIAGNOSTICS_STATUS})"
+fi
+
+# Test 80: PEER_REGISTRY discovers peers that requests can name
+print_test_header "Test 80: Peer discovery"
+mkdir -p "${TEST_DIR}/registry"
+echo "[{\"name\":\"backup\",\"address\":\"localhost:${RECEIVER_PORT}\"},{\"name\":\"rogue\",\"address\":\"10.255.0.1:50051\"}]" \
+    > "${TEST_DIR}/registry/peers.json"
+python3 -m http.server 8143 --bind 127.0.0.1 --directory "${TEST_DIR}/registry" > /dev/null 2>&1 &
+REGISTRY_PID=$!
+PEER_SERVER_ADDR="localhost:1" \
+ROOT_DIR="${SENDER_DIR}" \
+PEER_REGISTRY="http://127.0.0.1:8143/peers.json" \
+PEER_REGISTRY_INTERVAL=1s \
+DISCOVERED_PEERS_ALLOW="localhost:*" \
+HTTP_PORT=8144 \
+GRPC_PORT=50117 \
+./bin/file-transfer-server > "${TEST_DIR}/discovery.log" 2>&1 &
+DISCOVERY_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8144/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"discovered/small.txt","peer":"backup"}' \
+    > "${TEST_DIR}/transfer80.log" 2>&1
+ROGUE=$(curl -s -o "${TEST_DIR}/rogue80.json" -w '%{http_code}' -X POST http://localhost:8144/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"discovered/rogue.txt","peer":"rogue"}')
+# Peers registered later are picked up on the next lookup
+echo "[{\"name\":\"late\",\"address\":\"localhost:${RECEIVER_PORT}\"}]" > "${TEST_DIR}/registry/peers.json"
+sleep 2
+curl -s -X POST http://localhost:8144/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"discovered/late.txt","peer":"late"}' \
+    > "${TEST_DIR}/transfer80-late.log" 2>&1
+kill $DISCOVERY_PID $REGISTRY_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer80.log" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${RECEIVER_DIR}/discovered/small.txt" && \
+   [ "$ROGUE" = "400" ] && grep -q '"field":"peer","message":"is not a discovered peer"' "${TEST_DIR}/rogue80.json" && \
+   grep -q 'ignoring discovered peer: name=rogue, address=10.255.0.1:50051' "${TEST_DIR}/discovery.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer80-late.log" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${RECEIVER_DIR}/discovered/late.txt"; then
+    print_result 0 "Discovered peers were usable by name and the disallowed one was ignored"
+else
+    print_result 1 "Unexpected discovery results: first=$(tail -n1 "${TEST_DIR}/transfer80.log"), rogue=${ROGUE}, late=$(tail -n1 "${TEST_DIR}/transfer80-late.log")"
+fi
+
+# Test 81: MAX_TOTAL_USAGE rejects transfers beyond the cap
+print_test_header "Test 81: Total usage cap"
+mkdir -p "${TEST_DIR}/capped" "${SENDER_DIR}/capped"
+head -c 1000000 /dev/urandom > "${TEST_DIR}/capped/existing.bin"
+head -c 1500000 /dev/urandom > "${SENDER_DIR}/capped/first.bin"
+head -c 1000000 /dev/urandom > "${SENDER_DIR}/capped/second.bin"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/capped" \
+MAX_TOTAL_USAGE=3000000 \
+HTTP_PORT=8145 \
+GRPC_PORT=50118 \
+./bin/file-transfer-server > "${TEST_DIR}/capped-receiver.log" 2>&1 &
+CAPPED_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50118" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8146 \
+GRPC_PORT=50119 \
+./bin/file-transfer-server > "${TEST_DIR}/capped-sender.log" 2>&1 &
+CAPPED_SENDER_PID=$!
+sleep 2
+
+capped_transfer() {
+    curl -s -X POST http://localhost:8146/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"capped/$1\",\"target\":\"$2\"}" \
+        > "${TEST_DIR}/transfer81-$3.log" 2>&1 || true
+}
+# 1 MB + 1.5 MB fits under 3 MB, another 1 MB doesn't
+capped_transfer first.bin first.bin fits
+capped_transfer second.bin second.bin over
+# Replacing a file only needs room for the difference
+capped_transfer first.bin first.bin replace
+# Room freed outside of transfers is noticed before rejecting
+rm "${TEST_DIR}/capped/existing.bin"
+capped_transfer second.bin second.bin freed
+kill $CAPPED_RECEIVER_PID $CAPPED_SENDER_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer81-fits.log" && \
+   grep -q 'ResourceExhausted.*total usage limit reached' "${TEST_DIR}/transfer81-over.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer81-replace.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer81-freed.log" && \
+   cmp -s "${SENDER_DIR}/capped/second.bin" "${TEST_DIR}/capped/second.bin" && \
+   [ -z "$(find "${TEST_DIR}/capped" -name '*.part')" ]; then
+    print_result 0 "Transfers up to the cap succeeded and the one beyond it was rejected"
+else
+    print_result 1 "Unexpected usage cap results: over=$(tail -n1 "${TEST_DIR}/transfer81-over.log"), replace=$(tail -n1 "${TEST_DIR}/transfer81-replace.log"), freed=$(tail -n1 "${TEST_DIR}/transfer81-freed.log")"
+fi
+
+# Test 82: VALIDATE_CMD quarantines files it rejects
+print_test_header "Test 82: Post-receive validation command"
+mkdir -p "${SENDER_DIR}/scanned" "${TEST_DIR}/validated"
+echo "harmless" > "${SENDER_DIR}/scanned/clean.txt"
+echo "contains VIRUS-SIGNATURE" > "${SENDER_DIR}/scanned/infected.txt"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/validated" \
+VALIDATE_CMD='! grep -q VIRUS-SIGNATURE "$1"' \
+QUARANTINE_DIR="${TEST_DIR}/quarantine" \
+HTTP_PORT=8147 \
+GRPC_PORT=50120 \
+./bin/file-transfer-server > "${TEST_DIR}/validated-receiver.log" 2>&1 &
+VALIDATED_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50120" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8148 \
+GRPC_PORT=50121 \
+./bin/file-transfer-server > "${TEST_DIR}/validated-sender.log" 2>&1 &
+VALIDATED_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8148/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"scanned/clean.txt","target":"incoming/clean.txt"}' \
+    > "${TEST_DIR}/transfer82-clean.log" 2>&1 || true
+curl -s -X POST http://localhost:8148/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"scanned/infected.txt","target":"incoming/infected.txt"}' \
+    > "${TEST_DIR}/transfer82-infected.log" 2>&1 || true
+kill $VALIDATED_RECEIVER_PID $VALIDATED_SENDER_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer82-clean.log" && \
+   cmp -s "${SENDER_DIR}/scanned/clean.txt" "${TEST_DIR}/validated/incoming/clean.txt" && \
+   grep -q 'FailedPrecondition desc = file rejected by validation command: exit status 1' "${TEST_DIR}/transfer82-infected.log" && \
+   ! grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer82-infected.log" && \
+   [ ! -e "${TEST_DIR}/validated/incoming/infected.txt" ] && \
+   cmp -s "${SENDER_DIR}/scanned/infected.txt" "${TEST_DIR}/quarantine/incoming/infected.txt" && \
+   [ -z "$(find "${TEST_DIR}/validated" -name '*.part')" ]; then
+    print_result 0 "The rejected file was quarantined and its transfer reported failed"
+else
+    print_result 1 "Unexpected validation results: clean=$(tail -n1 "${TEST_DIR}/transfer82-clean.log"), infected=$(tail -n1 "${TEST_DIR}/transfer82-infected.log")"
+fi
+
+# Test 83: Servers listen on every address in HTTP_LISTEN_ADDR and GRPC_LISTEN_ADDR
+print_test_header "Test 83: Multiple listen addresses"
+mkdir -p "${TEST_DIR}/multi-listen"
+echo "via first" > "${SENDER_DIR}/listen-first.txt"
+echo "via second" > "${SENDER_DIR}/listen-second.txt"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/multi-listen" \
+HTTP_PORT=8149 \
+GRPC_LISTEN_ADDR="127.0.0.1:50122, 127.0.0.1:50123" \
+./bin/file-transfer-server > "${TEST_DIR}/multi-listen-receiver.log" 2>&1 &
+MULTI_RECEIVER_PID=$!
+PEER_SERVER_ADDR="127.0.0.1:50122" \
+ALLOWED_PEERS="127.0.0.1:50123" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_LISTEN_ADDR="127.0.0.1:8150,127.0.0.1:8151" \
+GRPC_PORT=50124 \
+./bin/file-transfer-server > "${TEST_DIR}/multi-listen-sender.log" 2>&1 &
+MULTI_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://127.0.0.1:8150/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"listen-first.txt","target":"first.txt"}' \
+    > "${TEST_DIR}/transfer83-first.log" 2>&1 || true
+curl -s -X POST http://127.0.0.1:8151/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"listen-second.txt","target":"second.txt","peer_address":"127.0.0.1:50123"}' \
+    > "${TEST_DIR}/transfer83-second.log" 2>&1 || true
+
+# One address already taken fails startup, even though the other is free
+if PEER_SERVER_ADDR="127.0.0.1:50122" \
+    ROOT_DIR="${TEST_DIR}/multi-listen-taken" \
+    HTTP_LISTEN_ADDR="127.0.0.1:8152,127.0.0.1:8151" \
+    GRPC_PORT=50125 \
+    timeout 5 ./bin/file-transfer-server > "${TEST_DIR}/multi-listen-taken.log" 2>&1; then
+    TAKEN_EXIT=0
+else
+    TAKEN_EXIT=$?
+fi
+kill $MULTI_RECEIVER_PID $MULTI_SENDER_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer83-first.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer83-second.log" && \
+   cmp -s "${SENDER_DIR}/listen-first.txt" "${TEST_DIR}/multi-listen/first.txt" && \
+   cmp -s "${SENDER_DIR}/listen-second.txt" "${TEST_DIR}/multi-listen/second.txt" && \
+   [ "$TAKEN_EXIT" = "1" ] && \
+   grep -q "HTTP_LISTEN_ADDR 127.0.0.1:8151 is not bindable" "${TEST_DIR}/multi-listen-taken.log"; then
+    print_result 0 "Both addresses served transfers and a taken address failed startup"
+else
+    print_result 1 "Unexpected multi-listen results: exit=${TAKEN_EXIT}, first=$(tail -n1 "${TEST_DIR}/transfer83-first.log"), second=$(tail -n1 "${TEST_DIR}/transfer83-second.log")"
+fi
+
+# Test 84: USE_MMAP sends large files from a memory mapping
+print_test_header "Test 84: Memory-mapped reads"
+mkdir -p "${SENDER_DIR}/mapped"
+head -c 20000000 /dev/urandom > "${SENDER_DIR}/mapped/large.bin"
+head -c 1000 /dev/urandom > "${SENDER_DIR}/mapped/small.bin"
+head -c 50000000 /dev/urandom > "${SENDER_DIR}/mapped/shrinking.bin"
+# Forwards to the receiver at about 3 MB/s, so the file can be truncated mid-transfer
+python3 -c '
+import socket, sys, threading, time
+def pipe(src, dst, delay):
+    while True:
+        data = src.recv(32768)
+        if not data:
+            return
+        dst.sendall(data)
+        time.sleep(delay)
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 50127))
+s.listen(4)
+while True:
+    client = s.accept()[0]
+    server = socket.create_connection(("127.0.0.1", int(sys.argv[1])))
+    threading.Thread(target=pipe, args=(server, client, 0), daemon=True).start()
+    threading.Thread(target=pipe, args=(client, server, 0.01), daemon=True).start()
+' "${RECEIVER_PORT}" &
+MMAP_PROXY_PID=$!
+PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+ALLOWED_PEERS="127.0.0.1:50127" \
+ROOT_DIR="${SENDER_DIR}" \
+USE_MMAP=true \
+MMAP_MIN_SIZE=1048576 \
+HTTP_PORT=8153 \
+GRPC_PORT=50126 \
+./bin/file-transfer-server > "${TEST_DIR}/mmap.log" 2>&1 &
+MMAP_PID=$!
+sleep 2
+
+for name in large small; do
+    curl -s -X POST http://localhost:8153/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"mapped/${name}.bin\",\"target\":\"mapped/${name}.bin\"}" \
+        >> "${TEST_DIR}/transfer84.log" 2>&1 || true
+done
+curl -s -X POST http://localhost:8153/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"mapped/shrinking.bin","target":"mapped/shrinking.bin","peer_address":"127.0.0.1:50127"}' \
+    > "${TEST_DIR}/transfer84-shrinking.log" 2>&1 &
+SHRINK_CURL_PID=$!
+sleep 2
+truncate -s 1000000 "${SENDER_DIR}/mapped/shrinking.bin"
+wait $SHRINK_CURL_PID || true
+MMAP_HEALTH=$(curl -s http://localhost:8153/health || true)
+kill $MMAP_PID $MMAP_PROXY_PID 2>/dev/null || true
+
+if grep -q '"type":"file_completed".*"path":"mapped/large.bin".*"mapped":true' "${TEST_DIR}/transfer84.log" && \
+   grep '"type":"file_completed"' "${TEST_DIR}/transfer84.log" | grep '"path":"mapped/small.bin"' | grep -vq '"mapped"' && \
+   cmp -s "${SENDER_DIR}/mapped/large.bin" "${RECEIVER_DIR}/mapped/large.bin" && \
+   cmp -s "${SENDER_DIR}/mapped/small.bin" "${RECEIVER_DIR}/mapped/small.bin" && \
+   grep -q 'source file changed size during transfer: truncated while mapped' "${TEST_DIR}/transfer84-shrinking.log" && \
+   [ ! -e "${RECEIVER_DIR}/mapped/shrinking.bin" ] && \
+   [ "$MMAP_HEALTH" = "OK" ]; then
+    print_result 0 "Mapped files arrived intact and a truncated one failed without crashing the sender"
+else
+    print_result 1 "Unexpected mmap results: health=${MMAP_HEALTH}, batch=$(tail -n1 "${TEST_DIR}/transfer84.log"), shrinking=$(tail -n1 "${TEST_DIR}/transfer84-shrinking.log")"
+fi
+
+# Test 85: SKIP_OPEN_FILES leaves out files another process is writing (Linux only)
+print_test_header "Test 85: Skip files open for writing"
+if [ "$(uname -s)" = "Linux" ]; then
+    mkdir -p "${SENDER_DIR}/live"
+    echo "finished" > "${SENDER_DIR}/live/closed.log"
+    echo "still growing" > "${SENDER_DIR}/live/open.log"
+    # Holds the file open for writing, like a process still appending to it
+    sleep 60 >> "${SENDER_DIR}/live/open.log" &
+    WRITER_PID=$!
+    PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+    ROOT_DIR="${SENDER_DIR}" \
+    SKIP_OPEN_FILES=true \
+    REPORT_DIR="${TEST_DIR}/busy-reports" \
+    HTTP_PORT=8155 \
+    GRPC_PORT=50128 \
+    ./bin/file-transfer-server > "${TEST_DIR}/skip-open.log" 2>&1 &
+    SKIP_OPEN_PID=$!
+    sleep 2
+
+    curl -s -X POST http://localhost:8155/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"live/*.log","target":"live"}' \
+        > "${TEST_DIR}/transfer85.log" 2>&1 || true
+    kill $WRITER_PID 2>/dev/null || true
+    # Once the writer is done, the file is sent like any other
+    curl -s -X POST http://localhost:8155/transfer \
+        -H "Content-Type: application/json" \
+        -d '{"source":"live/open.log","target":"live/open.log"}' \
+        > "${TEST_DIR}/transfer85-closed.log" 2>&1 || true
+    kill $SKIP_OPEN_PID 2>/dev/null || true
+
+    if grep -q '"type":"file_busy".*file skipped, open for writing: live/open.log' "${TEST_DIR}/transfer85.log" && \
+       grep '"type":"batch_completed"' "${TEST_DIR}/transfer85.log" | grep -q '"files_completed":2,"files_total":2' && \
+       grep -q '"busy_files": 1' "${TEST_DIR}"/busy-reports/*.json && \
+       cmp -s "${SENDER_DIR}/live/closed.log" "${RECEIVER_DIR}/live/closed.log" && \
+       grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer85-closed.log" && \
+       cmp -s "${SENDER_DIR}/live/open.log" "${RECEIVER_DIR}/live/open.log"; then
+        print_result 0 "The file open for writing was skipped until its writer closed it"
+    else
+        print_result 1 "Unexpected open file results: batch=$(tail -n1 "${TEST_DIR}/transfer85.log"), closed=$(tail -n1 "${TEST_DIR}/transfer85-closed.log")"
+    fi
+else
+    print_result 0 "Skipped: open files are only detected on Linux"
+fi
+
+# Test 86: HISTORY_FILE keeps the transfer history across restarts
+print_test_header "Test 86: Transfer history survives a restart"
+start_history_server() {
+    PEER_SERVER_ADDR="localhost:${RECEIVER_PORT}" \
+    ROOT_DIR="${SENDER_DIR}" \
+    HISTORY_FILE="${TEST_DIR}/history.ndjson" \
+    HTTP_PORT=8156 \
+    GRPC_PORT=50129 \
+    ./bin/file-transfer-server >> "${TEST_DIR}/history.log" 2>&1 &
+    HISTORY_PID=$!
+    sleep 2
+}
+start_history_server
+curl -s -X POST http://localhost:8156/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"history/small.txt"}' \
+    > "${TEST_DIR}/transfer86.log" 2>&1 || true
+curl -s -X POST http://localhost:8156/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"missing.txt","target":"history/missing.txt"}' \
+    > "${TEST_DIR}/transfer86-failed.log" 2>&1 || true
+kill $HISTORY_PID 2>/dev/null || true
+wait $HISTORY_PID 2>/dev/null || true
+
+start_history_server
+curl -s "http://localhost:8156/history?status=completed&peer=localhost:${RECEIVER_PORT}" > "${TEST_DIR}/history-completed.json" || true
+curl -s "http://localhost:8156/history?status=failed" > "${TEST_DIR}/history-failed.json" || true
+curl -s "http://localhost:8156/history?since=2099-01-01T00:00:00Z" > "${TEST_DIR}/history-future.json" || true
+HISTORY_BAD_STATUS=$(curl -s -o /dev/null -w '%{http_code}' "http://localhost:8156/history?since=yesterday" || true)
+kill $HISTORY_PID 2>/dev/null || true
+
+SMALL_SUM=$(sha256sum "${SENDER_DIR}/small.txt" | cut -d' ' -f1)
+if grep -q "\"source\":\"small.txt\",\"target\":\"history/small.txt\",\"status\":\"completed\",\"bytes_transferred\":[0-9]*,\"checksum\":\"${SMALL_SUM}\"" "${TEST_DIR}/history-completed.json" && \
+   ! grep -q 'missing.txt' "${TEST_DIR}/history-completed.json" && \
+   grep -q '"source":"missing.txt".*"status":"failed"' "${TEST_DIR}/history-failed.json" && \
+   [ "$(cat "${TEST_DIR}/history-future.json")" = "[]" ] && \
+   [ "$HISTORY_BAD_STATUS" = "400" ]; then
+    print_result 0 "Both transfers were listed after the restart and filters applied"
+else
+    print_result 1 "Unexpected history: completed=$(cat "${TEST_DIR}/history-completed.json"), failed=$(cat "${TEST_DIR}/history-failed.json"), future=$(cat "${TEST_DIR}/history-future.json"), bad=${HISTORY_BAD_STATUS}"
+fi
+
+# Test 87: GRPC_MAX_CONCURRENT_STREAMS limits the streams a connection may have open
+print_test_header "Test 87: gRPC stream limit and window size"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/stream-limit" \
+GRPC_MAX_CONCURRENT_STREAMS=1 \
+GRPC_STREAM_WINDOW_SIZE=1048576 \
+HTTP_PORT=8157 \
+GRPC_PORT=50130 \
+./bin/file-transfer-server > "${TEST_DIR}/stream-limit.log" 2>&1 &
+STREAM_LIMIT_PID=$!
+PEER_SERVER_ADDR="localhost:50130" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8158 \
+GRPC_PORT=50131 \
+./bin/file-transfer-server > "${TEST_DIR}/stream-limit-sender.log" 2>&1 &
+STREAM_LIMIT_SENDER_PID=$!
+sleep 2
+
+# Speaks HTTP/2 directly to open several Transfer streams on one connection:
+# the second is refused while the first is open, and a third is accepted once
+# the first has ended. Prints the advertised limit and window, the code the
+# second stream was reset with and whether the third was answered.
+STREAM_LIMIT_RESULT=$(timeout 20 python3 -c '
+import socket, struct, sys, time
+def frame(kind, flags, stream, payload=b""):
+    return len(payload).to_bytes(3, "big") + bytes([kind, flags]) + stream.to_bytes(4, "big") + payload
+def recv_exact(sock, n):
+    data = b""
+    while len(data) < n:
+        chunk = sock.recv(n - len(data))
+        if not chunk:
+            raise EOFError
+        data += chunk
+    return data
+def read_frame(sock):
+    head = recv_exact(sock, 9)
+    stream = int.from_bytes(head[5:9], "big") & 0x7fffffff
+    return head[3], stream, recv_exact(sock, int.from_bytes(head[:3], "big"))
+def literal(name, value):
+    return b"\x00" + bytes([len(name)]) + name + bytes([len(value)]) + value
+headers = b"".join(literal(n, v) for n, v in [
+    (b":method", b"POST"), (b":scheme", b"http"), (b":path", b"/transfer.FileTransfer/Transfer"),
+    (b":authority", b"localhost"), (b"content-type", b"application/grpc"), (b"te", b"trailers")])
+s = socket.create_connection(("127.0.0.1", int(sys.argv[1])))
+s.sendall(b"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n" + frame(4, 0, 0))
+kind, _, payload = read_frame(s)
+settings = dict(struct.unpack(">HI", payload[i:i + 6]) for i in range(0, len(payload), 6))
+s.sendall(frame(4, 1, 0) + frame(1, 4, 1, headers) + frame(1, 4, 3, headers))
+refused = None
+while refused is None:
+    kind, stream, payload = read_frame(s)
+    if kind == 3 and stream == 3:
+        refused = int.from_bytes(payload, "big")
+s.sendall(frame(3, 0, 1, (8).to_bytes(4, "big")))
+time.sleep(0.5)
+s.sendall(frame(1, 4, 5, headers) + frame(0, 1, 5))
+answered = False
+while not answered:
+    kind, stream, payload = read_frame(s)
+    if stream == 5:
+        answered = kind == 1
+        if kind == 3:
+            break
+print(settings.get(3), settings.get(4), refused, answered)
+' 50130 2>&1 || true)
+
+curl -s -X POST http://localhost:8158/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt"}' \
+    > "${TEST_DIR}/transfer87.log" 2>&1 || true
+kill $STREAM_LIMIT_PID $STREAM_LIMIT_SENDER_PID 2>/dev/null || true
+
+if [ "$STREAM_LIMIT_RESULT" = "1 1048576 7 True" ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer87.log" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TEST_DIR}/stream-limit/small.txt"; then
+    print_result 0 "Streams past the limit were refused until the open one ended"
+else
+    print_result 1 "Unexpected stream limit results: ${STREAM_LIMIT_RESULT}, transfer=$(tail -n1 "${TEST_DIR}/transfer87.log")"
+fi
+
+# Test 88: /verify-tree flags tampered, missing and extra files against the manifests
+print_test_header "Test 88: Verifying a tree against checksum manifests"
+mkdir -p "${TEST_DIR}/verify-tree"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/verify-tree" \
+WRITE_CHECKSUM_MANIFEST=true \
+HTTP_PORT=8159 \
+GRPC_PORT=50132 \
+./bin/file-transfer-server > "${TEST_DIR}/verify-tree.log" 2>&1 &
+VERIFY_TREE_PID=$!
+PEER_SERVER_ADDR="localhost:50132" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8160 \
+GRPC_PORT=50133 \
+./bin/file-transfer-server > "${TEST_DIR}/verify-tree-sender.log" 2>&1 &
+VERIFY_TREE_SENDER_PID=$!
+sleep 2
+
+for f in small.txt medium.bin large.bin; do
+    curl -s -X POST http://localhost:8160/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"${f}\",\"target\":\"tree/${f}\"}" \
+        > "${TEST_DIR}/transfer88-${f}.log" 2>&1 || true
+done
+curl -s -X POST http://localhost:8159/verify-tree \
+    -H "Content-Type: application/json" \
+    -d '{"path":"tree"}' > "${TEST_DIR}/verify88-clean.json" 2>&1 || true
+(cd "${TEST_DIR}/verify-tree/tree" && sha256sum small.txt medium.bin large.bin) > "${TEST_DIR}/verify-tree/tree.sha256"
+echo "tampered" >> "${TEST_DIR}/verify-tree/tree/small.txt"
+rm -f "${TEST_DIR}/verify-tree/tree/large.bin"
+echo "extra" > "${TEST_DIR}/verify-tree/tree/extra.txt"
+curl -s -X POST http://localhost:8159/verify-tree \
+    -H "Content-Type: application/json" \
+    -d '{"path":"tree"}' > "${TEST_DIR}/verify88-sidecars.json" 2>&1 || true
+curl -s -X POST http://localhost:8159/verify-tree \
+    -H "Content-Type: application/json" \
+    -d '{"path":"tree","manifest":"tree.sha256"}' > "${TEST_DIR}/verify88-manifest.json" 2>&1 || true
+VERIFY_MISSING_STATUS=$(curl -s -o /dev/null -w '%{http_code}' -X POST http://localhost:8159/verify-tree \
+    -H "Content-Type: application/json" \
+    -d '{"path":"missing"}' || true)
+kill $VERIFY_TREE_PID $VERIFY_TREE_SENDER_PID 2>/dev/null || true
+
+VERIFY_RESULT=$(python3 -c '
+import json, sys
+results = []
+for path in sys.argv[1:]:
+    r = json.load(open(path))
+    results.append("%s %d %s %s %s" % (r["ok"], r["verified"], ",".join(r["missing"]), ",".join(r["extra"]),
+                                       ",".join(m["path"] for m in r["mismatched"])))
+print("|".join(results))
+' "${TEST_DIR}/verify88-clean.json" "${TEST_DIR}/verify88-sidecars.json" "${TEST_DIR}/verify88-manifest.json" 2>&1 || true)
+if [ "$VERIFY_RESULT" = "True 3   |False 1 large.bin extra.txt small.txt|False 1 large.bin extra.txt small.txt" ] && \
+   [ "$VERIFY_MISSING_STATUS" = "404" ]; then
+    print_result 0 "Tampered, missing and extra files were reported against sidecars and a manifest"
+else
+    print_result 1 "Unexpected verify results: ${VERIFY_RESULT}, missing directory=${VERIFY_MISSING_STATUS}"
+fi
+
+# Test 89: DISABLE_PROGRESS drops per-file progress updates, transfers still succeed
+print_test_header "Test 89: Transfers with progress tracking disabled"
+mkdir -p "${TEST_DIR}/no-progress"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/no-progress" \
+HTTP_PORT=8161 \
+GRPC_PORT=50134 \
+./bin/file-transfer-server > "${TEST_DIR}/no-progress.log" 2>&1 &
+NO_PROGRESS_PID=$!
+PEER_SERVER_ADDR="localhost:50134" \
+ROOT_DIR="${SENDER_DIR}" \
+DISABLE_PROGRESS=true \
+HTTP_PORT=8162 \
+GRPC_PORT=50135 \
+./bin/file-transfer-server > "${TEST_DIR}/no-progress-sender.log" 2>&1 &
+NO_PROGRESS_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8162/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"{small.txt,medium.bin}","target":"batch"}' \
+    > "${TEST_DIR}/transfer89-batch.log" 2>&1 || true
+curl -s -X POST http://localhost:8162/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"large.bin","target":"large.bin","parallel_chunks":4}' \
+    > "${TEST_DIR}/transfer89-ranged.log" 2>&1 || true
+kill $NO_PROGRESS_PID $NO_PROGRESS_SENDER_PID 2>/dev/null || true
+
+if [ "$(grep -c '"type":"file_completed"' "${TEST_DIR}/transfer89-batch.log")" = "2" ] && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer89-batch.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer89-ranged.log" && \
+   ! grep -q 'transfer started\|sending: \|awaiting peer confirmation' "${TEST_DIR}"/transfer89-*.log && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TEST_DIR}/no-progress/batch/small.txt" && \
+   cmp -s "${SENDER_DIR}/medium.bin" "${TEST_DIR}/no-progress/batch/medium.bin" && \
+   cmp -s "${SENDER_DIR}/large.bin" "${TEST_DIR}/no-progress/large.bin"; then
+    print_result 0 "Files arrived with only batch events in the response"
+else
+    print_result 1 "Unexpected results without progress: batch=$(tail -n1 "${TEST_DIR}/transfer89-batch.log"), ranged=$(tail -n1 "${TEST_DIR}/transfer89-ranged.log")"
+fi
+
+# Test 90: on_conflict=ask pauses at existing targets until POST /resolve/{id} decides
+print_test_header "Test 90: Resolving conflicts interactively"
+mkdir -p "${TEST_DIR}/conflict/docs" "${SENDER_DIR}/conflict-src"
+for f in a b c; do
+    echo "existing ${f}" > "${TEST_DIR}/conflict/docs/${f}.txt"
+    echo "new ${f}" > "${SENDER_DIR}/conflict-src/${f}.txt"
+done
+echo "new d" > "${SENDER_DIR}/conflict-src/d.txt"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/conflict" \
+HTTP_PORT=8163 \
+GRPC_PORT=50136 \
+./bin/file-transfer-server > "${TEST_DIR}/conflict.log" 2>&1 &
+CONFLICT_PID=$!
+PEER_SERVER_ADDR="localhost:50136" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8164 \
+GRPC_PORT=50137 \
+./bin/file-transfer-server > "${TEST_DIR}/conflict-sender.log" 2>&1 &
+CONFLICT_SENDER_PID=$!
+sleep 2
+
+# Answers each conflict event as it streams in: a is overwritten, b kept, c renamed.
+# The kept file still counts towards files_completed.
+CONFLICT_RESULT=$(timeout 30 python3 -c '
+import json, urllib.error, urllib.request
+def post(path, body):
+    return urllib.request.urlopen(urllib.request.Request("http://localhost:8164" + path,
+        data=json.dumps(body).encode(), headers={"Content-Type": "application/json"}))
+try:
+    post("/resolve/unknown", {"action": "skip"})
+    missing = 200
+except urllib.error.HTTPError as e:
+    missing = e.code
+actions = {"docs/a.txt": "overwrite", "docs/b.txt": "skip", "docs/c.txt": "rename"}
+conflicts, resolved, completed = [], [], None
+for line in post("/transfer", {"source": "conflict-src/*", "target": "docs", "on_conflict": "ask"}):
+    event = json.loads(line)
+    if event.get("type") == "conflict":
+        conflicts.append(event["path"])
+        post("/resolve/" + event["conflict"]["id"], {"action": actions[event["path"]]})
+    elif event.get("type") == "conflict_resolved":
+        resolved.append(event["path"])
+    elif event.get("type") == "batch_completed":
+        completed = "%d %d/%d" % (event["files"], event["files_completed"], event["files_total"])
+print(missing, ",".join(conflicts), ",".join(resolved), completed)
+' 2>&1 || true)
+kill $CONFLICT_PID $CONFLICT_SENDER_PID 2>/dev/null || true
+
+if [ "$CONFLICT_RESULT" = "404 docs/a.txt,docs/b.txt,docs/c.txt docs/a.txt,docs/b.txt,docs/c-1.txt 3 4/4" ] && \
+   [ "$(cat "${TEST_DIR}/conflict/docs/a.txt")" = "new a" ] && \
+   [ "$(cat "${TEST_DIR}/conflict/docs/b.txt")" = "existing b" ] && \
+   [ "$(cat "${TEST_DIR}/conflict/docs/c.txt")" = "existing c" ] && \
+   [ "$(cat "${TEST_DIR}/conflict/docs/c-1.txt")" = "new c" ] && \
+   [ "$(cat "${TEST_DIR}/conflict/docs/d.txt")" = "new d" ]; then
+    print_result 0 "Conflicts paused the batch and were overwritten, kept and renamed as decided"
+else
+    print_result 1 "Unexpected conflict results: ${CONFLICT_RESULT}, files=$(ls "${TEST_DIR}/conflict/docs" | tr '\n' ' ')"
+fi
+
+# Test 91: NORMALIZE_NAMES stores decomposed (NFD) names in the configured form
+print_test_header "Test 91: Unicode name normalization"
+NFD_NAME=$'cafe\xcc\x81.txt'
+NFC_NAME=$'caf\xc3\xa9.txt'
+mkdir -p "${TEST_DIR}/normalize" "${SENDER_DIR}/nfd-dir/"$'re\xcc\x81sume\xcc\x81'
+echo "decomposed" > "${SENDER_DIR}/${NFD_NAME}"
+echo "inside" > "${SENDER_DIR}/nfd-dir/"$'re\xcc\x81sume\xcc\x81'"/${NFD_NAME}"
+PEER_SERVER_ADDR="localhost:${SENDER_PORT}" \
+ROOT_DIR="${TEST_DIR}/normalize" \
+NORMALIZE_NAMES=nfc \
+HTTP_PORT=8165 \
+GRPC_PORT=50138 \
+./bin/file-transfer-server > "${TEST_DIR}/normalize.log" 2>&1 &
+NORMALIZE_PID=$!
+PEER_SERVER_ADDR="localhost:50138" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8166 \
+GRPC_PORT=50139 \
+./bin/file-transfer-server > "${TEST_DIR}/normalize-sender.log" 2>&1 &
+NORMALIZE_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8166/transfer \
+    -H "Content-Type: application/json" \
+    -d "{\"source\":\"${NFD_NAME}\",\"target\":\"${NFD_NAME}\",\"batch_checksum\":true}" \
+    > "${TEST_DIR}/transfer91-file.log" 2>&1 || true
+curl -s -X POST http://localhost:8166/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"nfd-dir","target":"nfd-archive","archive":"tar","batch_checksum":true}' \
+    > "${TEST_DIR}/transfer91-archive.log" 2>&1 || true
+# Sending the same name again finds the normalized file up to date
+curl -s -X POST http://localhost:8166/transfer \
+    -H "Content-Type: application/json" \
+    -d "{\"source\":\"${NFD_NAME}\",\"target\":\"${NFD_NAME}\",\"sync\":\"checksum\"}" \
+    > "${TEST_DIR}/transfer91-sync.log" 2>&1 || true
+kill $NORMALIZE_PID $NORMALIZE_SENDER_PID 2>/dev/null || true
+
+if grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer91-file.log" && \
+   grep -q '"type":"batch_completed"' "${TEST_DIR}/transfer91-archive.log" && \
+   grep -q 'file unchanged' "${TEST_DIR}/transfer91-sync.log" && \
+   [ "$(cat "${TEST_DIR}/normalize/${NFC_NAME}" 2>/dev/null)" = "decomposed" ] && \
+   [ ! -e "${TEST_DIR}/normalize/${NFD_NAME}" ] && \
+   [ "$(cat "${TEST_DIR}/normalize/nfd-archive/"$'r\xc3\xa9sum\xc3\xa9'"/${NFC_NAME}" 2>/dev/null)" = "inside" ]; then
+    print_result 0 "Decomposed names were stored composed, and batch checksums and sync still matched"
+else
+    print_result 1 "Unexpected normalization results: file=$(tail -n1 "${TEST_DIR}/transfer91-file.log"), archive=$(tail -n1 "${TEST_DIR}/transfer91-archive.log"), on disk=$(ls -R "${TEST_DIR}/normalize" | od -c | head -5)"
+fi
+
+# Test 92: a transfer that exhausts MAX_RETRIES fails with structured retry details
+print_test_header "Test 92: Structured error after exhausting retries"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${SENDER_DIR}" \
+MAX_RETRIES=2 \
+RETRY_DELAY=100ms \
+DIAL_TIMEOUT=1s \
+HTTP_PORT=8167 \
+GRPC_PORT=50141 \
+./bin/file-transfer-server > "${TEST_DIR}/retries-sender.log" 2>&1 &
+RETRIES_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8167/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt"}' \
+    > "${TEST_DIR}/transfer92.log" 2>&1 || true
+kill $RETRIES_SENDER_PID 2>/dev/null || true
+
+RETRIES_RESULT=$(python3 -c '
+import json, sys
+events = [json.loads(line) for line in open(sys.argv[1])]
+failed = [e for e in events if e["level"] == "error"][-1]
+retries = failed.get("retries", {})
+print(len([e for e in events if e.get("type") == "retry"]), failed.get("code"),
+      retries.get("attempts"), retries.get("category"), retries.get("peer_address"))
+' "${TEST_DIR}/transfer92.log" 2>&1 || true)
+if [ "$RETRIES_RESULT" = "2 retries_exhausted 3 unavailable localhost:50140" ]; then
+    print_result 0 "The final error carried the attempts, category and peer address"
+else
+    print_result 1 "Unexpected retry failure: ${RETRIES_RESULT}, last event=$(tail -n1 "${TEST_DIR}/transfer92.log")"
+fi
+
+# Test 93: PEER_TRANSPORT=http sends files to the peer's /receive without gRPC
+print_test_header "Test 93: Transfer over the HTTP peer transport"
+HTTP_RECEIVER_DIR="${TEST_DIR}/http-receiver"
+mkdir -p "${HTTP_RECEIVER_DIR}"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${HTTP_RECEIVER_DIR}" \
+API_TOKEN=http-secret \
+HTTP_PORT=8168 \
+GRPC_PORT=50142 \
+./bin/file-transfer-server > "${TEST_DIR}/http-receiver.log" 2>&1 &
+HTTP_RECEIVER_PID=$!
+PEER_TRANSPORT=http \
+PEER_API_TOKEN=http-secret \
+PEER_SERVER_ADDR="localhost:8168" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8169 \
+GRPC_PORT=50143 \
+./bin/file-transfer-server > "${TEST_DIR}/http-sender.log" 2>&1 &
+HTTP_SENDER_PID=$!
+PEER_TRANSPORT=http \
+PEER_API_TOKEN=wrong \
+PEER_SERVER_ADDR="localhost:8168" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8170 \
+GRPC_PORT=50144 \
+./bin/file-transfer-server > "${TEST_DIR}/http-badtoken.log" 2>&1 &
+HTTP_BADTOKEN_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8169/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt"}' \
+    > "${TEST_DIR}/transfer93a.log" 2>&1 || true
+curl -s -X POST http://localhost:8169/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"large.bin","target":"large.bin","parallel_chunks":4}' \
+    > "${TEST_DIR}/transfer93b.log" 2>&1 || true
+curl -s -X POST http://localhost:8170/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"denied.txt"}' \
+    > "${TEST_DIR}/transfer93c.log" 2>&1 || true
+HTTP_PULL=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8169/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"small.txt","pull":true}' || true)
+kill $HTTP_RECEIVER_PID $HTTP_SENDER_PID $HTTP_BADTOKEN_PID 2>/dev/null || true
+
+if tail -n1 "${TEST_DIR}/transfer93a.log" | grep -q '"type":"batch_completed"' && \
+   tail -n1 "${TEST_DIR}/transfer93b.log" | grep -q '"type":"batch_completed"' && \
+   cmp -s "${SENDER_DIR}/small.txt" "${HTTP_RECEIVER_DIR}/small.txt" && \
+   cmp -s "${SENDER_DIR}/large.bin" "${HTTP_RECEIVER_DIR}/large.bin" && \
+   grep -q "Unauthenticated\|401" "${TEST_DIR}/transfer93c.log" && \
+   [ ! -e "${HTTP_RECEIVER_DIR}/denied.txt" ] && [ "$HTTP_PULL" = "400" ]; then
+    print_result 0 "Files arrived intact over /receive, a wrong token was refused and pull was rejected"
+else
+    print_result 1 "HTTP transport failed (pull status ${HTTP_PULL}): $(tail -n1 "${TEST_DIR}/transfer93a.log") / $(tail -n1 "${TEST_DIR}/transfer93b.log") / $(tail -n1 "${TEST_DIR}/transfer93c.log")"
+fi
+
+# Test 94: STALE_TEMP_AGE sweeps orphaned temp files at startup but keeps resumable ones
+print_test_header "Test 94: Startup sweep of stale temp files"
+SWEEP_DIR="${TEST_DIR}/sweep"
+SWEEP_FINGERPRINT="1024-$(printf '%064d' 0)"
+mkdir -p "${SWEEP_DIR}/docs" "${SWEEP_DIR}/.resume"
+echo "orphan" > "${SWEEP_DIR}/docs/old.txt.0123abcd.part"
+echo "recent" > "${SWEEP_DIR}/docs/new.txt.4567cdef.part"
+echo "resumable" > "${SWEEP_DIR}/.resume/${SWEEP_FINGERPRINT}.part"
+touch -d "2 hours ago" "${SWEEP_DIR}/docs/old.txt.0123abcd.part" "${SWEEP_DIR}/.resume/${SWEEP_FINGERPRINT}.part"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${SWEEP_DIR}" \
+STALE_TEMP_AGE=1h \
+RESUME_PARTIAL=true \
+HTTP_PORT=8171 \
+GRPC_PORT=50145 \
+./bin/file-transfer-server > "${TEST_DIR}/sweep.log" 2>&1 &
+SWEEP_PID=$!
+sleep 2
+kill $SWEEP_PID 2>/dev/null || true
+
+if [ ! -e "${SWEEP_DIR}/docs/old.txt.0123abcd.part" ] && \
+   [ -f "${SWEEP_DIR}/docs/new.txt.4567cdef.part" ] && \
+   [ -f "${SWEEP_DIR}/.resume/${SWEEP_FINGERPRINT}.part" ] && \
+   grep -q "Sweeping stale temp file: path=docs/old.txt.0123abcd.part" "${TEST_DIR}/sweep.log" && \
+   grep -q "swept=1" "${TEST_DIR}/sweep.log"; then
+    print_result 0 "The old orphan was removed; the recent and resumable temp files were kept"
+else
+    print_result 1 "Unexpected sweep result: $(ls -R "${SWEEP_DIR}" | tr '\n' ' '), log=$(grep -i sweep "${TEST_DIR}/sweep.log")"
+fi
+
+# Test 95: storage_class writes files under the receiver's root for that class
+print_test_header "Test 95: Per-request storage class"
+TIER_DIR="${TEST_DIR}/tiers"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${TIER_DIR}/standard" \
+STORAGE_CLASSES="cold=${TIER_DIR}/cold, archive=${TIER_DIR}/archive" \
+HTTP_PORT=8172 \
+GRPC_PORT=50146 \
+./bin/file-transfer-server > "${TEST_DIR}/tier-receiver.log" 2>&1 &
+TIER_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50146" \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8173 \
+GRPC_PORT=50147 \
+./bin/file-transfer-server > "${TEST_DIR}/tier-sender.log" 2>&1 &
+TIER_SENDER_PID=$!
+sleep 2
+
+for class in "" standard cold archive hot; do
+    curl -s -X POST http://localhost:8173/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"small.txt\",\"target\":\"tiered/${class:-default}.txt\",\"storage_class\":\"${class}\"}" \
+        > "${TEST_DIR}/transfer95-${class:-default}.log" 2>&1 || true
+done
+curl -s -X POST http://localhost:8173/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"medium.bin","target":"tiered/medium.bin","storage_class":"archive","parallel_chunks":3}' \
+    > "${TEST_DIR}/transfer95-ranges.log" 2>&1 || true
+TIER_INVALID=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8173/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"x.txt","storage_class":"Cold","stage":true}' || true)
+kill $TIER_RECEIVER_PID $TIER_SENDER_PID 2>/dev/null || true
+
+if cmp -s "${SENDER_DIR}/small.txt" "${TIER_DIR}/standard/tiered/default.txt" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TIER_DIR}/standard/tiered/standard.txt" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TIER_DIR}/cold/tiered/cold.txt" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${TIER_DIR}/archive/tiered/archive.txt" && \
+   cmp -s "${SENDER_DIR}/medium.bin" "${TIER_DIR}/archive/tiered/medium.bin" && \
+   [ ! -e "${TIER_DIR}/standard/tiered/cold.txt" ] && [ ! -e "${TIER_DIR}/standard/tiered/medium.bin" ] && \
+   grep -q "unknown storage class: hot" "${TEST_DIR}/transfer95-hot.log" && \
+   [ "$TIER_INVALID" = "400" ]; then
+    print_result 0 "Each class landed under its own root; unknown and invalid classes were rejected"
+else
+    print_result 1 "Unexpected tiering (invalid status ${TIER_INVALID}): $(find "${TIER_DIR}" -type f | tr '\n' ' '), hot=$(tail -n1 "${TEST_DIR}/transfer95-hot.log")"
+fi
+
+# Test 96: POST /sync reconciles two trees in both directions and reports conflicts
+print_test_header "Test 96: Bidirectional sync"
+BISYNC_A="${TEST_DIR}/bisync-a"
+BISYNC_B="${TEST_DIR}/bisync-b"
+mkdir -p "${BISYNC_A}/shared" "${BISYNC_B}/shared"
+echo "a1" > "${BISYNC_A}/shared/a.txt"
+echo "same" > "${BISYNC_A}/shared/common.txt"
+echo "base" > "${BISYNC_A}/shared/both.txt"
+echo "doomed" > "${BISYNC_A}/shared/gone.txt"
+echo "b1" > "${BISYNC_B}/shared/b.txt"
+echo "same" > "${BISYNC_B}/shared/common.txt"
+PEER_SERVER_ADDR="localhost:50149" \
+ROOT_DIR="${BISYNC_A}" \
+HTTP_PORT=8174 \
+GRPC_PORT=50148 \
+./bin/file-transfer-server > "${TEST_DIR}/bisync-a.log" 2>&1 &
+BISYNC_A_PID=$!
+PEER_SERVER_ADDR="localhost:50148" \
+ROOT_DIR="${BISYNC_B}" \
+HTTP_PORT=8175 \
+GRPC_PORT=50149 \
+./bin/file-transfer-server > "${TEST_DIR}/bisync-b.log" 2>&1 &
+BISYNC_B_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8174/sync -H "Content-Type: application/json" \
+    -d '{"path":"shared"}' > "${TEST_DIR}/sync96a.json" 2>&1 || true
+# Diverge: both sides edit both.txt, the peer edits a.txt and deletes gone.txt
+echo "edited on a" > "${BISYNC_A}/shared/both.txt"
+echo "edited on b" > "${BISYNC_B}/shared/both.txt"
+echo "a2" > "${BISYNC_B}/shared/a.txt"
+rm -f "${BISYNC_B}/shared/gone.txt"
+echo "c1" > "${BISYNC_A}/shared/c.txt"
+curl -s -X POST http://localhost:8174/sync -H "Content-Type: application/json" \
+    -d '{"path":"shared","delete":true}' > "${TEST_DIR}/sync96b.json" 2>&1 || true
+BISYNC_KEPT=$(cat "${BISYNC_A}/shared/both.txt" "${BISYNC_B}/shared/both.txt" | tr '\n' ' ')
+# Settle the conflict: the peer's edit is newer
+touch -d "+1 minute" "${BISYNC_B}/shared/both.txt"
+curl -s -X POST http://localhost:8174/sync -H "Content-Type: application/json" \
+    -d '{"path":"shared","delete":true,"conflict_policy":"newer"}' > "${TEST_DIR}/sync96c.json" 2>&1 || true
+kill $BISYNC_A_PID $BISYNC_B_PID 2>/dev/null || true
+
+BISYNC_RESULT=$(python3 -c '
+import json, sys
+first, second, third = (json.load(open(p)) for p in sys.argv[1:4])
+print(first["converged"], first["pushed"], first["pulled"], first["in_sync"],
+      "|", second["converged"], [(c["path"], c.get("resolution", "")) for c in second["conflicts"]],
+      second["pulled"], second["pushed"], second["deleted_local"],
+      "|", third["converged"], [(c["path"], c.get("resolution")) for c in third["conflicts"]], third["pulled"])
+' "${TEST_DIR}/sync96a.json" "${TEST_DIR}/sync96b.json" "${TEST_DIR}/sync96c.json" 2>&1 || true)
+BISYNC_EXPECTED="True ['a.txt', 'both.txt', 'gone.txt'] ['b.txt'] 1 | False [('both.txt', '')] ['a.txt'] ['c.txt'] ['gone.txt'] | True [('both.txt', 'remote')] ['both.txt']"
+if [ "$BISYNC_RESULT" = "$BISYNC_EXPECTED" ] && \
+   [ "$BISYNC_KEPT" = "edited on a edited on b " ] && \
+   diff -r "${BISYNC_A}/shared" "${BISYNC_B}/shared" > /dev/null && \
+   [ "$(cat "${BISYNC_A}/shared/both.txt")" = "edited on b" ] && [ ! -e "${BISYNC_A}/shared/gone.txt" ]; then
+    print_result 0 "Both trees converged; the two-sided edit was reported, then settled by the newer policy"
+else
+    print_result 1 "Unexpected sync: ${BISYNC_RESULT}, kept=${BISYNC_KEPT}, $(diff -r "${BISYNC_A}/shared" "${BISYNC_B}/shared" 2>&1 | tr '\n' ' ')"
+fi
+
+# Test 97: REQUEST_RATE_LIMIT answers 429 with Retry-After once /transfer requests come too fast
+print_test_header "Test 97: Request throttling"
+THROTTLE_ROOT="${TEST_DIR}/throttle-root"
+mkdir -p "${THROTTLE_ROOT}"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${THROTTLE_ROOT}" \
+HTTP_PORT=8176 \
+GRPC_PORT=50150 \
+REQUEST_RATE_LIMIT=0.5 \
+REQUEST_RATE_BURST=2 \
+REQUEST_RATE_KEY=ip \
+./bin/file-transfer-server > "${TEST_DIR}/throttle.log" 2>&1 &
+THROTTLE_PID=$!
+sleep 2
+
+# Invalid requests still count: the limit applies before the request is read
+THROTTLE_CODES=""
+for i in 1 2 3 4 5; do
+    CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://127.0.0.1:8176/transfer \
+        -H "Content-Type: application/json" -d '{}' 2>/dev/null || true)
+    THROTTLE_CODES="${THROTTLE_CODES}${CODE} "
+done
+THROTTLE_RETRY=$(curl -s -D - -o /dev/null -X POST http://127.0.0.1:8176/transfer \
+    -H "Content-Type: application/json" -d '{}' 2>/dev/null | tr -d '\r' | awk -F': ' 'tolower($1) == "retry-after" {print $2}' || true)
+# Another client has its own bucket, and other endpoints aren't limited
+OTHER_CODE=$(curl -s --interface 127.0.0.2 -o /dev/null -w "%{http_code}" -X POST http://127.0.0.1:8176/transfer \
+    -H "Content-Type: application/json" -d '{}' 2>/dev/null || true)
+HEALTH_CODE=$(curl -s -o /dev/null -w "%{http_code}" http://127.0.0.1:8176/health 2>/dev/null || true)
+THROTTLED_METRIC=$(curl -s http://127.0.0.1:8176/metrics 2>/dev/null | awk '$1 == "throttled_requests_total" {print $2}' || true)
+kill $THROTTLE_PID 2>/dev/null || true
+
+if [ "$THROTTLE_CODES" = "400 400 429 429 429 " ] && [ "$THROTTLE_RETRY" = "2" ] && \
+   [ "$OTHER_CODE" = "400" ] && [ "$HEALTH_CODE" = "200" ] && [ "$THROTTLED_METRIC" = "4" ]; then
+    print_result 0 "Requests beyond the burst got 429 with Retry-After; other clients and endpoints were unaffected"
+else
+    print_result 1 "Unexpected throttling: codes=${THROTTLE_CODES}, retryAfter=${THROTTLE_RETRY}, other=${OTHER_CODE}, health=${HEALTH_CODE}, metric=${THROTTLED_METRIC}"
+fi
+
+# Test 98: Targets are canonicalized before validation; TARGET_BACKSLASHES converts or rejects backslashes
+print_test_header "Test 98: Target path canonicalization"
+CANON_DIR="${TEST_DIR}/canon-receiver"
+mkdir -p "${CANON_DIR}"
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${CANON_DIR}" \
+HTTP_PORT=8178 \
+GRPC_PORT=50152 \
+./bin/file-transfer-server > "${TEST_DIR}/canon-receiver.log" 2>&1 &
+CANON_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50152" \
+ROOT_DIR="${SENDER_DIR}" \
+TARGET_BACKSLASHES=convert \
+HTTP_PORT=8177 \
+GRPC_PORT=50151 \
+./bin/file-transfer-server > "${TEST_DIR}/canon-sender.log" 2>&1 &
+CANON_SENDER_PID=$!
+PEER_SERVER_ADDR="localhost:50152" \
+ROOT_DIR="${SENDER_DIR}" \
+TARGET_BACKSLASHES=reject \
+HTTP_PORT=8179 \
+GRPC_PORT=50153 \
+./bin/file-transfer-server > "${TEST_DIR}/canon-strict.log" 2>&1 &
+CANON_STRICT_PID=$!
+sleep 2
+
+CANON_CODES=""
+for target in 'canon//a/./one.txt' 'canon\\win\\two.txt' './canon//dir//' 'canon/x/../three.txt' 'canon/../../escape.txt' '/canon/abs.txt'; do
+    CODE=$(curl -s -o /dev/null -w "%{http_code}" -X POST http://localhost:8177/transfer \
+        -H "Content-Type: application/json" \
+        -d "{\"source\":\"small.txt\",\"target\":\"${target}\"}" 2>/dev/null || true)
+    CANON_CODES="${CANON_CODES}${CODE} "
+done
+CANON_STRICT=$(curl -s -X POST http://localhost:8179/transfer \
+    -H "Content-Type: application/json" \
+    -d '{"source":"small.txt","target":"canon\\strict.txt"}' 2>/dev/null || true)
+kill $CANON_RECEIVER_PID $CANON_SENDER_PID $CANON_STRICT_PID 2>/dev/null || true
+
+CANON_FILES=$(cd "${CANON_DIR}" && find . -type f | sort | tr '\n' ' ')
+if [ "$CANON_CODES" = "200 200 200 200 400 400 " ] && \
+   [ "$CANON_FILES" = "./canon/a/one.txt ./canon/dir/small.txt ./canon/three.txt ./canon/win/two.txt " ] && \
+   cmp -s "${SENDER_DIR}/small.txt" "${CANON_DIR}/canon/win/two.txt" && \
+   echo "$CANON_STRICT" | grep -q "must not contain backslashes"; then
+    print_result 0 "Messy targets were stored under their canonical paths; escaping, absolute and rejected backslash targets were refused"
+else
+    print_result 1 "Unexpected canonicalization: codes=${CANON_CODES}, files=${CANON_FILES}, strict=${CANON_STRICT}"
+fi
+
+# Test 99: The first event of a transfer reports the options in effect after merging profile and defaults
+print_test_header "Test 99: Effective options in the first event"
+OPTIONS_DIR="${TEST_DIR}/options-receiver"
+mkdir -p "${OPTIONS_DIR}"
+cat > "${TEST_DIR}/options-profiles.json" << 'EOF'
+{"nightly": {"source": "small.txt", "target": "opts/small.txt", "verify_policy": "lenient"}}
+EOF
+PEER_SERVER_ADDR="localhost:50140" \
+ROOT_DIR="${OPTIONS_DIR}" \
+HTTP_PORT=8181 \
+GRPC_PORT=50155 \
+./bin/file-transfer-server > "${TEST_DIR}/options-receiver.log" 2>&1 &
+OPTIONS_RECEIVER_PID=$!
+PEER_SERVER_ADDR="localhost:50155" \
+ALLOWED_PEERS="localhost:50155=1048576" \
+PROFILES_FILE="${TEST_DIR}/options-profiles.json" \
+MAX_RETRIES=2 \
+ROOT_DIR="${SENDER_DIR}" \
+HTTP_PORT=8180 \
+GRPC_PORT=50154 \
+./bin/file-transfer-server > "${TEST_DIR}/options-sender.log" 2>&1 &
+OPTIONS_SENDER_PID=$!
+sleep 2
+
+curl -s -X POST http://localhost:8180/transfer -H "Content-Type: application/json" \
+    -d '{"profile":"nightly","sync":"quick"}' > "${TEST_DIR}/transfer99-profile.log" 2>&1 || true
+curl -s -X POST http://localhost:8180/transfer -H "Content-Type: application/json" \
+    -d '{"source":"opts","target":"options-pulled","pull":true}' > "${TEST_DIR}/transfer99-pull.log" 2>&1 || true
+kill $OPTIONS_RECEIVER_PID $OPTIONS_SENDER_PID 2>/dev/null || true
+
+OPTIONS_RESULT=$(python3 -c '
+import json, sys
+for path in sys.argv[1:]:
+    with open(path) as f:
+        first = json.loads(f.readline())
+    o = first.get("options", {})
+    print(o.get("profile", "-"), o.get("peer_address"), o.get("transport"), o.get("mode"), o.get("chunk_size"),
+          o.get("parallel_chunks"), o.get("archive") or "-", o.get("verify_policy"), o.get("on_conflict"), o.get("sync") or "-",
+          o.get("storage_class"), o.get("special_files"), o.get("include_hidden"), o.get("max_retries"), end=" | ")
+' "${TEST_DIR}/transfer99-profile.log" "${TEST_DIR}/transfer99-pull.log" 2>&1 || true)
+OPTIONS_EXPECTED="nightly localhost:50155 grpc file 1048576 1 - lenient overwrite quick standard skip True 2 | - localhost:50155 grpc pull 1048576 1 tar strict overwrite - standard skip True 2 | "
+if [ "$OPTIONS_RESULT" = "$OPTIONS_EXPECTED" ] && \
+   cmp -s "${SENDER_DIR}/small.txt" "${OPTIONS_DIR}/opts/small.txt" && \
+   cmp -s "${SENDER_DIR}/small.txt" "${SENDER_DIR}/options-pulled/small.txt"; then
+    print_result 0 "The first event listed the merged profile, request and server defaults"
+else
+    print_result 1 "Unexpected effective options: ${OPTIONS_RESULT}"
+fi
+rm -rf "${SENDER_DIR}/options-pulled"
+
 # Print summary
 print_test_header "Test Summary"
 echo -e "${GREEN}All tests passed!${NC}"
@@ -15,6 +15,10 @@ LOCAL_DIR="/tmp/transfer-test"
 FILE_SIZE_GB=10
 HTTP_PORT=8080
 GRPC_PORT=50052
+# Run once with USE_MMAP=true and once without to compare mapped and buffered reads
+USE_MMAP="${USE_MMAP:-false}"
+# Likewise with DISABLE_PROGRESS=true to measure what progress tracking costs
+DISABLE_PROGRESS="${DISABLE_PROGRESS:-false}"
 
 echo -e "${BLUE}========================================${NC}"
 echo -e "${BLUE}  ${FILE_SIZE_GB}GB File Transfer Test${NC}"
@@ -59,6 +63,9 @@ PEER_SERVER_ADDR="${PEER_SERVER}" \
 ROOT_DIR="${LOCAL_DIR}" \
 HTTP_PORT=${HTTP_PORT} \
 GRPC_PORT=${GRPC_PORT} \
+USE_MMAP=${USE_MMAP} \
+MMAP_MIN_SIZE=0 \
+DISABLE_PROGRESS=${DISABLE_PROGRESS} \
 ./bin/file-transfer-server > /tmp/transfer-server.log 2>&1 &
 SERVER_PID=$!
 
@@ -118,6 +125,8 @@ echo ""
 echo -e "${GREEN}Transfer Statistics:${NC}"
 echo "File Size: ${FILE_SIZE_MB} MB (${FILE_SIZE_BYTES} bytes)"
 echo "Transfer Time: ${ELAPSED_TIME} seconds"
+echo "Memory-mapped reads: ${USE_MMAP}"
+echo "Progress disabled: ${DISABLE_PROGRESS}"
 echo ""
 echo -e "${GREEN}Transfer Speed: ${MBPS} Mbps${NC}"
 echo ""